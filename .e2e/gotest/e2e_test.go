@@ -28,6 +28,7 @@ var (
 	metricsUrl      = flag.String("metricsurl", "http://127.0.0.1:8080/metrics", "Metrics URL of the geolocation-go service")
 	pprofUrl        = flag.String("pprofurl", "http://127.0.0.1:6060/debug/pprof/", "Pprof URL of the geolocation-go service")
 	redisConnString = flag.String("redisconnstr", "redis://localhost:6379", "Redis connection string")
+	redisKeyPrefix  = flag.String("rediskeyprefix", "geo:v2:", "Prefix of the redis keys, including the schema version")
 
 	rdb *redis.Client
 )
@@ -205,8 +206,8 @@ func getIP(url string) string {
 	return s[len(s)-1]
 }
 
-func isInRedis(key string) (bool, error) {
-	_, err := rdb.Get(context.Background(), key).Result()
+func isInRedis(ip string) (bool, error) {
+	_, err := rdb.Get(context.Background(), *redisKeyPrefix+ip).Result()
 	if err != nil {
 		return false, err
 	}
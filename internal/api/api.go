@@ -2,12 +2,62 @@ package api
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"sync"
+	"time"
 
 	"github.com/lescactus/geolocation-go/internal/models"
 )
 
+// Errors returned by a GeoAPI when the ip address can't be geolocated
+// because of the ip address itself. Retrying the same query won't succeed
+// hence the result must not be cached.
+var (
+	// ErrPrivateRange is returned when the ip address belongs to a private range
+	ErrPrivateRange = errors.New("private range")
+
+	// ErrReservedRange is returned when the ip address belongs to a reserved range
+	ErrReservedRange = errors.New("reserved range")
+
+	// ErrInvalidQuery is returned when the query is rejected by the remote GeoIP API
+	ErrInvalidQuery = errors.New("invalid query")
+)
+
+// ErrQuotaExhausted is returned when the quota of the remote GeoIP API is exhausted
+var ErrQuotaExhausted = errors.New("upstream quota exhausted")
+
+// QuotaError is returned when the quota of the remote GeoIP API is exhausted.
+// It matches ErrQuotaExhausted with errors.Is().
+type QuotaError struct {
+	// RetryAfter is the duration until the quota is available again
+	RetryAfter time.Duration
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrQuotaExhausted, e.RetryAfter)
+}
+
+func (e *QuotaError) Unwrap() error {
+	return ErrQuotaExhausted
+}
+
+// IsClientError returns true if the error is caused by the ip address itself
+// rather than by the GeoAPI.
+func IsClientError(err error) bool {
+	return errors.Is(err, ErrPrivateRange) ||
+		errors.Is(err, ErrReservedRange) ||
+		errors.Is(err, ErrInvalidQuery)
+}
+
 type GeoAPI interface {
 	Get(ctx context.Context, ip string) (*models.GeoIP, error)
 	Status(ctx context.Context, wg *sync.WaitGroup, ch chan error)
 }
+
+// Reporter is implemented by the GeoAPI able to describe their current state,
+// such as the dataset loaded by an offline provider.
+// The report is exposed by the health endpoints.
+type Reporter interface {
+	Report() string
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestIsClientError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "Private range", err: ErrPrivateRange, want: true},
+		{name: "Reserved range", err: ErrReservedRange, want: true},
+		{name: "Invalid query", err: ErrInvalidQuery, want: true},
+		{name: "Wrapped invalid query", err: fmt.Errorf("error: query failed: %w", ErrInvalidQuery), want: true},
+		{name: "Quota exhausted", err: &QuotaError{RetryAfter: time.Minute}, want: false},
+		{name: "Other error", err: errors.New("http response code is not 200"), want: false},
+		{name: "Nil error", err: nil, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsClientError(tt.err); got != tt.want {
+				t.Errorf("IsClientError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuotaError(t *testing.T) {
+	err := fmt.Errorf("error: query failed: %w", &QuotaError{RetryAfter: 42 * time.Second})
+
+	if !errors.Is(err, ErrQuotaExhausted) {
+		t.Errorf("errors.Is(%v, ErrQuotaExhausted) = false, want true", err)
+	}
+
+	var qerr *QuotaError
+	if !errors.As(err, &qerr) {
+		t.Fatalf("errors.As(%v, *QuotaError) = false, want true", err)
+	}
+	if qerr.RetryAfter != 42*time.Second {
+		t.Errorf("RetryAfter = %v, want %v", qerr.RetryAfter, 42*time.Second)
+	}
+	if got, want := qerr.Error(), "upstream quota exhausted, retry after 42s"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
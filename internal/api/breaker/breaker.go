@@ -0,0 +1,269 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lescactus/geolocation-go/internal/api"
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+)
+
+const (
+	// DefaultThreshold is the default number of consecutive failures
+	// opening the breaker
+	DefaultThreshold = 5
+
+	// DefaultCooldown is the default duration the breaker stays open
+	// before letting a trial query through
+	DefaultCooldown = 30 * time.Second
+)
+
+// ErrOpen is returned without querying the provider while the breaker is open
+var ErrOpen = errors.New("circuit breaker is open")
+
+// Prometheus metrics
+var (
+	breakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "breaker_state",
+		Help: "State of the circuit breaker of each geolocation api provider (0: closed, 1: open, 2: half-open)",
+	}, []string{"provider"})
+	breakerRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "breaker_rejected_total",
+		Help: "Total number of queries rejected by the open circuit breaker of each geolocation api provider",
+	}, []string{"provider"})
+)
+
+// State is the state of a Breaker
+type State int
+
+const (
+	// StateClosed lets all the queries through
+	StateClosed State = iota
+	// StateOpen rejects all the queries
+	StateOpen
+	// StateHalfOpen lets a single trial query through
+	StateHalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// Breaker is a circuit breaker wrapping an api.GeoAPI.
+//
+// The breaker is closed by default and opens after Threshold consecutive
+// failures of the provider. While open, the queries fail fast with ErrOpen
+// instead of waiting for an unhealthy provider to time out.
+// Once Cooldown has elapsed, the breaker is half-open and a single trial query
+// is sent to the provider: the breaker closes if it succeeds
+// and opens again otherwise.
+//
+// Queries rejected because of the ip address itself (private or reserved range,
+// invalid query) or because of the provider quota, and queries cancelled
+// by the caller aren't failures of the provider.
+type Breaker struct {
+	Name      string
+	API       api.GeoAPI
+	Threshold int
+	Cooldown  time.Duration
+	Logger    *zerolog.Logger
+
+	mu       sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+	// Whether the trial query of the half-open state is in flight
+	probing bool
+	// Moves the open breaker to half-open once the cooldown has elapsed
+	cooldownTimer *time.Timer
+
+	// now is used to mock the time in the tests
+	now func() time.Time
+}
+
+// New will return a new closed Breaker wrapping the given api.GeoAPI.
+// The default threshold and cooldown are used when threshold or cooldown
+// are not positive.
+func New(name string, a api.GeoAPI, threshold int, cooldown time.Duration, logger *zerolog.Logger) *Breaker {
+	if threshold <= 0 {
+		threshold = DefaultThreshold
+	}
+	if cooldown <= 0 {
+		cooldown = DefaultCooldown
+	}
+
+	b := &Breaker{Name: name, API: a, Threshold: threshold, Cooldown: cooldown, Logger: logger, now: time.Now}
+	breakerState.WithLabelValues(name).Set(float64(StateClosed))
+
+	return b
+}
+
+// State returns the current state of the breaker.
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.endCooldown()
+	return b.state
+}
+
+func (b *Breaker) Get(ctx context.Context, ip string) (*models.GeoIP, error) {
+	// Get request id for logging purposes
+	req_id, _ := hlog.IDFromCtx(ctx)
+
+	if !b.allow() {
+		// Increment Prometheus counter
+		breakerRejected.WithLabelValues(b.Name).Inc()
+
+		b.Logger.Debug().Str("req_id", req_id.String()).Msgf("circuit breaker of %s geolocation api is open", b.Name)
+		return nil, fmt.Errorf("error: %s: %w", b.Name, ErrOpen)
+	}
+
+	g, err := b.API.Get(ctx, ip)
+
+	switch {
+	case err == nil || api.IsClientError(err):
+		b.success()
+	case ctx.Err() != nil || errors.Is(err, api.ErrQuotaExhausted):
+		// The query has been cancelled by the caller,
+		// or rejected by the provider rate limit
+		b.release()
+	default:
+		b.failure()
+	}
+
+	return g, err
+}
+
+// Status will report ErrOpen while the breaker is open.
+// The provider itself isn't queried: the state of the breaker already
+// reflects its health and the health endpoints don't consume its quota.
+func (b *Breaker) Status(ctx context.Context, wg *sync.WaitGroup, ch chan error) {
+	defer wg.Done()
+
+	if b.State() == StateOpen {
+		ch <- ErrOpen
+		return
+	}
+
+	ch <- nil
+}
+
+// Report returns the state of the breaker.
+func (b *Breaker) Report() string {
+	return "circuit breaker " + b.State().String()
+}
+
+// allow returns whether a query can be sent to the provider,
+// moving from open to half-open once the cooldown has elapsed.
+func (b *Breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case StateClosed:
+		return true
+	case StateOpen:
+		if !b.endCooldown() {
+			return false
+		}
+		b.probing = true
+		return true
+	case StateHalfOpen:
+		// Only a single trial query at a time
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+
+	return false
+}
+
+// success records a successful query
+func (b *Breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.probing = false
+	if b.state != StateClosed {
+		b.Logger.Info().Msgf("circuit breaker of %s geolocation api closed", b.Name)
+		b.setState(StateClosed)
+	}
+}
+
+// failure records a failed query
+func (b *Breaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// The late failure of a query sent before the breaker opened
+	// mustn't push the end of the cooldown back
+	if b.state == StateOpen {
+		return
+	}
+
+	b.failures++
+	b.probing = false
+	if b.state == StateHalfOpen || b.failures >= b.Threshold {
+		if b.state != StateOpen {
+			b.Logger.Warn().Msgf("circuit breaker of %s geolocation api opened after %d consecutive failures", b.Name, b.failures)
+		}
+		b.openedAt = b.now()
+		b.setState(StateOpen)
+
+		// Update the gauge when the cooldown ends, even without any query
+		if b.cooldownTimer != nil {
+			b.cooldownTimer.Stop()
+		}
+		b.cooldownTimer = time.AfterFunc(b.Cooldown, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.endCooldown()
+		})
+	}
+}
+
+// endCooldown moves the open breaker to half-open once the cooldown
+// has elapsed, and returns whether it did. b.mu must be held.
+func (b *Breaker) endCooldown() bool {
+	if b.state != StateOpen || b.now().Sub(b.openedAt) < b.Cooldown {
+		return false
+	}
+
+	b.setState(StateHalfOpen)
+	return true
+}
+
+// release records a query which neither succeeded nor failed
+func (b *Breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
+
+// setState sets the state of the breaker and updates the Prometheus gauge.
+// b.mu must be held.
+func (b *Breaker) setState(s State) {
+	b.state = s
+	breakerState.WithLabelValues(b.Name).Set(float64(s))
+}
@@ -0,0 +1,325 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lescactus/geolocation-go/internal/api"
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+var logger = zerolog.New(os.Stdout).Level(zerolog.NoLevel)
+
+var errTimeout = errors.New("context deadline exceeded (Client.Timeout exceeded while awaiting headers)")
+
+// GeoAPIMock fails with its err, if any.
+// It counts the number of queries it received.
+type GeoAPIMock struct {
+	mu      sync.Mutex
+	err     error
+	queried int
+	// Closed to release the queries
+	block chan struct{}
+}
+
+func (m *GeoAPIMock) Get(ctx context.Context, ip string) (*models.GeoIP, error) {
+	m.mu.Lock()
+	m.queried++
+	err := m.err
+	m.mu.Unlock()
+
+	if m.block != nil {
+		<-m.block
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return &models.GeoIP{IP: ip, CountryCode: "AU"}, nil
+}
+
+func (m *GeoAPIMock) Status(ctx context.Context, wg *sync.WaitGroup, ch chan error) {
+	defer wg.Done()
+	ch <- errors.New("the provider must not be queried")
+}
+
+func (m *GeoAPIMock) setErr(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.err = err
+}
+
+// clock is a manually advanced time source
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time { return c.t }
+
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestBreaker(m *GeoAPIMock, threshold int, cooldown time.Duration) (*Breaker, *clock) {
+	c := &clock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	b := New("mock", m, threshold, cooldown, &logger)
+	b.now = c.now
+	return b, c
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name          string
+		threshold     int
+		cooldown      time.Duration
+		wantThreshold int
+		wantCooldown  time.Duration
+	}{
+		{name: "Custom values", threshold: 3, cooldown: 10 * time.Second, wantThreshold: 3, wantCooldown: 10 * time.Second},
+		{name: "Default values", wantThreshold: DefaultThreshold, wantCooldown: DefaultCooldown},
+		{name: "Negative values", threshold: -1, cooldown: -time.Second, wantThreshold: DefaultThreshold, wantCooldown: DefaultCooldown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := New("mock", &GeoAPIMock{}, tt.threshold, tt.cooldown, &logger)
+			assert.Equal(t, tt.wantThreshold, b.Threshold)
+			assert.Equal(t, tt.wantCooldown, b.Cooldown)
+			assert.Equal(t, StateClosed, b.State())
+		})
+	}
+}
+
+func TestBreakerGet(t *testing.T) {
+	t.Run("Opens after threshold consecutive failures", func(t *testing.T) {
+		m := &GeoAPIMock{err: errTimeout}
+		b, _ := newTestBreaker(m, 3, time.Minute)
+
+		for i := 0; i < 3; i++ {
+			_, err := b.Get(context.Background(), "1.1.1.1")
+			assert.ErrorIs(t, err, errTimeout)
+		}
+		assert.Equal(t, StateOpen, b.State())
+
+		// Fail fast without querying the provider
+		_, err := b.Get(context.Background(), "1.1.1.1")
+		assert.ErrorIs(t, err, ErrOpen)
+		assert.Equal(t, 3, m.queried)
+	})
+
+	t.Run("A success resets the consecutive failures", func(t *testing.T) {
+		m := &GeoAPIMock{err: errTimeout}
+		b, _ := newTestBreaker(m, 3, time.Minute)
+
+		b.Get(context.Background(), "1.1.1.1")
+		b.Get(context.Background(), "1.1.1.1")
+		m.setErr(nil)
+		b.Get(context.Background(), "1.1.1.1")
+		m.setErr(errTimeout)
+		b.Get(context.Background(), "1.1.1.1")
+		b.Get(context.Background(), "1.1.1.1")
+
+		assert.Equal(t, StateClosed, b.State())
+	})
+
+	t.Run("Client errors aren't failures", func(t *testing.T) {
+		m := &GeoAPIMock{err: fmt.Errorf("error: query failed: %w", api.ErrPrivateRange)}
+		b, _ := newTestBreaker(m, 1, time.Minute)
+
+		_, err := b.Get(context.Background(), "10.0.0.1")
+		assert.ErrorIs(t, err, api.ErrPrivateRange)
+		assert.Equal(t, StateClosed, b.State())
+	})
+
+	t.Run("Quota errors aren't failures", func(t *testing.T) {
+		m := &GeoAPIMock{err: fmt.Errorf("error: query failed: %w", &api.QuotaError{RetryAfter: time.Minute})}
+		b, _ := newTestBreaker(m, 1, time.Minute)
+
+		_, err := b.Get(context.Background(), "1.1.1.1")
+		assert.ErrorIs(t, err, api.ErrQuotaExhausted)
+		assert.Equal(t, StateClosed, b.State())
+	})
+
+	t.Run("Cancelled queries aren't failures", func(t *testing.T) {
+		m := &GeoAPIMock{err: context.Canceled}
+		b, _ := newTestBreaker(m, 1, time.Minute)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := b.Get(ctx, "1.1.1.1")
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Equal(t, StateClosed, b.State())
+	})
+
+	t.Run("Half-open closes after a successful trial query", func(t *testing.T) {
+		m := &GeoAPIMock{err: errTimeout}
+		b, c := newTestBreaker(m, 1, time.Minute)
+
+		b.Get(context.Background(), "1.1.1.1")
+		assert.Equal(t, StateOpen, b.State())
+
+		c.advance(time.Minute)
+		assert.Equal(t, StateHalfOpen, b.State())
+
+		m.setErr(nil)
+		g, err := b.Get(context.Background(), "1.1.1.1")
+		assert.NoError(t, err)
+		assert.Equal(t, "AU", g.CountryCode)
+		assert.Equal(t, StateClosed, b.State())
+	})
+
+	t.Run("Half-open opens again after a failed trial query", func(t *testing.T) {
+		m := &GeoAPIMock{err: errTimeout}
+		b, c := newTestBreaker(m, 1, time.Minute)
+
+		b.Get(context.Background(), "1.1.1.1")
+		c.advance(time.Minute)
+
+		_, err := b.Get(context.Background(), "1.1.1.1")
+		assert.ErrorIs(t, err, errTimeout)
+		assert.Equal(t, StateOpen, b.State())
+
+		// The cooldown starts over
+		c.advance(30 * time.Second)
+		_, err = b.Get(context.Background(), "1.1.1.1")
+		assert.ErrorIs(t, err, ErrOpen)
+		assert.Equal(t, 2, m.queried)
+	})
+
+	t.Run("Half-open lets a single trial query through", func(t *testing.T) {
+		m := &GeoAPIMock{err: errTimeout}
+		b, c := newTestBreaker(m, 1, time.Minute)
+
+		b.Get(context.Background(), "1.1.1.1")
+		c.advance(time.Minute)
+
+		// Block the trial query
+		m.setErr(nil)
+		m.block = make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_, err := b.Get(context.Background(), "1.1.1.1")
+			assert.NoError(t, err)
+		}()
+
+		assert.Eventually(t, func() bool {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			return m.queried == 2
+		}, time.Second, time.Millisecond)
+
+		_, err := b.Get(context.Background(), "1.1.1.1")
+		assert.ErrorIs(t, err, ErrOpen)
+
+		close(m.block)
+		<-done
+		assert.Equal(t, StateClosed, b.State())
+	})
+
+	t.Run("A failure while open doesn't restart the cooldown", func(t *testing.T) {
+		m := &GeoAPIMock{err: errTimeout}
+		b, c := newTestBreaker(m, 1, time.Minute)
+
+		// A query is sent while the breaker is closed...
+		assert.True(t, b.allow())
+
+		// ...another one fails and opens the breaker...
+		b.Get(context.Background(), "1.1.1.1")
+		assert.Equal(t, StateOpen, b.State())
+
+		// ...then the first one fails
+		c.advance(30 * time.Second)
+		b.failure()
+		assert.Equal(t, StateOpen, b.State())
+
+		c.advance(30 * time.Second)
+		assert.Equal(t, StateHalfOpen, b.State())
+	})
+
+	t.Run("Half-open allows a new trial query after a cancelled one", func(t *testing.T) {
+		m := &GeoAPIMock{err: errTimeout}
+		b, c := newTestBreaker(m, 1, time.Minute)
+
+		b.Get(context.Background(), "1.1.1.1")
+		c.advance(time.Minute)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		m.setErr(context.Canceled)
+		b.Get(ctx, "1.1.1.1")
+
+		m.setErr(nil)
+		_, err := b.Get(context.Background(), "1.1.1.1")
+		assert.NoError(t, err)
+		assert.Equal(t, StateClosed, b.State())
+	})
+}
+
+func TestBreakerStatus(t *testing.T) {
+	m := &GeoAPIMock{err: errTimeout}
+	b, c := newTestBreaker(m, 1, time.Minute)
+
+	status := func() error {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		ch := make(chan error, 1)
+		b.Status(context.Background(), &wg, ch)
+		wg.Wait()
+		return <-ch
+	}
+
+	assert.NoError(t, status())
+	assert.Equal(t, "circuit breaker closed", b.Report())
+
+	b.Get(context.Background(), "1.1.1.1")
+	assert.ErrorIs(t, status(), ErrOpen)
+	assert.Equal(t, "circuit breaker open", b.Report())
+
+	c.advance(time.Minute)
+	assert.NoError(t, status())
+	assert.Equal(t, "circuit breaker half-open", b.Report())
+}
+
+func TestBreakerStateGauge(t *testing.T) {
+	gauge := func(name string) State {
+		return State(testutil.ToFloat64(breakerState.WithLabelValues(name)))
+	}
+
+	t.Run("Half-open once the cooldown has elapsed and the state is read", func(t *testing.T) {
+		m := &GeoAPIMock{err: errTimeout}
+		b, c := newTestBreaker(m, 1, time.Minute)
+
+		b.Get(context.Background(), "1.1.1.1")
+		assert.Equal(t, StateOpen, gauge("mock"))
+
+		c.advance(time.Minute)
+		assert.Equal(t, StateHalfOpen, b.State())
+		assert.Equal(t, StateHalfOpen, gauge("mock"))
+
+		m.setErr(nil)
+		b.Get(context.Background(), "1.1.1.1")
+		assert.Equal(t, StateClosed, gauge("mock"))
+	})
+
+	t.Run("Half-open once the cooldown has elapsed without any query", func(t *testing.T) {
+		m := &GeoAPIMock{err: errTimeout}
+		b := New("mock-timer", m, 1, 10*time.Millisecond, &logger)
+
+		b.Get(context.Background(), "1.1.1.1")
+		assert.Equal(t, StateOpen, gauge("mock-timer"))
+		assert.Eventually(t, func() bool { return gauge("mock-timer") == StateHalfOpen }, time.Second, time.Millisecond)
+	})
+}
+
+func TestStateString(t *testing.T) {
+	assert.Equal(t, "closed", StateClosed.String())
+	assert.Equal(t, "open", StateOpen.String())
+	assert.Equal(t, "half-open", StateHalfOpen.String())
+	assert.Equal(t, "unknown", State(42).String())
+}
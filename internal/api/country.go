@@ -0,0 +1,20 @@
+package api
+
+import (
+	"strings"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/language/display"
+)
+
+// CountryName returns the english name of the country identified by
+// the given ISO 3166-1 alpha-2 code, or an empty string if the code
+// isn't a valid country code.
+func CountryName(code string) string {
+	region, err := language.ParseRegion(strings.TrimSpace(code))
+	if err != nil || !region.IsCountry() {
+		return ""
+	}
+
+	return display.English.Regions().Name(region)
+}
@@ -0,0 +1,27 @@
+package api
+
+import "testing"
+
+func TestCountryName(t *testing.T) {
+	tests := []struct {
+		name string
+		code string
+		want string
+	}{
+		{name: "Australia", code: "AU", want: "Australia"},
+		{name: "France", code: "FR", want: "France"},
+		{name: "Germany - lowercase", code: "de", want: "Germany"},
+		{name: "United States", code: "US", want: "United States"},
+		{name: "Empty code", code: "", want: ""},
+		{name: "Unknown code", code: "ZZ", want: ""},
+		{name: "Not a country - continent", code: "150", want: ""},
+		{name: "Invalid code", code: "notacountry", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CountryName(tt.code); got != tt.want {
+				t.Errorf("CountryName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
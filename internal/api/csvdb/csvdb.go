@@ -0,0 +1,493 @@
+package csvdb
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lescactus/geolocation-go/internal/api"
+	"github.com/lescactus/geolocation-go/internal/filewatch"
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+)
+
+// Supported csv formats
+const (
+	// FormatDBIPCountry is the DB-IP "IP to Country Lite" format:
+	// start_ip,end_ip,country_code
+	FormatDBIPCountry = "dbip-country"
+
+	// FormatDBIPCity is the DB-IP "IP to City Lite" format:
+	// start_ip,end_ip,continent,country_code,region,city,latitude,longitude
+	FormatDBIPCity = "dbip-city"
+
+	// FormatIP2Location is the IP2Location LITE DB1 to DB5 format:
+	// ip_from,ip_to,country_code,country_name[,region,city,latitude,longitude]
+	FormatIP2Location = "ip2location"
+)
+
+var (
+	// ErrNotFound is returned when the ip address isn't in the database
+	ErrNotFound = errors.New("ip address not found in the csv database")
+
+	// ErrNotLoaded is returned when no database is loaded
+	ErrNotLoaded = errors.New("csv database not loaded")
+)
+
+// Prometheus metrics
+var (
+	csvdbLookups = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "csvdb_lookups_total",
+		Help: "Total number of successful lookups in the csv database",
+	})
+	csvdbFailedLookups = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "csvdb_lookups_failed_total",
+		Help: "Total number of failed lookups in the csv database",
+	})
+	csvdbReloads = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "csvdb_reloads_total",
+		Help: "Total number of successful reloads of the csv database file",
+	})
+	csvdbFailedReloads = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "csvdb_reloads_failed_total",
+		Help: "Total number of failed reloads of the csv database file",
+	})
+	csvdbRecords = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "csvdb_records",
+		Help: "Number of ip ranges in the currently loaded csv database",
+	})
+)
+
+// columns holds the position of each field in a csv record.
+// A negative position means the field isn't available in the format.
+type columns struct {
+	countryCode int
+	countryName int
+	city        int
+	latitude    int
+	longitude   int
+}
+
+var formats = map[string]columns{
+	FormatDBIPCountry: {countryCode: 2, countryName: -1, city: -1, latitude: -1, longitude: -1},
+	FormatDBIPCity:    {countryCode: 3, countryName: -1, city: 5, latitude: 6, longitude: 7},
+	FormatIP2Location: {countryCode: 2, countryName: 3, city: 5, latitude: 6, longitude: 7},
+}
+
+// CSVClient is a GeoIP API reading a local csv file of ip ranges,
+// such as the DB-IP Lite or the IP2Location LITE databases.
+// The database is loaded in memory in a sorted range index and can be
+// swapped at runtime without interrupting the lookups.
+type CSVClient struct {
+	Path   string
+	Format string
+	Logger *zerolog.Logger
+
+	// Currently loaded database
+	db atomic.Pointer[Database]
+}
+
+// NewCSVClient will create a new CSVClient and load the given database.
+func NewCSVClient(path, format string, logger *zerolog.Logger) (*CSVClient, error) {
+	if _, ok := formats[format]; !ok {
+		return nil, fmt.Errorf("error: unsupported csv database format %q", format)
+	}
+
+	c := &CSVClient{Path: path, Format: format, Logger: logger}
+
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Reload will read the database file again and atomically swap the current
+// database with the new one.
+// The current database is kept in case of error.
+func (c *CSVClient) Reload() error {
+	db, err := Load(c.Path, c.Format)
+	if err != nil {
+		// Increment Prometheus counter
+		csvdbFailedReloads.Inc()
+		return err
+	}
+
+	c.db.Store(db)
+
+	// Increment Prometheus counter and update gauge
+	csvdbReloads.Inc()
+	csvdbRecords.Set(float64(db.Len()))
+
+	c.Logger.Info().Msgf("csv database %s loaded: %s", c.Path, db)
+
+	return nil
+}
+
+// Watch will reload the database every time the database
+// file is replaced on disk, until ctx is cancelled.
+func (c *CSVClient) Watch(ctx context.Context) error {
+	return filewatch.Watch(ctx, c.Path, filewatch.DefaultDebounce, func() {
+		if err := c.Reload(); err != nil {
+			c.Logger.Error().Err(err).Msg("failed to reload csv database")
+		}
+	})
+}
+
+func (c *CSVClient) Get(ctx context.Context, ip string) (*models.GeoIP, error) {
+	// Get request id for logging purposes
+	req_id, _ := hlog.IDFromCtx(ctx)
+
+	db := c.db.Load()
+	if db == nil {
+		// Increment Prometheus counter
+		csvdbFailedLookups.Inc()
+		return nil, ErrNotLoaded
+	}
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		// Increment Prometheus counter
+		csvdbFailedLookups.Inc()
+		return nil, fmt.Errorf("error: invalid ip address %s: %w", ip, err)
+	}
+
+	c.Logger.Trace().Str("req_id", req_id.String()).Msgf("looking up %s in csv database %s", ip, c.Path)
+	l, ok := db.Lookup(addr)
+	if !ok {
+		// Increment Prometheus counter
+		csvdbFailedLookups.Inc()
+		return nil, fmt.Errorf("error: %s: %w", ip, ErrNotFound)
+	}
+
+	// Increment Prometheus counter
+	csvdbLookups.Inc()
+
+	return &models.GeoIP{
+		IP:          ip,
+		CountryCode: l.countryCode,
+		CountryName: l.countryName,
+		City:        l.city,
+		Latitude:    l.latitude,
+		Longitude:   l.longitude,
+	}, nil
+}
+
+// Status will retrieve the status of the csv database.
+// It will ensure a database is loaded.
+func (c *CSVClient) Status(ctx context.Context, wg *sync.WaitGroup, ch chan error) {
+	defer wg.Done()
+
+	if c.db.Load() == nil {
+		ch <- ErrNotLoaded
+		return
+	}
+
+	ch <- nil
+}
+
+// Report returns the build date and the number of records
+// of the currently loaded database.
+func (c *CSVClient) Report() string {
+	db := c.db.Load()
+	if db == nil {
+		return ErrNotLoaded.Error()
+	}
+
+	return db.String()
+}
+
+// location is a geolocation shared by one or more ip ranges
+type location struct {
+	countryCode string
+	countryName string
+	city        string
+	latitude    float64
+	longitude   float64
+}
+
+// v4Range is an inclusive range of ipv4 addresses
+type v4Range struct {
+	start, end uint32
+	loc        uint32
+}
+
+// uint128 is an ipv6 address as a pair of integers,
+// cheaper to compare than a netip.Addr
+type uint128 struct {
+	hi, lo uint64
+}
+
+func (u uint128) less(v uint128) bool {
+	return u.hi < v.hi || (u.hi == v.hi && u.lo < v.lo)
+}
+
+// v6Range is an inclusive range of ipv6 addresses
+type v6Range struct {
+	start, end uint128
+	loc        uint32
+}
+
+// Database is an in-memory index of non overlapping ip ranges
+// sorted by their first address. Identical locations are stored
+// only once and shared among their ranges.
+type Database struct {
+	v4        []v4Range
+	v6        []v6Range
+	locations []location
+
+	// BuildDate is the modification time of the database file as
+	// the csv formats don't carry their build date
+	BuildDate time.Time
+}
+
+// Len returns the number of ip ranges of the database
+func (db *Database) Len() int {
+	return len(db.v4) + len(db.v6)
+}
+
+func (db *Database) String() string {
+	return fmt.Sprintf("build date %s, %d records", db.BuildDate.UTC().Format(time.RFC3339), db.Len())
+}
+
+// Lookup returns the location of the range containing addr
+// using a binary search.
+func (db *Database) Lookup(addr netip.Addr) (*location, bool) {
+	addr = addr.Unmap()
+
+	if addr.Is4() {
+		ip := binary.BigEndian.Uint32(addr.AsSlice())
+		i := sort.Search(len(db.v4), func(i int) bool { return db.v4[i].end >= ip })
+		if i < len(db.v4) && db.v4[i].start <= ip {
+			return &db.locations[db.v4[i].loc], true
+		}
+		return nil, false
+	}
+
+	ip := toUint128(addr)
+	i := sort.Search(len(db.v6), func(i int) bool { return !db.v6[i].end.less(ip) })
+	if i < len(db.v6) && !ip.less(db.v6[i].start) {
+		return &db.locations[db.v6[i].loc], true
+	}
+	return nil, false
+}
+
+// Load reads the csv database at path in the given format.
+func Load(path, format string) (*Database, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error: failed to open csv database: %w", err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("error: failed to stat csv database: %w", err)
+	}
+
+	db, err := Parse(f, format)
+	if err != nil {
+		return nil, fmt.Errorf("error: failed to parse csv database %s: %w", path, err)
+	}
+	db.BuildDate = fi.ModTime()
+
+	return db, nil
+}
+
+// Parse reads a csv database in the given format from r.
+// A header line is skipped if present.
+func Parse(r io.Reader, format string) (*Database, error) {
+	cols, ok := formats[format]
+	if !ok {
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+
+	db := &Database{}
+	// Index of each distinct location in db.locations
+	seen := make(map[location]uint32)
+
+	for line := 1; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if len(record) <= cols.countryCode {
+			return nil, fmt.Errorf("line %d: expected at least %d fields, got %d", line, cols.countryCode+1, len(record))
+		}
+
+		start, err := parseBound(record[0])
+		if err != nil {
+			// Skip the optional header
+			if line == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		end, err := parseBound(record[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		l, ok, err := parseLocation(record, cols)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		// Unallocated ranges
+		if !ok {
+			continue
+		}
+
+		if start.Is4() != end.Is4() || end.Less(start) {
+			return nil, fmt.Errorf("line %d: invalid range %s-%s", line, start, end)
+		}
+
+		i, ok := seen[l]
+		if !ok {
+			i = uint32(len(db.locations))
+			db.locations = append(db.locations, l)
+			seen[l] = i
+		}
+
+		if start.Is4() {
+			db.v4 = append(db.v4, v4Range{
+				start: binary.BigEndian.Uint32(start.AsSlice()),
+				end:   binary.BigEndian.Uint32(end.AsSlice()),
+				loc:   i,
+			})
+		} else {
+			db.v6 = append(db.v6, v6Range{start: toUint128(start), end: toUint128(end), loc: i})
+		}
+	}
+
+	sort.Slice(db.v4, func(i, j int) bool { return db.v4[i].start < db.v4[j].start })
+	sort.Slice(db.v6, func(i, j int) bool { return db.v6[i].start.less(db.v6[j].start) })
+
+	// The binary search requires non overlapping ranges
+	for i := 1; i < len(db.v4); i++ {
+		if db.v4[i].start <= db.v4[i-1].end {
+			return nil, fmt.Errorf("overlapping ranges starting at %s", netip.AddrFrom4(toBytes4(db.v4[i].start)))
+		}
+	}
+	for i := 1; i < len(db.v6); i++ {
+		if !db.v6[i-1].end.less(db.v6[i].start) {
+			return nil, fmt.Errorf("overlapping ranges starting at %s", fromUint128(db.v6[i].start))
+		}
+	}
+
+	return db, nil
+}
+
+// parseLocation maps a csv record into a location.
+// It returns false if the range isn't allocated to any country.
+func parseLocation(record []string, cols columns) (location, bool, error) {
+	field := func(i int) string {
+		if i < 0 || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	l := location{
+		countryCode: strings.ToUpper(field(cols.countryCode)),
+		countryName: field(cols.countryName),
+		city:        field(cols.city),
+	}
+
+	// IP2Location uses "-" and DB-IP "ZZ" for unallocated ranges
+	if l.countryCode == "" || l.countryCode == "-" || l.countryCode == "ZZ" {
+		return l, false, nil
+	}
+
+	if l.countryName == "" {
+		l.countryName = api.CountryName(l.countryCode)
+	}
+	if l.city == "-" {
+		l.city = ""
+	}
+
+	var err error
+	if s := field(cols.latitude); s != "" {
+		if l.latitude, err = strconv.ParseFloat(s, 64); err != nil {
+			return l, false, fmt.Errorf("invalid latitude %q", s)
+		}
+	}
+	if s := field(cols.longitude); s != "" {
+		if l.longitude, err = strconv.ParseFloat(s, 64); err != nil {
+			return l, false, fmt.Errorf("invalid longitude %q", s)
+		}
+	}
+
+	return l, true, nil
+}
+
+// maxUint32 is the highest ipv4 address as an integer
+var maxUint32 = big.NewInt(1<<32 - 1)
+
+// parseBound parses the bound of a range, either as an ip address
+// (DB-IP) or as an integer (IP2Location).
+// IPv4-mapped IPv6 addresses are unmapped.
+func parseBound(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+
+	if strings.ContainsAny(s, ".:") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Addr{}, fmt.Errorf("invalid ip address %q", s)
+		}
+		return addr.Unmap(), nil
+	}
+
+	n, ok := new(big.Int).SetString(s, 10)
+	if !ok || n.Sign() < 0 || n.BitLen() > 128 {
+		return netip.Addr{}, fmt.Errorf("invalid ip address %q", s)
+	}
+
+	if n.Cmp(maxUint32) <= 0 {
+		return netip.AddrFrom4(toBytes4(uint32(n.Uint64()))), nil
+	}
+
+	var b [16]byte
+	n.FillBytes(b[:])
+	return netip.AddrFrom16(b).Unmap(), nil
+}
+
+func toBytes4(u uint32) [4]byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], u)
+	return b
+}
+
+func toUint128(addr netip.Addr) uint128 {
+	b := addr.As16()
+	return uint128{hi: binary.BigEndian.Uint64(b[:8]), lo: binary.BigEndian.Uint64(b[8:])}
+}
+
+func fromUint128(u uint128) netip.Addr {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], u.hi)
+	binary.BigEndian.PutUint64(b[8:], u.lo)
+	return netip.AddrFrom16(b)
+}
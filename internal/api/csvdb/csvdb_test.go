@@ -0,0 +1,291 @@
+package csvdb
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lescactus/geolocation-go/internal/filewatch"
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+var logger = zerolog.New(os.Stdout).Level(zerolog.NoLevel)
+
+func TestNewCSVClient(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		format  string
+		wantLen int
+		wantErr bool
+	}{
+		{name: "dbip city", path: "testdata/dbip-city-lite.csv", format: FormatDBIPCity, wantLen: 4},
+		{name: "dbip country", path: "testdata/dbip-country-lite.csv", format: FormatDBIPCountry, wantLen: 3},
+		{name: "ip2location", path: "testdata/ip2location-lite-db5.csv", format: FormatIP2Location, wantLen: 4},
+		{name: "Unsupported format", path: "testdata/dbip-city-lite.csv", format: "bla", wantErr: true},
+		{name: "Non existing file", path: "testdata/nonexistent.csv", format: FormatDBIPCity, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewCSVClient(tt.path, tt.format, &logger)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewCSVClient() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil {
+				assert.Equal(t, tt.wantLen, c.db.Load().Len())
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		format  string
+		wantLen int
+		wantErr bool
+	}{
+		{name: "Empty", content: "", format: FormatDBIPCountry, wantLen: 0},
+		{name: "Header", content: "start_ip,end_ip,country_code\n1.1.1.0,1.1.1.255,AU\n", format: FormatDBIPCountry, wantLen: 1},
+		{name: "Quoted fields", content: "\"1.1.1.0\",\"1.1.1.255\",\"AU\"\n", format: FormatDBIPCountry, wantLen: 1},
+		{name: "IPv4-mapped bounds", content: "::ffff:1.1.1.0,::ffff:1.1.1.255,AU\n", format: FormatDBIPCountry, wantLen: 1},
+		{name: "Unallocated range", content: "1.1.1.0,1.1.1.255,ZZ\n", format: FormatDBIPCountry, wantLen: 0},
+		{name: "Invalid start ip", content: "1.1.1.0,1.1.1.255,AU\nbla,2.2.2.255,FR\n", format: FormatDBIPCountry, wantErr: true},
+		{name: "Invalid end ip", content: "1.1.1.0,bla,AU\n", format: FormatDBIPCountry, wantErr: true},
+		{name: "Invalid integer", content: "16843008,-1,AU,Australia\n", format: FormatIP2Location, wantErr: true},
+		{name: "Reversed range", content: "1.1.1.255,1.1.1.0,AU\n", format: FormatDBIPCountry, wantErr: true},
+		{name: "Mixed families", content: "1.1.1.0,2606:4700::,AU\n", format: FormatDBIPCountry, wantErr: true},
+		{name: "Overlapping ipv4 ranges", content: "1.1.1.0,1.1.1.255,AU\n1.1.1.128,1.1.2.255,FR\n", format: FormatDBIPCountry, wantErr: true},
+		{name: "Overlapping ipv6 ranges", content: "2606:4700::,2606:4700::ffff,US\n2606:4700::1,2606:4700::1:0,FR\n", format: FormatDBIPCountry, wantErr: true},
+		{name: "Missing fields", content: "1.1.1.0,1.1.1.255\n", format: FormatDBIPCountry, wantErr: true},
+		{name: "Invalid latitude", content: "1.1.1.0,1.1.1.255,OC,AU,Queensland,South Brisbane,bla,153.0166\n", format: FormatDBIPCity, wantErr: true},
+		{name: "Invalid longitude", content: "1.1.1.0,1.1.1.255,OC,AU,Queensland,South Brisbane,-27.4766,bla\n", format: FormatDBIPCity, wantErr: true},
+		{name: "Unsupported format", content: "1.1.1.0,1.1.1.255,AU\n", format: "bla", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := Parse(strings.NewReader(tt.content), tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil {
+				assert.Equal(t, tt.wantLen, db.Len())
+			}
+		})
+	}
+
+	t.Run("Identical locations are shared", func(t *testing.T) {
+		db, err := Parse(strings.NewReader("1.1.1.0,1.1.1.255,AU\n1.1.3.0,1.1.3.255,AU\n2606:4700::,2606:4700::ffff,AU\n"), FormatDBIPCountry)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, db.Len())
+		assert.Len(t, db.locations, 1)
+	})
+}
+
+func TestDatabaseLookup(t *testing.T) {
+	db, err := Parse(strings.NewReader(`1.1.1.0,1.1.1.255,AU
+1.1.3.0,1.1.3.255,FR
+0.0.0.0,0.255.255.255,US
+255.255.255.0,255.255.255.255,DE
+2606:4700::,2606:4700::ffff,US
+::,::ffff,DE
+`), FormatDBIPCountry)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		ip    string
+		want  string
+		found bool
+	}{
+		{name: "Range first address", ip: "1.1.1.0", want: "AU", found: true},
+		{name: "Range last address", ip: "1.1.1.255", want: "AU", found: true},
+		{name: "Range middle address", ip: "1.1.3.42", want: "FR", found: true},
+		{name: "Between two ranges", ip: "1.1.2.1", found: false},
+		{name: "Lowest ipv4 address", ip: "0.0.0.0", want: "US", found: true},
+		{name: "Highest ipv4 address", ip: "255.255.255.255", want: "DE", found: true},
+		{name: "After the last range", ip: "2.2.2.2", found: false},
+		{name: "IPv4-mapped address", ip: "::ffff:1.1.1.1", want: "AU", found: true},
+		{name: "IPv6 range", ip: "2606:4700::1111", want: "US", found: true},
+		{name: "Lowest ipv6 address", ip: "::", want: "DE", found: true},
+		{name: "IPv6 not found", ip: "2606:4700::1:0", found: false},
+		{name: "IPv6 highest address", ip: "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", found: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, found := db.Lookup(netip.MustParseAddr(tt.ip))
+			assert.Equal(t, tt.found, found)
+			if tt.found {
+				assert.Equal(t, tt.want, l.countryCode)
+			}
+		})
+	}
+}
+
+func TestCSVClientGet(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		format  string
+		ip      string
+		want    *models.GeoIP
+		wantErr bool
+	}{
+		{
+			name:   "dbip city - ipv4",
+			path:   "testdata/dbip-city-lite.csv",
+			format: FormatDBIPCity,
+			ip:     "1.1.1.1",
+			want:   &models.GeoIP{IP: "1.1.1.1", CountryCode: "AU", CountryName: "Australia", City: "South Brisbane", Latitude: -27.4766, Longitude: 153.0166},
+		},
+		{
+			name:   "dbip city - ipv6",
+			path:   "testdata/dbip-city-lite.csv",
+			format: FormatDBIPCity,
+			ip:     "2606:4700::1111",
+			want:   &models.GeoIP{IP: "2606:4700::1111", CountryCode: "US", CountryName: "United States", City: "San Francisco", Latitude: 37.7749, Longitude: -122.4194},
+		},
+		{
+			name:    "dbip city - unallocated range",
+			path:    "testdata/dbip-city-lite.csv",
+			format:  FormatDBIPCity,
+			ip:      "4.4.4.4",
+			wantErr: true,
+		},
+		{
+			name:   "dbip country - ipv4",
+			path:   "testdata/dbip-country-lite.csv",
+			format: FormatDBIPCountry,
+			ip:     "2.2.2.2",
+			want:   &models.GeoIP{IP: "2.2.2.2", CountryCode: "FR", CountryName: "France"},
+		},
+		{
+			name:   "ip2location - ipv4",
+			path:   "testdata/ip2location-lite-db5.csv",
+			format: FormatIP2Location,
+			ip:     "2.2.2.2",
+			want:   &models.GeoIP{IP: "2.2.2.2", CountryCode: "FR", CountryName: "France", City: "Paris", Latitude: 48.8566, Longitude: 2.35222},
+		},
+		{
+			name:   "ip2location - ipv4-mapped range",
+			path:   "testdata/ip2location-lite-db5.csv",
+			format: FormatIP2Location,
+			ip:     "3.3.3.3",
+			want:   &models.GeoIP{IP: "3.3.3.3", CountryCode: "US", CountryName: "United States of America", City: "Columbus", Latitude: 39.96118, Longitude: -82.99879},
+		},
+		{
+			name:   "ip2location - ipv6",
+			path:   "testdata/ip2location-lite-db5.csv",
+			format: FormatIP2Location,
+			ip:     "2606:4700::1111",
+			want:   &models.GeoIP{IP: "2606:4700::1111", CountryCode: "US", CountryName: "United States of America", City: "San Francisco", Latitude: 37.7749, Longitude: -122.4194},
+		},
+		{
+			name:    "ip2location - unallocated range",
+			path:    "testdata/ip2location-lite-db5.csv",
+			format:  FormatIP2Location,
+			ip:      "4.4.4.4",
+			wantErr: true,
+		},
+		{
+			name:    "Invalid ip",
+			path:    "testdata/dbip-city-lite.csv",
+			format:  FormatDBIPCity,
+			ip:      "bla",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewCSVClient(tt.path, tt.format, &logger)
+			assert.NoError(t, err)
+
+			got, err := c.Get(context.Background(), tt.ip)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CSVClient.Get() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	t.Run("Not loaded", func(t *testing.T) {
+		c := &CSVClient{Logger: &logger}
+		_, err := c.Get(context.Background(), "1.1.1.1")
+		assert.ErrorIs(t, err, ErrNotLoaded)
+	})
+}
+
+func TestCSVClientWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dbip-country-lite.csv")
+	assert.NoError(t, os.WriteFile(path, []byte("1.1.1.0,1.1.1.255,AU\n"), 0o644))
+
+	c, err := NewCSVClient(path, FormatDBIPCountry, &logger)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.NoError(t, c.Watch(ctx))
+
+	t.Run("Valid update", func(t *testing.T) {
+		assert.NoError(t, os.WriteFile(path, []byte("1.1.1.0,1.1.1.255,FR\n2.2.2.0,2.2.2.255,FR\n"), 0o644))
+
+		assert.Eventually(t, func() bool {
+			g, err := c.Get(context.Background(), "1.1.1.1")
+			return err == nil && g.CountryCode == "FR"
+		}, 5*time.Second, 50*time.Millisecond)
+	})
+
+	t.Run("Invalid update keeps the current database", func(t *testing.T) {
+		assert.NoError(t, os.WriteFile(path, []byte("1.1.1.0,bla,AU\n"), 0o644))
+		time.Sleep(2 * filewatch.DefaultDebounce)
+
+		assert.Equal(t, 2, c.db.Load().Len())
+	})
+}
+
+func TestCSVClientStatus(t *testing.T) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	t.Run("csv status - loaded", func(t *testing.T) {
+		ch := make(chan error, 1)
+		c, err := NewCSVClient("testdata/dbip-city-lite.csv", FormatDBIPCity, &logger)
+		assert.NoError(t, err)
+		c.Status(context.Background(), &wg, ch)
+		assert.NoError(t, <-ch)
+	})
+
+	t.Run("csv status - not loaded", func(t *testing.T) {
+		ch := make(chan error, 1)
+		c := &CSVClient{Logger: &logger}
+		c.Status(context.Background(), &wg, ch)
+		assert.ErrorIs(t, <-ch, ErrNotLoaded)
+	})
+
+	wg.Wait()
+}
+
+func TestCSVClientReport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dbip-country-lite.csv")
+	assert.NoError(t, os.WriteFile(path, []byte("1.1.1.0,1.1.1.255,AU\n2606:4700::,2606:4700::ffff,US\n"), 0o644))
+	buildDate := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.NoError(t, os.Chtimes(path, buildDate, buildDate))
+
+	c, err := NewCSVClient(path, FormatDBIPCountry, &logger)
+	assert.NoError(t, err)
+	assert.Equal(t, "build date 2024-01-01T00:00:00Z, 2 records", c.Report())
+
+	c = &CSVClient{Logger: &logger}
+	assert.Equal(t, ErrNotLoaded.Error(), c.Report())
+}
@@ -0,0 +1,192 @@
+package failover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/lescactus/geolocation-go/internal/api"
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+)
+
+// ErrNoProvider is returned when the Failover doesn't hold any provider
+var ErrNoProvider = errors.New("no geolocation api provider")
+
+// Prometheus metrics
+var (
+	failoverAnswers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "failover_provider_answers_total",
+		Help: "Total number of queries answered by each geolocation api provider",
+	}, []string{"provider"})
+	failoverErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "failover_provider_errors_total",
+		Help: "Total number of queries failed by each geolocation api provider and sent to the next one",
+	}, []string{"provider"})
+)
+
+// Provider is an api.GeoAPI used within a Failover.
+type Provider struct {
+	name string
+	api  api.GeoAPI
+}
+
+// Failover is an api.GeoAPI composed of an ordered list of api.GeoAPI.
+// Each query is sent to the first provider, and in case of failure to the
+// second provider, then in case of failure to the third provider and so on...
+// until one of them succeeds.
+//
+// The query isn't sent to the next provider when it is rejected
+// because of the ip address itself (private or reserved range, invalid query)
+// as every provider would reject it as well.
+type Failover struct {
+	providers []Provider
+	l         *zerolog.Logger
+}
+
+// New will return a new empty Failover.
+// It is then up to the caller to use the Add()
+// method to add providers to the Failover.
+func New(l *zerolog.Logger) *Failover {
+	return &Failover{
+		l:         l,
+		providers: make([]Provider, 0),
+	}
+}
+
+// Add will add an api.GeoAPI at the end of the Failover.
+// Return an error if the provider is already present.
+func (f *Failover) Add(name string, a api.GeoAPI) error {
+	if a == nil {
+		return errors.New("error: GeoAPI cannot be nil")
+	}
+
+	for _, p := range f.providers {
+		if p.name == name {
+			return fmt.Errorf("error: GeoAPI %s already present in failover", name)
+		}
+	}
+
+	f.providers = append(f.providers, Provider{name: name, api: a})
+
+	return nil
+}
+
+// Names returns the names of the providers, in order.
+func (f *Failover) Names() []string {
+	names := make([]string, len(f.providers))
+	for i, p := range f.providers {
+		names[i] = p.name
+	}
+	return names
+}
+
+// Get will query each provider in turn and return the first *models.GeoIP
+// found. The name of the provider which answered is set as the source
+// of the *models.GeoIP.
+//
+// If every provider fails, the errors of all the providers are returned.
+func (f *Failover) Get(ctx context.Context, ip string) (*models.GeoIP, error) {
+	if len(f.providers) == 0 {
+		return nil, ErrNoProvider
+	}
+
+	// Get request id for logging purposes
+	req_id, _ := hlog.IDFromCtx(ctx)
+
+	var errs []error
+	for _, p := range f.providers {
+		f.l.Trace().Str("req_id", req_id.String()).Msgf("looking for %s in %s geolocation api", ip, p.name)
+
+		g, err := p.api.Get(ctx, ip)
+		if err == nil {
+			// Increment Prometheus counter
+			failoverAnswers.WithLabelValues(p.name).Inc()
+
+			f.l.Debug().Str("req_id", req_id.String()).Msgf("%s answered by %s geolocation api", ip, p.name)
+
+			g.Source = p.name
+			return g, nil
+		}
+
+		// The ip address is rejected: no need to try the next provider
+		if api.IsClientError(err) {
+			return nil, err
+		}
+
+		// Increment Prometheus counter
+		failoverErrors.WithLabelValues(p.name).Inc()
+
+		f.l.Warn().Str("req_id", req_id.String()).Err(err).Msgf("%s geolocation api failed", p.name)
+		errs = append(errs, fmt.Errorf("%s: %w", p.name, err))
+
+		// The request has been cancelled or timed out
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, fmt.Errorf("error: all geolocation api failed: %w", errors.Join(errs...))
+}
+
+// Status will call each provider Status() function concurrently.
+// It will return an error only if every provider is failing, as the
+// Failover is still able to answer as long as one of them is healthy.
+func (f *Failover) Status(ctx context.Context, wg *sync.WaitGroup, ch chan error) {
+	defer wg.Done()
+
+	if len(f.providers) == 0 {
+		ch <- ErrNoProvider
+		return
+	}
+
+	errs := f.statuses(ctx)
+	for _, err := range errs {
+		if err == nil {
+			ch <- nil
+			return
+		}
+	}
+
+	ch <- fmt.Errorf("error: all geolocation api are failing: %w", errors.Join(errs...))
+}
+
+// statuses returns the errors of each provider Status() function, in order.
+func (f *Failover) statuses(ctx context.Context) []error {
+	var wg sync.WaitGroup
+
+	chans := make([]chan error, len(f.providers))
+	for i, p := range f.providers {
+		chans[i] = make(chan error, 1)
+		wg.Add(1)
+		go p.api.Status(ctx, &wg, chans[i])
+	}
+	wg.Wait()
+
+	errs := make([]error, len(f.providers))
+	for i, p := range f.providers {
+		if err := <-chans[i]; err != nil {
+			errs[i] = fmt.Errorf("%s: %w", p.name, err)
+		}
+	}
+
+	return errs
+}
+
+// Report returns the reports of the providers implementing api.Reporter,
+// or an empty string if none of them does.
+func (f *Failover) Report() string {
+	var reports []string
+	for _, p := range f.providers {
+		if r, ok := p.api.(api.Reporter); ok {
+			reports = append(reports, fmt.Sprintf("%s: %s", p.name, r.Report()))
+		}
+	}
+
+	return strings.Join(reports, "; ")
+}
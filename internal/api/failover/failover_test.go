@@ -0,0 +1,228 @@
+package failover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/lescactus/geolocation-go/internal/api"
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+var logger = zerolog.New(os.Stdout).Level(zerolog.NoLevel)
+
+// GeoAPIMock answers with its geoip or fails with its err.
+// It counts the number of queries it received.
+type GeoAPIMock struct {
+	geoip  *models.GeoIP
+	err    error
+	status error
+	report string
+
+	mu      sync.Mutex
+	queried int
+}
+
+func (m *GeoAPIMock) Get(ctx context.Context, ip string) (*models.GeoIP, error) {
+	m.mu.Lock()
+	m.queried++
+	m.mu.Unlock()
+
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	g := *m.geoip
+	g.IP = ip
+	return &g, nil
+}
+
+func (m *GeoAPIMock) Status(ctx context.Context, wg *sync.WaitGroup, ch chan error) {
+	defer wg.Done()
+	ch <- m.status
+}
+
+// ReporterGeoAPIMock is a GeoAPIMock implementing api.Reporter
+type ReporterGeoAPIMock struct {
+	GeoAPIMock
+}
+
+func (m *ReporterGeoAPIMock) Report() string {
+	return m.report
+}
+
+var (
+	geoipAU = &models.GeoIP{CountryCode: "AU", CountryName: "Australia", City: "South Brisbane", Latitude: -27.4766, Longitude: 153.0166}
+	geoipFR = &models.GeoIP{CountryCode: "FR", CountryName: "France", City: "Paris", Latitude: 48.8566, Longitude: 2.35222}
+)
+
+func TestNew(t *testing.T) {
+	f := New(&logger)
+	assert.NotNil(t, f)
+	assert.Empty(t, f.providers)
+	assert.Empty(t, f.Names())
+}
+
+func TestFailoverAdd(t *testing.T) {
+	f := New(&logger)
+
+	assert.NoError(t, f.Add("ip-api", &GeoAPIMock{}))
+	assert.NoError(t, f.Add("ipbase", &GeoAPIMock{}))
+	assert.Error(t, f.Add("ip-api", &GeoAPIMock{}))
+	assert.Error(t, f.Add("ipinfo", nil))
+
+	assert.Equal(t, []string{"ip-api", "ipbase"}, f.Names())
+}
+
+func TestFailoverGet(t *testing.T) {
+	errUnavailable := errors.New("http response code is not 200: 503")
+
+	tests := []struct {
+		name        string
+		providers   []*GeoAPIMock
+		want        *models.GeoIP
+		wantErr     error
+		wantQueried []int
+	}{
+		{
+			name:        "First provider answers",
+			providers:   []*GeoAPIMock{{geoip: geoipAU}, {geoip: geoipFR}},
+			want:        &models.GeoIP{IP: "1.1.1.1", CountryCode: "AU", CountryName: "Australia", City: "South Brisbane", Latitude: -27.4766, Longitude: 153.0166, Source: "p0"},
+			wantQueried: []int{1, 0},
+		},
+		{
+			name:        "First provider fails - second provider answers",
+			providers:   []*GeoAPIMock{{err: errUnavailable}, {geoip: geoipFR}},
+			want:        &models.GeoIP{IP: "1.1.1.1", CountryCode: "FR", CountryName: "France", City: "Paris", Latitude: 48.8566, Longitude: 2.35222, Source: "p1"},
+			wantQueried: []int{1, 1},
+		},
+		{
+			name:        "First two providers fail - third provider answers",
+			providers:   []*GeoAPIMock{{err: errUnavailable}, {err: errUnavailable}, {geoip: geoipFR}},
+			want:        &models.GeoIP{IP: "1.1.1.1", CountryCode: "FR", CountryName: "France", City: "Paris", Latitude: 48.8566, Longitude: 2.35222, Source: "p2"},
+			wantQueried: []int{1, 1, 1},
+		},
+		{
+			name:        "All providers fail",
+			providers:   []*GeoAPIMock{{err: errUnavailable}, {err: errUnavailable}},
+			wantErr:     errUnavailable,
+			wantQueried: []int{1, 1},
+		},
+		{
+			name:        "Private range - no failover",
+			providers:   []*GeoAPIMock{{err: fmt.Errorf("error: query failed: %w", api.ErrPrivateRange)}, {geoip: geoipFR}},
+			wantErr:     api.ErrPrivateRange,
+			wantQueried: []int{1, 0},
+		},
+		{
+			name:        "Reserved range - no failover",
+			providers:   []*GeoAPIMock{{err: fmt.Errorf("error: query failed: %w", api.ErrReservedRange)}, {geoip: geoipFR}},
+			wantErr:     api.ErrReservedRange,
+			wantQueried: []int{1, 0},
+		},
+		{
+			name:        "Invalid query after a failure - no failover",
+			providers:   []*GeoAPIMock{{err: errUnavailable}, {err: fmt.Errorf("error: query failed: %w", api.ErrInvalidQuery)}, {geoip: geoipFR}},
+			wantErr:     api.ErrInvalidQuery,
+			wantQueried: []int{1, 1, 0},
+		},
+		{
+			name:    "No provider",
+			wantErr: ErrNoProvider,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := New(&logger)
+			for i, p := range tt.providers {
+				assert.NoError(t, f.Add(fmt.Sprintf("p%d", i), p))
+			}
+
+			got, err := f.Get(context.Background(), "1.1.1.1")
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.want, got)
+
+			for i, p := range tt.providers {
+				assert.Equal(t, tt.wantQueried[i], p.queried, "provider p%d", i)
+			}
+		})
+	}
+
+	t.Run("Cancelled context - no failover", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		p0 := &GeoAPIMock{err: context.Canceled}
+		p1 := &GeoAPIMock{geoip: geoipFR}
+		f := New(&logger)
+		assert.NoError(t, f.Add("p0", p0))
+		assert.NoError(t, f.Add("p1", p1))
+
+		_, err := f.Get(ctx, "1.1.1.1")
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Equal(t, 0, p1.queried)
+	})
+}
+
+func TestFailoverStatus(t *testing.T) {
+	errDown := errors.New("down")
+
+	tests := []struct {
+		name      string
+		providers []*GeoAPIMock
+		wantErr   error
+	}{
+		{name: "All providers healthy", providers: []*GeoAPIMock{{}, {}}},
+		{name: "One provider healthy", providers: []*GeoAPIMock{{status: errDown}, {}}},
+		{name: "All providers failing", providers: []*GeoAPIMock{{status: errDown}, {status: errDown}}, wantErr: errDown},
+		{name: "No provider", wantErr: ErrNoProvider},
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(tests))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := New(&logger)
+			for i, p := range tt.providers {
+				assert.NoError(t, f.Add(fmt.Sprintf("p%d", i), p))
+			}
+
+			ch := make(chan error, 1)
+			f.Status(context.Background(), &wg, ch)
+			err := <-ch
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	wg.Wait()
+}
+
+func TestFailoverReport(t *testing.T) {
+	t.Run("No reporter", func(t *testing.T) {
+		f := New(&logger)
+		assert.NoError(t, f.Add("ip-api", &GeoAPIMock{}))
+		assert.Equal(t, "", f.Report())
+	})
+
+	t.Run("Reporters", func(t *testing.T) {
+		f := New(&logger)
+		assert.NoError(t, f.Add("maxmind", &ReporterGeoAPIMock{GeoAPIMock{report: "loaded"}}))
+		assert.NoError(t, f.Add("ip-api", &GeoAPIMock{}))
+		assert.NoError(t, f.Add("csv", &ReporterGeoAPIMock{GeoAPIMock{report: "build date 2024-01-01T00:00:00Z, 2 records"}}))
+		assert.Equal(t, "maxmind: loaded; csv: build date 2024-01-01T00:00:00Z, 2 records", f.Report())
+	})
+}
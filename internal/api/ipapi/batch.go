@@ -0,0 +1,290 @@
+package ipapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lescactus/geolocation-go/internal/api/ratelimit"
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+)
+
+const (
+	DefaultBatchURL = "http://ip-api.com/batch" // https isn't available for free usage
+
+	// DefaultBatchMaxSize is the maximum number of ip addresses
+	// accepted by the batch endpoint in a single request
+	DefaultBatchMaxSize = 100
+
+	// DefaultBatchWindow is the default duration the queries
+	// are collected for before the batch request is sent
+	DefaultBatchWindow = 10 * time.Millisecond
+
+	// Rate limit of the batch endpoint for free usage: 15 requests per minute
+	// ref: https://ip-api.com/docs/api:batch#usage_limits
+	DefaultBatchRateLimit = 15
+)
+
+// Prometheus metrics
+var (
+	ipAPIBatchSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ip_api_batch_size",
+		Help:    "Number of ip addresses sent in each batch request to the ip-api API",
+		Buckets: []float64{1, 2, 5, 10, 25, 50, 100},
+	})
+)
+
+// Batcher is an api.GeoAPI using the batch endpoint of the http://ip-api.com/ API.
+//
+// The concurrent queries are collected for Window, or until MaxSize of them
+// are queued, and sent as a single request. The results are then fanned out
+// to each caller. It multiplies the number of queries answered within the
+// rate limit of the API.
+type Batcher struct {
+	URL     string
+	Window  time.Duration
+	MaxSize int
+	Client  *http.Client
+	Logger  *zerolog.Logger
+
+	// Limiter rate limits the batch requests. It is adjusted from the
+	// X-Rl and X-Ttl response headers. Optional.
+	Limiter *ratelimit.Limiter
+
+	// c answers the Status queries
+	c *IPAPIClient
+
+	mu      sync.Mutex
+	pending []*batchCall
+	timer   *time.Timer
+}
+
+// batchCall is a query waiting for its batch request
+type batchCall struct {
+	ip     string
+	req_id string
+	// Buffered so the batch never blocks on a cancelled caller
+	done chan batchResult
+}
+
+type batchResult struct {
+	g   *models.GeoIP
+	err error
+}
+
+// NewBatcher will return a new Batcher sending its requests to url,
+// with the http client and logger of c.
+// The default window and max size are used when window or maxSize
+// are not positive, and maxSize can't be higher than DefaultBatchMaxSize.
+func NewBatcher(c *IPAPIClient, url string, window time.Duration, maxSize int) *Batcher {
+	if url == "" {
+		url = DefaultBatchURL
+	}
+	if window <= 0 {
+		window = DefaultBatchWindow
+	}
+	if maxSize <= 0 || maxSize > DefaultBatchMaxSize {
+		maxSize = DefaultBatchMaxSize
+	}
+
+	return &Batcher{
+		URL:     url,
+		Window:  window,
+		MaxSize: maxSize,
+		Client:  c.Client,
+		Logger:  c.Logger,
+		c:       c,
+	}
+}
+
+func (b *Batcher) Get(ctx context.Context, ip string) (*models.GeoIP, error) {
+	// Get request id for logging purposes
+	req_id, _ := hlog.IDFromCtx(ctx)
+
+	call := &batchCall{ip: ip, req_id: req_id.String(), done: make(chan batchResult, 1)}
+	b.enqueue(call)
+
+	select {
+	case r := <-call.done:
+		return r.g, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// enqueue adds the call to the pending batch. The batch is sent
+// once it is full, or when the window started by its first call elapses.
+func (b *Batcher) enqueue(call *batchCall) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.pending = append(b.pending, call)
+
+	if len(b.pending) >= b.MaxSize {
+		go b.send(b.take())
+		return
+	}
+
+	if len(b.pending) == 1 {
+		b.timer = time.AfterFunc(b.Window, b.flush)
+	}
+}
+
+// flush sends the pending batch, if any.
+func (b *Batcher) flush() {
+	b.mu.Lock()
+	batch := b.take()
+	b.mu.Unlock()
+
+	if len(batch) > 0 {
+		b.send(batch)
+	}
+}
+
+// take returns the pending batch and starts a new one.
+// b.mu must be held.
+func (b *Batcher) take() []*batchCall {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+
+	batch := b.pending
+	b.pending = nil
+
+	return batch
+}
+
+// send sends the batch request and fans the results out to the callers.
+func (b *Batcher) send(batch []*batchCall) {
+	// The same ip address is only sent once
+	calls := make(map[string][]*batchCall, len(batch))
+	ips := make([]string, 0, len(batch))
+	for _, call := range batch {
+		if _, ok := calls[call.ip]; !ok {
+			ips = append(ips, call.ip)
+		}
+		calls[call.ip] = append(calls[call.ip], call)
+	}
+
+	results, err := b.query(ips, batch)
+	for i, ip := range ips {
+		var r batchResult
+		if err != nil {
+			r.err = err
+		} else {
+			r.g, r.err = results[i].geoIP(ip)
+			if r.err != nil {
+				r.err = fmt.Errorf("error: batch query %s failed for %s: %w", b.URL, ip, r.err)
+			}
+		}
+
+		for _, call := range calls[ip] {
+			if r.g != nil {
+				// Each caller gets its own copy
+				g := *r.g
+				call.done <- batchResult{g: &g}
+			} else {
+				call.done <- r
+			}
+		}
+	}
+}
+
+// query sends the batch request for the given ip addresses and returns
+// the responses, in the same order.
+// The batch is only used for logging purposes.
+func (b *Batcher) query(ips []string, batch []*batchCall) ([]IPAPIResponse, error) {
+	req_ids := make([]string, len(batch))
+	for i, call := range batch {
+		req_ids[i] = call.req_id
+	}
+	logger := b.Logger.With().Strs("req_ids", req_ids).Logger()
+
+	// Increment Prometheus histogram
+	ipAPIBatchSize.Observe(float64(len(ips)))
+
+	// Wait for the rate limiter. The batch isn't bound to the context
+	// of any caller, the Limiter MaxWait bounds the wait.
+	if err := b.Limiter.Wait(context.Background()); err != nil {
+		logger.Warn().Err(err).Msg("ip-api batch rate limit reached")
+		return nil, fmt.Errorf("error: ip-api batch rate limit reached: %w", err)
+	}
+
+	// Building http request
+	body, err := json.Marshal(ips)
+	if err != nil {
+		return nil, fmt.Errorf("error: error while marshalling batch request to %s: %w", b.URL, err)
+	}
+
+	logger.Trace().Msg("building http request to " + b.URL)
+	req, err := http.NewRequestWithContext(context.Background(), "POST", b.URL, bytes.NewReader(body))
+	if err != nil {
+		logger.Error().Msg(fmt.Sprintf("error while building http request to %s: %s", b.URL, err.Error()))
+		return nil, fmt.Errorf("error: error while building http request to %s: %w", b.URL, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// Send http request
+	logger.Debug().Msg(fmt.Sprintf("sending http request to %s with %d ip addresses", b.URL, len(ips)))
+	resp, err := b.Client.Do(req)
+	if err != nil {
+		logger.Error().Msg(fmt.Sprintf("error while sending http request to %s: %s", b.URL, err.Error()))
+		// Increment Prometheus counter
+		ipAPIFailedRequestSend.Inc()
+		return nil, fmt.Errorf("error: error while sending http request to %s: %w", b.URL, err)
+	}
+	defer resp.Body.Close()
+
+	// Increment Prometheus counter
+	ipAPISuccessRequestSend.Inc()
+
+	// Adjust the rate limiter from the remaining quota
+	if err := checkQuota(b.Limiter, resp); err != nil {
+		logger.Warn().Msg(fmt.Sprintf("http response code is 429 for http request %s", b.URL))
+		return nil, fmt.Errorf("error: batch query %s failed: %w", b.URL, err)
+	}
+
+	// Ensure the response code is 200 OK
+	if resp.StatusCode != 200 {
+		logger.Error().Msg(fmt.Sprintf("http response code is not 200 for http request %s: %d", b.URL, resp.StatusCode))
+		return nil, fmt.Errorf("error: http response code is not 200 for http request %s: %d", b.URL, resp.StatusCode)
+	}
+
+	// Read http response
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		logger.Error().Msg(fmt.Sprintf("error while reading http response to %s: %s", b.URL, err.Error()))
+		return nil, fmt.Errorf("error: error while reading http response to %s: %w", b.URL, err)
+	}
+
+	// Unmarshal http response into a list of IPAPIResponse
+	var r []IPAPIResponse
+	if err := json.Unmarshal(data, &r); err != nil {
+		logger.Error().Msg(fmt.Sprintf("error while unmarshalling http response from %s: %s", b.URL, err))
+		return nil, fmt.Errorf("error: error while unmarshalling http response from %s: %w", b.URL, err)
+	}
+
+	// The responses are in the same order as the ip addresses
+	if len(r) != len(ips) {
+		logger.Error().Msg(fmt.Sprintf("http response from %s holds %d results for %d ip addresses", b.URL, len(r), len(ips)))
+		return nil, fmt.Errorf("error: http response from %s holds %d results for %d ip addresses", b.URL, len(r), len(ips))
+	}
+
+	return r, nil
+}
+
+// Status will retrieve the status of ip-api.com API
+// with the single query endpoint.
+func (b *Batcher) Status(ctx context.Context, wg *sync.WaitGroup, ch chan error) {
+	b.c.Status(ctx, wg, ch)
+}
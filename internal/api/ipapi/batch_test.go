@@ -0,0 +1,270 @@
+package ipapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lescactus/geolocation-go/internal/api"
+	"github.com/lescactus/geolocation-go/internal/api/ratelimit"
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+var batchResponses = map[string]string{
+	"1.1.1.1":  `{"status":"success","country":"Australia","countryCode":"AU","region":"QLD","regionName":"Queensland","city":"South Brisbane","zip":"4101","lat":-27.4766,"lon":153.0166,"timezone":"Australia/Brisbane","isp":"Cloudflare, Inc","org":"APNIC and Cloudflare DNS Resolver project","as":"AS13335 Cloudflare, Inc.","query":"1.1.1.1"}`,
+	"2.2.2.2":  `{"status":"success","country":"France","countryCode":"FR","region":"IDF","regionName":"Île-de-France","city":"Paris","zip":"75000","lat":48.8566,"lon":2.35222,"timezone":"Europe/Paris","isp":"France Telecom Orange","org":"","as":"AS3215 Orange S.A.","query":"2.2.2.2"}`,
+	"10.0.0.1": `{"status":"fail","message":"private range","query":"10.0.0.1"}`,
+}
+
+// batchServer is a fake ip-api batch endpoint.
+// It records the ip addresses of each batch request it received.
+type batchServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	batches [][]string
+}
+
+func newBatchServer(t *testing.T, handler func(w http.ResponseWriter, ips []string)) *batchServer {
+	s := &batchServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/batch" {
+			w.WriteHeader(404)
+			return
+		}
+
+		var ips []string
+		if err := json.NewDecoder(r.Body).Decode(&ips); err != nil {
+			w.WriteHeader(400)
+			return
+		}
+
+		s.mu.Lock()
+		s.batches = append(s.batches, ips)
+		s.mu.Unlock()
+
+		handler(w, ips)
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *batchServer) Batches() [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.batches
+}
+
+// answer answers each ip address from batchResponses
+func answer(w http.ResponseWriter, ips []string) {
+	w.Write([]byte("["))
+	for i, ip := range ips {
+		if i > 0 {
+			w.Write([]byte(","))
+		}
+		w.Write([]byte(batchResponses[ip]))
+	}
+	w.Write([]byte("]"))
+}
+
+func newTestBatcher(s *batchServer, window time.Duration, maxSize int) *Batcher {
+	return NewBatcher(NewIPAPIClient(s.URL+"/json/", s.Client(), &logger), s.URL+"/batch", window, maxSize)
+}
+
+func TestNewBatcher(t *testing.T) {
+	c := NewIPAPIClient("", nil, &logger)
+
+	tests := []struct {
+		name        string
+		url         string
+		window      time.Duration
+		maxSize     int
+		wantURL     string
+		wantWindow  time.Duration
+		wantMaxSize int
+	}{
+		{name: "Default values", wantURL: DefaultBatchURL, wantWindow: DefaultBatchWindow, wantMaxSize: DefaultBatchMaxSize},
+		{name: "Custom values", url: "http://localhost:8080/batch", window: time.Second, maxSize: 10, wantURL: "http://localhost:8080/batch", wantWindow: time.Second, wantMaxSize: 10},
+		{name: "Max size too high", maxSize: 1000, wantURL: DefaultBatchURL, wantWindow: DefaultBatchWindow, wantMaxSize: DefaultBatchMaxSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBatcher(c, tt.url, tt.window, tt.maxSize)
+			assert.Equal(t, tt.wantURL, b.URL)
+			assert.Equal(t, tt.wantWindow, b.Window)
+			assert.Equal(t, tt.wantMaxSize, b.MaxSize)
+		})
+	}
+}
+
+func TestBatcherGet(t *testing.T) {
+	t.Run("Concurrent queries are sent in a single batch", func(t *testing.T) {
+		s := newBatchServer(t, answer)
+		b := newTestBatcher(s, 100*time.Millisecond, DefaultBatchMaxSize)
+
+		ips := []string{"1.1.1.1", "2.2.2.2", "1.1.1.1", "10.0.0.1"}
+		errs := make([]error, len(ips))
+		countries := make([]string, len(ips))
+
+		var wg sync.WaitGroup
+		for i, ip := range ips {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				g, err := b.Get(context.Background(), ip)
+				errs[i] = err
+				if g != nil {
+					countries[i] = g.CountryCode
+				}
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, []string{"AU", "FR", "AU", ""}, countries)
+		assert.NoError(t, errs[0])
+		assert.NoError(t, errs[1])
+		assert.NoError(t, errs[2])
+		assert.ErrorIs(t, errs[3], api.ErrPrivateRange)
+
+		// Duplicates are only sent once
+		batches := s.Batches()
+		assert.Len(t, batches, 1)
+		assert.ElementsMatch(t, []string{"1.1.1.1", "2.2.2.2", "10.0.0.1"}, batches[0])
+	})
+
+	t.Run("Full batch is sent without waiting for the window", func(t *testing.T) {
+		s := newBatchServer(t, answer)
+		b := newTestBatcher(s, time.Hour, 2)
+
+		var wg sync.WaitGroup
+		for _, ip := range []string{"1.1.1.1", "2.2.2.2"} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := b.Get(context.Background(), ip)
+				assert.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+
+		assert.Len(t, s.Batches(), 1)
+	})
+
+	t.Run("Each caller gets its own copy", func(t *testing.T) {
+		s := newBatchServer(t, answer)
+		b := newTestBatcher(s, 100*time.Millisecond, DefaultBatchMaxSize)
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var seen []*models.GeoIP
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				g, err := b.Get(context.Background(), "1.1.1.1")
+				assert.NoError(t, err)
+				mu.Lock()
+				seen = append(seen, g)
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+
+		assert.Len(t, seen, 2)
+		assert.NotSame(t, seen[0], seen[1])
+	})
+
+	t.Run("Failed batch request fails every caller", func(t *testing.T) {
+		s := newBatchServer(t, func(w http.ResponseWriter, ips []string) {
+			w.WriteHeader(503)
+		})
+		b := newTestBatcher(s, time.Millisecond, DefaultBatchMaxSize)
+
+		g, err := b.Get(context.Background(), "1.1.1.1")
+		assert.Error(t, err)
+		assert.Empty(t, g)
+	})
+
+	t.Run("Invalid json", func(t *testing.T) {
+		s := newBatchServer(t, func(w http.ResponseWriter, ips []string) {
+			w.Write([]byte(`thisisnotjson`))
+		})
+		b := newTestBatcher(s, time.Millisecond, DefaultBatchMaxSize)
+
+		g, err := b.Get(context.Background(), "1.1.1.1")
+		assert.Error(t, err)
+		assert.Empty(t, g)
+	})
+
+	t.Run("Missing results", func(t *testing.T) {
+		s := newBatchServer(t, func(w http.ResponseWriter, ips []string) {
+			w.Write([]byte(`[]`))
+		})
+		b := newTestBatcher(s, time.Millisecond, DefaultBatchMaxSize)
+
+		g, err := b.Get(context.Background(), "1.1.1.1")
+		assert.Error(t, err)
+		assert.Empty(t, g)
+	})
+
+	t.Run("Invalid url", func(t *testing.T) {
+		s := newBatchServer(t, answer)
+		b := newTestBatcher(s, time.Millisecond, DefaultBatchMaxSize)
+		b.URL = "_invalidUrl_"
+
+		g, err := b.Get(context.Background(), "1.1.1.1")
+		assert.Error(t, err)
+		assert.Empty(t, g)
+	})
+
+	t.Run("429 Too Many Requests", func(t *testing.T) {
+		s := newBatchServer(t, func(w http.ResponseWriter, ips []string) {
+			w.Header().Set(HeaderRemaining, "0")
+			w.Header().Set(HeaderTTL, "30")
+			w.WriteHeader(http.StatusTooManyRequests)
+		})
+		b := newTestBatcher(s, time.Millisecond, DefaultBatchMaxSize)
+		b.Limiter = ratelimit.NewLimiter("ip-api-batch", DefaultBatchRateLimit, DefaultRateLimitPeriod, 0)
+
+		_, err := b.Get(context.Background(), "1.1.1.1")
+		assert.ErrorIs(t, err, api.ErrQuotaExhausted)
+
+		// The next batch isn't sent
+		_, err = b.Get(context.Background(), "1.1.1.1")
+		assert.ErrorIs(t, err, api.ErrQuotaExhausted)
+		assert.Len(t, s.Batches(), 1)
+	})
+
+	t.Run("Cancelled context", func(t *testing.T) {
+		s := newBatchServer(t, answer)
+		b := newTestBatcher(s, time.Hour, DefaultBatchMaxSize)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		_, err := b.Get(ctx, "1.1.1.1")
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
+
+func TestBatcherStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`ok`))
+	}))
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	ch := make(chan error, 1)
+	b := NewBatcher(NewIPAPIClient(server.URL, server.Client(), &logger), "", 0, 0)
+	b.Status(context.Background(), &wg, ch)
+	wg.Wait()
+	assert.NoError(t, <-ch)
+}
@@ -3,11 +3,16 @@ package ipapi
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"sync"
+	"time"
 
+	"github.com/lescactus/geolocation-go/internal/api"
+	"github.com/lescactus/geolocation-go/internal/api/ratelimit"
 	"github.com/lescactus/geolocation-go/internal/models"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -17,6 +22,25 @@ import (
 
 const (
 	DefaultBaseURL = "http://ip-api.com/json/" // https isn't available for free usage
+
+	// StatusSuccess is the value of IPAPIResponse.Status for successful queries
+	StatusSuccess = "success"
+
+	// StatusFail is the value of IPAPIResponse.Status for failed queries
+	StatusFail = "fail"
+
+	// Rate limit of the free usage: 45 requests per minute
+	// ref: https://ip-api.com/docs/api:json#usage_limits
+	DefaultRateLimit       = 45
+	DefaultRateLimitPeriod = time.Minute
+
+	// HeaderRemaining is the response header holding the number of
+	// requests remaining in the current rate limit window
+	HeaderRemaining = "X-Rl"
+
+	// HeaderTTL is the response header holding the number of seconds
+	// until the rate limit window is reset
+	HeaderTTL = "X-Ttl"
 )
 
 // Prometheus metrics
@@ -29,6 +53,10 @@ var (
 		Name: "ip_api_http_requests_failed_total",
 		Help: "Total number of failed http requests sent to the ip-api API",
 	})
+	ipAPIFailedQueries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ip_api_queries_failed_total",
+		Help: "Total number of queries answered with a fail status by the ip-api API",
+	})
 )
 
 // IPAPIClient is an http client for the http://ip-api.com/ API.
@@ -36,12 +64,17 @@ type IPAPIClient struct {
 	BaseURL string
 	Client  *http.Client
 	Logger  *zerolog.Logger
+
+	// Limiter rate limits the queries. It is adjusted from the
+	// X-Rl and X-Ttl response headers. Optional.
+	Limiter *ratelimit.Limiter
 }
 
 // IPAPIResponse represent the json response of the http://ip-api.com/ API.
 // Documentation can be found at https://ip-api.com/docs/api:json
 type IPAPIResponse struct {
 	Status      string  `json:"status"`
+	Message     string  `json:"message"`
 	Country     string  `json:"country"`
 	CountryCode string  `json:"countryCode"`
 	Region      string  `json:"region"`
@@ -68,6 +101,12 @@ func (c *IPAPIClient) Get(ctx context.Context, ip string) (*models.GeoIP, error)
 	// Get request id for logging purposes
 	req_id, _ := hlog.IDFromCtx(ctx)
 
+	// Wait for the rate limiter
+	if err := c.Limiter.Wait(ctx); err != nil {
+		c.Logger.Warn().Str("req_id", req_id.String()).Err(err).Msg("ip-api rate limit reached")
+		return nil, fmt.Errorf("error: ip-api rate limit reached: %w", err)
+	}
+
 	// Building http request
 	c.Logger.Trace().Str("req_id", req_id.String()).Msg("building http request to " + c.BaseURL + ip)
 	req, err := http.NewRequestWithContext(ctx, "GET", c.BaseURL+ip, nil)
@@ -87,12 +126,21 @@ func (c *IPAPIClient) Get(ctx context.Context, ip string) (*models.GeoIP, error)
 		ipAPIFailedRequestSend.Inc()
 		return nil, fmt.Errorf("error: error while sending http request to %s: %w", c.BaseURL+ip, err)
 	}
+	defer resp.Body.Close()
 
 	// Increment Prometheus counter
 	ipAPISuccessRequestSend.Inc()
 
-	// Ensure the response code is 200 OK
 	c.Logger.Trace().Str("req_id", req_id.String()).Msg("http request to " + c.BaseURL + ip + " sent")
+
+	// Adjust the rate limiter from the remaining quota
+	if err := checkQuota(c.Limiter, resp); err != nil {
+		c.Logger.Warn().Str("req_id", req_id.String()).
+			Msg(fmt.Sprintf("http response code is 429 for http request %s", c.BaseURL+ip))
+		return nil, fmt.Errorf("error: query %s failed: %w", c.BaseURL+ip, err)
+	}
+
+	// Ensure the response code is 200 OK
 	if resp.StatusCode != 200 {
 		c.Logger.Error().Str("req_id", req_id.String()).
 			Msg(fmt.Sprintf("http response code is not 200 for http request %s: %d", c.BaseURL+ip, resp.StatusCode))
@@ -101,7 +149,6 @@ func (c *IPAPIClient) Get(ctx context.Context, ip string) (*models.GeoIP, error)
 
 	// Read http response
 	c.Logger.Trace().Str("req_id", req_id.String()).Msg("reading http response from " + c.BaseURL + ip)
-	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		c.Logger.Error().Str("req_id", req_id.String()).
@@ -119,16 +166,85 @@ func (c *IPAPIClient) Get(ctx context.Context, ip string) (*models.GeoIP, error)
 	}
 
 	// Map the IPAPIResponse into a models.GeoIP
-	g := &models.GeoIP{
+	g, err := r.geoIP(ip)
+	if err != nil {
+		c.Logger.Debug().Str("req_id", req_id.String()).
+			Msg(fmt.Sprintf("query %s failed with message: %s", c.BaseURL+ip, r.Message))
+		return nil, fmt.Errorf("error: query %s failed: %w", c.BaseURL+ip, err)
+	}
+
+	return g, nil
+}
+
+// geoIP maps the IPAPIResponse of the given ip into a *models.GeoIP,
+// or into an error if the query failed.
+func (r *IPAPIResponse) geoIP(ip string) (*models.GeoIP, error) {
+	// Ensure the query succeeded
+	if r.Status == StatusFail {
+		// Increment Prometheus counter
+		ipAPIFailedQueries.Inc()
+
+		return nil, statusError(r.Message)
+	}
+
+	return &models.GeoIP{
 		IP:          ip,
 		CountryCode: r.CountryCode,
 		CountryName: r.Country,
 		City:        r.City,
 		Latitude:    r.Lat,
 		Longitude:   r.Lon,
+	}, nil
+}
+
+// checkQuota adjusts the given rate limiter from the X-Rl and X-Ttl headers
+// of the response, and returns an *api.QuotaError if the response is
+// 429 Too Many Requests.
+func checkQuota(l *ratelimit.Limiter, resp *http.Response) error {
+	remaining, ttl, ok := quota(resp.Header)
+	if ok {
+		l.Update(remaining, ttl)
 	}
 
-	return g, nil
+	// The quota is exhausted
+	if resp.StatusCode == http.StatusTooManyRequests {
+		l.Exhaust(ttl)
+		return &api.QuotaError{RetryAfter: ttl}
+	}
+
+	return nil
+}
+
+// quota returns the remaining number of requests and the duration until
+// the rate limit window is reset, read from the X-Rl and X-Ttl headers.
+// ref: https://ip-api.com/docs/unban
+func quota(h http.Header) (int, time.Duration, bool) {
+	remaining, err := strconv.Atoi(h.Get(HeaderRemaining))
+	if err != nil {
+		return 0, DefaultRateLimitPeriod, false
+	}
+
+	ttl, err := strconv.Atoi(h.Get(HeaderTTL))
+	if err != nil {
+		return 0, DefaultRateLimitPeriod, false
+	}
+
+	return remaining, time.Duration(ttl) * time.Second, true
+}
+
+// statusError maps the message of a failed query to an error.
+// ref: https://ip-api.com/docs/api:json
+func statusError(message string) error {
+	switch message {
+	case "private range":
+		return api.ErrPrivateRange
+	case "reserved range":
+		return api.ErrReservedRange
+	case "invalid query":
+		return api.ErrInvalidQuery
+	default:
+		return errors.New(message)
+	}
 }
 
 // Status will retrieve the status of ip-api.com API.
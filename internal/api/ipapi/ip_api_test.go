@@ -2,14 +2,18 @@ package ipapi
 
 import (
 	"context"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/lescactus/geolocation-go/internal/api"
+	"github.com/lescactus/geolocation-go/internal/api/ratelimit"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 )
@@ -67,6 +71,14 @@ func TestIPAPIClientGet(t *testing.T) {
 			w.Write([]byte(`{"status":"success","country":"France","countryCode":"FR","region":"IDF","regionName":"Île-de-France","city":"Paris","zip":"75000","lat":48.8566,"lon":2.35222,"timezone":"Europe/Paris","isp":"France Telecom Orange","org":"","as":"AS3215 Orange S.A.","query":"2.2.2.2"}`))
 		case "/3.3.3.3":
 			w.Write([]byte(`thisisnotjson`))
+		case "/10.0.0.1":
+			w.Write([]byte(`{"status":"fail","message":"private range","query":"10.0.0.1"}`))
+		case "/240.0.0.1":
+			w.Write([]byte(`{"status":"fail","message":"reserved range","query":"240.0.0.1"}`))
+		case "/bla":
+			w.Write([]byte(`{"status":"fail","message":"invalid query","query":"bla"}`))
+		case "/5.5.5.5":
+			w.Write([]byte(`{"status":"fail","message":"some unknown failure","query":"5.5.5.5"}`))
 		case "/4.4.4.4":
 			// Says returned content is 50 but actuaklly send nil
 			// resulting in ioutil.ReadAll() returning an error.
@@ -135,6 +147,204 @@ func TestIPAPIClientGet(t *testing.T) {
 		assert.Empty(t, g)
 	})
 
+	t.Run("ip-api - fail status - private range", func(t *testing.T) {
+		c := NewIPAPIClient(server.URL, server.Client(), &logger)
+		g, err := c.Get(context.Background(), "/10.0.0.1")
+		assert.ErrorIs(t, err, api.ErrPrivateRange)
+		assert.Empty(t, g)
+	})
+
+	t.Run("ip-api - fail status - reserved range", func(t *testing.T) {
+		c := NewIPAPIClient(server.URL, server.Client(), &logger)
+		g, err := c.Get(context.Background(), "/240.0.0.1")
+		assert.ErrorIs(t, err, api.ErrReservedRange)
+		assert.Empty(t, g)
+	})
+
+	t.Run("ip-api - fail status - invalid query", func(t *testing.T) {
+		c := NewIPAPIClient(server.URL, server.Client(), &logger)
+		g, err := c.Get(context.Background(), "/bla")
+		assert.ErrorIs(t, err, api.ErrInvalidQuery)
+		assert.Empty(t, g)
+	})
+
+	t.Run("ip-api - fail status - unknown message", func(t *testing.T) {
+		c := NewIPAPIClient(server.URL, server.Client(), &logger)
+		g, err := c.Get(context.Background(), "/5.5.5.5")
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, api.ErrPrivateRange)
+		assert.NotErrorIs(t, err, api.ErrReservedRange)
+		assert.NotErrorIs(t, err, api.ErrInvalidQuery)
+		assert.Empty(t, g)
+	})
+
+}
+
+func TestIPAPIClientGetQuota(t *testing.T) {
+	// Start local http server
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/1.1.1.1":
+			w.Header().Set(HeaderRemaining, "44")
+			w.Header().Set(HeaderTTL, "60")
+			w.Write([]byte(`{"status":"success","country":"Australia","countryCode":"AU","region":"QLD","regionName":"Queensland","city":"South Brisbane","zip":"4101","lat":-27.4766,"lon":153.0166,"timezone":"Australia/Brisbane","isp":"Cloudflare, Inc","org":"APNIC and Cloudflare DNS Resolver project","as":"AS13335 Cloudflare, Inc.","query":"1.1.1.1"}`))
+		case "/2.2.2.2":
+			// Last query of the window
+			w.Header().Set(HeaderRemaining, "0")
+			w.Header().Set(HeaderTTL, "42")
+			w.Write([]byte(`{"status":"success","country":"France","countryCode":"FR","region":"IDF","regionName":"Île-de-France","city":"Paris","zip":"75000","lat":48.8566,"lon":2.35222,"timezone":"Europe/Paris","isp":"France Telecom Orange","org":"","as":"AS3215 Orange S.A.","query":"2.2.2.2"}`))
+		case "/3.3.3.3":
+			w.Header().Set(HeaderRemaining, "0")
+			w.Header().Set(HeaderTTL, "30")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "/4.4.4.4":
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+
+	// Close the http server
+	defer server.Close()
+
+	newClient := func() *IPAPIClient {
+		c := NewIPAPIClient(server.URL, server.Client(), &logger)
+		c.Limiter = ratelimit.NewLimiter("ip-api", DefaultRateLimit, DefaultRateLimitPeriod, 0)
+		return c
+	}
+
+	t.Run("ip-api - remaining quota", func(t *testing.T) {
+		c := newClient()
+		g, err := c.Get(context.Background(), "/1.1.1.1")
+		assert.NoError(t, err)
+		assert.NotEmpty(t, g)
+
+		g, err = c.Get(context.Background(), "/1.1.1.1")
+		assert.NoError(t, err)
+		assert.NotEmpty(t, g)
+	})
+
+	t.Run("ip-api - quota exhausted by the last query", func(t *testing.T) {
+		c := newClient()
+		g, err := c.Get(context.Background(), "/2.2.2.2")
+		assert.NoError(t, err)
+		assert.NotEmpty(t, g)
+
+		// The next query isn't sent
+		g, err = c.Get(context.Background(), "/1.1.1.1")
+		assert.ErrorIs(t, err, api.ErrQuotaExhausted)
+		assert.Empty(t, g)
+
+		var qerr *api.QuotaError
+		assert.ErrorAs(t, err, &qerr)
+		assert.InDelta(t, 42*time.Second, qerr.RetryAfter, float64(time.Second))
+	})
+
+	t.Run("ip-api - 429 Too Many Requests", func(t *testing.T) {
+		c := newClient()
+		g, err := c.Get(context.Background(), "/3.3.3.3")
+		assert.ErrorIs(t, err, api.ErrQuotaExhausted)
+		assert.Empty(t, g)
+
+		var qerr *api.QuotaError
+		assert.ErrorAs(t, err, &qerr)
+		assert.Equal(t, 30*time.Second, qerr.RetryAfter)
+
+		// The next query isn't sent
+		_, err = c.Get(context.Background(), "/1.1.1.1")
+		assert.ErrorIs(t, err, api.ErrQuotaExhausted)
+	})
+
+	t.Run("ip-api - 429 Too Many Requests - no headers", func(t *testing.T) {
+		c := NewIPAPIClient(server.URL, server.Client(), &logger)
+		g, err := c.Get(context.Background(), "/4.4.4.4")
+		assert.ErrorIs(t, err, api.ErrQuotaExhausted)
+		assert.Empty(t, g)
+
+		var qerr *api.QuotaError
+		assert.ErrorAs(t, err, &qerr)
+		assert.Equal(t, DefaultRateLimitPeriod, qerr.RetryAfter)
+	})
+}
+
+// bodyCloseTransport records whether the bodies of its responses are closed
+type bodyCloseTransport struct {
+	http.RoundTripper
+	closed atomic.Int32
+}
+
+type closeRecorder struct {
+	io.ReadCloser
+	closed *atomic.Int32
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed.Add(1)
+	return c.ReadCloser.Close()
+}
+
+func (t *bodyCloseTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &closeRecorder{ReadCloser: resp.Body, closed: &t.closed}
+	return resp, nil
+}
+
+func TestIPAPIClientGetClosesBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/3.3.3.3":
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte("Too Many Requests"))
+		default:
+			w.WriteHeader(500)
+		}
+	}))
+	defer server.Close()
+
+	for _, ip := range []string{"/3.3.3.3", "/4.4.4.4"} {
+		transport := &bodyCloseTransport{RoundTripper: server.Client().Transport}
+		c := NewIPAPIClient(server.URL, &http.Client{Transport: transport}, &logger)
+
+		_, err := c.Get(context.Background(), ip)
+		assert.Error(t, err)
+		assert.Equal(t, int32(1), transport.closed.Load(), ip)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	tests := []struct {
+		name          string
+		remaining     string
+		ttl           string
+		wantRemaining int
+		wantTTL       time.Duration
+		wantOk        bool
+	}{
+		{name: "Valid headers", remaining: "44", ttl: "60", wantRemaining: 44, wantTTL: time.Minute, wantOk: true},
+		{name: "Quota exhausted", remaining: "0", ttl: "12", wantRemaining: 0, wantTTL: 12 * time.Second, wantOk: true},
+		{name: "Missing headers", wantTTL: DefaultRateLimitPeriod},
+		{name: "Invalid remaining", remaining: "a", ttl: "12", wantTTL: DefaultRateLimitPeriod},
+		{name: "Invalid ttl", remaining: "44", ttl: "a", wantTTL: DefaultRateLimitPeriod},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			if tt.remaining != "" {
+				h.Set(HeaderRemaining, tt.remaining)
+			}
+			if tt.ttl != "" {
+				h.Set(HeaderTTL, tt.ttl)
+			}
+
+			remaining, ttl, ok := quota(h)
+			assert.Equal(t, tt.wantRemaining, remaining)
+			assert.Equal(t, tt.wantTTL, ttl)
+			assert.Equal(t, tt.wantOk, ok)
+		})
+	}
 }
 
 func TestIPAPIClientStatus(t *testing.T) {
@@ -0,0 +1,258 @@
+package ipinfo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lescactus/geolocation-go/internal/api"
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+)
+
+const (
+	DefaultBaseURL   = "https://ipinfo.io/"
+	DefaultStatusURL = "https://ipinfo.io/me"
+
+	// ErrorTitleWrongIP is the title of the error returned by the
+	// ipinfo.io API for invalid ip addresses
+	ErrorTitleWrongIP = "Wrong ip"
+)
+
+// Prometheus metrics
+var (
+	ipInfoSuccessRequestSend = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ipinfo_http_requests_success_total",
+		Help: "Total number of successful http requests sent to the ipinfo API",
+	})
+	ipInfoFailedRequestSend = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ipinfo_http_requests_failed_total",
+		Help: "Total number of failed http requests sent to the ipinfo API",
+	})
+)
+
+// IPInfoClient is an http client for the https://ipinfo.io/ API.
+type IPInfoClient struct {
+	BaseURL   string
+	StatusURL string
+	token     string
+	Client    *http.Client
+	Logger    *zerolog.Logger
+}
+
+// IPInfoResponse represents the json response of the ipinfo.io API
+// Documentation can be found at https://ipinfo.io/developers/responses
+type IPInfoResponse struct {
+	IP       string `json:"ip"`
+	Hostname string `json:"hostname"`
+	Bogon    bool   `json:"bogon"`
+	City     string `json:"city"`
+	Region   string `json:"region"`
+	Country  string `json:"country"`
+	Loc      string `json:"loc"` // "latitude,longitude"
+	Org      string `json:"org"` // "AS<number> <organization>"
+	Postal   string `json:"postal"`
+	Timezone string `json:"timezone"`
+}
+
+// IPInfoErrorResponse represents the json response of the ipinfo.io API
+// when the request fails
+type IPInfoErrorResponse struct {
+	Status int `json:"status"`
+	Error  struct {
+		Title   string `json:"title"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func NewIPInfoClient(baseURL, token string, client *http.Client, logger *zerolog.Logger) *IPInfoClient {
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	return &IPInfoClient{BaseURL: baseURL, StatusURL: DefaultStatusURL, token: token, Client: client, Logger: logger}
+}
+
+func (c *IPInfoClient) Get(ctx context.Context, ip string) (*models.GeoIP, error) {
+	// Get request id for logging purposes
+	req_id, _ := hlog.IDFromCtx(ctx)
+
+	// Building url
+	url := fmt.Sprintf("%s%s/json", c.BaseURL, ip)
+
+	// Building http request
+	c.Logger.Trace().Str("req_id", req_id.String()).Msg("building http request to " + url)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		c.Logger.Error().Str("req_id", req_id.String()).
+			Msg(fmt.Sprintf("error while building http request to %s: %s", url, err.Error()))
+		return nil, fmt.Errorf("error: error while building http request to %s: %w", url, err)
+	}
+	c.authenticate(req)
+
+	// Send http request
+	c.Logger.Debug().Str("req_id", req_id.String()).Msg("sending http request to " + url)
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		c.Logger.Error().Str("req_id", req_id.String()).
+			Msg(fmt.Sprintf("error while sending http request to %s: %s", url, err.Error()))
+		// Increment Prometheus counter
+		ipInfoFailedRequestSend.Inc()
+		return nil, fmt.Errorf("error: error while sending http request to %s: %w", url, err)
+	}
+
+	// Increment Prometheus counter
+	ipInfoSuccessRequestSend.Inc()
+
+	// Read http response
+	c.Logger.Trace().Str("req_id", req_id.String()).Msg("reading http response from " + url)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		c.Logger.Error().Str("req_id", req_id.String()).
+			Msg(fmt.Sprintf("error while reading http response to %s: %s", url, err.Error()))
+		return nil, fmt.Errorf("error: error while reading http response to %s: %w", url, err)
+	}
+
+	// Ensure the response code is 200 OK
+	c.Logger.Trace().Str("req_id", req_id.String()).Msg("http request to " + url + " sent")
+	if resp.StatusCode != 200 {
+		c.Logger.Error().Str("req_id", req_id.String()).
+			Msg(fmt.Sprintf("http response code is not 200 for http request %s: %d", url, resp.StatusCode))
+
+		// The ip address has been rejected
+		var e IPInfoErrorResponse
+		if json.Unmarshal(body, &e) == nil && e.Error.Title == ErrorTitleWrongIP {
+			return nil, fmt.Errorf("error: query %s failed: %w", url, api.ErrInvalidQuery)
+		}
+
+		return nil, fmt.Errorf("error: http response code is not 200 for http request %s: %d", url, resp.StatusCode)
+	}
+
+	// Unmarshal http response into a IPInfoResponse
+	var r IPInfoResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		c.Logger.Error().Str("req_id", req_id.String()).
+			Msg(fmt.Sprintf("error while unmarshalling http response from %s: %s", url, err))
+		return nil, fmt.Errorf("error: error while unmarshalling http response from %s: %w", url, err)
+	}
+
+	// Bogon addresses are private or reserved addresses
+	// ref: https://ipinfo.io/bogon
+	if r.Bogon {
+		return nil, fmt.Errorf("error: query %s failed: %w", url, api.ErrReservedRange)
+	}
+
+	lat, lon, err := parseLoc(r.Loc)
+	if err != nil {
+		c.Logger.Error().Str("req_id", req_id.String()).
+			Msg(fmt.Sprintf("error while parsing location from %s: %s", url, err))
+		return nil, fmt.Errorf("error: error while parsing location from %s: %w", url, err)
+	}
+
+	asn, org := parseOrg(r.Org)
+
+	// Map the IPInfoResponse into a models.GeoIP
+	g := &models.GeoIP{
+		IP:           ip,
+		CountryCode:  r.Country,
+		CountryName:  api.CountryName(r.Country),
+		City:         r.City,
+		Latitude:     lat,
+		Longitude:    lon,
+		ASN:          asn,
+		Organization: org,
+	}
+
+	return g, nil
+}
+
+// Status will retrieve the status of ipinfo.io API.
+// It will simply send a GET request to the status URL.
+// ref: https://ipinfo.io/developers#checking-your-limits
+func (c *IPInfoClient) Status(ctx context.Context, wg *sync.WaitGroup, ch chan error) {
+	defer wg.Done()
+
+	// Building http request
+	req, err := http.NewRequestWithContext(ctx, "GET", c.StatusURL, nil)
+	if err != nil {
+		ch <- fmt.Errorf("error: error while building http request to %s: %w", c.StatusURL, err)
+		return
+	}
+	c.authenticate(req)
+
+	// Send http request
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		ch <- fmt.Errorf("error: error while sending http request to %s: %w", c.StatusURL, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	// Ensure the response code is 200 OK
+	if resp.StatusCode != 200 {
+		ch <- fmt.Errorf("error: http response code is not 200 for http request %s: %d", c.StatusURL, resp.StatusCode)
+		return
+	}
+
+	ch <- nil
+}
+
+// authenticate sets the token of the client, if any, to the request.
+// The API can be used without token with a limited quota.
+func (c *IPInfoClient) authenticate(req *http.Request) {
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+}
+
+// parseLoc parses a "latitude,longitude" location.
+// An empty location is parsed as 0,0.
+func parseLoc(loc string) (float64, float64, error) {
+	if loc == "" {
+		return 0, 0, nil
+	}
+
+	lat, lon, ok := strings.Cut(loc, ",")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid location %q", loc)
+	}
+
+	latitude, err := strconv.ParseFloat(strings.TrimSpace(lat), 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid latitude %q", lat)
+	}
+
+	longitude, err := strconv.ParseFloat(strings.TrimSpace(lon), 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid longitude %q", lon)
+	}
+
+	return latitude, longitude, nil
+}
+
+// parseOrg parses an "AS<number> <organization>" organization
+// into its autonomous system number and organization name.
+// The whole string is returned as the organization name if it
+// doesn't start with an autonomous system number.
+func parseOrg(org string) (uint, string) {
+	as, name, _ := strings.Cut(org, " ")
+	if !strings.HasPrefix(as, "AS") {
+		return 0, org
+	}
+
+	asn, err := strconv.ParseUint(strings.TrimPrefix(as, "AS"), 10, 32)
+	if err != nil {
+		return 0, org
+	}
+
+	return uint(asn), name
+}
@@ -0,0 +1,355 @@
+package ipinfo
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lescactus/geolocation-go/internal/api"
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+var logger = zerolog.New(os.Stdout).Level(zerolog.NoLevel)
+
+func TestNewIPInfoClient(t *testing.T) {
+	type args struct {
+		baseURL string
+		token   string
+		client  *http.Client
+		logger  *zerolog.Logger
+	}
+	tests := []struct {
+		name string
+		args args
+		want *IPInfoClient
+	}{
+		{
+			name: "Empty base URL - empty token - empty http client",
+			args: args{},
+			want: &IPInfoClient{BaseURL: DefaultBaseURL, StatusURL: DefaultStatusURL},
+		},
+		{
+			name: "Non empty base URL - empty token - empty http client",
+			args: args{baseURL: "http://localhost:8080/"},
+			want: &IPInfoClient{BaseURL: "http://localhost:8080/", StatusURL: DefaultStatusURL},
+		},
+		{
+			name: "Non empty base URL - non empty token - empty http client",
+			args: args{baseURL: "http://localhost:8080/", token: "sometoken"},
+			want: &IPInfoClient{BaseURL: "http://localhost:8080/", StatusURL: DefaultStatusURL, token: "sometoken"},
+		},
+		{
+			name: "Non empty base URL - non empty token - non empty http client",
+			args: args{baseURL: "http://localhost:8080/", token: "sometoken", client: &http.Client{Timeout: 5 * time.Second}},
+			want: &IPInfoClient{BaseURL: "http://localhost:8080/", StatusURL: DefaultStatusURL, token: "sometoken", Client: &http.Client{Timeout: 5 * time.Second}},
+		},
+		{
+			name: "Empty base URL - non empty token - non empty http client",
+			args: args{token: "sometoken", client: &http.Client{Timeout: 5 * time.Second}},
+			want: &IPInfoClient{BaseURL: DefaultBaseURL, StatusURL: DefaultStatusURL, token: "sometoken", Client: &http.Client{Timeout: 5 * time.Second}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NewIPInfoClient(tt.args.baseURL, tt.args.token, tt.args.client, tt.args.logger); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NewIPInfoClient() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPInfoClientGet(t *testing.T) {
+	// Start local http server
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer sometoken" {
+			w.WriteHeader(403)
+			w.Write([]byte(`{"status":403,"error":{"title":"Unknown token","message":"Please ensure you've entered your token correctly."}}`))
+			return
+		}
+
+		switch r.URL.Path {
+		case "/1.1.1.1/json":
+			w.Write([]byte(`{"ip":"1.1.1.1","hostname":"one.one.one.one","city":"Brisbane","region":"Queensland","country":"AU","loc":"-27.4820,153.0136","org":"AS13335 Cloudflare, Inc.","postal":"4000","timezone":"Australia/Brisbane","anycast":true}`))
+		case "/2606:4700:4700::1111/json":
+			w.Write([]byte(`{"ip":"2606:4700:4700::1111","hostname":"one.one.one.one","city":"San Francisco","region":"California","country":"US","loc":"37.7621,-122.3971","org":"AS13335 Cloudflare, Inc.","postal":"94107","timezone":"America/Los_Angeles","anycast":true}`))
+		case "/2.2.2.2/json":
+			w.Write([]byte(`{"ip":"2.2.2.2","city":"Paris","region":"Île-de-France","country":"FR","loc":"48.8534,2.3488","postal":"75000","timezone":"Europe/Paris"}`))
+		case "/3.3.3.3/json":
+			w.Write([]byte(`thisisnotjson`))
+		case "/4.4.4.4/json":
+			// Says returned content is 50 but actuaklly send nil
+			// resulting in ioutil.ReadAll() returning an error.
+			w.Header().Add("Content-Length", "50")
+			w.Write(nil)
+		case "/5.5.5.5/json":
+			w.Write([]byte(`{"ip":"5.5.5.5","country":"DE","loc":"bla"}`))
+		case "/10.0.0.1/json":
+			w.Write([]byte(`{"ip":"10.0.0.1","bogon":true}`))
+		case "/bla/json":
+			w.WriteHeader(404)
+			w.Write([]byte(`{"status":404,"error":{"title":"Wrong ip","message":"Please provide a valid IP address"}}`))
+		case "/6.6.6.6/json":
+			w.WriteHeader(429)
+			w.Write([]byte(`{"status":429,"error":{"title":"Rate limit exceeded","message":"You've hit the daily limit for the unauthenticated API."}}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+
+	// Close the http server
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		baseURL string
+		token   string
+		ip      string
+		want    *models.GeoIP
+		wantErr error
+	}{
+		{
+			name:    "ipinfo - /1.1.1.1/json",
+			baseURL: server.URL + "/",
+			token:   "sometoken",
+			ip:      "1.1.1.1",
+			want:    &models.GeoIP{IP: "1.1.1.1", CountryCode: "AU", CountryName: "Australia", City: "Brisbane", Latitude: -27.482, Longitude: 153.0136, ASN: 13335, Organization: "Cloudflare, Inc."},
+		},
+		{
+			name:    "ipinfo - /2606:4700:4700::1111/json",
+			baseURL: server.URL + "/",
+			token:   "sometoken",
+			ip:      "2606:4700:4700::1111",
+			want:    &models.GeoIP{IP: "2606:4700:4700::1111", CountryCode: "US", CountryName: "United States", City: "San Francisco", Latitude: 37.7621, Longitude: -122.3971, ASN: 13335, Organization: "Cloudflare, Inc."},
+		},
+		{
+			name:    "ipinfo - /2.2.2.2/json - no org",
+			baseURL: server.URL + "/",
+			token:   "sometoken",
+			ip:      "2.2.2.2",
+			want:    &models.GeoIP{IP: "2.2.2.2", CountryCode: "FR", CountryName: "France", City: "Paris", Latitude: 48.8534, Longitude: 2.3488},
+		},
+		{
+			name:    "ipinfo - /3.3.3.3/json - invalid json",
+			baseURL: server.URL + "/",
+			token:   "sometoken",
+			ip:      "3.3.3.3",
+			wantErr: errAny,
+		},
+		{
+			name:    "ipinfo - /4.4.4.4/json - invalid body",
+			baseURL: server.URL + "/",
+			token:   "sometoken",
+			ip:      "4.4.4.4",
+			wantErr: errAny,
+		},
+		{
+			name:    "ipinfo - /5.5.5.5/json - invalid loc",
+			baseURL: server.URL + "/",
+			token:   "sometoken",
+			ip:      "5.5.5.5",
+			wantErr: errAny,
+		},
+		{
+			name:    "ipinfo - /6.6.6.6/json - rate limited",
+			baseURL: server.URL + "/",
+			token:   "sometoken",
+			ip:      "6.6.6.6",
+			wantErr: errAny,
+		},
+		{
+			name:    "ipinfo - bogon",
+			baseURL: server.URL + "/",
+			token:   "sometoken",
+			ip:      "10.0.0.1",
+			wantErr: api.ErrReservedRange,
+		},
+		{
+			name:    "ipinfo - wrong ip",
+			baseURL: server.URL + "/",
+			token:   "sometoken",
+			ip:      "bla",
+			wantErr: api.ErrInvalidQuery,
+		},
+		{
+			name:    "ipinfo - invalid token",
+			baseURL: server.URL + "/",
+			token:   "invalidtoken",
+			ip:      "1.1.1.1",
+			wantErr: errAny,
+		},
+		{
+			name:    "ipinfo - /invalid-path",
+			baseURL: server.URL + "/invalid-path/",
+			token:   "sometoken",
+			ip:      "1.1.1.1",
+			wantErr: errAny,
+		},
+		{
+			// string([]byte{0x7f}) is a control character which will make NewRequestWithContext()
+			// throw an error.
+			name:    "ipinfo - invalid url - 01",
+			baseURL: string([]byte{0x7f}),
+			token:   "sometoken",
+			ip:      "1.1.1.1",
+			wantErr: errAny,
+		},
+		{
+			name:    "ipinfo - invalid url - 02",
+			baseURL: "_invalidUrl_",
+			token:   "sometoken",
+			ip:      "1.1.1.1",
+			wantErr: errAny,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Use Client & URL from the local test server
+			c := NewIPInfoClient(tt.baseURL, tt.token, server.Client(), &logger)
+			g, err := c.Get(context.Background(), tt.ip)
+			switch tt.wantErr {
+			case nil:
+				assert.NoError(t, err)
+			case errAny:
+				assert.Error(t, err)
+				assert.NotErrorIs(t, err, api.ErrInvalidQuery)
+				assert.NotErrorIs(t, err, api.ErrReservedRange)
+			default:
+				assert.ErrorIs(t, err, tt.wantErr)
+			}
+			assert.Equal(t, tt.want, g)
+		})
+	}
+}
+
+// errAny is used by the tests expecting an error
+// which isn't an api client error
+var errAny = fmt.Errorf("any error")
+
+func TestIPInfoClientStatus(t *testing.T) {
+	// Start local http server
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/me":
+			if r.Header.Get("Authorization") != "Bearer sometoken" {
+				w.WriteHeader(403)
+				return
+			}
+			w.Write([]byte(`{"token":"sometoken","requests":{"day":2,"month":2,"limit":50000,"remaining":49998}}`))
+		default:
+			w.WriteHeader(404)
+			w.Write([]byte(`ko`))
+		}
+	}))
+
+	// Close the http server
+	defer server.Close()
+
+	var wg sync.WaitGroup
+
+	wg.Add(5)
+
+	t.Run("ipinfo status - /me", func(t *testing.T) {
+		ch := make(chan error, 1)
+		// Use Client & URL from the local test server
+		c := NewIPInfoClient(server.URL, "sometoken", server.Client(), &logger)
+		c.StatusURL = fmt.Sprintf("%s/me", server.URL)
+		c.Status(context.Background(), &wg, ch)
+		assert.NoError(t, <-ch)
+	})
+
+	t.Run("ipinfo status - /me - invalid token", func(t *testing.T) {
+		ch := make(chan error, 1)
+		// Use Client & URL from the local test server
+		c := NewIPInfoClient(server.URL, "invalidtoken", server.Client(), &logger)
+		c.StatusURL = fmt.Sprintf("%s/me", server.URL)
+		c.Status(context.Background(), &wg, ch)
+		assert.Error(t, <-ch)
+	})
+
+	t.Run("ipinfo status - invalid url - 01", func(t *testing.T) {
+		ch := make(chan error, 1)
+		// string([]byte{0x7f}) is a control character which will make NewRequestWithContext()
+		// throw an error.
+		c := NewIPInfoClient(string([]byte{0x7f}), "sometoken", server.Client(), &logger)
+		c.StatusURL = fmt.Sprintf("%s/me", string([]byte{0x7f}))
+		c.Status(context.Background(), &wg, ch)
+		assert.Error(t, <-ch)
+	})
+
+	t.Run("ipinfo status - invalid url - 02", func(t *testing.T) {
+		ch := make(chan error, 1)
+		c := NewIPInfoClient("_invalidUrl_", "sometoken", server.Client(), &logger)
+		c.StatusURL = fmt.Sprintf("%s/me", "_invalidUrl_")
+		c.Status(context.Background(), &wg, ch)
+		assert.Error(t, <-ch)
+	})
+
+	t.Run("ipinfo status - /404", func(t *testing.T) {
+		ch := make(chan error, 1)
+		// Use Client & URL from the local test server
+		c := NewIPInfoClient(server.URL, "sometoken", server.Client(), &logger)
+		c.StatusURL = fmt.Sprintf("%s/404", server.URL)
+		c.Status(context.Background(), &wg, ch)
+		assert.Error(t, <-ch)
+	})
+
+	wg.Wait()
+}
+
+func TestParseLoc(t *testing.T) {
+	tests := []struct {
+		name    string
+		loc     string
+		wantLat float64
+		wantLon float64
+		wantErr bool
+	}{
+		{name: "Valid location", loc: "-27.4820,153.0136", wantLat: -27.482, wantLon: 153.0136},
+		{name: "Valid location - spaces", loc: "48.8534, 2.3488", wantLat: 48.8534, wantLon: 2.3488},
+		{name: "Empty location", loc: ""},
+		{name: "Missing longitude", loc: "48.8534", wantErr: true},
+		{name: "Invalid latitude", loc: "bla,2.3488", wantErr: true},
+		{name: "Invalid longitude", loc: "48.8534,bla", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lat, lon, err := parseLoc(tt.loc)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseLoc() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			assert.Equal(t, tt.wantLat, lat)
+			assert.Equal(t, tt.wantLon, lon)
+		})
+	}
+}
+
+func TestParseOrg(t *testing.T) {
+	tests := []struct {
+		name    string
+		org     string
+		wantASN uint
+		wantOrg string
+	}{
+		{name: "ASN and organization", org: "AS13335 Cloudflare, Inc.", wantASN: 13335, wantOrg: "Cloudflare, Inc."},
+		{name: "ASN only", org: "AS3215", wantASN: 3215, wantOrg: ""},
+		{name: "Organization only", org: "Orange S.A.", wantOrg: "Orange S.A."},
+		{name: "Invalid ASN", org: "ASbla Orange S.A.", wantOrg: "ASbla Orange S.A."},
+		{name: "Empty", org: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			asn, org := parseOrg(tt.org)
+			assert.Equal(t, tt.wantASN, asn)
+			assert.Equal(t, tt.wantOrg, org)
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package maxmind
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lescactus/geolocation-go/internal/filewatch"
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+)
+
+const (
+	// DefaultLanguage is the language used for the city and country names
+	DefaultLanguage = "en"
+)
+
+var (
+	// ErrNotFound is returned when the ip address isn't in the database
+	ErrNotFound = errors.New("ip address not found in the maxmind database")
+
+	// ErrNotLoaded is returned when no database is loaded
+	ErrNotLoaded = errors.New("maxmind database not loaded")
+)
+
+// Prometheus metrics
+var (
+	maxmindLookups = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "maxmind_lookups_total",
+		Help: "Total number of successful lookups in the maxmind database",
+	})
+	maxmindFailedLookups = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "maxmind_lookups_failed_total",
+		Help: "Total number of failed lookups in the maxmind database",
+	})
+	maxmindReloads = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "maxmind_reloads_total",
+		Help: "Total number of successful reloads of the maxmind database files",
+	})
+	maxmindFailedReloads = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "maxmind_reloads_failed_total",
+		Help: "Total number of failed reloads of the maxmind database files",
+	})
+)
+
+// MaxMindClient is a GeoIP API reading local MaxMind GeoIP2 or GeoLite2
+// database files (.mmdb).
+// Databases are loaded in memory and can be swapped at runtime without
+// interrupting the lookups.
+type MaxMindClient struct {
+	// Path to a City or Country database
+	CityPath string
+	// Path to an optional ASN database
+	ASNPath string
+	Logger  *zerolog.Logger
+
+	// Currently loaded databases
+	city atomic.Pointer[maxminddb.Reader]
+	asn  atomic.Pointer[maxminddb.Reader]
+}
+
+// cityRecord represents a record of a GeoIP2/GeoLite2 City or Country database.
+// The traits are only available in the GeoIP2 Enterprise and ISP databases.
+// ref: https://dev.maxmind.com/geoip/docs/databases/city-and-country
+type cityRecord struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Country struct {
+		ISOCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	Location struct {
+		Latitude  float64 `maxminddb:"latitude"`
+		Longitude float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+	Traits asnRecord `maxminddb:"traits"`
+}
+
+// asnRecord represents a record of a GeoIP2/GeoLite2 ASN database.
+// ref: https://dev.maxmind.com/geoip/docs/databases/asn
+type asnRecord struct {
+	AutonomousSystemNumber       uint   `maxminddb:"autonomous_system_number"`
+	AutonomousSystemOrganization string `maxminddb:"autonomous_system_organization"`
+}
+
+// NewMaxMindClient will create a new MaxMindClient and load the given databases.
+// asnPath is optional.
+func NewMaxMindClient(cityPath, asnPath string, logger *zerolog.Logger) (*MaxMindClient, error) {
+	c := &MaxMindClient{CityPath: cityPath, ASNPath: asnPath, Logger: logger}
+
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Reload will read the database files again and atomically swap the current
+// databases with the new ones.
+// The current databases are kept in case of error.
+func (c *MaxMindClient) Reload() error {
+	city, err := open(c.CityPath)
+	if err != nil {
+		// Increment Prometheus counter
+		maxmindFailedReloads.Inc()
+		return err
+	}
+
+	var asn *maxminddb.Reader
+	if c.ASNPath != "" {
+		asn, err = open(c.ASNPath)
+		if err != nil {
+			// Increment Prometheus counter
+			maxmindFailedReloads.Inc()
+			return err
+		}
+	}
+
+	// The databases are read in memory rather than memory mapped,
+	// hence the previous readers don't have to be closed and are
+	// garbage collected once the in-flight lookups are done.
+	c.city.Store(city)
+	c.asn.Store(asn)
+
+	// Increment Prometheus counter
+	maxmindReloads.Inc()
+
+	c.Logger.Info().Msgf("maxmind database %s (%s) loaded", c.CityPath, city.Metadata.DatabaseType)
+	if asn != nil {
+		c.Logger.Info().Msgf("maxmind database %s (%s) loaded", c.ASNPath, asn.Metadata.DatabaseType)
+	}
+
+	return nil
+}
+
+// Watch will reload the databases every time one of the database
+// files is replaced on disk, until ctx is cancelled.
+func (c *MaxMindClient) Watch(ctx context.Context) error {
+	reload := func() {
+		if err := c.Reload(); err != nil {
+			c.Logger.Error().Err(err).Msg("failed to reload maxmind database")
+		}
+	}
+
+	if err := filewatch.Watch(ctx, c.CityPath, filewatch.DefaultDebounce, reload); err != nil {
+		return err
+	}
+
+	if c.ASNPath != "" {
+		return filewatch.Watch(ctx, c.ASNPath, filewatch.DefaultDebounce, reload)
+	}
+
+	return nil
+}
+
+func (c *MaxMindClient) Get(ctx context.Context, ip string) (*models.GeoIP, error) {
+	// Get request id for logging purposes
+	req_id, _ := hlog.IDFromCtx(ctx)
+
+	city := c.city.Load()
+	if city == nil {
+		// Increment Prometheus counter
+		maxmindFailedLookups.Inc()
+		return nil, ErrNotLoaded
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		// Increment Prometheus counter
+		maxmindFailedLookups.Inc()
+		return nil, fmt.Errorf("error: invalid ip address %s", ip)
+	}
+
+	// Lookup the city database
+	c.Logger.Trace().Str("req_id", req_id.String()).Msgf("looking up %s in maxmind database %s", ip, c.CityPath)
+	var r cityRecord
+	_, ok, err := city.LookupNetwork(addr, &r)
+	if err != nil {
+		c.Logger.Error().Str("req_id", req_id.String()).
+			Msg(fmt.Sprintf("error while looking up %s in maxmind database %s: %s", ip, c.CityPath, err.Error()))
+		// Increment Prometheus counter
+		maxmindFailedLookups.Inc()
+		return nil, fmt.Errorf("error: error while looking up %s in maxmind database %s: %w", ip, c.CityPath, err)
+	}
+	if !ok {
+		// Increment Prometheus counter
+		maxmindFailedLookups.Inc()
+		return nil, fmt.Errorf("error: %s: %w", ip, ErrNotFound)
+	}
+
+	// Lookup the optional asn database
+	if asn := c.asn.Load(); asn != nil {
+		c.Logger.Trace().Str("req_id", req_id.String()).Msgf("looking up %s in maxmind database %s", ip, c.ASNPath)
+		if err := asn.Lookup(addr, &r.Traits); err != nil {
+			c.Logger.Error().Str("req_id", req_id.String()).
+				Msg(fmt.Sprintf("error while looking up %s in maxmind database %s: %s", ip, c.ASNPath, err.Error()))
+		}
+	}
+
+	// Increment Prometheus counter
+	maxmindLookups.Inc()
+
+	// Map the cityRecord into a models.GeoIP
+	g := &models.GeoIP{
+		IP:           ip,
+		CountryCode:  r.Country.ISOCode,
+		CountryName:  r.Country.Names[DefaultLanguage],
+		City:         r.City.Names[DefaultLanguage],
+		Latitude:     r.Location.Latitude,
+		Longitude:    r.Location.Longitude,
+		ASN:          r.Traits.AutonomousSystemNumber,
+		Organization: r.Traits.AutonomousSystemOrganization,
+	}
+
+	return g, nil
+}
+
+// Status will retrieve the status of the MaxMind databases.
+// It will ensure a City or Country database is loaded.
+func (c *MaxMindClient) Status(ctx context.Context, wg *sync.WaitGroup, ch chan error) {
+	defer wg.Done()
+
+	if c.city.Load() == nil {
+		ch <- ErrNotLoaded
+		return
+	}
+
+	ch <- nil
+}
+
+// open reads the given database file in memory and
+// returns a reader for it.
+func open(path string) (*maxminddb.Reader, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error: failed to read maxmind database: %w", err)
+	}
+
+	r, err := maxminddb.FromBytes(b)
+	if err != nil {
+		return nil, fmt.Errorf("error: failed to open maxmind database %s: %w", path, err)
+	}
+
+	return r, nil
+}
@@ -0,0 +1,263 @@
+package maxmind
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+var logger = zerolog.New(os.Stdout).Level(zerolog.NoLevel)
+
+// writeDB writes a mmdb database of the given type containing the
+// given records at path.
+func writeDB(t *testing.T, path, dbType string, records map[string]mmdbtype.Map) {
+	t.Helper()
+
+	tree, err := mmdbwriter.New(mmdbwriter.Options{DatabaseType: dbType, RecordSize: 24})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for cidr, record := range records {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tree.Insert(network, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Write to a temporary file and rename it to mimic
+	// an atomic replacement of the database
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.WriteTo(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func cityRecordFixture(countryCode, countryName, city string, lat, lon float64) mmdbtype.Map {
+	return mmdbtype.Map{
+		"city": mmdbtype.Map{
+			"names": mmdbtype.Map{"en": mmdbtype.String(city)},
+		},
+		"country": mmdbtype.Map{
+			"iso_code": mmdbtype.String(countryCode),
+			"names":    mmdbtype.Map{"en": mmdbtype.String(countryName)},
+		},
+		"location": mmdbtype.Map{
+			"latitude":  mmdbtype.Float64(lat),
+			"longitude": mmdbtype.Float64(lon),
+		},
+	}
+}
+
+func asnRecordFixture(asn uint32, org string) mmdbtype.Map {
+	return mmdbtype.Map{
+		"autonomous_system_number":       mmdbtype.Uint32(asn),
+		"autonomous_system_organization": mmdbtype.String(org),
+	}
+}
+
+func TestNewMaxMindClient(t *testing.T) {
+	dir := t.TempDir()
+	cityPath := filepath.Join(dir, "GeoLite2-City.mmdb")
+	asnPath := filepath.Join(dir, "GeoLite2-ASN.mmdb")
+	writeDB(t, cityPath, "GeoLite2-City", map[string]mmdbtype.Map{
+		"1.1.1.0/24": cityRecordFixture("AU", "Australia", "South Brisbane", -27.4766, 153.0166),
+	})
+	writeDB(t, asnPath, "GeoLite2-ASN", map[string]mmdbtype.Map{
+		"1.1.1.0/24": asnRecordFixture(13335, "CLOUDFLARENET"),
+	})
+
+	tests := []struct {
+		name     string
+		cityPath string
+		asnPath  string
+		wantErr  bool
+	}{
+		{name: "City database only", cityPath: cityPath},
+		{name: "City and ASN databases", cityPath: cityPath, asnPath: asnPath},
+		{name: "Non existing city database", cityPath: filepath.Join(dir, "nonexistent.mmdb"), wantErr: true},
+		{name: "Non existing asn database", cityPath: cityPath, asnPath: filepath.Join(dir, "nonexistent.mmdb"), wantErr: true},
+		{name: "Empty city database path", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewMaxMindClient(tt.cityPath, tt.asnPath, &logger)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewMaxMindClient() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("Invalid database", func(t *testing.T) {
+		path := filepath.Join(dir, "invalid.mmdb")
+		assert.NoError(t, os.WriteFile(path, []byte("thisisnotammdb"), 0o644))
+
+		_, err := NewMaxMindClient(path, "", &logger)
+		assert.Error(t, err)
+	})
+}
+
+func TestMaxMindClientGet(t *testing.T) {
+	dir := t.TempDir()
+	cityPath := filepath.Join(dir, "GeoLite2-City.mmdb")
+	asnPath := filepath.Join(dir, "GeoLite2-ASN.mmdb")
+	writeDB(t, cityPath, "GeoLite2-City", map[string]mmdbtype.Map{
+		"1.1.1.0/24":      cityRecordFixture("AU", "Australia", "South Brisbane", -27.4766, 153.0166),
+		"2606:4700::/32":  cityRecordFixture("US", "United States", "San Francisco", 37.7749, -122.4194),
+		"2.2.2.0/24":      cityRecordFixture("FR", "France", "", 48.8582, 2.3387),
+		"88.74.7.0/24":    cityRecordFixture("DE", "Germany", "Düsseldorf", 51.2217, 6.77616),
+		"80.80.80.0/24":   cityRecordFixture("NL", "Netherlands", "Amsterdam", 52.3676, 4.9041),
+		"208.67.222.0/24": cityRecordFixture("US", "United States", "San Francisco", 37.7749, -122.4194),
+	})
+	writeDB(t, asnPath, "GeoLite2-ASN", map[string]mmdbtype.Map{
+		"1.1.1.0/24":     asnRecordFixture(13335, "CLOUDFLARENET"),
+		"2606:4700::/32": asnRecordFixture(13335, "CLOUDFLARENET"),
+	})
+
+	c, err := NewMaxMindClient(cityPath, asnPath, &logger)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		ip      string
+		want    *models.GeoIP
+		wantErr bool
+	}{
+		{
+			name: "IPv4 - with asn",
+			ip:   "1.1.1.1",
+			want: &models.GeoIP{IP: "1.1.1.1", CountryCode: "AU", CountryName: "Australia", City: "South Brisbane", Latitude: -27.4766, Longitude: 153.0166, ASN: 13335, Organization: "CLOUDFLARENET"},
+		},
+		{
+			name: "IPv6 - with asn",
+			ip:   "2606:4700::1111",
+			want: &models.GeoIP{IP: "2606:4700::1111", CountryCode: "US", CountryName: "United States", City: "San Francisco", Latitude: 37.7749, Longitude: -122.4194, ASN: 13335, Organization: "CLOUDFLARENET"},
+		},
+		{
+			name: "IPv4 - without asn - without city",
+			ip:   "2.2.2.2",
+			want: &models.GeoIP{IP: "2.2.2.2", CountryCode: "FR", CountryName: "France", Latitude: 48.8582, Longitude: 2.3387},
+		},
+		{
+			name:    "Not in database",
+			ip:      "3.3.3.3",
+			wantErr: true,
+		},
+		{
+			name:    "Invalid ip",
+			ip:      "bla",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := c.Get(context.Background(), tt.ip)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("MaxMindClient.Get() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	t.Run("Not loaded", func(t *testing.T) {
+		c := &MaxMindClient{Logger: &logger}
+		_, err := c.Get(context.Background(), "1.1.1.1")
+		assert.ErrorIs(t, err, ErrNotLoaded)
+	})
+}
+
+func TestMaxMindClientWatch(t *testing.T) {
+	dir := t.TempDir()
+	cityPath := filepath.Join(dir, "GeoLite2-City.mmdb")
+	writeDB(t, cityPath, "GeoLite2-City", map[string]mmdbtype.Map{
+		"1.1.1.0/24": cityRecordFixture("AU", "Australia", "South Brisbane", -27.4766, 153.0166),
+	})
+
+	c, err := NewMaxMindClient(cityPath, "", &logger)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.NoError(t, c.Watch(ctx))
+
+	// Keep looking up while the database is replaced to
+	// ensure no request is dropped
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				_, err := c.Get(context.Background(), "1.1.1.1")
+				assert.NoError(t, err)
+			}
+		}
+	}()
+
+	writeDB(t, cityPath, "GeoLite2-City", map[string]mmdbtype.Map{
+		"1.1.1.0/24": cityRecordFixture("AU", "Australia", "Sydney", -33.8688, 151.2093),
+	})
+
+	assert.Eventually(t, func() bool {
+		g, err := c.Get(context.Background(), "1.1.1.1")
+		return err == nil && g.City == "Sydney"
+	}, 5*time.Second, 50*time.Millisecond)
+
+	close(done)
+	wg.Wait()
+}
+
+func TestMaxMindClientStatus(t *testing.T) {
+	dir := t.TempDir()
+	cityPath := filepath.Join(dir, "GeoLite2-City.mmdb")
+	writeDB(t, cityPath, "GeoLite2-City", map[string]mmdbtype.Map{
+		"1.1.1.0/24": cityRecordFixture("AU", "Australia", "South Brisbane", -27.4766, 153.0166),
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	t.Run("maxmind status - loaded", func(t *testing.T) {
+		ch := make(chan error, 1)
+		c, err := NewMaxMindClient(cityPath, "", &logger)
+		assert.NoError(t, err)
+		c.Status(context.Background(), &wg, ch)
+		assert.NoError(t, <-ch)
+	})
+
+	t.Run("maxmind status - not loaded", func(t *testing.T) {
+		ch := make(chan error, 1)
+		c := &MaxMindClient{Logger: &logger}
+		c.Status(context.Background(), &wg, ch)
+		assert.ErrorIs(t, <-ch, ErrNotLoaded)
+	})
+
+	wg.Wait()
+}
@@ -0,0 +1,206 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/lescactus/geolocation-go/internal/api"
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics
+var (
+	rateLimitWaits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ratelimit_waits_total",
+		Help: "Total number of queries delayed by the rate limiter of each geolocation api provider",
+	}, []string{"provider"})
+	rateLimitRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ratelimit_rejected_total",
+		Help: "Total number of queries rejected by the rate limiter of each geolocation api provider",
+	}, []string{"provider"})
+)
+
+// Limiter is a token bucket rate limiter.
+//
+// The bucket holds up to Burst tokens and is refilled at the configured rate.
+// Each query takes a token. When the bucket is empty, the query waits for
+// a token for at most MaxWait, or until the deadline of its context, and is
+// rejected with an *api.QuotaError otherwise.
+//
+// The bucket can be adjusted from the quota reported by the remote API
+// with Update() and Exhaust().
+//
+// A nil *Limiter doesn't limit anything.
+type Limiter struct {
+	// Name of the provider, used as metrics label
+	Name    string
+	MaxWait time.Duration
+
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+	// The bucket stays empty until blockedUntil, then is full again
+	blockedUntil time.Time
+
+	// now is used to mock the time in the tests
+	now func() time.Time
+}
+
+// NewLimiter returns a full Limiter allowing requests queries per period.
+// It returns nil, hence no limit, if requests or period are not positive.
+func NewLimiter(name string, requests int, period, maxWait time.Duration) *Limiter {
+	if requests <= 0 || period <= 0 {
+		return nil
+	}
+
+	l := &Limiter{
+		Name:    name,
+		MaxWait: maxWait,
+		rate:    float64(requests) / period.Seconds(),
+		burst:   float64(requests),
+		tokens:  float64(requests),
+		now:     time.Now,
+	}
+	l.last = l.now()
+
+	return l
+}
+
+// Wait takes a token from the bucket, waiting for one if needed.
+// It returns an *api.QuotaError if no token will be available within
+// MaxWait or before the deadline of ctx, and ctx.Err() if ctx is done
+// while waiting.
+func (l *Limiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	start := l.now()
+	waited := false
+
+	for {
+		wait := l.take()
+		if wait == 0 {
+			return nil
+		}
+
+		// Don't wait if the token won't be available in time
+		now := l.now()
+		deadline, ok := ctx.Deadline()
+		if now.Add(wait).After(start.Add(l.MaxWait)) || (ok && now.Add(wait).After(deadline)) {
+			// Increment Prometheus counter
+			rateLimitRejected.WithLabelValues(l.Name).Inc()
+			return &api.QuotaError{RetryAfter: wait}
+		}
+
+		if !waited {
+			// Increment Prometheus counter
+			rateLimitWaits.WithLabelValues(l.Name).Inc()
+			waited = true
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// take takes a token from the bucket if available, and returns
+// the duration until a token is available otherwise.
+func (l *Limiter) take() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.refill(now)
+
+	if now.Before(l.blockedUntil) {
+		return l.blockedUntil.Sub(now)
+	}
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+
+	return time.Duration(math.Ceil((1 - l.tokens) / l.rate * float64(time.Second)))
+}
+
+// refill adds the tokens accumulated since the last refill.
+// l.mu must be held.
+func (l *Limiter) refill(now time.Time) {
+	if !l.blockedUntil.IsZero() && !now.Before(l.blockedUntil) {
+		// The quota has been reset
+		l.tokens = l.burst
+		l.blockedUntil = time.Time{}
+		l.last = now
+		return
+	}
+
+	if elapsed := now.Sub(l.last).Seconds(); elapsed > 0 {
+		l.tokens = math.Min(l.burst, l.tokens+elapsed*l.rate)
+		l.last = now
+	}
+}
+
+// Update adjusts the bucket from the quota reported by the remote API:
+// remaining queries are allowed until the quota is reset in reset.
+func (l *Limiter) Update(remaining int, reset time.Duration) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.refill(now)
+
+	if remaining <= 0 {
+		l.tokens = 0
+		l.blockedUntil = now.Add(reset)
+		return
+	}
+
+	l.tokens = math.Min(l.tokens, float64(remaining))
+}
+
+// Exhaust empties the bucket until the quota is reset in reset,
+// typically after a 429 Too Many Requests response.
+func (l *Limiter) Exhaust(reset time.Duration) {
+	l.Update(0, reset)
+}
+
+// GeoAPI is an api.GeoAPI whose queries are rate limited
+// by a Limiter.
+type GeoAPI struct {
+	API     api.GeoAPI
+	Limiter *Limiter
+}
+
+// NewGeoAPI returns the given api.GeoAPI rate limited by the given Limiter.
+func NewGeoAPI(a api.GeoAPI, l *Limiter) *GeoAPI {
+	return &GeoAPI{API: a, Limiter: l}
+}
+
+func (g *GeoAPI) Get(ctx context.Context, ip string) (*models.GeoIP, error) {
+	if err := g.Limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+
+	return g.API.Get(ctx, ip)
+}
+
+func (g *GeoAPI) Status(ctx context.Context, wg *sync.WaitGroup, ch chan error) {
+	g.API.Status(ctx, wg, ch)
+}
@@ -0,0 +1,239 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lescactus/geolocation-go/internal/api"
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// clock is a manually advanced time source
+type clock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *clock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func newTestLimiter(requests int, period, maxWait time.Duration) (*Limiter, *clock) {
+	c := &clock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l := NewLimiter("mock", requests, period, maxWait)
+	l.now = c.now
+	l.last = c.now()
+	return l, c
+}
+
+// GeoAPIMock counts the number of queries it received
+type GeoAPIMock struct {
+	queried int
+}
+
+func (m *GeoAPIMock) Get(ctx context.Context, ip string) (*models.GeoIP, error) {
+	m.queried++
+	return &models.GeoIP{IP: ip, CountryCode: "AU"}, nil
+}
+
+func (m *GeoAPIMock) Status(ctx context.Context, wg *sync.WaitGroup, ch chan error) {
+	defer wg.Done()
+	ch <- nil
+}
+
+func TestNewLimiter(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests int
+		period   time.Duration
+		wantNil  bool
+	}{
+		{name: "Valid limit", requests: 45, period: time.Minute},
+		{name: "No requests", requests: 0, period: time.Minute, wantNil: true},
+		{name: "Negative requests", requests: -1, period: time.Minute, wantNil: true},
+		{name: "No period", requests: 45, period: 0, wantNil: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLimiter("mock", tt.requests, tt.period, time.Second)
+			if tt.wantNil {
+				assert.Nil(t, l)
+				return
+			}
+			assert.NotNil(t, l)
+			assert.Equal(t, float64(tt.requests), l.tokens)
+		})
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+
+	assert.NoError(t, l.Wait(context.Background()))
+	l.Update(0, time.Minute)
+	l.Exhaust(time.Minute)
+	assert.NoError(t, l.Wait(context.Background()))
+}
+
+func TestLimiterTake(t *testing.T) {
+	l, c := newTestLimiter(2, time.Second, 0)
+
+	assert.Equal(t, time.Duration(0), l.take())
+	assert.Equal(t, time.Duration(0), l.take())
+	// Empty bucket: a token every 500ms
+	assert.Equal(t, 500*time.Millisecond, l.take())
+
+	c.advance(250 * time.Millisecond)
+	assert.Equal(t, 250*time.Millisecond, l.take())
+
+	c.advance(250 * time.Millisecond)
+	assert.Equal(t, time.Duration(0), l.take())
+
+	// The bucket doesn't hold more than the burst
+	c.advance(time.Hour)
+	assert.Equal(t, time.Duration(0), l.take())
+	assert.Equal(t, time.Duration(0), l.take())
+	assert.Equal(t, 500*time.Millisecond, l.take())
+}
+
+func TestLimiterWait(t *testing.T) {
+	t.Run("Token available", func(t *testing.T) {
+		l, _ := newTestLimiter(1, time.Minute, 0)
+		assert.NoError(t, l.Wait(context.Background()))
+	})
+
+	t.Run("Wait for a token", func(t *testing.T) {
+		l := NewLimiter("mock", 100, time.Second, time.Second)
+		for i := 0; i < 100; i++ {
+			assert.NoError(t, l.Wait(context.Background()))
+		}
+
+		// The next token is available in 10ms
+		start := time.Now()
+		assert.NoError(t, l.Wait(context.Background()))
+		assert.GreaterOrEqual(t, time.Since(start), 5*time.Millisecond)
+	})
+
+	t.Run("No token within max wait", func(t *testing.T) {
+		l, _ := newTestLimiter(1, time.Minute, time.Second)
+		assert.NoError(t, l.Wait(context.Background()))
+
+		err := l.Wait(context.Background())
+		assert.ErrorIs(t, err, api.ErrQuotaExhausted)
+
+		var qerr *api.QuotaError
+		assert.ErrorAs(t, err, &qerr)
+		assert.Equal(t, time.Minute, qerr.RetryAfter)
+	})
+
+	t.Run("No token before the context deadline", func(t *testing.T) {
+		l := NewLimiter("mock", 1, time.Minute, time.Hour)
+		assert.NoError(t, l.Wait(context.Background()))
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		assert.ErrorIs(t, l.Wait(ctx), api.ErrQuotaExhausted)
+	})
+
+	t.Run("Context cancelled while waiting", func(t *testing.T) {
+		l := NewLimiter("mock", 1, time.Minute, time.Hour)
+		assert.NoError(t, l.Wait(context.Background()))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(10*time.Millisecond, cancel)
+		assert.ErrorIs(t, l.Wait(ctx), context.Canceled)
+	})
+}
+
+func TestLimiterUpdate(t *testing.T) {
+	t.Run("Remaining quota lower than the bucket", func(t *testing.T) {
+		l, _ := newTestLimiter(45, time.Minute, 0)
+		l.Update(1, 30*time.Second)
+
+		assert.Equal(t, time.Duration(0), l.take())
+		assert.NotEqual(t, time.Duration(0), l.take())
+	})
+
+	t.Run("Remaining quota higher than the bucket", func(t *testing.T) {
+		l, _ := newTestLimiter(2, time.Minute, 0)
+		l.Update(40, 30*time.Second)
+
+		assert.Equal(t, time.Duration(0), l.take())
+		assert.Equal(t, time.Duration(0), l.take())
+		assert.NotEqual(t, time.Duration(0), l.take())
+	})
+
+	t.Run("Quota exhausted until reset", func(t *testing.T) {
+		l, c := newTestLimiter(45, time.Minute, 0)
+		l.Update(0, 30*time.Second)
+
+		assert.Equal(t, 30*time.Second, l.take())
+
+		c.advance(20 * time.Second)
+		assert.Equal(t, 10*time.Second, l.take())
+
+		// The bucket is full again once the quota is reset
+		c.advance(10 * time.Second)
+		for i := 0; i < 45; i++ {
+			assert.Equal(t, time.Duration(0), l.take())
+		}
+		assert.NotEqual(t, time.Duration(0), l.take())
+	})
+
+	t.Run("Exhaust", func(t *testing.T) {
+		l, c := newTestLimiter(45, time.Minute, 0)
+		l.Exhaust(time.Minute)
+
+		assert.Equal(t, time.Minute, l.take())
+		c.advance(time.Minute)
+		assert.Equal(t, time.Duration(0), l.take())
+	})
+}
+
+func TestGeoAPI(t *testing.T) {
+	t.Run("Rate limited", func(t *testing.T) {
+		m := &GeoAPIMock{}
+		l, _ := newTestLimiter(1, time.Minute, 0)
+		g := NewGeoAPI(m, l)
+
+		got, err := g.Get(context.Background(), "1.1.1.1")
+		assert.NoError(t, err)
+		assert.Equal(t, "AU", got.CountryCode)
+
+		_, err = g.Get(context.Background(), "1.1.1.1")
+		assert.True(t, errors.Is(err, api.ErrQuotaExhausted))
+		assert.Equal(t, 1, m.queried)
+	})
+
+	t.Run("No limit", func(t *testing.T) {
+		m := &GeoAPIMock{}
+		g := NewGeoAPI(m, nil)
+
+		for i := 0; i < 100; i++ {
+			_, err := g.Get(context.Background(), "1.1.1.1")
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, 100, m.queried)
+	})
+
+	t.Run("Status", func(t *testing.T) {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		ch := make(chan error, 1)
+		NewGeoAPI(&GeoAPIMock{}, nil).Status(context.Background(), &wg, ch)
+		wg.Wait()
+		assert.NoError(t, <-ch)
+	})
+}
@@ -3,18 +3,200 @@ package chain
 import (
 	"context"
 	"errors"
+	"fmt"
+	"strings"
 	"sync"
 
 	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/hlog"
 )
 
+const (
+	// DefaultMaxBackfills is the default maximum number
+	// of backfills in progress
+	DefaultMaxBackfills = 64
+
+	// DefaultWriteBehindQueueSize is the default number of writes
+	// queued for each write-behind cache
+	DefaultWriteBehindQueueSize = 1024
+)
+
+// ErrWriteBehindQueueFull is returned when a write can't be queued
+// because the queue of a write-behind cache is full
+var ErrWriteBehindQueueFull = errors.New("write-behind queue full")
+
+// Prometheus metrics
+var (
+	backfillsDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "chain_backfills_dropped_total",
+		Help: "The total number of backfills of the cache chain dropped because too many were in progress",
+	})
+	writeBehindQueued = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "chain_write_behind_queued_items",
+		Help: "Number of writes queued for a write-behind cache",
+	}, []string{"cache"})
+	writeBehindDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chain_write_behind_dropped_total",
+		Help: "The total number of backfills dropped because the queue of a write-behind cache was full",
+	}, []string{"cache"})
+)
+
+// WritePolicy defines how the chain writes to a cache
+type WritePolicy int
+
+const (
+	// WriteThrough caches are written by Save before it returns,
+	// and asynchronously when they are backfilled.
+	WriteThrough WritePolicy = iota
+
+	// WriteBehind caches are backfilled in the background, in order,
+	// from a bounded queue. The backfills are dropped when the queue is full,
+	// except the entries just fetched from the remote GeoIP API which are
+	// then saved directly. Save and Delete write them synchronously.
+	WriteBehind
+
+	// ReadOnly caches are only read: the chain never saves nor
+	// deletes their entries. Also known as write-around.
+	ReadOnly
+)
+
+// String returns the name of the WritePolicy, as parsed by ParseWritePolicy
+func (p WritePolicy) String() string {
+	switch p {
+	case WriteThrough:
+		return "write-through"
+	case WriteBehind:
+		return "write-behind"
+	case ReadOnly:
+		return "read-only"
+	default:
+		return fmt.Sprintf("WritePolicy(%d)", int(p))
+	}
+}
+
+// ParseWritePolicy returns the WritePolicy of the given name: "write-through",
+// "write-behind", "read-only" or its alias "write-around".
+func ParseWritePolicy(s string) (WritePolicy, error) {
+	switch strings.TrimSpace(s) {
+	case "write-through":
+		return WriteThrough, nil
+	case "write-behind":
+		return WriteBehind, nil
+	case "read-only", "write-around":
+		return ReadOnly, nil
+	default:
+		return 0, fmt.Errorf("error: unknown write policy %q", s)
+	}
+}
+
+// ParseWritePolicies returns the write policies of the given comma separated
+// list of "<cache>=<policy>", ex: "redis=write-behind,postgres=read-only".
+func ParseWritePolicies(s string) (map[string]WritePolicy, error) {
+	policies := make(map[string]WritePolicy)
+
+	for _, kv := range strings.Split(s, ",") {
+		if strings.TrimSpace(kv) == "" {
+			continue
+		}
+
+		name, policy, ok := strings.Cut(kv, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("error: invalid write policy %q, expected <cache>=<policy>", kv)
+		}
+		if _, ok := policies[name]; ok {
+			return nil, fmt.Errorf("error: write policy of %s set twice", name)
+		}
+
+		p, err := ParseWritePolicy(policy)
+		if err != nil {
+			return nil, err
+		}
+		policies[name] = p
+	}
+
+	return policies, nil
+}
+
 // Cache is a models.GeoIPRepository and is used within a
 // Chain.
 type Cache struct {
 	name       string
 	repository models.GeoIPRepository
+	policy     WritePolicy
+
+	// wb holds the pending writes of a WriteBehind cache
+	wb *writeBehind
+}
+
+// write is a pending write of a WriteBehind cache
+type write struct {
+	ctx   context.Context
+	geoip *models.GeoIP
+	seq   uint64
+}
+
+// writeBehind is the queue of pending writes of a WriteBehind cache
+type writeBehind struct {
+	queue chan write
+
+	// writing serializes the writes of the queue with the
+	// synchronous writes and deletes of the cache
+	writing sync.Mutex
+
+	mu  sync.Mutex
+	seq uint64
+	// Number of queued writes of each ip address
+	pending map[string]int
+	// Sequence up to which the queued writes of an ip address are skipped
+	cancelled map[string]uint64
+}
+
+// push queues w without blocking and returns false if the queue is full.
+func (wb *writeBehind) push(w write) bool {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	w.seq = wb.seq + 1
+	select {
+	case wb.queue <- w:
+		wb.seq = w.seq
+		wb.pending[w.geoip.IP]++
+		return true
+	default:
+		return false
+	}
+}
+
+// cancel skips the writes of ip queued so far. wb.writing must be held.
+func (wb *writeBehind) cancel(ip string) {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	if wb.pending[ip] > 0 {
+		wb.cancelled[ip] = wb.seq
+	}
+}
+
+// pop records that w has been dequeued and returns whether
+// it has been cancelled. wb.writing must be held.
+func (wb *writeBehind) pop(w write) bool {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	ip := w.geoip.IP
+	cancelled := w.seq <= wb.cancelled[ip]
+
+	wb.pending[ip]--
+	if wb.pending[ip] <= 0 {
+		delete(wb.pending, ip)
+		delete(wb.cancelled, ip)
+	}
+
+	return cancelled
 }
 
 // Chain acts as a list of GeoIPRepository.
@@ -22,7 +204,8 @@ type Cache struct {
 // in a chained way: when requesting a read, the first GeoIPRepository
 // will be queried and in case of cache miss, the second GeoIPRepository will be queried,
 // then in case of cache miss, the third GeoIPRepository will be queried and so on...
-// When one of the cache is a hit, all the other caches will be updated if necessary.
+// When one of the cache is a hit, the caches queried before will be updated according
+// to their WritePolicy.
 //
 //
 // Typically, the chain would be composed of several caches stores, starting from the fastest to
@@ -41,6 +224,22 @@ type Cache struct {
 type Chain struct {
 	caches []Cache
 	l      *zerolog.Logger
+
+	// MaxBackfills is the maximum number of backfills of the caches which
+	// missed in progress. The next ones are dropped.
+	// DefaultMaxBackfills if not positive.
+	MaxBackfills int
+
+	// WriteBehindQueueSize is the number of writes queued for each
+	// WriteBehind cache added to the chain.
+	// DefaultWriteBehindQueueSize if not positive.
+	WriteBehindQueueSize int
+
+	mu        sync.Mutex
+	closed    bool
+	backfills int
+	inflight  sync.WaitGroup
+	workers   sync.WaitGroup
 }
 
 // New will return a new empty chain.
@@ -48,33 +247,55 @@ type Chain struct {
 // method to add GeoIPRepository to the chain.
 func New(l *zerolog.Logger) *Chain {
 	return &Chain{
-		l:      l,
-		caches: make([]Cache, 0),
+		l:                    l,
+		caches:               make([]Cache, 0),
+		MaxBackfills:         DefaultMaxBackfills,
+		WriteBehindQueueSize: DefaultWriteBehindQueueSize,
 	}
 }
 
-// Add will add a models.GeoIPRepository to the chain.
+// Add will add a models.GeoIPRepository to the chain, written through.
 // Return an error if the GeoIPRepository is already present.
 func (c *Chain) Add(name string, g models.GeoIPRepository) error {
+	return c.AddWithPolicy(name, g, WriteThrough)
+}
+
+// AddWithPolicy will add a models.GeoIPRepository to the chain,
+// written according to the given WritePolicy.
+// Return an error if the GeoIPRepository is already present.
+// The caches must be added before the chain is used.
+func (c *Chain) AddWithPolicy(name string, g models.GeoIPRepository, policy WritePolicy) error {
 	if g == nil {
 		return errors.New("error: GeoIPRepository cannot be nil")
 	}
 
-	if len(c.caches) == 0 {
-		c.caches = append(c.caches, Cache{
-			name:       name,
-			repository: g,
-		})
-		return nil
-	}
-
 	for _, cache := range c.caches {
 		if cache.name == name {
 			return errors.New("error: GeoIPRepository already present in chain")
 		}
 	}
 
-	c.caches = append(c.caches, Cache{name: name, repository: g})
+	cache := Cache{name: name, repository: g, policy: policy}
+	switch policy {
+	case WriteThrough, ReadOnly:
+	case WriteBehind:
+		size := c.WriteBehindQueueSize
+		if size <= 0 {
+			size = DefaultWriteBehindQueueSize
+		}
+		cache.wb = &writeBehind{
+			queue:     make(chan write, size),
+			pending:   make(map[string]int),
+			cancelled: make(map[string]uint64),
+		}
+
+		c.workers.Add(1)
+		go c.writeBehind(cache)
+	default:
+		return fmt.Errorf("error: unknown write policy %s", policy)
+	}
+
+	c.caches = append(c.caches, cache)
 
 	return nil
 }
@@ -83,29 +304,28 @@ func (c *Chain) Add(name string, g models.GeoIPRepository) error {
 //
 // It will lookup each GeoIPRepository in the chain and return the first *models.GeoIP
 // found.
-// Each GeoIPRepository which doesn't have the *models.GeoIP will be updated accordingly.
+// Each GeoIPRepository looked up before, which doesn't have the *models.GeoIP,
+// will be backfilled asynchronously according to its WritePolicy.
 //
 // If no *models.GeoIP is found, an error will be returned.
 func (c *Chain) Get(ctx context.Context, ip string) (*models.GeoIP, error) {
 	var g *models.GeoIP
 	var err error
-	var cacheMiss []string
 
 	req_id := reqIDFromContext(ctx)
 
-	for _, cache := range c.caches {
+	for i, cache := range c.caches {
 		c.l.Trace().Str("req_id", req_id).Msgf("looking for %s in %s database from cache chain", ip, cache.name)
 
 		g, err = cache.repository.Get(ctx, ip)
 		if err != nil {
 			c.l.Debug().Str("req_id", req_id).Err(err).Msgf("cache miss from %s database", cache.name)
-			cacheMiss = append(cacheMiss, cache.name)
 		} else {
 			c.l.Debug().Str("req_id", req_id).Msgf("cache hit from %s database", cache.name)
 
-			// Update all caches with g if needed
-			if len(cacheMiss) > 0 {
-				go c.SaveInAllCaches(ctx, g)
+			// Update the caches which missed
+			if i > 0 {
+				c.backfill(ctx, c.caches[:i], g)
 			}
 			return g, nil
 		}
@@ -133,27 +353,264 @@ func (c *Chain) Statuses(ctx context.Context) map[string]error {
 	return errors
 }
 
-// SaveInAllCaches will save geoip asynchronousely in all the caches from the chain.
+// SaveInAllCaches will save geoip asynchronousely in all the caches from the chain,
+// according to their WritePolicy. It isn't bound to the cancellation of ctx.
+// Unlike the backfills, the write isn't dropped when too many writes are in progress,
+// since geoip has just been fetched from the remote GeoIP API: a WriteBehind cache
+// whose queue is full is saved directly.
 func (c *Chain) SaveInAllCaches(ctx context.Context, geoip *models.GeoIP) {
-	req_id := reqIDFromContext(ctx)
+	ctx = context.WithoutCancel(ctx)
 
-	var wg sync.WaitGroup
-	wg.Add(len(c.caches))
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		c.fill(ctx, geoip)
+		return
+	}
+	c.inflight.Add(1)
+	c.mu.Unlock()
 
+	go func() {
+		defer c.inflight.Done()
+		c.fill(ctx, geoip)
+	}()
+}
+
+// fill will save geoip in all the caches from the chain according to their WritePolicy,
+// directly in the WriteBehind caches whose queue is full.
+func (c *Chain) fill(ctx context.Context, geoip *models.GeoIP) {
+	var caches []Cache
 	for _, cache := range c.caches {
-		go func(cache Cache) {
+		switch cache.policy {
+		case WriteThrough:
+			caches = append(caches, cache)
+		case WriteBehind:
+			if err := c.enqueue(ctx, cache, geoip); err != nil {
+				c.l.Debug().Str("req_id", reqIDFromContext(ctx)).Msgf("write-behind queue of %s full, saving entry %s directly", cache.name, geoip.IP)
+				caches = append(caches, cache)
+			}
+		}
+	}
+
+	_ = c.save(ctx, caches, geoip)
+}
+
+// Save will save geoip synchronously and concurrently in all the caches
+// from the chain but the ReadOnly ones, and return the errors of the caches
+// which failed, if any. The writes of geoip still queued for the WriteBehind
+// caches are skipped, so they can't replace it afterwards.
+func (c *Chain) Save(ctx context.Context, geoip *models.GeoIP) error {
+	var caches []Cache
+	for _, cache := range c.caches {
+		if cache.policy != ReadOnly {
+			caches = append(caches, cache)
+		}
+	}
+
+	return c.save(ctx, caches, geoip)
+}
+
+// save will save geoip concurrently in the given caches, superseding the
+// writes of geoip queued for the WriteBehind caches, and return the errors
+// of the caches which failed, if any.
+func (c *Chain) save(ctx context.Context, caches []Cache, geoip *models.GeoIP) error {
+	var wg sync.WaitGroup
+	wg.Add(len(caches))
+
+	errs := make([]error, len(caches))
+	for i, cache := range caches {
+		go func(i int, cache Cache) {
 			defer wg.Done()
 
-			c.l.Debug().Str("req_id", req_id).Msgf("updating cache %s with entry %s", cache.name, geoip.IP)
-			if err := cache.repository.Save(ctx, geoip); err != nil {
-				c.l.Error().Str("req_id", req_id).Msgf("fail to cache in %s database: %s", cache.name, err.Error())
-			} else {
-				c.l.Trace().Str("req_id", req_id).Msgf("cache %s updated with entry %s", cache.name, geoip.IP)
+			if cache.wb != nil {
+				cache.wb.writing.Lock()
+				defer cache.wb.writing.Unlock()
+				cache.wb.cancel(geoip.IP)
 			}
-		}(cache)
+
+			errs[i] = c.saveIn(ctx, cache, geoip)
+		}(i, cache)
 	}
 
 	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// saveIn will save geoip in the given cache.
+func (c *Chain) saveIn(ctx context.Context, cache Cache, geoip *models.GeoIP) error {
+	req_id := reqIDFromContext(ctx)
+
+	c.l.Debug().Str("req_id", req_id).Msgf("updating cache %s with entry %s", cache.name, geoip.IP)
+	if err := cache.repository.Save(ctx, geoip); err != nil {
+		c.l.Error().Str("req_id", req_id).Msgf("fail to cache in %s database: %s", cache.name, err.Error())
+		return fmt.Errorf("%s: %w", cache.name, err)
+	}
+	c.l.Trace().Str("req_id", req_id).Msgf("cache %s updated with entry %s", cache.name, geoip.IP)
+
+	return nil
+}
+
+// Delete will delete the entry of the given ip from all the caches
+// of the chain able to delete entries, and return the errors of the
+// caches which failed, if any. The writes of ip still queued for the
+// WriteBehind caches are skipped, so they can't restore the entry.
+func (c *Chain) Delete(ctx context.Context, ip string) error {
+	req_id := reqIDFromContext(ctx)
+
+	var errs []error
+	for _, cache := range c.caches {
+		if cache.policy == ReadOnly {
+			continue
+		}
+
+		d, ok := cache.repository.(models.GeoIPDeleter)
+		if !ok {
+			c.l.Debug().Str("req_id", req_id).Msgf("cache %s can't delete entries, skipping", cache.name)
+			continue
+		}
+
+		if err := c.deleteIn(ctx, cache, d, ip); err != nil {
+			c.l.Error().Str("req_id", req_id).Msgf("fail to delete %s from %s database: %s", ip, cache.name, err.Error())
+			errs = append(errs, fmt.Errorf("%s: %w", cache.name, err))
+			continue
+		}
+		c.l.Debug().Str("req_id", req_id).Msgf("entry %s deleted from cache %s", ip, cache.name)
+	}
+
+	return errors.Join(errs...)
+}
+
+// deleteIn will delete the entry of ip from the given cache.
+func (c *Chain) deleteIn(ctx context.Context, cache Cache, d models.GeoIPDeleter, ip string) error {
+	if cache.wb != nil {
+		cache.wb.writing.Lock()
+		defer cache.wb.writing.Unlock()
+		cache.wb.cancel(ip)
+	}
+
+	return d.Delete(ctx, ip)
+}
+
+// backfill will save geoip asynchronously in the given caches according
+// to their WritePolicy. The writes are dropped when MaxBackfills backfills
+// are already in progress, when the queue of a WriteBehind cache is full
+// or when the chain is closed.
+func (c *Chain) backfill(ctx context.Context, caches []Cache, geoip *models.GeoIP) {
+	req_id := reqIDFromContext(ctx)
+
+	// The backfill outlives the request
+	ctx = context.WithoutCancel(ctx)
+
+	var through []Cache
+	for _, cache := range caches {
+		switch cache.policy {
+		case WriteThrough:
+			through = append(through, cache)
+		case WriteBehind:
+			if err := c.enqueue(ctx, cache, geoip); err != nil {
+				// Increment Prometheus counter
+				writeBehindDropped.WithLabelValues(cache.name).Inc()
+
+				c.l.Warn().Str("req_id", req_id).Msgf("write-behind queue of %s full, entry %s not backfilled", cache.name, geoip.IP)
+			}
+		}
+	}
+	if len(through) == 0 {
+		return
+	}
+
+	max := c.MaxBackfills
+	if max <= 0 {
+		max = DefaultMaxBackfills
+	}
+
+	c.mu.Lock()
+	if c.closed || c.backfills >= max {
+		c.mu.Unlock()
+
+		// Increment Prometheus counter
+		backfillsDropped.Inc()
+
+		c.l.Warn().Str("req_id", req_id).Msgf("too many backfills in progress, entry %s not backfilled", geoip.IP)
+		return
+	}
+	c.backfills++
+	c.inflight.Add(1)
+	c.mu.Unlock()
+
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			c.backfills--
+			c.mu.Unlock()
+			c.inflight.Done()
+		}()
+
+		_ = c.save(ctx, through, geoip)
+	}()
+}
+
+// enqueue will queue the write of geoip in the given WriteBehind cache.
+// It returns ErrWriteBehindQueueFull if the queue is full or the chain is closed.
+func (c *Chain) enqueue(ctx context.Context, cache Cache, geoip *models.GeoIP) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed || !cache.wb.push(write{ctx: context.WithoutCancel(ctx), geoip: geoip}) {
+		return ErrWriteBehindQueueFull
+	}
+	writeBehindQueued.WithLabelValues(cache.name).Inc()
+
+	return nil
+}
+
+// writeBehind saves the queued writes of the given
+// WriteBehind cache, until its queue is closed.
+func (c *Chain) writeBehind(cache Cache) {
+	defer c.workers.Done()
+
+	for w := range cache.wb.queue {
+		writeBehindQueued.WithLabelValues(cache.name).Dec()
+
+		cache.wb.writing.Lock()
+		if cache.wb.pop(w) {
+			c.l.Trace().Str("req_id", reqIDFromContext(w.ctx)).Msgf("queued write of entry %s in cache %s superseded, skipping", w.geoip.IP, cache.name)
+		} else {
+			_ = c.saveIn(w.ctx, cache, w.geoip)
+		}
+		cache.wb.writing.Unlock()
+	}
+}
+
+// Close stops accepting asynchronous writes, then waits until the ones
+// in progress and the queued ones are saved, or ctx is done.
+// The chain mustn't be used after Close.
+func (c *Chain) Close(ctx context.Context) error {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		for _, cache := range c.caches {
+			if cache.wb != nil {
+				close(cache.wb.queue)
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		c.inflight.Wait()
+		c.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("error: failed to drain the writes of the cache chain: %w", ctx.Err())
+	}
 }
 
 // reqIDFromContext extracts and returns the request id from
@@ -2,15 +2,19 @@ package chain
 
 import (
 	"context"
+	"errors"
 	"os"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/lescactus/geolocation-go/internal/models"
 	"github.com/lescactus/geolocation-go/internal/repositories"
 	"github.com/rs/xid"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/hlog"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestNew(t *testing.T) {
@@ -26,12 +30,12 @@ func TestNew(t *testing.T) {
 		{
 			name: "With logger",
 			args: args{&logger},
-			want: &Chain{caches: make([]Cache, 0), l: &logger},
+			want: &Chain{caches: make([]Cache, 0), l: &logger, MaxBackfills: DefaultMaxBackfills, WriteBehindQueueSize: DefaultWriteBehindQueueSize},
 		},
 		{
 			name: "Without logger",
 			args: args{nil},
-			want: &Chain{caches: make([]Cache, 0), l: nil},
+			want: &Chain{caches: make([]Cache, 0), l: nil, MaxBackfills: DefaultMaxBackfills, WriteBehindQueueSize: DefaultWriteBehindQueueSize},
 		},
 	}
 	for _, tt := range tests {
@@ -74,13 +78,13 @@ func TestChainAdd(t *testing.T) {
 		},
 		{
 			name:    "Add non-nil to non-empty chain",
-			fields:  fields{append(([]Cache)(nil), Cache{"cache1", repositories.NewInMemoryDB()}), &logger},
+			fields:  fields{append(([]Cache)(nil), Cache{name: "cache1", repository: repositories.NewInMemoryDB()}), &logger},
 			args:    args{"cache2", repositories.NewInMemoryDB()},
 			wantErr: false,
 		},
 		{
 			name:    "Add existing cache to chain",
-			fields:  fields{append(([]Cache)(nil), Cache{"cache1", repositories.NewInMemoryDB()}), &logger},
+			fields:  fields{append(([]Cache)(nil), Cache{name: "cache1", repository: repositories.NewInMemoryDB()}), &logger},
 			args:    args{"cache1", repositories.NewInMemoryDB()},
 			wantErr: true,
 		},
@@ -133,3 +137,477 @@ func TestReqIDFromContext(t *testing.T) {
 		})
 	}
 }
+
+// FailingRepositoryMock fails to save and to delete any entry
+type FailingRepositoryMock struct{}
+
+func (m *FailingRepositoryMock) Get(ctx context.Context, ip string) (*models.GeoIP, error) {
+	return nil, errors.New("error: no value found")
+}
+
+func (m *FailingRepositoryMock) Save(ctx context.Context, geoip *models.GeoIP) error {
+	return errors.New("error: cannot save")
+}
+
+func (m *FailingRepositoryMock) Delete(ctx context.Context, ip string) error {
+	return errors.New("error: cannot delete")
+}
+
+func (m *FailingRepositoryMock) Status(ctx context.Context, wg *sync.WaitGroup, ch chan error) {}
+
+// ReadOnlyRepositoryMock can't delete entries
+type ReadOnlyRepositoryMock struct{}
+
+func (m *ReadOnlyRepositoryMock) Get(ctx context.Context, ip string) (*models.GeoIP, error) {
+	return &models.GeoIP{IP: ip}, nil
+}
+
+func (m *ReadOnlyRepositoryMock) Save(ctx context.Context, geoip *models.GeoIP) error { return nil }
+
+func (m *ReadOnlyRepositoryMock) Status(ctx context.Context, wg *sync.WaitGroup, ch chan error) {}
+
+func TestChainSave(t *testing.T) {
+	logger := zerolog.New(os.Stdout).Level(zerolog.NoLevel)
+	ctx := context.Background()
+
+	mdb := repositories.NewInMemoryDB()
+	c := New(&logger)
+	c.Add("in-memory", mdb)
+	assert.NoError(t, c.Save(ctx, &models.GeoIP{IP: "1.1.1.1"}))
+
+	_, err := mdb.Get(ctx, "1.1.1.1")
+	assert.NoError(t, err)
+
+	// The other caches are saved despite the failure
+	c.Add("failing", &FailingRepositoryMock{})
+	err = c.Save(ctx, &models.GeoIP{IP: "2.2.2.2"})
+	assert.ErrorContains(t, err, "failing: error: cannot save")
+
+	_, err = mdb.Get(ctx, "2.2.2.2")
+	assert.NoError(t, err)
+}
+
+func TestChainDelete(t *testing.T) {
+	logger := zerolog.New(os.Stdout).Level(zerolog.NoLevel)
+	ctx := context.Background()
+
+	mdb1, mdb2 := repositories.NewInMemoryDB(), repositories.NewInMemoryDB()
+	c := New(&logger)
+	c.Add("cache1", mdb1)
+	c.Add("read-only", &ReadOnlyRepositoryMock{})
+	c.Add("cache2", mdb2)
+	c.Save(ctx, &models.GeoIP{IP: "1.1.1.1"})
+
+	assert.NoError(t, c.Delete(ctx, "1.1.1.1"))
+	_, err := mdb1.Get(ctx, "1.1.1.1")
+	assert.Error(t, err)
+	_, err = mdb2.Get(ctx, "1.1.1.1")
+	assert.Error(t, err)
+
+	// Deleting a missing entry isn't an error
+	assert.NoError(t, c.Delete(ctx, "1.1.1.1"))
+
+	// The other caches are deleted despite the failure
+	c.Save(ctx, &models.GeoIP{IP: "2.2.2.2"})
+	c.Add("failing", &FailingRepositoryMock{})
+	err = c.Delete(ctx, "2.2.2.2")
+	assert.ErrorContains(t, err, "failing: error: cannot delete")
+	_, err = mdb2.Get(ctx, "2.2.2.2")
+	assert.Error(t, err)
+}
+
+func TestChainEmpty(t *testing.T) {
+	logger := zerolog.New(os.Stdout).Level(zerolog.NoLevel)
+	ctx := context.Background()
+
+	// A chain without cache always misses
+	c := New(&logger)
+	_, err := c.Get(ctx, "1.1.1.1")
+	assert.Error(t, err)
+
+	assert.NoError(t, c.Save(ctx, &models.GeoIP{IP: "1.1.1.1"}))
+	assert.NoError(t, c.Delete(ctx, "1.1.1.1"))
+	assert.Empty(t, c.Statuses(ctx))
+}
+
+// RecordingRepositoryMock records the saved entries. Once blocked,
+// its saves wait until it is released.
+type RecordingRepositoryMock struct {
+	models.GeoIPRepository
+
+	mu      sync.Mutex
+	saved   []string
+	release chan struct{}
+}
+
+func NewRecordingRepositoryMock(blocked bool) *RecordingRepositoryMock {
+	r := &RecordingRepositoryMock{GeoIPRepository: repositories.NewInMemoryDB()}
+	if blocked {
+		r.release = make(chan struct{})
+	}
+	return r
+}
+
+func (m *RecordingRepositoryMock) Save(ctx context.Context, geoip *models.GeoIP) error {
+	if m.release != nil {
+		<-m.release
+	}
+
+	m.mu.Lock()
+	m.saved = append(m.saved, geoip.IP)
+	m.mu.Unlock()
+
+	return m.GeoIPRepository.Save(ctx, geoip)
+}
+
+func (m *RecordingRepositoryMock) Delete(ctx context.Context, ip string) error {
+	return m.GeoIPRepository.(models.GeoIPDeleter).Delete(ctx, ip)
+}
+
+func (m *RecordingRepositoryMock) Saved() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.saved...)
+}
+
+func TestParseWritePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    WritePolicy
+		wantErr bool
+	}{
+		{name: "Write-through", s: "write-through", want: WriteThrough},
+		{name: "Write-behind", s: "write-behind", want: WriteBehind},
+		{name: "Read-only", s: "read-only", want: ReadOnly},
+		{name: "Write-around", s: "write-around", want: ReadOnly},
+		{name: "With spaces", s: " write-behind ", want: WriteBehind},
+		{name: "Empty", s: "", wantErr: true},
+		{name: "Unknown", s: "write-back", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseWritePolicy(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseWritePolicy() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestWritePolicyString(t *testing.T) {
+	for _, p := range []WritePolicy{WriteThrough, WriteBehind, ReadOnly} {
+		got, err := ParseWritePolicy(p.String())
+		assert.NoError(t, err)
+		assert.Equal(t, p, got)
+	}
+	assert.Equal(t, "WritePolicy(42)", WritePolicy(42).String())
+}
+
+func TestParseWritePolicies(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    map[string]WritePolicy
+		wantErr bool
+	}{
+		{name: "Empty", s: "", want: map[string]WritePolicy{}},
+		{name: "One policy", s: "redis=write-behind", want: map[string]WritePolicy{"redis": WriteBehind}},
+		{
+			name: "Several policies - with spaces",
+			s:    " redis = write-behind, postgres=read-only,memory=write-through, ",
+			want: map[string]WritePolicy{"redis": WriteBehind, "postgres": ReadOnly, "memory": WriteThrough},
+		},
+		{name: "Missing policy", s: "redis", wantErr: true},
+		{name: "Missing cache", s: "=read-only", wantErr: true},
+		{name: "Unknown policy", s: "redis=write-back", wantErr: true},
+		{name: "Set twice", s: "redis=read-only,redis=write-behind", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseWritePolicies(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseWritePolicies() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestChainAddWithPolicy(t *testing.T) {
+	logger := zerolog.New(os.Stdout).Level(zerolog.NoLevel)
+
+	c := New(&logger)
+	assert.NoError(t, c.AddWithPolicy("cache1", repositories.NewInMemoryDB(), WriteBehind))
+	assert.Error(t, c.AddWithPolicy("cache1", repositories.NewInMemoryDB(), ReadOnly))
+	assert.Error(t, c.AddWithPolicy("cache2", repositories.NewInMemoryDB(), WritePolicy(42)))
+	assert.NoError(t, c.Close(context.Background()))
+}
+
+func TestChainGetBackfillsMissedCaches(t *testing.T) {
+	logger := zerolog.New(os.Stdout).Level(zerolog.NoLevel)
+	ctx := context.Background()
+	g := &models.GeoIP{IP: "1.1.1.1"}
+
+	first, second, third := NewRecordingRepositoryMock(false), NewRecordingRepositoryMock(false), NewRecordingRepositoryMock(false)
+	readOnly := &FailingRepositoryMock{}
+
+	c := New(&logger)
+	c.Add("first", first)
+	c.AddWithPolicy("read-only", readOnly, ReadOnly)
+	c.AddWithPolicy("second", second, WriteBehind)
+	c.Add("third", third)
+	assert.NoError(t, third.GeoIPRepository.Save(ctx, g))
+
+	got, err := c.Get(ctx, g.IP)
+	assert.NoError(t, err)
+	assert.Equal(t, g, got)
+	assert.NoError(t, c.Close(ctx))
+
+	// Only the caches which missed are backfilled
+	assert.Equal(t, []string{g.IP}, first.Saved())
+	assert.Equal(t, []string{g.IP}, second.Saved())
+	assert.Empty(t, third.Saved())
+}
+
+func TestChainGetHitFromFirstCache(t *testing.T) {
+	logger := zerolog.New(os.Stdout).Level(zerolog.NoLevel)
+	ctx := context.Background()
+	g := &models.GeoIP{IP: "1.1.1.1"}
+
+	first, second := NewRecordingRepositoryMock(false), NewRecordingRepositoryMock(false)
+	c := New(&logger)
+	c.Add("first", first)
+	c.Add("second", second)
+	assert.NoError(t, first.GeoIPRepository.Save(ctx, g))
+
+	_, err := c.Get(ctx, g.IP)
+	assert.NoError(t, err)
+	assert.NoError(t, c.Close(ctx))
+
+	assert.Empty(t, first.Saved())
+	assert.Empty(t, second.Saved())
+}
+
+func TestChainSaveWithPolicies(t *testing.T) {
+	logger := zerolog.New(os.Stdout).Level(zerolog.NoLevel)
+	ctx := context.Background()
+
+	through, behind := NewRecordingRepositoryMock(false), NewRecordingRepositoryMock(false)
+	c := New(&logger)
+	c.Add("through", through)
+	c.AddWithPolicy("behind", behind, WriteBehind)
+	c.AddWithPolicy("read-only", &FailingRepositoryMock{}, ReadOnly)
+
+	// The write-behind cache is saved before Save returns too
+	assert.NoError(t, c.Save(ctx, &models.GeoIP{IP: "1.1.1.1"}))
+	assert.Equal(t, []string{"1.1.1.1"}, through.Saved())
+	assert.Equal(t, []string{"1.1.1.1"}, behind.Saved())
+
+	// The read-only cache isn't deleted either
+	assert.NoError(t, c.Delete(ctx, "1.1.1.1"))
+	_, err := behind.Get(ctx, "1.1.1.1")
+	assert.Error(t, err)
+
+	assert.NoError(t, c.Close(ctx))
+}
+
+func TestChainSaveSupersedesQueuedWrites(t *testing.T) {
+	logger := zerolog.New(os.Stdout).Level(zerolog.NoLevel)
+	ctx := context.Background()
+
+	behind := NewRecordingRepositoryMock(true)
+	c := New(&logger)
+	c.AddWithPolicy("behind", behind, WriteBehind)
+
+	// The worker holds a write, the queue holds the others
+	c.backfill(ctx, c.caches, &models.GeoIP{IP: "1.1.1.1", CountryCode: "AU"})
+	assert.Eventually(t, func() bool { return len(c.caches[0].wb.queue) == 0 }, time.Second, time.Millisecond)
+	c.backfill(ctx, c.caches, &models.GeoIP{IP: "1.1.1.1", CountryCode: "AU"})
+	c.backfill(ctx, c.caches, &models.GeoIP{IP: "2.2.2.2", CountryCode: "FR"})
+
+	saved := make(chan error)
+	go func() { saved <- c.Save(ctx, &models.GeoIP{IP: "1.1.1.1", CountryCode: "NZ"}) }()
+
+	// Save waits for the write in progress
+	select {
+	case <-saved:
+		t.Fatal("Save returned before the write in progress")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(behind.release)
+	assert.NoError(t, <-saved)
+	assert.NoError(t, c.Close(ctx))
+
+	// The queued write of 1.1.1.1 didn't replace the saved one
+	g, err := behind.Get(ctx, "1.1.1.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "NZ", g.CountryCode)
+	_, err = behind.Get(ctx, "2.2.2.2")
+	assert.NoError(t, err)
+}
+
+func TestChainDeleteSkipsQueuedWrites(t *testing.T) {
+	logger := zerolog.New(os.Stdout).Level(zerolog.NoLevel)
+	ctx := context.Background()
+
+	behind := NewRecordingRepositoryMock(true)
+	c := New(&logger)
+	c.AddWithPolicy("behind", behind, WriteBehind)
+
+	c.backfill(ctx, c.caches, &models.GeoIP{IP: "2.2.2.2"})
+	assert.Eventually(t, func() bool { return len(c.caches[0].wb.queue) == 0 }, time.Second, time.Millisecond)
+	c.backfill(ctx, c.caches, &models.GeoIP{IP: "1.1.1.1"})
+
+	deleted := make(chan error)
+	go func() { deleted <- c.Delete(ctx, "1.1.1.1") }()
+
+	close(behind.release)
+	assert.NoError(t, <-deleted)
+	assert.NoError(t, c.Close(ctx))
+
+	// The queued write didn't restore the deleted entry
+	_, err := behind.Get(ctx, "1.1.1.1")
+	assert.Error(t, err)
+	_, err = behind.Get(ctx, "2.2.2.2")
+	assert.NoError(t, err)
+}
+
+func TestWriteBehindCancel(t *testing.T) {
+	wb := &writeBehind{queue: make(chan write, 3), pending: make(map[string]int), cancelled: make(map[string]uint64)}
+
+	assert.True(t, wb.push(write{geoip: &models.GeoIP{IP: "1.1.1.1"}}))
+	assert.True(t, wb.push(write{geoip: &models.GeoIP{IP: "2.2.2.2"}}))
+	wb.cancel("1.1.1.1")
+	wb.cancel("3.3.3.3")
+	assert.True(t, wb.push(write{geoip: &models.GeoIP{IP: "1.1.1.1"}}))
+	assert.False(t, wb.push(write{geoip: &models.GeoIP{IP: "4.4.4.4"}}))
+
+	// Only the writes queued before the cancellation are skipped
+	var skipped []bool
+	for i := 0; i < 3; i++ {
+		skipped = append(skipped, wb.pop(<-wb.queue))
+	}
+	assert.Equal(t, []bool{true, false, false}, skipped)
+	assert.Empty(t, wb.pending)
+	assert.Empty(t, wb.cancelled)
+}
+
+func TestChainWriteBehindQueueFull(t *testing.T) {
+	logger := zerolog.New(os.Stdout).Level(zerolog.NoLevel)
+	ctx := context.Background()
+
+	behind := NewRecordingRepositoryMock(true)
+	c := New(&logger)
+	c.WriteBehindQueueSize = 1
+	c.AddWithPolicy("behind", behind, WriteBehind)
+
+	// The worker holds one write, the queue another one
+	assert.NoError(t, c.enqueue(ctx, c.caches[0], &models.GeoIP{IP: "1.1.1.1"}))
+	assert.Eventually(t, func() bool { return len(c.caches[0].wb.queue) == 0 }, time.Second, time.Millisecond)
+	assert.NoError(t, c.enqueue(ctx, c.caches[0], &models.GeoIP{IP: "2.2.2.2"}))
+
+	// The backfill is dropped
+	c.backfill(ctx, c.caches, &models.GeoIP{IP: "3.3.3.3"})
+
+	close(behind.release)
+	assert.NoError(t, c.Close(ctx))
+	assert.Equal(t, []string{"1.1.1.1", "2.2.2.2"}, behind.Saved())
+
+	// The writes can't be queued once the chain is closed
+	assert.ErrorIs(t, c.enqueue(ctx, c.caches[0], &models.GeoIP{IP: "4.4.4.4"}), ErrWriteBehindQueueFull)
+}
+
+func TestChainMaxBackfills(t *testing.T) {
+	logger := zerolog.New(os.Stdout).Level(zerolog.NoLevel)
+	ctx := context.Background()
+
+	tests := []struct {
+		name         string
+		maxBackfills int
+		want         int
+	}{
+		{name: "Backfills beyond MaxBackfills are dropped", maxBackfills: 2, want: 2},
+		{name: "Default MaxBackfills", maxBackfills: 0, want: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blocked, mdb := NewRecordingRepositoryMock(true), repositories.NewInMemoryDB()
+			c := New(&logger)
+			c.MaxBackfills = tt.maxBackfills
+			c.Add("blocked", blocked)
+			c.Add("in-memory", mdb)
+
+			for _, ip := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"} {
+				mdb.Save(ctx, &models.GeoIP{IP: ip})
+				_, err := c.Get(ctx, ip)
+				assert.NoError(t, err)
+			}
+
+			close(blocked.release)
+			assert.NoError(t, c.Close(ctx))
+			assert.Len(t, blocked.Saved(), tt.want)
+
+			// So are the ones once the chain is closed
+			c.Get(ctx, "1.1.1.1")
+			assert.Len(t, blocked.Saved(), tt.want)
+		})
+	}
+}
+
+func TestChainSaveInAllCachesIsNotDropped(t *testing.T) {
+	logger := zerolog.New(os.Stdout).Level(zerolog.NoLevel)
+	ctx := context.Background()
+
+	through, behind := NewRecordingRepositoryMock(true), NewRecordingRepositoryMock(true)
+	c := New(&logger)
+	c.MaxBackfills = 1
+	c.WriteBehindQueueSize = 1
+	c.Add("through", through)
+	c.AddWithPolicy("behind", behind, WriteBehind)
+
+	ips := []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"}
+	for _, ip := range ips {
+		c.SaveInAllCaches(ctx, &models.GeoIP{IP: ip})
+	}
+
+	// Neither MaxBackfills nor the full write-behind queue drop the writes
+	close(through.release)
+	close(behind.release)
+	assert.NoError(t, c.Close(ctx))
+	assert.ElementsMatch(t, ips, through.Saved())
+	assert.ElementsMatch(t, ips, behind.Saved())
+
+	// The entries are saved synchronously once the chain is closed
+	c.SaveInAllCaches(ctx, &models.GeoIP{IP: "4.4.4.4"})
+	assert.Contains(t, through.Saved(), "4.4.4.4")
+	assert.Contains(t, behind.Saved(), "4.4.4.4")
+}
+
+func TestChainCloseTimeout(t *testing.T) {
+	logger := zerolog.New(os.Stdout).Level(zerolog.NoLevel)
+
+	blocked, behind := NewRecordingRepositoryMock(true), NewRecordingRepositoryMock(true)
+	c := New(&logger)
+	c.Add("blocked", blocked)
+	c.AddWithPolicy("behind", behind, WriteBehind)
+
+	// The backfill isn't canceled with the request
+	reqCtx, cancel := context.WithCancel(context.Background())
+	c.SaveInAllCaches(reqCtx, &models.GeoIP{IP: "1.1.1.1"})
+	cancel()
+
+	ctx, cancelClose := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelClose()
+	assert.ErrorIs(t, c.Close(ctx), context.DeadlineExceeded)
+
+	close(blocked.release)
+	close(behind.release)
+	assert.NoError(t, c.Close(context.Background()))
+	assert.Equal(t, []string{"1.1.1.1"}, blocked.Saved())
+	assert.Equal(t, []string{"1.1.1.1"}, behind.Saved())
+}
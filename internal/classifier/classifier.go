@@ -0,0 +1,135 @@
+package classifier
+
+import (
+	"net/netip"
+	"sort"
+)
+
+// Scope represents the scope of an ip address, as defined by the IANA
+// IPv4 and IPv6 special-purpose address registries.
+type Scope string
+
+const (
+	// ScopeGlobal is the scope of the globally routable ip addresses.
+	// These are the only ip addresses which can be geolocated.
+	ScopeGlobal Scope = "global"
+
+	// ScopeUnspecified is the scope of the unspecified addresses ("this network")
+	ScopeUnspecified Scope = "unspecified"
+
+	// ScopePrivate is the scope of the private-use addresses (RFC 1918)
+	// and of the IPv6 unique local addresses (RFC 4193)
+	ScopePrivate Scope = "private"
+
+	// ScopeLoopback is the scope of the loopback addresses
+	ScopeLoopback Scope = "loopback"
+
+	// ScopeLinkLocal is the scope of the link-local addresses
+	ScopeLinkLocal Scope = "link-local"
+
+	// ScopeCGNAT is the scope of the shared address space used
+	// by carrier-grade NAT (RFC 6598)
+	ScopeCGNAT Scope = "cgnat"
+
+	// ScopeMulticast is the scope of the multicast addresses
+	ScopeMulticast Scope = "multicast"
+
+	// ScopeBroadcast is the scope of the limited broadcast address
+	ScopeBroadcast Scope = "broadcast"
+
+	// ScopeDocumentation is the scope of the addresses reserved
+	// for documentation (RFC 5737, RFC 3849, RFC 9637)
+	ScopeDocumentation Scope = "documentation"
+
+	// ScopeBenchmarking is the scope of the addresses reserved for
+	// benchmarking (RFC 2544, RFC 5180)
+	ScopeBenchmarking Scope = "benchmarking"
+
+	// ScopeReserved is the scope of the other special-purpose or
+	// reserved addresses
+	ScopeReserved Scope = "reserved"
+)
+
+// rangeScope associates a special-purpose range to its scope
+type rangeScope struct {
+	prefix netip.Prefix
+	scope  Scope
+}
+
+// ranges is the list of special-purpose ranges.
+// It is sorted from the most specific to the least specific range
+// at init time so nested ranges are matched first.
+//
+// ref: https://www.iana.org/assignments/iana-ipv4-special-registry
+// ref: https://www.iana.org/assignments/iana-ipv6-special-registry
+var ranges = []rangeScope{
+	// IPv4
+	{netip.MustParsePrefix("0.0.0.0/8"), ScopeUnspecified},
+	{netip.MustParsePrefix("10.0.0.0/8"), ScopePrivate},
+	{netip.MustParsePrefix("100.64.0.0/10"), ScopeCGNAT},
+	{netip.MustParsePrefix("127.0.0.0/8"), ScopeLoopback},
+	{netip.MustParsePrefix("169.254.0.0/16"), ScopeLinkLocal},
+	{netip.MustParsePrefix("172.16.0.0/12"), ScopePrivate},
+	{netip.MustParsePrefix("192.0.0.0/24"), ScopeReserved},
+	{netip.MustParsePrefix("192.0.0.9/32"), ScopeGlobal},  // Port Control Protocol anycast, nested in 192.0.0.0/24
+	{netip.MustParsePrefix("192.0.0.10/32"), ScopeGlobal}, // TURN anycast, nested in 192.0.0.0/24
+	{netip.MustParsePrefix("192.0.2.0/24"), ScopeDocumentation},
+	{netip.MustParsePrefix("192.88.99.0/24"), ScopeReserved},
+	{netip.MustParsePrefix("192.168.0.0/16"), ScopePrivate},
+	{netip.MustParsePrefix("198.18.0.0/15"), ScopeBenchmarking},
+	{netip.MustParsePrefix("198.51.100.0/24"), ScopeDocumentation},
+	{netip.MustParsePrefix("203.0.113.0/24"), ScopeDocumentation},
+	{netip.MustParsePrefix("224.0.0.0/4"), ScopeMulticast},
+	{netip.MustParsePrefix("240.0.0.0/4"), ScopeReserved},
+	{netip.MustParsePrefix("255.255.255.255/32"), ScopeBroadcast},
+
+	// IPv6
+	{netip.MustParsePrefix("::/128"), ScopeUnspecified},
+	{netip.MustParsePrefix("::1/128"), ScopeLoopback},
+	{netip.MustParsePrefix("::/96"), ScopeReserved}, // Deprecated IPv4-compatible addresses
+	{netip.MustParsePrefix("64:ff9b:1::/48"), ScopePrivate},
+	{netip.MustParsePrefix("100::/64"), ScopeReserved}, // Discard-only
+	{netip.MustParsePrefix("2001::/23"), ScopeReserved},
+	{netip.MustParsePrefix("2001::/32"), ScopeGlobal},       // TEREDO, nested in 2001::/23
+	{netip.MustParsePrefix("2001:1::1/128"), ScopeGlobal},   // Port Control Protocol anycast, nested in 2001::/23
+	{netip.MustParsePrefix("2001:1::2/128"), ScopeGlobal},   // TURN anycast, nested in 2001::/23
+	{netip.MustParsePrefix("2001:3::/32"), ScopeGlobal},     // AMT, nested in 2001::/23
+	{netip.MustParsePrefix("2001:4:112::/48"), ScopeGlobal}, // AS112-v6, nested in 2001::/23
+	{netip.MustParsePrefix("2001:20::/28"), ScopeGlobal},    // ORCHIDv2, nested in 2001::/23
+	{netip.MustParsePrefix("2001:30::/28"), ScopeGlobal},    // DRIP Entity Tags, nested in 2001::/23
+	{netip.MustParsePrefix("2001:2::/48"), ScopeBenchmarking},
+	{netip.MustParsePrefix("2001:db8::/32"), ScopeDocumentation},
+	{netip.MustParsePrefix("3fff::/20"), ScopeDocumentation},
+	{netip.MustParsePrefix("fc00::/7"), ScopePrivate},
+	{netip.MustParsePrefix("fe80::/10"), ScopeLinkLocal},
+	{netip.MustParsePrefix("fec0::/10"), ScopeReserved}, // Deprecated site-local addresses
+	{netip.MustParsePrefix("ff00::/8"), ScopeMulticast},
+}
+
+func init() {
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].prefix.Bits() > ranges[j].prefix.Bits()
+	})
+}
+
+// Classify returns the scope of the given address.
+// IPv4-mapped IPv6 addresses are classified as IPv4 addresses.
+// It returns ScopeGlobal if the address doesn't belong to
+// any special-purpose range.
+func Classify(addr netip.Addr) Scope {
+	addr = addr.Unmap()
+
+	for _, r := range ranges {
+		if r.prefix.Contains(addr) {
+			return r.scope
+		}
+	}
+
+	return ScopeGlobal
+}
+
+// IsGlobal returns true if the given address is globally routable
+// and can therefore be geolocated.
+func IsGlobal(addr netip.Addr) bool {
+	return Classify(addr) == ScopeGlobal
+}
@@ -0,0 +1,108 @@
+package classifier
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		addr string
+		want Scope
+	}{
+		// IPv4
+		{"1.1.1.1", ScopeGlobal},
+		{"8.8.8.8", ScopeGlobal},
+		{"0.0.0.0", ScopeUnspecified},
+		{"10.1.2.3", ScopePrivate},
+		{"172.16.0.1", ScopePrivate},
+		{"172.31.255.255", ScopePrivate},
+		{"172.32.0.1", ScopeGlobal},
+		{"192.168.1.1", ScopePrivate},
+		{"100.64.0.1", ScopeCGNAT},
+		{"100.127.255.255", ScopeCGNAT},
+		{"100.128.0.1", ScopeGlobal},
+		{"127.0.0.1", ScopeLoopback},
+		{"169.254.169.254", ScopeLinkLocal},
+		{"192.0.0.8", ScopeReserved},
+		{"192.0.0.9", ScopeGlobal},
+		{"192.0.0.10", ScopeGlobal},
+		{"192.0.0.11", ScopeReserved},
+		{"192.0.2.1", ScopeDocumentation},
+		{"198.51.100.1", ScopeDocumentation},
+		{"203.0.113.1", ScopeDocumentation},
+		{"198.18.0.1", ScopeBenchmarking},
+		{"224.0.0.251", ScopeMulticast},
+		{"239.255.255.250", ScopeMulticast},
+		{"240.0.0.1", ScopeReserved},
+		{"255.255.255.255", ScopeBroadcast},
+
+		// IPv4-mapped IPv6
+		{"::ffff:10.0.0.1", ScopePrivate},
+		{"::ffff:1.1.1.1", ScopeGlobal},
+
+		// IPv6
+		{"2606:4700:4700::1111", ScopeGlobal},
+		{"::", ScopeUnspecified},
+		{"::1", ScopeLoopback},
+		{"::1.2.3.4", ScopeReserved},
+		{"64:ff9b:1::1", ScopePrivate},
+		{"64:ff9b::1.1.1.1", ScopeGlobal},
+		{"100::1", ScopeReserved},
+		{"2001::1", ScopeGlobal},
+		{"2001:1::1", ScopeGlobal},
+		{"2001:1::2", ScopeGlobal},
+		{"2001:1::3", ScopeReserved},
+		{"2001:3::1", ScopeGlobal},
+		{"2001:4:112::1", ScopeGlobal},
+		{"2001:4:113::1", ScopeReserved},
+		{"2001:20::1", ScopeGlobal},
+		{"2001:2f:ffff::1", ScopeGlobal},
+		{"2001:30::1", ScopeGlobal},
+		{"2001:3f:ffff::1", ScopeGlobal},
+		{"2001:40::1", ScopeReserved},
+		{"2001:2::1", ScopeBenchmarking},
+		{"2001:100::1", ScopeReserved},
+		{"2001:db8::1", ScopeDocumentation},
+		{"3fff::1", ScopeDocumentation},
+		{"fc00::1", ScopePrivate},
+		{"fd12:3456:789a::1", ScopePrivate},
+		{"fe80::1", ScopeLinkLocal},
+		{"fec0::1", ScopeReserved},
+		{"ff02::1", ScopeMulticast},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := Classify(netip.MustParseAddr(tt.addr)); got != tt.want {
+				t.Errorf("Classify() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsGlobal(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"1.1.1.1", true},
+		{"2606:4700:4700::1111", true},
+		{"10.0.0.1", false},
+		{"fe80::1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := IsGlobal(netip.MustParseAddr(tt.addr)); got != tt.want {
+				t.Errorf("IsGlobal() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func BenchmarkClassify(b *testing.B) {
+	addr := netip.MustParseAddr("1.1.1.1")
+
+	for i := 0; i < b.N; i++ {
+		Classify(addr)
+	}
+}
@@ -55,6 +55,17 @@ func (config *Config) setDefaults() {
 	config.SetDefault("SERVER_READ_HEADER_TIMEOUT", 10*time.Second)
 	config.SetDefault("SERVER_WRITE_TIMEOUT", 30*time.Second)
 
+	// Batch endpoint configuration
+	config.SetDefault("BATCH_MAX_SIZE", 100)
+
+	// Comma separated list of CIDRs allowed to set the client address
+	// through the CLIENT_IP_HEADER header
+	config.SetDefault("TRUSTED_PROXIES", "")
+
+	// Header the trusted proxies set the client address in,
+	// ex: "Forwarded", "X-Forwarded-For" or "X-Real-IP"
+	config.SetDefault("CLIENT_IP_HEADER", "X-Forwarded-For")
+
 	// Logger configuration
 	// Available: "trace", "debug", "info", "warn", "error", "fatal", "panic"
 	// ref: https://pkg.go.dev/github.com/rs/zerolog@v1.26.1#pkg-variables
@@ -69,19 +80,87 @@ func (config *Config) setDefaults() {
 	// pprof configuration
 	config.SetDefault("PPROF", false)
 
+	// Location overrides configuration
+	config.SetDefault("OVERRIDES_FILE", "")    // Path to a csv or yaml file. Empty to disable overrides
+	config.SetDefault("OVERRIDES_WATCH", true) // Reload the file when it changes on disk
+
+	// Cache chain configuration
+	config.SetDefault("CACHE_CHAIN", "memory,redis")         // Comma separated list, looked up in order. Available: "memory", "memcached", "redis", "postgres", "bolt". "none" to disable caching
+	config.SetDefault("CACHE_WRITE_POLICIES", "")            // Comma separated list of <layer>=<policy>. Available: "write-through", "write-behind", "read-only". Unlisted layers are written through
+	config.SetDefault("CACHE_MAX_BACKFILLS", 64)             // Maximum number of backfills in progress, after a cache hit
+	config.SetDefault("CACHE_WRITE_BEHIND_QUEUE_SIZE", 1024) // Number of writes queued for each write-behind layer
+
+	// In-memory cache configuration
+	config.SetDefault("IN_MEMORY_SHARDS", 16)          // Number of independently locked shards
+	config.SetDefault("IN_MEMORY_MAX_ENTRIES", 100000) // Maximum number of entries. 0 for no limit
+	config.SetDefault("IN_MEMORY_MAX_BYTES", "0")      // Approximate memory budget, ex: "64MB". 0 for no limit
+	config.SetDefault("IN_MEMORY_TTL", 24*time.Hour)   // Time before an entry expires. 0 for no expiry
+
+	// In-memory cache snapshot configuration
+	config.SetDefault("SNAPSHOT_PATH", "")                // Path to the snapshot file. Empty to disable snapshots
+	config.SetDefault("SNAPSHOT_INTERVAL", 5*time.Minute) // Duration between two snapshots
+
+	// Memcached configuration
+	config.SetDefault("MEMCACHED_SERVERS", "localhost:11211") // Comma separated list of servers, ex: "10.0.0.1:11211,10.0.0.2:11211"
+	config.SetDefault("MEMCACHED_KEY_TTL", 24*time.Hour)
+	config.SetDefault("MEMCACHED_KEY_PREFIX", "geo") // Namespace of the keys. The keys are "<prefix>:v<version>:<ip>"
+
 	// Redis configuration
 	config.SetDefault("REDIS_CONNECTION_STRING", "redis://localhost:6379")
 	config.SetDefault("REDIS_KEY_TTL", 24*time.Hour)
+	config.SetDefault("REDIS_KEY_PREFIX", "geo")                         // Namespace of the keys. The keys are "<prefix>:v<version>:<ip>"
+	config.SetDefault("REDIS_INVALIDATION_CHANNEL", "geo:invalidations") // Pub/sub channel notifying the replicas of the deleted or replaced entries. Empty to disable
+
+	// Postgres configuration
+	config.SetDefault("POSTGRES_CONNECTION_STRING", "postgres://localhost:5432/geoip")
+	config.SetDefault("POSTGRES_TTL", 30*24*time.Hour)            // Time before a row expires
+	config.SetDefault("POSTGRES_CONNECT_TIMEOUT", 10*time.Second) // Maximum duration to connect and migrate the schema on start
+
+	// Bolt database configuration
+	config.SetDefault("BOLT_PATH", "geoip.db")            // Path to the database file
+	config.SetDefault("BOLT_TTL", 30*24*time.Hour)        // Time before an item expires
+	config.SetDefault("BOLT_CLEANUP_INTERVAL", time.Hour) // Duration between two removals of the expired items
+
+	// Admin API configuration
+	config.SetDefault("ADMIN_API_TOKEN", "") // Bearer token of the admin endpoints. Empty to disable them
 
 	// Set default IP Geolocation API
-	config.SetDefault("GEOLOCATION_API", "ip-api") // Available: "ipapi", "ipbase"
+	config.SetDefault("GEOLOCATION_API", "ip-api") // Comma separated list, queried in order. Available: "ip-api", "ipbase", "ipinfo", "maxmind", "csv"
+
+	// Circuit breaker configuration of the upstream geolocation APIs
+	config.SetDefault("BREAKER_FAILURE_THRESHOLD", 5)     // Consecutive failures opening the breaker
+	config.SetDefault("BREAKER_COOLDOWN", 30*time.Second) // Duration before a trial query is let through
+
+	// Rate limit of the upstream geolocation APIs
+	config.SetDefault("RATE_LIMIT_MAX_WAIT", 1*time.Second) // Maximum duration a query waits for the rate limiter
 
 	// Configuration for ip-api.com API
 	config.SetDefault("IP_API_BASE_URL", "http://ip-api.com/json/") // https isn't available for free usage
+	config.SetDefault("IP_API_RATE_LIMIT", 45)                      // Requests per minute. 0 to disable
+	config.SetDefault("IP_API_BATCH", false)                        // Use the batch endpoint
+	config.SetDefault("IP_API_BATCH_URL", "http://ip-api.com/batch")
+	config.SetDefault("IP_API_BATCH_WINDOW", 10*time.Millisecond) // Duration the queries are collected for
+	config.SetDefault("IP_API_BATCH_RATE_LIMIT", 15)              // Batch requests per minute. 0 to disable
 
 	// Configuration for ipbase.com API
 	config.SetDefault("IPBASE_BASE_URL", "https://api.ipbase.com/v2/info/?ip=")
 	config.SetDefault("IPBASE_API_KEY", "")
+	config.SetDefault("IPBASE_RATE_LIMIT", 0) // Requests per minute. 0 to disable
+
+	// Configuration for ipinfo.io API
+	config.SetDefault("IPINFO_BASE_URL", "https://ipinfo.io/")
+	config.SetDefault("IPINFO_TOKEN", "")
+	config.SetDefault("IPINFO_RATE_LIMIT", 0) // Requests per minute. 0 to disable
+
+	// Configuration for the local MaxMind databases
+	config.SetDefault("MAXMIND_DB_PATH", "GeoLite2-City.mmdb") // GeoIP2/GeoLite2 City or Country database
+	config.SetDefault("MAXMIND_ASN_DB_PATH", "")               // GeoIP2/GeoLite2 ASN database. Empty to disable
+	config.SetDefault("MAXMIND_WATCH", true)                   // Reload the databases when they change on disk
+
+	// Configuration for the local csv database
+	config.SetDefault("CSV_DB_PATH", "dbip-city-lite.csv")
+	config.SetDefault("CSV_DB_FORMAT", "dbip-city") // Available: "dbip-country", "dbip-city", "ip2location"
+	config.SetDefault("CSV_DB_WATCH", true)         // Reload the database when it changes on disk
 
 	// Set default http client configuration
 	config.SetDefault("HTTP_CLIENT_TIMEOUT", 15*time.Second)
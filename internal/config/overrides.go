@@ -0,0 +1,127 @@
+package config
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// Override represents an operator-defined location
+// for all the ip addresses of a network.
+type Override struct {
+	CIDR        netip.Prefix `yaml:"cidr"`
+	CountryCode string       `yaml:"country_code"`
+	CountryName string       `yaml:"country_name"`
+	City        string       `yaml:"city"`
+	Latitude    float64      `yaml:"latitude"`
+	Longitude   float64      `yaml:"longitude"`
+}
+
+// overridesCSVHeader is the list of columns of an overrides csv file
+var overridesCSVHeader = []string{"cidr", "country_code", "country_name", "city", "latitude", "longitude"}
+
+// LoadOverrides reads the list of location overrides from the given file.
+//
+// Files with a ".yaml" or ".yml" extension are parsed as a yaml list of Override.
+// Other files are parsed as csv files with the following columns:
+// "cidr,country_code,country_name,city,latitude,longitude".
+// The csv header line is optional and lines starting with '#' are ignored.
+func LoadOverrides(path string) ([]Override, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error: failed to open overrides file: %w", err)
+	}
+	defer f.Close()
+
+	var overrides []Override
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		overrides, err = parseOverridesYAML(f)
+	default:
+		overrides, err = parseOverridesCSV(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error: failed to parse overrides file %s: %w", path, err)
+	}
+
+	for i, o := range overrides {
+		if !o.CIDR.IsValid() {
+			return nil, fmt.Errorf("error: invalid cidr for override #%d in %s", i+1, path)
+		}
+		overrides[i].CIDR = o.CIDR.Masked()
+	}
+
+	return overrides, nil
+}
+
+// parseOverridesYAML parses a yaml list of Override
+func parseOverridesYAML(r io.Reader) ([]Override, error) {
+	var overrides []Override
+
+	if err := yaml.NewDecoder(r).Decode(&overrides); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	return overrides, nil
+}
+
+// parseOverridesCSV parses a csv file of Override
+func parseOverridesCSV(r io.Reader) ([]Override, error) {
+	var overrides []Override
+
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = len(overridesCSVHeader)
+	cr.TrimLeadingSpace = true
+
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Skip the optional header line
+		if len(overrides) == 0 && record[0] == overridesCSVHeader[0] {
+			continue
+		}
+
+		line, _ := cr.FieldPos(0)
+
+		cidr, err := netip.ParsePrefix(record[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		lat, err := strconv.ParseFloat(record[4], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid latitude: %w", line, err)
+		}
+
+		lon, err := strconv.ParseFloat(record[5], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid longitude: %w", line, err)
+		}
+
+		overrides = append(overrides, Override{
+			CIDR:        cidr,
+			CountryCode: record[1],
+			CountryName: record[2],
+			City:        record[3],
+			Latitude:    lat,
+			Longitude:   lon,
+		})
+	}
+
+	return overrides, nil
+}
@@ -0,0 +1,128 @@
+package config
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadOverrides(t *testing.T) {
+	want := []Override{
+		{CIDR: netip.MustParsePrefix("203.0.113.0/24"), CountryCode: "FR", CountryName: "France", City: "Paris", Latitude: 48.8566, Longitude: 2.35222},
+		{CIDR: netip.MustParsePrefix("2001:db8::/32"), CountryCode: "DE", CountryName: "Germany", City: "Berlin", Latitude: 52.52, Longitude: 13.405},
+	}
+
+	tests := []struct {
+		name     string
+		filename string
+		content  string
+		want     []Override
+		wantErr  bool
+	}{
+		{
+			name:     "csv with header",
+			filename: "overrides.csv",
+			content:  "cidr,country_code,country_name,city,latitude,longitude\n203.0.113.0/24,FR,France,Paris,48.8566,2.35222\n2001:db8::/32,DE,Germany,Berlin,52.52,13.405\n",
+			want:     want,
+		},
+		{
+			name:     "csv without header - with comments and non canonical cidr",
+			filename: "overrides.csv",
+			content:  "# office networks\n203.0.113.10/24, FR, France, Paris, 48.8566, 2.35222\n2001:db8::/32,DE,Germany,Berlin,52.52,13.405\n",
+			want:     want,
+		},
+		{
+			name:     "empty csv",
+			filename: "overrides.csv",
+			content:  "",
+			want:     nil,
+		},
+		{
+			name:     "csv with invalid cidr",
+			filename: "overrides.csv",
+			content:  "bla,FR,France,Paris,48.8566,2.35222\n",
+			wantErr:  true,
+		},
+		{
+			name:     "csv with invalid latitude",
+			filename: "overrides.csv",
+			content:  "203.0.113.0/24,FR,France,Paris,bla,2.35222\n",
+			wantErr:  true,
+		},
+		{
+			name:     "csv with invalid longitude",
+			filename: "overrides.csv",
+			content:  "203.0.113.0/24,FR,France,Paris,48.8566,bla\n",
+			wantErr:  true,
+		},
+		{
+			name:     "csv with missing columns",
+			filename: "overrides.csv",
+			content:  "203.0.113.0/24,FR,France\n",
+			wantErr:  true,
+		},
+		{
+			name:     "yaml",
+			filename: "overrides.yaml",
+			content: `
+- cidr: 203.0.113.0/24
+  country_code: FR
+  country_name: France
+  city: Paris
+  latitude: 48.8566
+  longitude: 2.35222
+- cidr: 2001:db8::/32
+  country_code: DE
+  country_name: Germany
+  city: Berlin
+  latitude: 52.52
+  longitude: 13.405
+`,
+			want: want,
+		},
+		{
+			name:     "empty yaml",
+			filename: "overrides.yml",
+			content:  "",
+			want:     nil,
+		},
+		{
+			name:     "yaml with invalid cidr",
+			filename: "overrides.yml",
+			content:  "- cidr: bla\n",
+			wantErr:  true,
+		},
+		{
+			name:     "yaml with missing cidr",
+			filename: "overrides.yml",
+			content:  "- country_code: FR\n",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.filename)
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := LoadOverrides(path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("LoadOverrides() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LoadOverrides() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("non existing file", func(t *testing.T) {
+		_, err := LoadOverrides(filepath.Join(t.TempDir(), "nonexistent.csv"))
+		if err == nil {
+			t.Errorf("LoadOverrides() error = %v, wantErr %v", err, true)
+		}
+	})
+}
@@ -0,0 +1,157 @@
+package controllers
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/rs/zerolog/hlog"
+)
+
+const (
+	// AdminSource is the value of models.GeoIP.Source for the
+	// GeoIP information saved through the admin endpoints,
+	// unless the request sets it
+	AdminSource = "admin"
+
+	// adminMaxBodyBytes is the maximum number of bytes
+	// accepted in the body of the admin requests
+	adminMaxBodyBytes = 4096
+)
+
+// Invalidator notifies all the replicas that the GeoIP
+// information of an ip address changed
+type Invalidator interface {
+	Publish(ctx context.Context, ip string) error
+}
+
+// RequireAdminToken is a middleware rejecting the requests without
+// the "Authorization: Bearer <AdminToken>" http header.
+// All the requests are rejected when AdminToken is empty.
+func (h *BaseHandler) RequireAdminToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if h.AdminToken == "" || !ok || subtle.ConstantTimeCompare([]byte(token), []byte(h.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			h.writeError(w, http.StatusUnauthorized, "a valid admin token is required")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// DeleteGeoIP is the admin handler removing the GeoIP information of
+// the given ip address from all the caches of the chain.
+// All the replicas are then notified to drop it from their in-memory cache.
+func (h *BaseHandler) DeleteGeoIP(w http.ResponseWriter, r *http.Request) {
+	// Get request id for logging purposes
+	req_id, _ := hlog.IDFromCtx(r.Context())
+
+	var ctx = r.Context()
+
+	addr, err := parseIP(httprouter.ParamsFromContext(ctx).ByName("ip"))
+	if err != nil {
+		h.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ip := addr.String()
+
+	if err := h.CacheChain.Delete(ctx, ip); err != nil {
+		h.Logger.Error().Str("req_id", req_id.String()).Err(err).Msgf("couldn't delete %s from the cache chain", ip)
+		h.writeError(w, http.StatusInternalServerError, "couldn't delete geo ip information")
+		return
+	}
+
+	if !h.invalidate(ctx, w, ip) {
+		return
+	}
+
+	h.Logger.Info().Str("req_id", req_id.String()).Msgf("%s deleted from the cache chain", ip)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PutGeoIP is the admin handler replacing the GeoIP information of the
+// given ip address in all the caches of the chain by the one of the json
+// request body. All the replicas are then notified to drop it from their
+// in-memory cache, so they read the new one.
+func (h *BaseHandler) PutGeoIP(w http.ResponseWriter, r *http.Request) {
+	// Get request id for logging purposes
+	req_id, _ := hlog.IDFromCtx(r.Context())
+
+	var ctx = r.Context()
+
+	addr, err := parseIP(httprouter.ParamsFromContext(ctx).ByName("ip"))
+	if err != nil {
+		h.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ip := addr.String()
+
+	var g models.GeoIP
+	r.Body = http.MaxBytesReader(w, r.Body, adminMaxBodyBytes)
+	if err := json.NewDecoder(r.Body).Decode(&g); err != nil {
+		h.Logger.Error().Str("req_id", req_id.String()).Err(err).Msg("couldn't decode geo ip information")
+		h.writeError(w, http.StatusBadRequest, "the request body must be the json geo ip information")
+		return
+	}
+
+	if g.IP != "" {
+		bodyAddr, err := parseIP(g.IP)
+		if err != nil || bodyAddr != addr {
+			h.writeError(w, http.StatusBadRequest, "the ip of the request body doesn't match the ip of the path")
+			return
+		}
+	}
+	if g.CountryCode == "" {
+		h.writeError(w, http.StatusBadRequest, "the country code is required")
+		return
+	}
+
+	g.IP = ip
+	if g.Source == "" {
+		g.Source = AdminSource
+	}
+	saved := withFamily(&g, addr)
+
+	if err := h.CacheChain.Save(ctx, saved); err != nil {
+		h.Logger.Error().Str("req_id", req_id.String()).Err(err).Msgf("couldn't save %s in the cache chain", ip)
+		h.writeError(w, http.StatusInternalServerError, "couldn't save geo ip information")
+		return
+	}
+
+	if !h.invalidate(ctx, w, ip) {
+		return
+	}
+
+	h.Logger.Info().Str("req_id", req_id.String()).Msgf("%s replaced in the cache chain", ip)
+
+	resp, _ := json.Marshal(saved)
+	w.Header().Set("Content-Type", ContentTypeApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+// invalidate notifies all the replicas that the GeoIP information of ip
+// changed, if an Invalidator is set. It answers with an error and returns
+// false if they couldn't be notified.
+func (h *BaseHandler) invalidate(ctx context.Context, w http.ResponseWriter, ip string) bool {
+	// Get request id for logging purposes
+	req_id, _ := hlog.IDFromCtx(ctx)
+
+	if h.Invalidator == nil {
+		return true
+	}
+
+	if err := h.Invalidator.Publish(ctx, ip); err != nil {
+		h.Logger.Error().Str("req_id", req_id.String()).Err(err).Msg("couldn't notify the other replicas")
+		h.writeError(w, http.StatusInternalServerError, "the caches were updated but the other replicas couldn't be notified")
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,340 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/julienschmidt/httprouter"
+	"github.com/lescactus/geolocation-go/internal/chain"
+	"github.com/lescactus/geolocation-go/internal/invalidation"
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/lescactus/geolocation-go/internal/repositories"
+	"github.com/stretchr/testify/assert"
+)
+
+const adminToken = "s3cr3t"
+
+// InvalidatorMock records the published invalidations
+type InvalidatorMock struct {
+	mu        sync.Mutex
+	published []string
+	err       error
+}
+
+func (m *InvalidatorMock) Publish(ctx context.Context, ip string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.published = append(m.published, ip)
+	return nil
+}
+
+// FailingRepositoryMock fails to save and to delete any entry
+type FailingRepositoryMock struct{}
+
+func (m *FailingRepositoryMock) Get(ctx context.Context, ip string) (*models.GeoIP, error) {
+	return nil, errors.New("error: no value found")
+}
+
+func (m *FailingRepositoryMock) Save(ctx context.Context, geoip *models.GeoIP) error {
+	return errors.New("error: cannot save")
+}
+
+func (m *FailingRepositoryMock) Delete(ctx context.Context, ip string) error {
+	return errors.New("error: cannot delete")
+}
+
+func (m *FailingRepositoryMock) Status(ctx context.Context, wg *sync.WaitGroup, ch chan error) {}
+
+// newAdminRouter registers the admin routes of h as main does
+func newAdminRouter(h *BaseHandler) *httprouter.Router {
+	r := httprouter.New()
+	r.Handler("GET", "/rest/v1/:ip", http.HandlerFunc(h.GetGeoIP))
+	r.Handler("DELETE", "/rest/v1/:ip", h.RequireAdminToken(http.HandlerFunc(h.DeleteGeoIP)))
+	r.Handler("PUT", "/rest/v1/:ip", h.RequireAdminToken(http.HandlerFunc(h.PutGeoIP)))
+	return r
+}
+
+func serve(r http.Handler, method, path, token, body string) (int, string) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, req)
+
+	resp := recorder.Result()
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+
+	return resp.StatusCode, string(data)
+}
+
+func TestRequireAdminToken(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+
+	tests := []struct {
+		name          string
+		adminToken    string
+		authorization string
+		code          int
+	}{
+		{name: "Valid token", adminToken: adminToken, authorization: "Bearer " + adminToken, code: http.StatusNoContent},
+		{name: "Invalid token", adminToken: adminToken, authorization: "Bearer other", code: http.StatusUnauthorized},
+		{name: "Not a bearer token", adminToken: adminToken, authorization: "Basic " + adminToken, code: http.StatusUnauthorized},
+		{name: "Missing token", adminToken: adminToken, code: http.StatusUnauthorized},
+		{name: "Admin API disabled", adminToken: "", authorization: "Bearer ", code: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewBaseHandler(chain.New(&logger), &GeoAPIMock{}, &logger)
+			h.AdminToken = tt.adminToken
+
+			req := httptest.NewRequest("DELETE", "/rest/v1/1.1.1.1", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			recorder := httptest.NewRecorder()
+			h.RequireAdminToken(next).ServeHTTP(recorder, req)
+
+			assert.Equal(t, tt.code, recorder.Code)
+			if tt.code == http.StatusUnauthorized {
+				assert.Equal(t, `Bearer realm="admin"`, recorder.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestDeleteGeoIP(t *testing.T) {
+	ctx := context.Background()
+
+	mdb := repositories.NewInMemoryDB()
+	c := chain.New(&logger)
+	c.Add("in-memory", mdb)
+
+	inv := &InvalidatorMock{}
+	h := NewBaseHandler(c, &GeoAPIMock{}, &logger)
+	h.AdminToken = adminToken
+	h.Invalidator = inv
+	r := newAdminRouter(h)
+
+	mdb.Save(ctx, &models.GeoIP{IP: "2606:4700:4700::1111"})
+
+	code, body := serve(r, "DELETE", "/rest/v1/2606:4700:4700:0:0:0:0:1111", adminToken, "")
+	assert.Equal(t, http.StatusNoContent, code)
+	assert.Empty(t, body)
+	assert.Equal(t, []string{"2606:4700:4700::1111"}, inv.published)
+	_, err := mdb.Get(ctx, "2606:4700:4700::1111")
+	assert.Error(t, err)
+
+	// Deleting a missing entry is idempotent
+	code, _ = serve(r, "DELETE", "/rest/v1/1.1.1.1", adminToken, "")
+	assert.Equal(t, http.StatusNoContent, code)
+
+	code, body = serve(r, "DELETE", "/rest/v1/bla", adminToken, "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, `{"status":"error","msg":"the provided ip is not a valid ipv4 or ipv6 address"}`, body)
+
+	code, _ = serve(r, "DELETE", "/rest/v1/1.1.1.1", "", "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	t.Run("Cache failure", func(t *testing.T) {
+		c := chain.New(&logger)
+		c.Add("failing", &FailingRepositoryMock{})
+		h := NewBaseHandler(c, &GeoAPIMock{}, &logger)
+		h.AdminToken = adminToken
+		inv := &InvalidatorMock{}
+		h.Invalidator = inv
+
+		code, body := serve(newAdminRouter(h), "DELETE", "/rest/v1/1.1.1.1", adminToken, "")
+		assert.Equal(t, http.StatusInternalServerError, code)
+		assert.Equal(t, `{"status":"error","msg":"couldn't delete geo ip information"}`, body)
+		assert.Empty(t, inv.published)
+	})
+
+	t.Run("Invalidation failure", func(t *testing.T) {
+		h := NewBaseHandler(chain.New(&logger), &GeoAPIMock{}, &logger)
+		h.AdminToken = adminToken
+		h.Invalidator = &InvalidatorMock{err: errors.New("error: connection refused")}
+
+		code, body := serve(newAdminRouter(h), "DELETE", "/rest/v1/1.1.1.1", adminToken, "")
+		assert.Equal(t, http.StatusInternalServerError, code)
+		assert.Equal(t, `{"status":"error","msg":"the caches were updated but the other replicas couldn't be notified"}`, body)
+	})
+}
+
+func TestPutGeoIP(t *testing.T) {
+	tests := []struct {
+		name      string
+		path      string
+		body      string
+		want      string
+		code      int
+		published []string
+	}{
+		{
+			name:      "Valid geo ip information",
+			path:      "/rest/v1/1.1.1.1",
+			body:      `{"country_code":"FR","country_name":"France","city":"Paris"}`,
+			want:      `{"ip":"1.1.1.1","family":"ipv4","country_code":"FR","country_name":"France","city":"Paris","source":"admin"}`,
+			code:      http.StatusOK,
+			published: []string{"1.1.1.1"},
+		},
+		{
+			name:      "Matching ip and source",
+			path:      "/rest/v1/2606:4700:4700:0:0:0:0:1111",
+			body:      `{"ip":"2606:4700:4700::1111","country_code":"US","country_name":"United States","source":"ip-api"}`,
+			want:      `{"ip":"2606:4700:4700::1111","family":"ipv6","country_code":"US","country_name":"United States","source":"ip-api"}`,
+			code:      http.StatusOK,
+			published: []string{"2606:4700:4700::1111"},
+		},
+		{
+			name: "Mismatching ip",
+			path: "/rest/v1/1.1.1.1",
+			body: `{"ip":"2.2.2.2","country_code":"FR"}`,
+			want: `{"status":"error","msg":"the ip of the request body doesn't match the ip of the path"}`,
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "Missing country code",
+			path: "/rest/v1/1.1.1.1",
+			body: `{"country_name":"France"}`,
+			want: `{"status":"error","msg":"the country code is required"}`,
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "Invalid body",
+			path: "/rest/v1/1.1.1.1",
+			body: `["1.1.1.1"]`,
+			want: `{"status":"error","msg":"the request body must be the json geo ip information"}`,
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "Body too large",
+			path: "/rest/v1/1.1.1.1",
+			body: `{"country_code":"FR","city":"` + strings.Repeat("a", adminMaxBodyBytes) + `"}`,
+			want: `{"status":"error","msg":"the request body must be the json geo ip information"}`,
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "Invalid ip",
+			path: "/rest/v1/bla",
+			body: `{"country_code":"FR"}`,
+			want: `{"status":"error","msg":"the provided ip is not a valid ipv4 or ipv6 address"}`,
+			code: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mdb := repositories.NewInMemoryDB()
+			c := chain.New(&logger)
+			c.Add("in-memory", mdb)
+
+			inv := &InvalidatorMock{}
+			h := NewBaseHandler(c, &GeoAPIMock{}, &logger)
+			h.AdminToken = adminToken
+			h.Invalidator = inv
+
+			code, body := serve(newAdminRouter(h), "PUT", tt.path, adminToken, tt.body)
+			assert.Equal(t, tt.code, code)
+			assert.Equal(t, tt.want, body)
+			assert.Equal(t, tt.published, inv.published)
+
+			if tt.code == http.StatusOK {
+				_, err := mdb.Get(context.Background(), tt.published[0])
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	t.Run("Cache failure", func(t *testing.T) {
+		c := chain.New(&logger)
+		c.Add("failing", &FailingRepositoryMock{})
+		h := NewBaseHandler(c, &GeoAPIMock{}, &logger)
+		h.AdminToken = adminToken
+
+		code, body := serve(newAdminRouter(h), "PUT", "/rest/v1/1.1.1.1", adminToken, `{"country_code":"FR"}`)
+		assert.Equal(t, http.StatusInternalServerError, code)
+		assert.Equal(t, `{"status":"error","msg":"couldn't save geo ip information"}`, body)
+	})
+}
+
+// TestAdminInvalidationE2E runs two replicas sharing a redis, each with its
+// own in-memory cache, and checks the entries deleted or replaced through one
+// of them are no longer served from the in-memory cache of the other one.
+func TestAdminInvalidationE2E(t *testing.T) {
+	s := miniredis.RunT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+
+	replicas := make([]http.Handler, 2)
+	for i := range replicas {
+		rdb, err := repositories.NewRedisDB(fmt.Sprintf("redis://%s", s.Addr()), time.Hour, repositories.DefaultKeyPrefix)
+		assert.NoError(t, err)
+		defer rdb.Client().Close()
+
+		mdb := repositories.NewShardedDB(4, 0, 0, 0)
+		c := chain.New(&logger)
+		c.Add("in-memory", mdb)
+		c.Add("redis", rdb)
+
+		bus := invalidation.New(rdb.Client(), "", mdb, &logger)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bus.Run(ctx)
+		}()
+
+		h := NewBaseHandler(c, &GeoAPIMock{}, &logger)
+		h.AdminToken = adminToken
+		h.Invalidator = bus
+		replicas[i] = newAdminRouter(h)
+	}
+
+	assert.Eventually(t, func() bool {
+		return s.PubSubNumSub(invalidation.DefaultChannel)[invalidation.DefaultChannel] == len(replicas)
+	}, time.Second, 5*time.Millisecond)
+
+	// The caches are updated asynchronously after a lookup. Let the
+	// updates complete so they don't race with the admin requests.
+	settle := func() { time.Sleep(50 * time.Millisecond) }
+
+	// Both replicas cache 1.1.1.1 from the remote GeoIP API
+	for _, r := range replicas {
+		code, body := serve(r, "GET", "/rest/v1/1.1.1.1", "", "")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Contains(t, body, `"country_code":"AU"`)
+	}
+	settle()
+
+	// The entry fixed through the first replica is served by the second one
+	code, _ := serve(replicas[0], "PUT", "/rest/v1/1.1.1.1", adminToken, `{"country_code":"FR","country_name":"France"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Eventually(t, func() bool {
+		_, body := serve(replicas[1], "GET", "/rest/v1/1.1.1.1", "", "")
+		return strings.Contains(body, `"country_code":"FR"`)
+	}, time.Second, 5*time.Millisecond)
+	settle()
+
+	// The entry deleted through the second replica is fetched again from
+	// the remote GeoIP API by the first one
+	code, _ = serve(replicas[1], "DELETE", "/rest/v1/1.1.1.1", adminToken, "")
+	assert.Equal(t, http.StatusNoContent, code)
+	assert.Eventually(t, func() bool {
+		_, body := serve(replicas[0], "GET", "/rest/v1/1.1.1.1", "", "")
+		return strings.Contains(body, `"country_code":"AU"`)
+	}, time.Second, 5*time.Millisecond)
+}
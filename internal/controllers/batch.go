@@ -0,0 +1,169 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/rs/zerolog/hlog"
+)
+
+const (
+	// BatchStatusSuccess is the status of a successful lookup within a batch
+	BatchStatusSuccess = "success"
+
+	// BatchStatusError is the status of a failed lookup within a batch
+	BatchStatusError = "error"
+
+	// batchMaxConcurrency is the maximum number of concurrent lookups
+	// performed for a single batch request
+	batchMaxConcurrency = 10
+
+	// batchMaxBodyBytesPerIP is the maximum number of bytes accepted per ip address
+	// in the request body. It is large enough for the longest IPv6 notation.
+	batchMaxBodyBytesPerIP = 64
+)
+
+// BatchResult represents the result of the lookup of a
+// single ip address within a batch request.
+type BatchResult struct {
+	IP     string        `json:"ip"`
+	Status string        `json:"status"`
+	GeoIP  *models.GeoIP `json:"geoip,omitempty"`
+	Scope  string        `json:"scope,omitempty"`
+	Msg    string        `json:"msg,omitempty"`
+}
+
+// PostGeoIPBatch is the handler for batch lookups.
+// It expects a json array of ip addresses in the request body and will answer
+// with a json array of BatchResult, in the same order as the request.
+// Each ip address is looked up in the cache chain first and only the cache misses
+// are sent to the remote GeoIP API.
+// A failed lookup doesn't fail the whole batch: the error is reported
+// in the corresponding BatchResult instead.
+func (h *BaseHandler) PostGeoIPBatch(w http.ResponseWriter, r *http.Request) {
+	// Get request id for logging purposes
+	req_id, _ := hlog.IDFromCtx(r.Context())
+
+	var ctx = r.Context()
+
+	maxSize := h.BatchMaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultBatchMaxSize
+	}
+
+	// Decode the request body into a list of ip addresses
+	var ips []string
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxSize*batchMaxBodyBytesPerIP))
+	if err := json.NewDecoder(r.Body).Decode(&ips); err != nil {
+		h.Logger.Error().Str("req_id", req_id.String()).Err(err).Msg("couldn't decode batch request body")
+		h.writeError(w, http.StatusBadRequest, "the request body must be a json array of ip addresses")
+		return
+	}
+
+	if len(ips) == 0 {
+		h.writeError(w, http.StatusBadRequest, "the request body must contain at least one ip address")
+		return
+	}
+
+	if len(ips) > maxSize {
+		h.writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("the batch must not contain more than %d ip addresses", maxSize))
+		return
+	}
+
+	// Lookup each unique ip address concurrently. Different spellings
+	// of the same address, ex: "::ffff:1.1.1.1" and "1.1.1.1", are looked up once.
+	results := make(map[string]*BatchResult, len(ips))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, batchMaxConcurrency)
+
+	// results is written concurrently, hence the separate set
+	// of the ip addresses already dispatched
+	keys := make([]string, len(ips))
+	seen := make(map[string]bool, len(ips))
+	for i, ip := range ips {
+		key := batchKey(ip)
+		keys[i] = key
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(ip, key string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			res := h.batchLookup(ctx, ip)
+
+			mu.Lock()
+			results[key] = res
+			mu.Unlock()
+		}(ip, key)
+	}
+	wg.Wait()
+
+	// Build the response in the same order as the request,
+	// each result echoing the ip address as it was sent
+	batch := make([]*BatchResult, len(ips))
+	for i, ip := range ips {
+		res := results[keys[i]]
+		if res.IP != ip {
+			c := *res
+			c.IP = ip
+			res = &c
+		}
+		batch[i] = res
+	}
+
+	resp, err := json.Marshal(batch)
+	if err != nil {
+		h.Logger.Error().Str("req_id", req_id.String()).Msg("couldn't marshal batch geo ip information")
+		h.writeError(w, http.StatusInternalServerError, "couldn't marshal geo ip information")
+		return
+	}
+
+	w.Header().Set("Content-Type", ContentTypeApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+// batchKey returns the canonical form of the given ip address,
+// or ip itself if it is invalid.
+func batchKey(ip string) string {
+	addr, err := parseIP(ip)
+	if err != nil {
+		return ip
+	}
+	return addr.String()
+}
+
+// batchLookup will lookup the given ip and wrap the result or the
+// error into a BatchResult.
+func (h *BaseHandler) batchLookup(ctx context.Context, ip string) *BatchResult {
+	addr, err := parseIP(ip)
+	if err != nil {
+		return &BatchResult{IP: ip, Status: BatchStatusError, Msg: err.Error()}
+	}
+
+	g, err := h.lookup(ctx, addr)
+	if err != nil {
+		var scopeErr *ScopeError
+		if errors.As(err, &scopeErr) {
+			return &BatchResult{IP: ip, Status: BatchStatusError, Scope: string(scopeErr.Scope), Msg: scopeErr.Error()}
+		}
+
+		_, msg := lookupErrorResponse(err)
+		return &BatchResult{IP: ip, Status: BatchStatusError, Msg: msg}
+	}
+
+	return &BatchResult{IP: ip, Status: BatchStatusSuccess, GeoIP: g}
+}
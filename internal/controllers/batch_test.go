@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/lescactus/geolocation-go/internal/chain"
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/lescactus/geolocation-go/internal/repositories"
+	"github.com/stretchr/testify/assert"
+)
+
+// CountingGeoAPIMock implements api.GeoIP and records the
+// ip addresses it has been queried for
+type CountingGeoAPIMock struct {
+	GeoAPIMock
+	mu      sync.Mutex
+	queried []string
+}
+
+func (m *CountingGeoAPIMock) Get(ctx context.Context, ip string) (*models.GeoIP, error) {
+	m.mu.Lock()
+	m.queried = append(m.queried, ip)
+	m.mu.Unlock()
+
+	return m.GeoAPIMock.Get(ctx, ip)
+}
+
+func TestPostGeoIPBatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		maxSize     int
+		want        []byte
+		code        int
+		wantQueried []string
+	}{
+		{
+			name:        "cache hit and cache misses",
+			body:        `["1.1.1.1","2.2.2.2","3.3.3.3"]`,
+			want:        []byte(`[{"ip":"1.1.1.1","status":"success","geoip":{"ip":"1.1.1.1","family":"ipv4","country_code":"AU","country_name":"Australia","city":"South Brisbane","latitude":-27.4766,"longitude":153.0166}},{"ip":"2.2.2.2","status":"success","geoip":{"ip":"2.2.2.2","family":"ipv4","country_code":"FR","country_name":"France","city":"Paris","latitude":48.8566,"longitude":2.35222}},{"ip":"3.3.3.3","status":"success","geoip":{"ip":"3.3.3.3","family":"ipv4","country_code":"US","country_name":"United States","city":"Chicago","latitude":41.8781,"longitude":-87.6298}}]`),
+			code:        200,
+			wantQueried: []string{"2.2.2.2", "3.3.3.3"},
+		},
+		{
+			name:        "partial failures",
+			body:        `["bla","4.4.4.4","2.2.2.2"]`,
+			want:        []byte(`[{"ip":"bla","status":"error","msg":"the provided ip is not a valid ipv4 or ipv6 address"},{"ip":"4.4.4.4","status":"error","msg":"couldn't get geo ip information"},{"ip":"2.2.2.2","status":"success","geoip":{"ip":"2.2.2.2","family":"ipv4","country_code":"FR","country_name":"France","city":"Paris","latitude":48.8566,"longitude":2.35222}}]`),
+			code:        200,
+			wantQueried: []string{"4.4.4.4", "2.2.2.2"},
+		},
+		{
+			name:        "non globally routable ip addresses",
+			body:        `["192.168.1.1","ff02::1","2.2.2.2"]`,
+			want:        []byte(`[{"ip":"192.168.1.1","status":"error","scope":"private","msg":"the provided ip belongs to a private range"},{"ip":"ff02::1","status":"error","scope":"multicast","msg":"the provided ip belongs to a multicast range"},{"ip":"2.2.2.2","status":"success","geoip":{"ip":"2.2.2.2","family":"ipv4","country_code":"FR","country_name":"France","city":"Paris","latitude":48.8566,"longitude":2.35222}}]`),
+			code:        200,
+			wantQueried: []string{"2.2.2.2"},
+		},
+		{
+			name:        "duplicated ip addresses",
+			body:        `["2.2.2.2","2.2.2.2"]`,
+			want:        []byte(`[{"ip":"2.2.2.2","status":"success","geoip":{"ip":"2.2.2.2","family":"ipv4","country_code":"FR","country_name":"France","city":"Paris","latitude":48.8566,"longitude":2.35222}},{"ip":"2.2.2.2","status":"success","geoip":{"ip":"2.2.2.2","family":"ipv4","country_code":"FR","country_name":"France","city":"Paris","latitude":48.8566,"longitude":2.35222}}]`),
+			code:        200,
+			wantQueried: []string{"2.2.2.2"},
+		},
+		{
+			name:        "different spellings of the same ip address",
+			body:        `["2.2.2.2","::ffff:2.2.2.2"]`,
+			want:        []byte(`[{"ip":"2.2.2.2","status":"success","geoip":{"ip":"2.2.2.2","family":"ipv4","country_code":"FR","country_name":"France","city":"Paris","latitude":48.8566,"longitude":2.35222}},{"ip":"::ffff:2.2.2.2","status":"success","geoip":{"ip":"2.2.2.2","family":"ipv4","country_code":"FR","country_name":"France","city":"Paris","latitude":48.8566,"longitude":2.35222}}]`),
+			code:        200,
+			wantQueried: []string{"2.2.2.2"},
+		},
+		{
+			name: "invalid json",
+			body: `{"ip":"1.1.1.1"}`,
+			want: []byte(`{"status":"error","msg":"the request body must be a json array of ip addresses"}`),
+			code: 400,
+		},
+		{
+			name: "empty batch",
+			body: `[]`,
+			want: []byte(`{"status":"error","msg":"the request body must contain at least one ip address"}`),
+			code: 400,
+		},
+		{
+			name:    "batch too large",
+			body:    `["1.1.1.1","2.2.2.2","3.3.3.3"]`,
+			maxSize: 2,
+			want:    []byte(`{"status":"error","msg":"the batch must not contain more than 2 ip addresses"}`),
+			code:    413,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httprouter.New()
+
+			// db
+			mdb := repositories.NewInMemoryDB()
+			rdb := &RedisMock{}
+			a := &CountingGeoAPIMock{}
+			c := chain.New(&logger)
+			c.Add("in-memory", mdb)
+			c.Add("redis", rdb)
+
+			// route registration
+			h := NewBaseHandler(c, a, &logger)
+			if tt.maxSize > 0 {
+				h.BatchMaxSize = tt.maxSize
+			}
+			r.Handler("POST", "/rest/v1/batch", http.HandlerFunc(h.PostGeoIPBatch))
+
+			req := httptest.NewRequest("POST", "/rest/v1/batch", strings.NewReader(tt.body))
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, req)
+
+			resp := recorder.Result()
+			defer resp.Body.Close()
+
+			data, err := ioutil.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, data)
+			assert.Equal(t, tt.code, resp.StatusCode)
+			assert.ElementsMatch(t, tt.wantQueried, a.queried)
+		})
+	}
+}
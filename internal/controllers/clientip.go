@@ -0,0 +1,194 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+const (
+	// DefaultClientIPHeader is the default header the trusted proxies
+	// set the client address in
+	DefaultClientIPHeader = "X-Forwarded-For"
+)
+
+var (
+	// ErrClientIPNotFound is returned when the ip address of the client
+	// couldn't be derived from the http request
+	ErrClientIPNotFound = errors.New("couldn't determine the client ip address")
+)
+
+// ParseTrustedProxies parses a comma separated list of CIDRs or ip addresses
+// into a list of netip.Prefix.
+// Single ip addresses are considered as /32 (IPv4) or /128 (IPv6) networks.
+func ParseTrustedProxies(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		if strings.Contains(v, "/") {
+			p, err := netip.ParsePrefix(v)
+			if err != nil {
+				return nil, fmt.Errorf("error: invalid trusted proxy cidr %s: %w", v, err)
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+
+		a, err := netip.ParseAddr(v)
+		if err != nil {
+			return nil, fmt.Errorf("error: invalid trusted proxy address %s: %w", v, err)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(a.Unmap(), a.Unmap().BitLen()))
+	}
+
+	return prefixes, nil
+}
+
+// ParseClientIPHeader validates the name of the header the trusted
+// proxies set the client address in, and returns its canonical form.
+// An empty name is DefaultClientIPHeader.
+func ParseClientIPHeader(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return DefaultClientIPHeader, nil
+	}
+
+	for _, c := range s {
+		if !(c == '-' || c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return "", fmt.Errorf("error: invalid client ip header %q, expected a single header name", s)
+		}
+	}
+
+	return http.CanonicalHeaderKey(s), nil
+}
+
+// clientIP derives the ip address of the client which sent the http request.
+//
+// The address is taken from the request remote address. The client ip header, ex: "Forwarded",
+// "X-Forwarded-For" or "X-Real-IP", is only looked at when the remote address belongs to one
+// of the trusted proxies, so clients can't spoof their address. The other headers are
+// never looked at, since the proxy may forward them as sent by the client.
+// Proxy chains are walked from right to left and the first address which isn't
+// a trusted proxy is considered as the client address.
+func (h *BaseHandler) clientIP(r *http.Request) (netip.Addr, error) {
+	remote, err := parseHostAddr(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, ErrClientIPNotFound
+	}
+
+	if !h.isTrustedProxy(remote) {
+		return remote, nil
+	}
+
+	header := h.ClientIPHeader
+	if header == "" {
+		header = DefaultClientIPHeader
+	}
+
+	v := r.Header.Values(header)
+	if len(v) == 0 {
+		return remote, nil
+	}
+
+	switch {
+	case strings.EqualFold(header, "Forwarded"):
+		if a, ok := h.rightmostUntrusted(parseForwarded(v)); ok {
+			return a, nil
+		}
+	case strings.EqualFold(header, "X-Forwarded-For"):
+		if a, ok := h.rightmostUntrusted(parseXForwardedFor(v)); ok {
+			return a, nil
+		}
+	default:
+		if a, err := parseHostAddr(v[len(v)-1]); err == nil {
+			return a, nil
+		}
+	}
+
+	return remote, nil
+}
+
+// isTrustedProxy returns true if the given address belongs to
+// one of the trusted proxies.
+func (h *BaseHandler) isTrustedProxy(a netip.Addr) bool {
+	for _, p := range h.TrustedProxies {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// rightmostUntrusted walks the given proxy chain from right to left and
+// returns the first address which isn't a trusted proxy.
+// If all the addresses are trusted proxies, the leftmost one is returned.
+// It returns false if the chain is empty or contains an invalid address.
+func (h *BaseHandler) rightmostUntrusted(chain []string) (netip.Addr, bool) {
+	var a netip.Addr
+	for i := len(chain) - 1; i >= 0; i-- {
+		var err error
+		a, err = parseHostAddr(chain[i])
+		if err != nil {
+			return netip.Addr{}, false
+		}
+
+		if !h.isTrustedProxy(a) {
+			return a, true
+		}
+	}
+	return a, a.IsValid()
+}
+
+// parseXForwardedFor returns the list of addresses from the
+// "X-Forwarded-For" header values.
+func parseXForwardedFor(values []string) []string {
+	var chain []string
+	for _, v := range values {
+		for _, e := range strings.Split(v, ",") {
+			chain = append(chain, strings.TrimSpace(e))
+		}
+	}
+	return chain
+}
+
+// parseForwarded returns the list of "for" addresses from the
+// "Forwarded" header values as described in RFC 7239.
+func parseForwarded(values []string) []string {
+	var chain []string
+	for _, v := range values {
+		for _, e := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(e, ";") {
+				k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(k, "for") {
+					continue
+				}
+				chain = append(chain, strings.Trim(v, `"`))
+			}
+		}
+	}
+	return chain
+}
+
+// parseHostAddr parses an address with an optional port, such as
+// "192.0.2.1", "192.0.2.1:8080", "2001:db8::1" or "[2001:db8::1]:8080".
+// The zone of IPv6 addresses is dropped and IPv4-mapped IPv6 addresses are unmapped.
+func parseHostAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().WithZone("").Unmap(), nil
+	}
+
+	a, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return a.WithZone("").Unmap(), nil
+}
@@ -0,0 +1,222 @@
+package controllers
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    []netip.Prefix
+		wantErr bool
+	}{
+		{
+			name: "Empty string",
+			s:    "",
+			want: nil,
+		},
+		{
+			name: "Single cidr",
+			s:    "10.0.0.0/8",
+			want: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		},
+		{
+			name: "Cidrs and addresses",
+			s:    "10.0.0.0/8, 192.168.1.1 ,fd00::/8,2001:db8::1",
+			want: []netip.Prefix{
+				netip.MustParsePrefix("10.0.0.0/8"),
+				netip.MustParsePrefix("192.168.1.1/32"),
+				netip.MustParsePrefix("fd00::/8"),
+				netip.MustParsePrefix("2001:db8::1/128"),
+			},
+		},
+		{
+			name: "Non canonical cidr",
+			s:    "10.1.2.3/8",
+			want: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		},
+		{
+			name:    "Invalid cidr",
+			s:       "10.0.0.0/33",
+			wantErr: true,
+		},
+		{
+			name:    "Invalid address",
+			s:       "10.0.0.0,bla",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTrustedProxies(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseTrustedProxies() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseTrustedProxies() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseClientIPHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    string
+		wantErr bool
+	}{
+		{name: "Empty", s: "", want: DefaultClientIPHeader},
+		{name: "Forwarded", s: "Forwarded", want: "Forwarded"},
+		{name: "Canonical form", s: " x-real-ip ", want: "X-Real-Ip"},
+		{name: "Custom header", s: "CF-Connecting-IP", want: "Cf-Connecting-Ip"},
+		{name: "List of headers", s: "Forwarded,X-Forwarded-For", wantErr: true},
+		{name: "Header with a space", s: "X Real IP", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseClientIPHeader(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseClientIPHeader() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("ParseClientIPHeader() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBaseHandlerClientIP(t *testing.T) {
+	trusted, _ := ParseTrustedProxies("10.0.0.0/8,2001:db8::/32")
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		headers    map[string]string
+		want       string
+		wantErr    bool
+	}{
+		{
+			name:       "Remote address only",
+			remoteAddr: "1.1.1.1:1234",
+			want:       "1.1.1.1",
+		},
+		{
+			name:       "Remote address only - IPv6",
+			remoteAddr: "[2606:4700:4700::1111]:1234",
+			want:       "2606:4700:4700::1111",
+		},
+		{
+			name:       "Remote address only - IPv4-mapped IPv6",
+			remoteAddr: "[::ffff:1.1.1.1]:1234",
+			want:       "1.1.1.1",
+		},
+		{
+			name:       "Untrusted proxy - headers are ignored",
+			remoteAddr: "1.1.1.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "2.2.2.2", "X-Real-IP": "3.3.3.3", "Forwarded": "for=3.3.3.3"},
+			want:       "1.1.1.1",
+		},
+		{
+			name:       "Trusted proxy - no header",
+			remoteAddr: "10.0.0.1:1234",
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "Trusted proxy - X-Forwarded-For",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "2.2.2.2"},
+			want:       "2.2.2.2",
+		},
+		{
+			name:       "Trusted proxy - X-Forwarded-For with chain of proxies",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "3.3.3.3, 2.2.2.2, 10.0.0.2"},
+			want:       "2.2.2.2",
+		},
+		{
+			name:       "Trusted proxy - X-Forwarded-For with only trusted proxies",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"},
+			want:       "10.0.0.3",
+		},
+		{
+			name:       "Trusted proxy - invalid X-Forwarded-For - fallback to remote address",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "bla", "X-Real-IP": "3.3.3.3"},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "Trusted proxy - only the client ip header is read",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"Forwarded": "for=1.1.1.1", "X-Real-IP": "3.3.3.3"},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "Trusted proxy - X-Real-IP",
+			remoteAddr: "10.0.0.1:1234",
+			header:     "X-Real-IP",
+			headers:    map[string]string{"X-Real-IP": "3.3.3.3", "X-Forwarded-For": "2.2.2.2"},
+			want:       "3.3.3.3",
+		},
+		{
+			name:       "Trusted proxy - invalid X-Real-IP - fallback to remote address",
+			remoteAddr: "10.0.0.1:1234",
+			header:     "X-Real-IP",
+			headers:    map[string]string{"X-Real-IP": "3.3.3.3, 2.2.2.2"},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "Trusted proxy - Forwarded",
+			remoteAddr: "[2001:db8::1]:1234",
+			header:     "Forwarded",
+			headers:    map[string]string{"Forwarded": `for=1.1.1.1;proto=https, For="[2606:4700:4700::1111]:4711";by=10.0.0.2`},
+			want:       "2606:4700:4700::1111",
+		},
+		{
+			name:       "Trusted proxy - Forwarded spoofed by the client is ignored",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"Forwarded": "for=1.1.1.1", "X-Forwarded-For": "2.2.2.2"},
+			want:       "2.2.2.2",
+		},
+		{
+			name:       "Trusted proxy - obfuscated Forwarded - fallback to remote address",
+			remoteAddr: "10.0.0.1:1234",
+			header:     "forwarded",
+			headers:    map[string]string{"Forwarded": "for=_hidden", "X-Forwarded-For": "2.2.2.2"},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "Invalid remote address",
+			remoteAddr: "bla",
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &BaseHandler{TrustedProxies: trusted, ClientIPHeader: tt.header}
+			req := httptest.NewRequest("GET", "/rest/v1/me", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+
+			got, err := h.clientIP(req)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("BaseHandler.clientIP() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && got.String() != tt.want {
+				t.Errorf("BaseHandler.clientIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,7 +2,12 @@ package controllers
 
 import (
 	"encoding/json"
+	"errors"
+	"math"
 	"net/http"
+	"strconv"
+
+	"github.com/lescactus/geolocation-go/internal/api"
 )
 
 // ErrorResponse represents the json response
@@ -44,9 +49,56 @@ func (h *BaseHandler) MethodNotAllowedHandler(w http.ResponseWriter, r *http.Req
 }
 
 // HandleOPTIONS is the custom http handler for OPTIONS requests.
-// It respond to the client with a 200 status code and set the
-// "Allow" http header.
+// It respond to the client with a 200 status code. The "Allow" http header
+// is set by the router from the methods registered for the path,
+// and defaults to "GET, OPTIONS".
 func (h *BaseHandler) OptionsHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Allow", "GET, OPTIONS")
+	if w.Header().Get("Allow") == "" {
+		w.Header().Set("Allow", "GET, OPTIONS")
+	}
 	w.WriteHeader(http.StatusOK)
 }
+
+// writeError will write an ErrorResponse with the given status code and message.
+func (h *BaseHandler) writeError(w http.ResponseWriter, code int, msg string) {
+	e := NewErrorResponse(msg)
+	resp, _ := json.Marshal(e)
+	w.Header().Set("Content-Type", ContentTypeApplicationJSON)
+	w.WriteHeader(code)
+	w.Write(resp)
+}
+
+// lookupErrorResponse maps an error returned while looking up the
+// GeoIP information of an ip address to an http status code and a
+// message intended to the client.
+// Errors caused by the ip address itself are mapped to 4xx status codes
+// and an exhausted quota of the geolocation api to a 503 status code.
+func lookupErrorResponse(err error) (int, string) {
+	switch {
+	case errors.Is(err, api.ErrPrivateRange):
+		return http.StatusUnprocessableEntity, "the provided ip belongs to a private range"
+	case errors.Is(err, api.ErrReservedRange):
+		return http.StatusUnprocessableEntity, "the provided ip belongs to a reserved range"
+	case errors.Is(err, api.ErrInvalidQuery):
+		return http.StatusBadRequest, "the provided ip has been rejected by the geolocation api"
+	case errors.Is(err, api.ErrQuotaExhausted):
+		return http.StatusServiceUnavailable, "the geolocation api quota is exhausted, retry later"
+	default:
+		return http.StatusInternalServerError, ErrGeoIPNotFound.Error()
+	}
+}
+
+// setRetryAfter sets the "Retry-After" http header, in seconds, when
+// the error is caused by the exhausted quota of the geolocation api.
+func setRetryAfter(w http.ResponseWriter, err error) {
+	var quotaErr *api.QuotaError
+	if !errors.As(err, &quotaErr) {
+		return
+	}
+
+	seconds := int(math.Ceil(quotaErr.RetryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
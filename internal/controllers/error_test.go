@@ -1,13 +1,17 @@
 package controllers
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/lescactus/geolocation-go/internal/api"
 	"github.com/lescactus/geolocation-go/internal/chain"
 	"github.com/lescactus/geolocation-go/internal/repositories"
 	"github.com/stretchr/testify/assert"
@@ -42,6 +46,73 @@ func TestNewErrorResponse(t *testing.T) {
 	}
 }
 
+func TestLookupErrorResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantCode int
+		wantMsg  string
+	}{
+		{
+			name:     "private range",
+			err:      fmt.Errorf("%w: %w", ErrGeoIPNotFound, api.ErrPrivateRange),
+			wantCode: http.StatusUnprocessableEntity,
+			wantMsg:  "the provided ip belongs to a private range",
+		},
+		{
+			name:     "reserved range",
+			err:      fmt.Errorf("%w: %w", ErrGeoIPNotFound, api.ErrReservedRange),
+			wantCode: http.StatusUnprocessableEntity,
+			wantMsg:  "the provided ip belongs to a reserved range",
+		},
+		{
+			name:     "invalid query",
+			err:      fmt.Errorf("%w: %w", ErrGeoIPNotFound, api.ErrInvalidQuery),
+			wantCode: http.StatusBadRequest,
+			wantMsg:  "the provided ip has been rejected by the geolocation api",
+		},
+		{
+			name:     "quota exhausted",
+			err:      fmt.Errorf("%w: %w", ErrGeoIPNotFound, &api.QuotaError{RetryAfter: time.Minute}),
+			wantCode: http.StatusServiceUnavailable,
+			wantMsg:  "the geolocation api quota is exhausted, retry later",
+		},
+		{
+			name:     "other error",
+			err:      fmt.Errorf("%w: %w", ErrGeoIPNotFound, errors.New("timeout")),
+			wantCode: http.StatusInternalServerError,
+			wantMsg:  "couldn't get geo ip information",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, msg := lookupErrorResponse(tt.err)
+			assert.Equal(t, tt.wantCode, code)
+			assert.Equal(t, tt.wantMsg, msg)
+		})
+	}
+}
+
+func TestSetRetryAfter(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "quota exhausted", err: fmt.Errorf("%w: %w", ErrGeoIPNotFound, &api.QuotaError{RetryAfter: 42 * time.Second}), want: "42"},
+		{name: "quota exhausted - rounded up", err: &api.QuotaError{RetryAfter: 1500 * time.Millisecond}, want: "2"},
+		{name: "quota exhausted - at least one second", err: &api.QuotaError{}, want: "1"},
+		{name: "other error", err: errors.New("timeout"), want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			setRetryAfter(recorder, tt.err)
+			assert.Equal(t, tt.want, recorder.Header().Get("Retry-After"))
+		})
+	}
+}
+
 func TestBaseHandlerNotFoundHandler(t *testing.T) {
 	tests := []struct {
 		name string
@@ -111,7 +182,7 @@ func TestBaseHandlerMethodNotAllowedHandler(t *testing.T) {
 		{
 			name:   "valid method",
 			method: "GET",
-			want:   []byte(`{"ip":"1.1.1.1","country_code":"AU","country_name":"Australia","city":"South Brisbane","latitude":-27.4766,"longitude":153.0166}`),
+			want:   []byte(`{"ip":"1.1.1.1","family":"ipv4","country_code":"AU","country_name":"Australia","city":"South Brisbane","latitude":-27.4766,"longitude":153.0166}`),
 			code:   http.StatusOK,
 		},
 	}
@@ -147,3 +218,57 @@ func TestBaseHandlerMethodNotAllowedHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestBaseHandlerOptionsHandler(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{
+			name: "lookup and admin routes",
+			path: "/rest/v1/1.1.1.1",
+			want: "DELETE, GET, OPTIONS, PUT",
+		},
+		{
+			name: "batch route",
+			path: "/rest/v1/batch",
+			want: "DELETE, GET, OPTIONS, POST, PUT",
+		},
+		{
+			name: "health route",
+			path: "/ready",
+			want: "GET, OPTIONS",
+		},
+	}
+
+	h := NewBaseHandler(chain.New(&logger), &GeoAPIMock{}, &logger)
+
+	// route registration
+	r := httprouter.New()
+	r.Handler("GET", "/rest/v1/:ip", http.HandlerFunc(h.GetGeoIP))
+	r.Handler("POST", "/rest/v1/batch", http.HandlerFunc(h.PostGeoIPBatch))
+	r.Handler("DELETE", "/rest/v1/:ip", http.HandlerFunc(h.DeleteGeoIP))
+	r.Handler("PUT", "/rest/v1/:ip", http.HandlerFunc(h.PutGeoIP))
+	r.Handler("GET", "/ready", http.HandlerFunc(h.Healthz))
+	r.GlobalOPTIONS = http.HandlerFunc(h.OptionsHandler)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("OPTIONS", tt.path, nil)
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, req)
+
+			assert.Equal(t, http.StatusOK, recorder.Code)
+			assert.Equal(t, tt.want, recorder.Header().Get("Allow"))
+		})
+	}
+
+	t.Run("without router", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		h.OptionsHandler(recorder, httptest.NewRequest("OPTIONS", "/rest/v1/1.1.1.1", nil))
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "GET, OPTIONS", recorder.Header().Get("Allow"))
+	})
+}
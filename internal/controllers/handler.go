@@ -1,17 +1,52 @@
 package controllers
 
 import (
+	"net/netip"
+
 	"github.com/lescactus/geolocation-go/internal/api"
 	"github.com/lescactus/geolocation-go/internal/chain"
+	"github.com/lescactus/geolocation-go/internal/overrides"
 	"github.com/rs/zerolog"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// DefaultBatchMaxSize is the default maximum number of ip addresses
+	// accepted by the batch endpoint
+	DefaultBatchMaxSize = 100
 )
 
 type BaseHandler struct {
-	CacheChain  *chain.Chain
-	RemoteIPAPI api.GeoAPI
-	Logger      *zerolog.Logger
+	CacheChain   *chain.Chain
+	RemoteIPAPI  api.GeoAPI
+	Logger       *zerolog.Logger
+	BatchMaxSize int
+
+	// TrustedProxies is the list of networks allowed to set the
+	// client address through the ClientIPHeader header
+	TrustedProxies []netip.Prefix
+
+	// ClientIPHeader is the header the trusted proxies set the client
+	// address in. DefaultClientIPHeader if empty.
+	ClientIPHeader string
+
+	// Overrides provides operator-defined locations taking precedence
+	// over the cache chain and the remote GeoIP API. Optional.
+	Overrides *overrides.Overrides
+
+	// AdminToken is the bearer token required by the admin endpoints.
+	// They reject all the requests when empty.
+	AdminToken string
+
+	// Invalidator notifies the other replicas of the entries
+	// deleted or replaced through the admin endpoints. Optional.
+	Invalidator Invalidator
+
+	// flights coalesces the concurrent remote GeoIP API
+	// queries for the same ip address
+	flights singleflight.Group
 }
 
 func NewBaseHandler(chain *chain.Chain, remoteIPAPI api.GeoAPI, logger *zerolog.Logger) *BaseHandler {
-	return &BaseHandler{CacheChain: chain, RemoteIPAPI: remoteIPAPI, Logger: logger}
+	return &BaseHandler{CacheChain: chain, RemoteIPAPI: remoteIPAPI, Logger: logger, BatchMaxSize: DefaultBatchMaxSize}
 }
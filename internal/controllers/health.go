@@ -4,7 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"net/http"
+	"sync"
 	"time"
+
+	"github.com/lescactus/geolocation-go/internal/api"
 )
 
 const (
@@ -18,8 +21,9 @@ const (
 // HealthzResponse represents the json response of a health endpoint.
 // It provides the status of the app dependencies.
 type HealthzResponse struct {
-	Status string             `json:"global_status"`
-	Checks []CacheHealthCheck `json:"checks"`
+	Status   string               `json:"global_status"`
+	Checks   []CacheHealthCheck   `json:"checks"`
+	Provider *ProviderHealthCheck `json:"provider,omitempty"`
 }
 
 // CacheHealthCheck represents the health status of a cache.
@@ -29,6 +33,40 @@ type CacheHealthCheck struct {
 	CacheStatusMsg string `json:"msg"`
 }
 
+// ProviderHealthCheck represents the health status of the GeoIP API.
+// It is only provided for the GeoIP API implementing api.Reporter
+// with a non empty report.
+type ProviderHealthCheck struct {
+	Status string `json:"status"`
+	Msg    string `json:"msg"`
+}
+
+// newProviderCheck returns the health status of the GeoIP API
+// or nil if it doesn't implement api.Reporter or has nothing to report.
+func newProviderCheck(ctx context.Context, a api.GeoAPI) *ProviderHealthCheck {
+	reporter, ok := a.(api.Reporter)
+	if !ok {
+		return nil
+	}
+
+	report := reporter.Report()
+	if report == "" {
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	ch := make(chan error, 1)
+	wg.Add(1)
+	a.Status(ctx, &wg, ch)
+	wg.Wait()
+
+	if err := <-ch; err != nil {
+		return &ProviderHealthCheck{Status: HealthzKO, Msg: err.Error()}
+	}
+
+	return &ProviderHealthCheck{Status: HealthzOK, Msg: report}
+}
+
 // newChecks convert a map of [string]error to a []HealthCheck
 func newChecks(m map[string]error) []CacheHealthCheck {
 	if len(m) <= 0 {
@@ -63,23 +101,26 @@ func newChecks(m map[string]error) []CacheHealthCheck {
 
 // Healthz provide a handler used for health checks.
 // It will verify the status of all the cache registries in the cache chain
+// and the status of the GeoIP API when it can report it,
 // and will always answer with a 200 http status code with a HealthzResponse.
 func (h *BaseHandler) Healthz(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
 	defer cancel()
 
 	errors := h.CacheChain.Statuses(ctx)
+	provider := newProviderCheck(ctx, h.RemoteIPAPI)
 
 	var status string
-	if hasErrors(errors) {
+	if hasErrors(errors) || (provider != nil && provider.Status == HealthzKO) {
 		status = HealthzKO
 	} else {
 		status = HealthzOK
 	}
 
 	health := HealthzResponse{
-		Status: status,
-		Checks: newChecks(errors),
+		Status:   status,
+		Checks:   newChecks(errors),
+		Provider: provider,
 	}
 
 	resp, err := json.Marshal(&health)
@@ -1,8 +1,13 @@
 package controllers
 
 import (
+	"context"
 	"errors"
+	"reflect"
+	"sync"
 	"testing"
+
+	"github.com/lescactus/geolocation-go/internal/api"
 )
 
 func TestHasErrors(t *testing.T) {
@@ -192,3 +197,55 @@ func TestNewChecks(t *testing.T) {
 		})
 	}
 }
+
+// ReporterGeoAPIMock is a GeoAPI implementing api.Reporter
+type ReporterGeoAPIMock struct {
+	GeoAPIMock
+	err    error
+	report string
+}
+
+func (m *ReporterGeoAPIMock) Status(ctx context.Context, wg *sync.WaitGroup, ch chan error) {
+	defer wg.Done()
+	ch <- m.err
+}
+
+func (m *ReporterGeoAPIMock) Report() string {
+	return m.report
+}
+
+func TestNewProviderCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		api  api.GeoAPI
+		want *ProviderHealthCheck
+	}{
+		{
+			name: "Not a reporter",
+			api:  &GeoAPIMock{},
+			want: nil,
+		},
+		{
+			name: "Reporter - empty report",
+			api:  &ReporterGeoAPIMock{},
+			want: nil,
+		},
+		{
+			name: "Reporter - healthy",
+			api:  &ReporterGeoAPIMock{report: "build date 2024-01-01T00:00:00Z, 2 records"},
+			want: &ProviderHealthCheck{Status: HealthzOK, Msg: "build date 2024-01-01T00:00:00Z, 2 records"},
+		},
+		{
+			name: "Reporter - unhealthy",
+			api:  &ReporterGeoAPIMock{report: "database not loaded", err: errors.New("database not loaded")},
+			want: &ProviderHealthCheck{Status: HealthzKO, Msg: "database not loaded"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newProviderCheck(context.Background(), tt.api); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("newProviderCheck() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
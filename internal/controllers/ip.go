@@ -3,70 +3,135 @@ package controllers
 import (
 	"context"
 	"encoding/json"
-	"net"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/netip"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/lescactus/geolocation-go/internal/classifier"
 	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/rs/zerolog/hlog"
 )
 
 const (
 	// ContentTypeApplicationJSON represent the applcation/json Content-Type value
 	ContentTypeApplicationJSON = "application/json"
+
+	// MeRouteParam is the route parameter used to lookup the GeoIP
+	// information of the client itself: "/rest/v1/me"
+	MeRouteParam = "me"
+)
+
+// Prometheus metrics
+var (
+	classifiedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "geoip_classified_requests_total",
+		Help: "Total number of requests for non globally routable ip addresses answered without any lookup, by scope",
+	}, []string{"scope"})
+	coalescedRequests = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "geoip_coalesced_requests_total",
+		Help: "Total number of cache misses answered by the in-flight remote GeoIP API query of the same ip address",
+	})
+)
+
+var (
+	// ErrInvalidIP is returned when the provided ip is neither a valid IPv4
+	// nor a valid IPv6 address
+	ErrInvalidIP = errors.New("the provided ip is not a valid ipv4 or ipv6 address")
+
+	// ErrGeoIPNotFound is returned when the geo ip information couldn't be retrieved
+	// neither from the cache chain nor from the remote GeoIP API
+	ErrGeoIPNotFound = errors.New("couldn't get geo ip information")
 )
 
+// ScopeResponse represents the json response for the ip addresses
+// which can't be geolocated because they aren't globally routable.
+type ScopeResponse struct {
+	IP     string `json:"ip"`
+	Family string `json:"family"`
+	Scope  string `json:"scope"`
+}
+
+// ScopeError is returned when the ip address can't be geolocated
+// because it isn't globally routable.
+type ScopeError struct {
+	Scope classifier.Scope
+}
+
+func (err *ScopeError) Error() string {
+	return fmt.Sprintf("the provided ip belongs to a %s range", err.Scope)
+}
+
 // GetGeoIP is the main handler.
-// It will parse the route variable to ensure it is a valid IPv4 address
+// It will parse the route variable to ensure it is a valid IPv4 or IPv6 address
 // before getting the GeoIP information for the given address.
 // It will take care of updating the caches if necessary.
 func (h *BaseHandler) GetGeoIP(w http.ResponseWriter, r *http.Request) {
 	// Get request id for logging purposes
 	req_id, _ := hlog.IDFromCtx(r.Context())
 
-	var ctx = r.Context()
-
-	// Get ip from URL and parse it to a net.IP
-	params := httprouter.ParamsFromContext(ctx)
+	// Get ip from URL
+	params := httprouter.ParamsFromContext(r.Context())
 	ip := params.ByName("ip")
-	if !isIpv4(ip) {
-		h.Logger.Error().Str("req_id", req_id.String()).Msg("the provided ip is not a valid ipv4 address")
 
-		e := NewErrorResponse("the provided ip is not a valid ipv4 address")
-		resp, _ := json.Marshal(e)
-		w.Header().Set("Content-Type", ContentTypeApplicationJSON)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write(resp)
+	// httprouter doesn't allow a static route segment to live next
+	// to a named parameter, hence "/rest/v1/me" is dispatched from here
+	if ip == MeRouteParam {
+		h.GetClientGeoIP(w, r)
+		return
+	}
 
+	// Parse ip to its canonical form
+	addr, err := parseIP(ip)
+	if err != nil {
+		h.Logger.Error().Str("req_id", req_id.String()).Msg(err.Error())
+		h.writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	var g *models.GeoIP
-	var err error
+	h.serveGeoIP(w, r, addr)
+}
 
-	// Lookup in the cache chain for the GeoIP matching the provided ip
-	g, err = h.CacheChain.Get(ctx, ip)
+// GetClientGeoIP is the handler returning the GeoIP information of
+// the client which sent the request.
+// The client ip address is derived from the request remote address, or from the
+// ClientIPHeader header if the request comes from a trusted proxy.
+func (h *BaseHandler) GetClientGeoIP(w http.ResponseWriter, r *http.Request) {
+	// Get request id for logging purposes
+	req_id, _ := hlog.IDFromCtx(r.Context())
+
+	addr, err := h.clientIP(r)
 	if err != nil {
-		h.Logger.Debug().Str("req_id", req_id.String()).Msgf("cache miss from the cache chain: %s", err.Error())
+		h.Logger.Error().Str("req_id", req_id.String()).Msg(err.Error())
+		h.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.serveGeoIP(w, r, addr)
+}
 
-		// Query the remote GeoIP API to retrieve IP information
-		g, err = h.RemoteIPAPI.Get(ctx, ip)
-		if err != nil {
-			h.Logger.Debug().Str("req_id", req_id.String()).Msg("couldn't retrieve geo IP information")
+// serveGeoIP will answer with the GeoIP information of the given address.
+func (h *BaseHandler) serveGeoIP(w http.ResponseWriter, r *http.Request, addr netip.Addr) {
+	// Get request id for logging purposes
+	req_id, _ := hlog.IDFromCtx(r.Context())
 
-			e := NewErrorResponse("couldn't get geo ip information")
-			resp, _ := json.Marshal(e)
-			w.Header().Set("Content-Type", ContentTypeApplicationJSON)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write(resp)
+	var ctx = r.Context()
 
+	g, err := h.lookup(ctx, addr)
+	if err != nil {
+		var scopeErr *ScopeError
+		if errors.As(err, &scopeErr) {
+			h.writeScope(w, addr, scopeErr.Scope)
 			return
 		}
 
-		// Update all the caches from the chain with the GeoIP
-		// Make a new context to be used in the cache save method
-		savectx := hlog.CtxWithID(context.Background(), req_id)
-		go h.CacheChain.SaveInAllCaches(savectx, g)
+		code, msg := lookupErrorResponse(err)
+		setRetryAfter(w, err)
+		h.writeError(w, code, msg)
+		return
 	}
 
 	// Marshal the response in json format
@@ -85,8 +150,141 @@ func (h *BaseHandler) GetGeoIP(w http.ResponseWriter, r *http.Request) {
 	w.Write(resp)
 }
 
-// isIpv4 verify the given string is a valid IPv4 address.
-// Return true if yes, false otherwise
-func isIpv4(host string) bool {
-	return net.ParseIP(host) != nil
+// writeScope will answer with a ScopeResponse for addresses which
+// aren't globally routable.
+func (h *BaseHandler) writeScope(w http.ResponseWriter, addr netip.Addr, scope classifier.Scope) {
+	s := ScopeResponse{
+		IP:     addr.String(),
+		Family: models.Family(addr),
+		Scope:  string(scope),
+	}
+	resp, _ := json.Marshal(s)
+	w.Header().Set("Content-Type", ContentTypeApplicationJSON)
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	w.Write(resp)
+}
+
+// lookup will retrieve the GeoIP information of the given address.
+// Operator-defined overrides take precedence over any other source.
+// Addresses which aren't globally routable (private, loopback, multicast, ...)
+// are answered right away with a *ScopeError.
+// Otherwise the cache chain is queried first and in case of cache miss, the
+// remote GeoIP API is queried, once for all the concurrent cache misses of
+// the same address. All the caches from the chain are then updated
+// asynchronously.
+//
+// The address must be in its canonical form, as returned by parseIP(),
+// since its string representation is used as the cache key.
+func (h *BaseHandler) lookup(ctx context.Context, addr netip.Addr) (*models.GeoIP, error) {
+	// Get request id for logging purposes
+	req_id, _ := hlog.IDFromCtx(ctx)
+
+	ip := addr.String()
+
+	// Overrides are looked up first so operators can also
+	// locate their private networks
+	if g, ok := h.Overrides.Lookup(addr); ok {
+		h.Logger.Debug().Str("req_id", req_id.String()).Msgf("%s is overridden", ip)
+		return g, nil
+	}
+
+	// Don't query the caches nor the remote GeoIP API
+	// for addresses which can't be geolocated
+	if scope := classifier.Classify(addr); scope != classifier.ScopeGlobal {
+		h.Logger.Debug().Str("req_id", req_id.String()).Msgf("%s belongs to a %s range", ip, scope)
+
+		// Increment Prometheus counter
+		classifiedRequests.WithLabelValues(string(scope)).Inc()
+
+		return nil, &ScopeError{Scope: scope}
+	}
+
+	// Lookup in the cache chain for the GeoIP matching the provided ip
+	g, err := h.CacheChain.Get(ctx, ip)
+	if err == nil {
+		return withFamily(g, addr), nil
+	}
+	h.Logger.Debug().Str("req_id", req_id.String()).Msgf("cache miss from the cache chain: %s", err.Error())
+
+	// Concurrent cache misses for the same ip address wait for a single
+	// query to the remote GeoIP API. The query isn't bound to the
+	// cancellation of the request which started it, as other requests
+	// may be waiting for it.
+	leader := false
+	ch := h.flights.DoChan(ip, func() (interface{}, error) {
+		leader = true
+		return h.fetch(context.WithoutCancel(ctx), addr)
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%w: %w", ErrGeoIPNotFound, ctx.Err())
+	case res := <-ch:
+		if !leader {
+			// Increment Prometheus counter
+			coalescedRequests.Inc()
+
+			h.Logger.Debug().Str("req_id", req_id.String()).Msgf("%s answered by an in-flight query", ip)
+		}
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*models.GeoIP), nil
+	}
+}
+
+// fetch will query the remote GeoIP API to retrieve the GeoIP information
+// of the given address, and update all the caches from the chain asynchronously.
+func (h *BaseHandler) fetch(ctx context.Context, addr netip.Addr) (*models.GeoIP, error) {
+	// Get request id for logging purposes
+	req_id, _ := hlog.IDFromCtx(ctx)
+
+	ip := addr.String()
+
+	// Query the remote GeoIP API to retrieve IP information
+	// Errors caused by the ip address itself (private or reserved range, invalid query)
+	// are not cached since the remote GeoIP API didn't return any information.
+	g, err := h.RemoteIPAPI.Get(ctx, ip)
+	if err != nil {
+		h.Logger.Debug().Str("req_id", req_id.String()).Err(err).Msg("couldn't retrieve geo IP information")
+		return nil, fmt.Errorf("%w: %w", ErrGeoIPNotFound, err)
+	}
+	g = withFamily(g, addr)
+
+	// Update all the caches from the chain with the GeoIP, asynchronously
+	// Make a new context to be used in the cache save method
+	savectx := hlog.CtxWithID(context.Background(), req_id)
+	h.CacheChain.SaveInAllCaches(savectx, g)
+
+	return g, nil
+}
+
+// parseIP verify the given string is a valid IPv4 or IPv6 address
+// and returns it in its canonical form, so every spelling of
+// the same address maps to the same cache key:
+//
+//   - IPv4-mapped IPv6 addresses (ex: "::ffff:1.2.3.4") are unmapped to IPv4
+//   - IPv6 addresses are compressed and lowercased (ex: "2001:DB8:0::1" => "2001:db8::1")
+//
+// IPv6 addresses with a zone (ex: "fe80::1%eth0") are rejected.
+func parseIP(host string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(host)
+	if err != nil || addr.Zone() != "" {
+		return netip.Addr{}, ErrInvalidIP
+	}
+
+	return addr.Unmap(), nil
+}
+
+// withFamily returns g with its address family set according to addr.
+// g is copied rather than modified since it may be shared with a cache.
+func withFamily(g *models.GeoIP, addr netip.Addr) *models.GeoIP {
+	family := models.Family(addr)
+	if g.Family == family {
+		return g
+	}
+
+	c := *g
+	c.Family = family
+	return &c
 }
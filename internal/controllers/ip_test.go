@@ -7,13 +7,18 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"os"
+	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/lescactus/geolocation-go/internal/api"
 	"github.com/lescactus/geolocation-go/internal/chain"
 	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/lescactus/geolocation-go/internal/overrides"
 	"github.com/lescactus/geolocation-go/internal/repositories"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
@@ -44,6 +49,14 @@ var (
 		Latitude:    41.8781,
 		Longitude:   -87.6298,
 	}
+	OneOneOneOneIPv6 = models.GeoIP{
+		IP:          "2606:4700:4700::1111",
+		CountryCode: "US",
+		CountryName: "United States",
+		City:        "San Francisco",
+		Latitude:    37.7749,
+		Longitude:   -122.4194,
+	}
 	muxRoute = "/ip/:ip"
 
 	logger = zerolog.New(os.Stdout).Level(zerolog.NoLevel)
@@ -80,6 +93,16 @@ func (m *GeoAPIMock) Get(ctx context.Context, ip string) (*models.GeoIP, error)
 		return &TwoTwoTwoTwo, nil
 	case "3.3.3.3":
 		return &ThreeThreeThree, nil
+	case "2606:4700:4700::1111":
+		return &OneOneOneOneIPv6, nil
+	case "5.5.5.5":
+		return nil, fmt.Errorf("error: query failed: %w", api.ErrPrivateRange)
+	case "6.6.6.6":
+		return nil, fmt.Errorf("error: query failed: %w", api.ErrReservedRange)
+	case "7.7.7.7":
+		return nil, fmt.Errorf("error: query failed: %w", api.ErrInvalidQuery)
+	case "8.8.8.8":
+		return nil, fmt.Errorf("error: query failed: %w", &api.QuotaError{RetryAfter: 1500 * time.Millisecond})
 	default:
 		return nil, fmt.Errorf("error: error while fetch geo information for %s", ip)
 	}
@@ -97,19 +120,19 @@ func TestGetGeoIP(t *testing.T) {
 		{
 			name: "valid path - /rest/v1/1.1.1.1",
 			path: "/rest/v1/1.1.1.1",
-			want: []byte(`{"ip":"1.1.1.1","country_code":"AU","country_name":"Australia","city":"South Brisbane","latitude":-27.4766,"longitude":153.0166}`),
+			want: []byte(`{"ip":"1.1.1.1","family":"ipv4","country_code":"AU","country_name":"Australia","city":"South Brisbane","latitude":-27.4766,"longitude":153.0166}`),
 			code: 200,
 		},
 		{
 			name: "valid path - /rest/v1/2.2.2.2",
 			path: "/rest/v1/2.2.2.2",
-			want: []byte(`{"ip":"2.2.2.2","country_code":"FR","country_name":"France","city":"Paris","latitude":48.8566,"longitude":2.35222}`),
+			want: []byte(`{"ip":"2.2.2.2","family":"ipv4","country_code":"FR","country_name":"France","city":"Paris","latitude":48.8566,"longitude":2.35222}`),
 			code: 200,
 		},
 		{
 			name: "valid path - /rest/v1/3.3.3.3",
 			path: "/rest/v1/3.3.3.3",
-			want: []byte(`{"ip":"3.3.3.3","country_code":"US","country_name":"United States","city":"Chicago","latitude":41.8781,"longitude":-87.6298}`),
+			want: []byte(`{"ip":"3.3.3.3","family":"ipv4","country_code":"US","country_name":"United States","city":"Chicago","latitude":41.8781,"longitude":-87.6298}`),
 			code: 200,
 		},
 		{
@@ -118,10 +141,82 @@ func TestGetGeoIP(t *testing.T) {
 			want: []byte(`{"status":"error","msg":"couldn't get geo ip information"}`),
 			code: 500,
 		},
+		{
+			name: "valid path - IPv6 - /rest/v1/2606:4700:4700::1111",
+			path: "/rest/v1/2606:4700:4700::1111",
+			want: []byte(`{"ip":"2606:4700:4700::1111","family":"ipv6","country_code":"US","country_name":"United States","city":"San Francisco","latitude":37.7749,"longitude":-122.4194}`),
+			code: 200,
+		},
+		{
+			name: "valid path - non canonical IPv6 - /rest/v1/2606:4700:4700:0:0:0:0:1111",
+			path: "/rest/v1/2606:4700:4700:0:0:0:0:1111",
+			want: []byte(`{"ip":"2606:4700:4700::1111","family":"ipv6","country_code":"US","country_name":"United States","city":"San Francisco","latitude":37.7749,"longitude":-122.4194}`),
+			code: 200,
+		},
+		{
+			name: "valid path - IPv4-mapped IPv6 - /rest/v1/::ffff:2.2.2.2",
+			path: "/rest/v1/::ffff:2.2.2.2",
+			want: []byte(`{"ip":"2.2.2.2","family":"ipv4","country_code":"FR","country_name":"France","city":"Paris","latitude":48.8566,"longitude":2.35222}`),
+			code: 200,
+		},
+		{
+			name: "private scope - /rest/v1/10.0.0.1",
+			path: "/rest/v1/10.0.0.1",
+			want: []byte(`{"ip":"10.0.0.1","family":"ipv4","scope":"private"}`),
+			code: 422,
+		},
+		{
+			name: "cgnat scope - /rest/v1/100.64.0.1",
+			path: "/rest/v1/100.64.0.1",
+			want: []byte(`{"ip":"100.64.0.1","family":"ipv4","scope":"cgnat"}`),
+			code: 422,
+		},
+		{
+			name: "loopback scope - IPv6 - /rest/v1/::1",
+			path: "/rest/v1/::1",
+			want: []byte(`{"ip":"::1","family":"ipv6","scope":"loopback"}`),
+			code: 422,
+		},
+		{
+			name: "loopback scope - IPv4-mapped IPv6 - /rest/v1/::ffff:127.0.0.1",
+			path: "/rest/v1/::ffff:127.0.0.1",
+			want: []byte(`{"ip":"127.0.0.1","family":"ipv4","scope":"loopback"}`),
+			code: 422,
+		},
+		{
+			name: "private range - /rest/v1/5.5.5.5",
+			path: "/rest/v1/5.5.5.5",
+			want: []byte(`{"status":"error","msg":"the provided ip belongs to a private range"}`),
+			code: 422,
+		},
+		{
+			name: "reserved range - /rest/v1/6.6.6.6",
+			path: "/rest/v1/6.6.6.6",
+			want: []byte(`{"status":"error","msg":"the provided ip belongs to a reserved range"}`),
+			code: 422,
+		},
+		{
+			name: "invalid query - /rest/v1/7.7.7.7",
+			path: "/rest/v1/7.7.7.7",
+			want: []byte(`{"status":"error","msg":"the provided ip has been rejected by the geolocation api"}`),
+			code: 400,
+		},
+		{
+			name: "quota exhausted - /rest/v1/8.8.8.8",
+			path: "/rest/v1/8.8.8.8",
+			want: []byte(`{"status":"error","msg":"the geolocation api quota is exhausted, retry later"}`),
+			code: 503,
+		},
+		{
+			name: "invalid path - IPv6 with zone - /rest/v1/fe80::1%25eth0",
+			path: "/rest/v1/fe80::1%25eth0",
+			want: []byte(`{"status":"error","msg":"the provided ip is not a valid ipv4 or ipv6 address"}`),
+			code: 400,
+		},
 		{
 			name: "invalid path - /rest/v1/bla",
 			path: "/rest/v1/bla",
-			want: []byte(`{"status":"error","msg":"the provided ip is not a valid ipv4 address"}`),
+			want: []byte(`{"status":"error","msg":"the provided ip is not a valid ipv4 or ipv6 address"}`),
 			code: 400,
 		},
 	}
@@ -155,6 +250,243 @@ func TestGetGeoIP(t *testing.T) {
 			assert.Equal(t, tt.code, resp.StatusCode)
 		})
 	}
+
+	t.Run("failed queries are not cached", func(t *testing.T) {
+		for _, ip := range []string{"5.5.5.5", "6.6.6.6", "7.7.7.7", "8.8.8.8"} {
+			_, err := mdb.Get(context.Background(), ip)
+			assert.Error(t, err)
+		}
+	})
+
+	t.Run("quota exhausted - Retry-After header", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/rest/v1/8.8.8.8", nil)
+		recorder := httptest.NewRecorder()
+		r.ServeHTTP(recorder, req)
+
+		assert.Equal(t, "2", recorder.Result().Header.Get("Retry-After"))
+	})
+}
+
+func TestGetGeoIPWithOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overrides.csv")
+	err := os.WriteFile(path, []byte("10.0.0.0/8,FR,France,Paris,48.8566,2.35222\n1.1.1.0/24,DE,Germany,Berlin,52.52,13.405\n"), 0o644)
+	assert.NoError(t, err)
+
+	o, err := overrides.New(path, &logger)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name string
+		path string
+		want []byte
+		code int
+	}{
+		{
+			name: "overridden private network - /rest/v1/10.1.2.3",
+			path: "/rest/v1/10.1.2.3",
+			want: []byte(`{"ip":"10.1.2.3","family":"ipv4","country_code":"FR","country_name":"France","city":"Paris","latitude":48.8566,"longitude":2.35222,"source":"override"}`),
+			code: 200,
+		},
+		{
+			name: "overridden public network - /rest/v1/1.1.1.1",
+			path: "/rest/v1/1.1.1.1",
+			want: []byte(`{"ip":"1.1.1.1","family":"ipv4","country_code":"DE","country_name":"Germany","city":"Berlin","latitude":52.52,"longitude":13.405,"source":"override"}`),
+			code: 200,
+		},
+		{
+			name: "non overridden network - /rest/v1/2.2.2.2",
+			path: "/rest/v1/2.2.2.2",
+			want: []byte(`{"ip":"2.2.2.2","family":"ipv4","country_code":"FR","country_name":"France","city":"Paris","latitude":48.8566,"longitude":2.35222}`),
+			code: 200,
+		},
+		{
+			name: "non overridden private network - /rest/v1/192.168.1.1",
+			path: "/rest/v1/192.168.1.1",
+			want: []byte(`{"ip":"192.168.1.1","family":"ipv4","scope":"private"}`),
+			code: 422,
+		},
+	}
+
+	r := httprouter.New()
+
+	// db
+	mdb := repositories.NewInMemoryDB()
+	rdb := &RedisMock{}
+	a := &GeoAPIMock{}
+	c := chain.New(&logger)
+	c.Add("in-memory", mdb)
+	c.Add("redis", rdb)
+
+	// route registration
+	h := NewBaseHandler(c, a, &logger)
+	h.Overrides = o
+	r.Handler("GET", "/rest/v1/:ip", http.HandlerFunc(h.GetGeoIP))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, req)
+
+			resp := recorder.Result()
+			defer resp.Body.Close()
+
+			data, err := ioutil.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, data)
+			assert.Equal(t, tt.code, resp.StatusCode)
+		})
+	}
+}
+
+// BlockingGeoAPIMock answers once released.
+// It counts the number of queries it received.
+type BlockingGeoAPIMock struct {
+	mu      sync.Mutex
+	queried int
+	release chan struct{}
+}
+
+func (m *BlockingGeoAPIMock) Get(ctx context.Context, ip string) (*models.GeoIP, error) {
+	m.mu.Lock()
+	m.queried++
+	m.mu.Unlock()
+
+	<-m.release
+	return &models.GeoIP{IP: ip, CountryCode: "AU"}, nil
+}
+
+func (m *BlockingGeoAPIMock) Status(ctx context.Context, wg *sync.WaitGroup, ch chan error) {}
+
+// CountingRepositoryMock is an empty cache counting the saves it received
+type CountingRepositoryMock struct {
+	mu    sync.Mutex
+	saved int
+}
+
+func (m *CountingRepositoryMock) Get(ctx context.Context, ip string) (*models.GeoIP, error) {
+	return nil, fmt.Errorf("error: no value found for key %s", ip)
+}
+
+func (m *CountingRepositoryMock) Save(ctx context.Context, geoip *models.GeoIP) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.saved++
+	return nil
+}
+
+func (m *CountingRepositoryMock) Status(ctx context.Context, wg *sync.WaitGroup, ch chan error) {}
+
+func (m *CountingRepositoryMock) Saved() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.saved
+}
+
+func TestLookupCoalescing(t *testing.T) {
+	addr := netip.MustParseAddr("1.1.1.1")
+
+	t.Run("concurrent cache misses share a single query", func(t *testing.T) {
+		a := &BlockingGeoAPIMock{release: make(chan struct{})}
+		repo := &CountingRepositoryMock{}
+		c := chain.New(&logger)
+		c.Add("counting", repo)
+		h := NewBaseHandler(c, a, &logger)
+
+		const n = 50
+		var wg sync.WaitGroup
+		results := make([]*models.GeoIP, n)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				g, err := h.lookup(context.Background(), addr)
+				assert.NoError(t, err)
+				results[i] = g
+			}()
+		}
+
+		// Let all the lookups join the in-flight query
+		time.Sleep(50 * time.Millisecond)
+		close(a.release)
+		wg.Wait()
+
+		assert.Equal(t, 1, a.queried)
+		for _, g := range results {
+			assert.Equal(t, "AU", g.CountryCode)
+		}
+		assert.Eventually(t, func() bool { return repo.Saved() == 1 }, time.Second, time.Millisecond)
+	})
+
+	t.Run("cancelled waiter doesn't cancel the in-flight query", func(t *testing.T) {
+		a := &BlockingGeoAPIMock{release: make(chan struct{})}
+		c := chain.New(&logger)
+		c.Add("counting", &CountingRepositoryMock{})
+		h := NewBaseHandler(c, a, &logger)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			_, err := h.lookup(ctx, addr)
+			done <- err
+		}()
+
+		// The second lookup waits for the query started by the first one
+		second := make(chan *models.GeoIP)
+		assert.Eventually(t, func() bool {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			return a.queried == 1
+		}, time.Second, time.Millisecond)
+		go func() {
+			g, err := h.lookup(context.Background(), addr)
+			assert.NoError(t, err)
+			second <- g
+		}()
+		time.Sleep(50 * time.Millisecond)
+
+		cancel()
+		err := <-done
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.ErrorIs(t, err, ErrGeoIPNotFound)
+
+		close(a.release)
+		g := <-second
+		assert.Equal(t, "AU", g.CountryCode)
+		assert.Equal(t, 1, a.queried)
+	})
+}
+
+func TestParseIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		host    string
+		want    string
+		wantErr bool
+	}{
+		{name: "IPv4", host: "1.1.1.1", want: "1.1.1.1"},
+		{name: "IPv4-mapped IPv6", host: "::ffff:1.1.1.1", want: "1.1.1.1"},
+		{name: "IPv4-mapped IPv6 - hex notation", host: "::ffff:101:101", want: "1.1.1.1"},
+		{name: "IPv6", host: "2001:db8::1", want: "2001:db8::1"},
+		{name: "IPv6 - uppercase", host: "2001:DB8::1", want: "2001:db8::1"},
+		{name: "IPv6 - expanded", host: "2001:0db8:0000:0000:0000:0000:0000:0001", want: "2001:db8::1"},
+		{name: "IPv6 - with zone", host: "fe80::1%eth0", wantErr: true},
+		{name: "IPv4 - leading zeroes", host: "01.1.1.1", wantErr: true},
+		{name: "Empty", host: "", wantErr: true},
+		{name: "Not an ip", host: "bla", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseIP(tt.host)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseIP() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && got.String() != tt.want {
+				t.Errorf("parseIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
 }
 
 func BenchmarkGetGeoIP_EntryNotInMemoryDB_EntryInRedis(b *testing.B) {
@@ -255,3 +587,77 @@ func BenchmarkGetGeoIP_EntryInMemoryDB_EntryInRedis(b *testing.B) {
 		r.ServeHTTP(recorder, req)
 	}
 }
+
+func TestGetClientGeoIP(t *testing.T) {
+	trusted, _ := ParseTrustedProxies("10.0.0.0/8")
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       []byte
+		code       int
+	}{
+		{
+			name:       "remote address",
+			remoteAddr: "1.1.1.1:1234",
+			want:       []byte(`{"ip":"1.1.1.1","family":"ipv4","country_code":"AU","country_name":"Australia","city":"South Brisbane","latitude":-27.4766,"longitude":153.0166}`),
+			code:       200,
+		},
+		{
+			name:       "trusted proxy - X-Forwarded-For",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "2.2.2.2"},
+			want:       []byte(`{"ip":"2.2.2.2","family":"ipv4","country_code":"FR","country_name":"France","city":"Paris","latitude":48.8566,"longitude":2.35222}`),
+			code:       200,
+		},
+		{
+			name:       "untrusted proxy - X-Forwarded-For",
+			remoteAddr: "3.3.3.3:1234",
+			headers:    map[string]string{"X-Forwarded-For": "2.2.2.2"},
+			want:       []byte(`{"ip":"3.3.3.3","family":"ipv4","country_code":"US","country_name":"United States","city":"Chicago","latitude":41.8781,"longitude":-87.6298}`),
+			code:       200,
+		},
+		{
+			name:       "invalid remote address",
+			remoteAddr: "bla",
+			want:       []byte(`{"status":"error","msg":"couldn't determine the client ip address"}`),
+			code:       400,
+		},
+	}
+
+	r := httprouter.New()
+
+	// db
+	mdb := repositories.NewInMemoryDB()
+	rdb := &RedisMock{}
+	a := &GeoAPIMock{}
+	c := chain.New(&logger)
+	c.Add("in-memory", mdb)
+	c.Add("redis", rdb)
+
+	// route registration
+	h := NewBaseHandler(c, a, &logger)
+	h.TrustedProxies = trusted
+	r.Handler("GET", "/rest/v1/:ip", http.HandlerFunc(h.GetGeoIP))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/rest/v1/me", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			recorder := httptest.NewRecorder()
+			r.ServeHTTP(recorder, req)
+
+			resp := recorder.Result()
+			defer resp.Body.Close()
+
+			data, err := ioutil.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, data)
+			assert.Equal(t, tt.code, resp.StatusCode)
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package filewatch
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// DefaultDebounce is the default delay to wait for a file to settle
+	// after a change before notifying the caller.
+	// Editors and deployment tools usually generate several events
+	// for a single change (write, chmod, rename, ...).
+	DefaultDebounce = 500 * time.Millisecond
+)
+
+// Watch will call onChange every time the given file is created, written,
+// replaced or renamed, until ctx is cancelled.
+//
+// The parent directory is watched rather than the file itself so atomic
+// replacements (write to a temporary file then rename) and Kubernetes
+// ConfigMap updates (symlink swap) are detected.
+// Consecutive events happening within debounce are coalesced into
+// a single call to onChange.
+func Watch(ctx context.Context, path string, debounce time.Duration, onChange func()) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("error: failed to create file watcher: %w", err)
+	}
+
+	path = filepath.Clean(path)
+	dir := filepath.Dir(path)
+	if err := w.Add(dir); err != nil {
+		w.Close()
+		return fmt.Errorf("error: failed to watch directory %s: %w", dir, err)
+	}
+
+	// Resolve the symlink target if any so Kubernetes ConfigMap
+	// updates, which swap a "..data" symlink, are detected
+	target, _ := filepath.EvalSymlinks(path)
+
+	go func() {
+		defer w.Close()
+
+		timer := time.NewTimer(debounce)
+		timer.Stop()
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case e, ok := <-w.Events:
+				if !ok {
+					return
+				}
+
+				if !isRelevant(e, path, target) {
+					continue
+				}
+
+				// Refresh the symlink target in case it changed
+				if t, err := filepath.EvalSymlinks(path); err == nil {
+					target = t
+				}
+
+				timer.Reset(debounce)
+
+			case _, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+
+			case <-timer.C:
+				onChange()
+			}
+		}
+	}()
+
+	return nil
+}
+
+// isRelevant returns true if the event concerns the watched file.
+func isRelevant(e fsnotify.Event, path, target string) bool {
+	if e.Has(fsnotify.Chmod) && !e.Has(fsnotify.Write) {
+		return false
+	}
+
+	name := filepath.Clean(e.Name)
+	if name == path {
+		return true
+	}
+
+	// Any change in the directory may have swapped the symlink target
+	if target != "" && target != path {
+		t, err := filepath.EvalSymlinks(path)
+		return err == nil && t != target
+	}
+
+	return false
+}
@@ -0,0 +1,80 @@
+package filewatch
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file.csv")
+	assert.NoError(t, os.WriteFile(path, []byte("v1"), 0o644))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changes := make(chan struct{}, 10)
+	err := Watch(ctx, path, 50*time.Millisecond, func() { changes <- struct{}{} })
+	assert.NoError(t, err)
+
+	t.Run("Write", func(t *testing.T) {
+		assert.NoError(t, os.WriteFile(path, []byte("v2"), 0o644))
+		assertChanged(t, changes)
+	})
+
+	t.Run("Atomic replacement", func(t *testing.T) {
+		tmp := filepath.Join(dir, "file.csv.tmp")
+		assert.NoError(t, os.WriteFile(tmp, []byte("v3"), 0o644))
+		assert.NoError(t, os.Rename(tmp, path))
+		assertChanged(t, changes)
+	})
+
+	t.Run("Other file", func(t *testing.T) {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "other.csv"), []byte("v1"), 0o644))
+		select {
+		case <-changes:
+			t.Error("Watch() notified a change of another file")
+		case <-time.After(200 * time.Millisecond):
+		}
+	})
+
+	t.Run("Symlink swap", func(t *testing.T) {
+		// Mimic a Kubernetes ConfigMap volume:
+		// file.yaml -> ..data/file.yaml, ..data -> ..v1
+		k8sDir := t.TempDir()
+		for _, v := range []string{"..v1", "..v2"} {
+			assert.NoError(t, os.Mkdir(filepath.Join(k8sDir, v), 0o755))
+			assert.NoError(t, os.WriteFile(filepath.Join(k8sDir, v, "file.yaml"), []byte(v), 0o644))
+		}
+		assert.NoError(t, os.Symlink("..v1", filepath.Join(k8sDir, "..data")))
+		assert.NoError(t, os.Symlink(filepath.Join("..data", "file.yaml"), filepath.Join(k8sDir, "file.yaml")))
+
+		k8sChanges := make(chan struct{}, 10)
+		err := Watch(ctx, filepath.Join(k8sDir, "file.yaml"), 50*time.Millisecond, func() { k8sChanges <- struct{}{} })
+		assert.NoError(t, err)
+
+		assert.NoError(t, os.Symlink("..v2", filepath.Join(k8sDir, "..data_tmp")))
+		assert.NoError(t, os.Rename(filepath.Join(k8sDir, "..data_tmp"), filepath.Join(k8sDir, "..data")))
+		assertChanged(t, k8sChanges)
+	})
+
+	t.Run("Non existing directory", func(t *testing.T) {
+		err := Watch(ctx, filepath.Join(dir, "nonexistent", "file.csv"), 50*time.Millisecond, func() {})
+		assert.Error(t, err)
+	})
+}
+
+func assertChanged(t *testing.T, changes chan struct{}) {
+	t.Helper()
+
+	select {
+	case <-changes:
+	case <-time.After(2 * time.Second):
+		t.Error("Watch() didn't notify the change")
+	}
+}
@@ -0,0 +1,215 @@
+package invalidation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+)
+
+const (
+	// DefaultChannel is the default redis channel of the invalidations
+	DefaultChannel = "geo:invalidations"
+
+	// DefaultPingInterval is the default duration without message
+	// after which the subscription is checked with a ping
+	DefaultPingInterval = 30 * time.Second
+
+	// DefaultRetryInterval is the default duration before the first
+	// attempt to subscribe again after a failure. It doubles after
+	// each failed attempt, up to MaxRetryInterval.
+	DefaultRetryInterval = 100 * time.Millisecond
+
+	// MaxRetryInterval is the maximum duration between two
+	// attempts to subscribe again
+	MaxRetryInterval = 30 * time.Second
+)
+
+// Prometheus metrics
+var (
+	invalidationsPublished = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "invalidations_published_total",
+		Help: "The total number of invalidations published to the other replicas",
+	})
+	invalidationsReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "invalidations_received_total",
+		Help: "The total number of invalidations received and applied to the in-memory database",
+	})
+	invalidationsPurges = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "invalidations_purges_total",
+		Help: "The total number of purges of the in-memory database after the invalidation subscription was lost",
+	})
+	invalidationsSubscriptionFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "invalidations_subscription_failures_total",
+		Help: "The total number of failures of the invalidation subscription",
+	})
+)
+
+// Repository is an in-memory database
+// whose entries can be invalidated
+type Repository interface {
+	Delete(ctx context.Context, ip string) error
+	Purge()
+}
+
+// Bus notifies all the replicas that the GeoIP information of an ip
+// address changed, through a redis pub/sub channel, so they drop it
+// from their in-memory database and read it again from redis.
+//
+// The invalidations published while a replica isn't subscribed are lost,
+// hence its whole in-memory database is purged when it subscribes again.
+type Bus struct {
+	Client  redis.UniversalClient
+	Channel string
+	Local   Repository
+	Logger  *zerolog.Logger
+
+	// PingInterval is the duration without message after which
+	// the subscription is checked with a ping
+	PingInterval time.Duration
+
+	// RetryInterval is the duration before the first
+	// attempt to subscribe again after a failure
+	RetryInterval time.Duration
+}
+
+// New will return a new Bus publishing on the given channel of client
+// and invalidating the entries of local.
+// The default channel is used when channel is empty.
+func New(client redis.UniversalClient, channel string, local Repository, logger *zerolog.Logger) *Bus {
+	if channel == "" {
+		channel = DefaultChannel
+	}
+
+	return &Bus{
+		Client:        client,
+		Channel:       channel,
+		Local:         local,
+		Logger:        logger,
+		PingInterval:  DefaultPingInterval,
+		RetryInterval: DefaultRetryInterval,
+	}
+}
+
+// Publish notifies all the replicas, including this one,
+// that the GeoIP information of ip changed.
+func (b *Bus) Publish(ctx context.Context, ip string) error {
+	// Get request id for logging purposes
+	req_id, _ := hlog.IDFromCtx(ctx)
+
+	if err := b.Client.Publish(ctx, b.Channel, ip).Err(); err != nil {
+		return fmt.Errorf("error: failed to publish the invalidation of %s: %w", ip, err)
+	}
+
+	// Increment Prometheus counter
+	invalidationsPublished.Inc()
+
+	b.Logger.Debug().Str("req_id", req_id.String()).Msgf("published the invalidation of %s on %s", ip, b.Channel)
+
+	return nil
+}
+
+// Run subscribes to the channel and drops the invalidated entries
+// from the in-memory database until ctx is done.
+// The subscription is established again after any failure, with an
+// exponential backoff, and the in-memory database is then purged
+// since invalidations may have been missed.
+func (b *Bus) Run(ctx context.Context) {
+	retry := b.RetryInterval
+	purge := false
+
+	for {
+		subscribed, err := b.subscribe(ctx, purge)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// Increment Prometheus counter
+		invalidationsSubscriptionFailures.Inc()
+
+		// Invalidations are missed until the subscription is established again
+		purge = true
+		if subscribed {
+			retry = b.RetryInterval
+		}
+
+		b.Logger.Error().Err(err).Msgf("Lost the subscription to %s, subscribing again in %s", b.Channel, retry)
+
+		t := time.NewTimer(retry)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+
+		retry = min(2*retry, MaxRetryInterval)
+	}
+}
+
+// subscribe handles the messages of the channel until ctx is done or
+// the subscription fails. It returns whether the subscription had been
+// established, and purges the in-memory database once it is if purge is true.
+func (b *Bus) subscribe(ctx context.Context, purge bool) (bool, error) {
+	ps := b.Client.Subscribe(ctx, b.Channel)
+	defer ps.Close()
+
+	// Unblock the pending receive once ctx is done
+	stop := context.AfterFunc(ctx, func() { ps.Close() })
+	defer stop()
+
+	subscribed := false
+	pinged := false
+
+	for {
+		msg, err := ps.ReceiveTimeout(ctx, b.PingInterval)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && !pinged {
+				// Check the subscription is still alive
+				pinged = true
+				if err := ps.Ping(ctx); err != nil {
+					return subscribed, fmt.Errorf("error: failed to ping: %w", err)
+				}
+				continue
+			}
+			return subscribed, fmt.Errorf("error: failed to receive: %w", err)
+		}
+		pinged = false
+
+		switch m := msg.(type) {
+		case *redis.Subscription:
+			if subscribed || m.Kind != "subscribe" {
+				continue
+			}
+			subscribed = true
+			b.Logger.Info().Msgf("Subscribed to the invalidations on %s", b.Channel)
+
+			if purge {
+				b.Local.Purge()
+
+				// Increment Prometheus counter
+				invalidationsPurges.Inc()
+
+				b.Logger.Warn().Msg("Purged the in-memory cache, invalidations may have been missed")
+			}
+		case *redis.Message:
+			if err := b.Local.Delete(ctx, m.Payload); err != nil {
+				b.Logger.Error().Err(err).Msgf("Failed to invalidate %s", m.Payload)
+				continue
+			}
+
+			// Increment Prometheus counter
+			invalidationsReceived.Inc()
+
+			b.Logger.Debug().Msgf("Invalidated %s", m.Payload)
+		}
+	}
+}
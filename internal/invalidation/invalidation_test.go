@@ -0,0 +1,161 @@
+package invalidation
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/lescactus/geolocation-go/internal/repositories"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+var logger = zerolog.New(os.Stdout).Level(zerolog.NoLevel)
+
+// replica is a running Bus with its own in-memory database
+type replica struct {
+	bus   *Bus
+	local interface {
+		Repository
+		models.GeoIPRepository
+		Len() int
+	}
+}
+
+func newTestReplica(t *testing.T, s *miniredis.Miniredis) *replica {
+	client := redis.NewClient(&redis.Options{Addr: s.Addr(), MaxRetries: -1})
+	t.Cleanup(func() { client.Close() })
+
+	r := &replica{local: repositories.NewShardedDB(4, 0, 0, 0)}
+	r.bus = New(client, "", r.local, &logger)
+	r.bus.RetryInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.bus.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return r
+}
+
+// waitSubscribers waits until n replicas are subscribed to the channel
+func waitSubscribers(t *testing.T, s *miniredis.Miniredis, n int) {
+	assert.Eventually(t, func() bool {
+		return s.PubSubNumSub(DefaultChannel)[DefaultChannel] == n
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestNew(t *testing.T) {
+	b := New(nil, "", nil, &logger)
+	assert.Equal(t, DefaultChannel, b.Channel)
+	assert.Equal(t, DefaultPingInterval, b.PingInterval)
+	assert.Equal(t, DefaultRetryInterval, b.RetryInterval)
+
+	b = New(nil, "custom", nil, &logger)
+	assert.Equal(t, "custom", b.Channel)
+}
+
+func TestBusInvalidation(t *testing.T) {
+	s := miniredis.RunT(t)
+	ctx := context.Background()
+
+	replicas := []*replica{newTestReplica(t, s), newTestReplica(t, s), newTestReplica(t, s)}
+	waitSubscribers(t, s, len(replicas))
+
+	for _, r := range replicas {
+		r.local.Save(ctx, &models.GeoIP{IP: "1.1.1.1"})
+		r.local.Save(ctx, &models.GeoIP{IP: "2001:db8::1"})
+	}
+
+	// Every replica, including the publisher, drops the entry
+	assert.NoError(t, replicas[0].bus.Publish(ctx, "1.1.1.1"))
+	for i, r := range replicas {
+		assert.Eventually(t, func() bool {
+			_, err := r.local.Get(ctx, "1.1.1.1")
+			return err != nil
+		}, time.Second, 5*time.Millisecond, "replica %d", i)
+
+		_, err := r.local.Get(ctx, "2001:db8::1")
+		assert.NoError(t, err, "replica %d", i)
+	}
+}
+
+func TestBusPublishError(t *testing.T) {
+	s := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: s.Addr(), MaxRetries: -1})
+	defer client.Close()
+
+	s.Close()
+	b := New(client, "", repositories.NewShardedDB(1, 0, 0, 0), &logger)
+	assert.Error(t, b.Publish(context.Background(), "1.1.1.1"))
+}
+
+func TestBusReconnect(t *testing.T) {
+	s := miniredis.RunT(t)
+	ctx := context.Background()
+
+	r := newTestReplica(t, s)
+	waitSubscribers(t, s, 1)
+
+	for i := 0; i < 10; i++ {
+		r.local.Save(ctx, &models.GeoIP{IP: fmt.Sprintf("%d.1.1.1", i)})
+	}
+
+	// The invalidations published while the connection is lost are
+	// missed, so the in-memory database is purged once subscribed again
+	s.Close()
+	assert.NoError(t, s.Restart())
+	waitSubscribers(t, s, 1)
+	assert.Eventually(t, func() bool { return r.local.Len() == 0 }, time.Second, 5*time.Millisecond)
+
+	// The invalidations are received again
+	r.local.Save(ctx, &models.GeoIP{IP: "1.1.1.1"})
+	r.local.Save(ctx, &models.GeoIP{IP: "2.2.2.2"})
+	assert.NoError(t, r.bus.Publish(ctx, "1.1.1.1"))
+	assert.Eventually(t, func() bool { return r.local.Len() == 1 }, time.Second, 5*time.Millisecond)
+}
+
+func TestBusPing(t *testing.T) {
+	s := miniredis.RunT(t)
+	ctx := context.Background()
+
+	client := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer client.Close()
+
+	local := repositories.NewShardedDB(1, 0, 0, 0)
+	local.Save(ctx, &models.GeoIP{IP: "1.1.1.1"})
+
+	b := New(client, "", local, &logger)
+	b.PingInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.Run(ctx)
+	}()
+
+	// An idle subscription answering the pings is kept
+	waitSubscribers(t, s, 1)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, local.Len())
+
+	// Run returns once ctx is done
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Bus.Run() didn't return after the context was done")
+	}
+}
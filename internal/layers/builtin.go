@@ -0,0 +1,74 @@
+package layers
+
+import (
+	"context"
+
+	"github.com/lescactus/geolocation-go/internal/config"
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/lescactus/geolocation-go/internal/repositories"
+	"github.com/rs/zerolog"
+)
+
+// Names of the built-in cache layers
+const (
+	Memory    = "memory"
+	Memcached = "memcached"
+	Redis     = "redis"
+	Postgres  = "postgres"
+	Bolt      = "bolt"
+)
+
+func init() {
+	Register(Memory, newMemory)
+	Register(Memcached, newMemcached)
+	Register(Redis, newRedis)
+	Register(Postgres, newPostgres)
+	Register(Bolt, newBolt)
+}
+
+// newMemory creates the in-memory database, configured by the IN_MEMORY_* variables
+func newMemory(ctx context.Context, cfg *config.Config, logger *zerolog.Logger) (models.GeoIPRepository, error) {
+	return repositories.NewShardedDB(
+		cfg.GetInt("IN_MEMORY_SHARDS"),
+		cfg.GetInt("IN_MEMORY_MAX_ENTRIES"),
+		int64(cfg.GetSizeInBytes("IN_MEMORY_MAX_BYTES")),
+		cfg.GetDuration("IN_MEMORY_TTL")), nil
+}
+
+// newMemcached creates the memcached database client, configured by the MEMCACHED_* variables
+func newMemcached(ctx context.Context, cfg *config.Config, logger *zerolog.Logger) (models.GeoIPRepository, error) {
+	return repositories.NewMemcachedDB(
+		cfg.GetString("MEMCACHED_SERVERS"),
+		cfg.GetDuration("MEMCACHED_KEY_TTL"),
+		cfg.GetString("MEMCACHED_KEY_PREFIX"))
+}
+
+// newRedis creates the redis database client, configured by the REDIS_* variables
+func newRedis(ctx context.Context, cfg *config.Config, logger *zerolog.Logger) (models.GeoIPRepository, error) {
+	return repositories.NewRedisDB(
+		cfg.GetString("REDIS_CONNECTION_STRING"),
+		cfg.GetDuration("REDIS_KEY_TTL"),
+		cfg.GetString("REDIS_KEY_PREFIX"))
+}
+
+// newPostgres creates the postgres database client, configured by the
+// POSTGRES_* variables, and migrates its schema
+func newPostgres(ctx context.Context, cfg *config.Config, logger *zerolog.Logger) (models.GeoIPRepository, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.GetDuration("POSTGRES_CONNECT_TIMEOUT"))
+	defer cancel()
+
+	return repositories.NewPostgresDB(ctx, cfg.GetString("POSTGRES_CONNECTION_STRING"), cfg.GetDuration("POSTGRES_TTL"))
+}
+
+// newBolt creates the bolt database, configured by the BOLT_* variables,
+// and removes its expired items periodically until ctx is done or it is closed
+func newBolt(ctx context.Context, cfg *config.Config, logger *zerolog.Logger) (models.GeoIPRepository, error) {
+	b, err := repositories.NewBoltDB(cfg.GetString("BOLT_PATH"), cfg.GetDuration("BOLT_TTL"), logger)
+	if err != nil {
+		return nil, err
+	}
+
+	go b.Run(ctx, cfg.GetDuration("BOLT_CLEANUP_INTERVAL"))
+
+	return b, nil
+}
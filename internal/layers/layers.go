@@ -0,0 +1,155 @@
+package layers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/lescactus/geolocation-go/internal/config"
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/rs/zerolog"
+)
+
+// None is the list of layers creating no layer, since an
+// empty environment variable is ignored by the configuration
+const None = "none"
+
+// Factory creates a cache layer from the configuration.
+// The background goroutines of the layer, if any, must return once
+// ctx is done. A layer implementing io.Closer is closed by Layers.Close.
+type Factory func(ctx context.Context, cfg *config.Config, logger *zerolog.Logger) (models.GeoIPRepository, error)
+
+var (
+	mu        sync.RWMutex
+	factories = make(map[string]Factory)
+)
+
+// Register makes a cache layer available under the given name,
+// so it can be listed in the CACHE_CHAIN configuration.
+// It panics if the name is empty, already registered, or if factory is nil.
+func Register(name string, factory Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if name == "" || name == None || strings.ContainsAny(name, ", ") {
+		panic(fmt.Sprintf("layers: invalid layer name %q", name))
+	}
+	if factory == nil {
+		panic("layers: nil factory for layer " + name)
+	}
+	if _, ok := factories[name]; ok {
+		panic("layers: layer " + name + " registered twice")
+	}
+
+	factories[name] = factory
+}
+
+// Registered returns the sorted names of the registered cache layers.
+func Registered() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return names
+}
+
+// Layer is a cache layer created by its Factory
+type Layer struct {
+	Name       string
+	Repository models.GeoIPRepository
+}
+
+// Layers are the cache layers of the chain, from the first one looked up to the last
+type Layers []Layer
+
+// Build creates the cache layers of the given comma separated list of
+// names, ex: "memory,redis", in order. An empty list, or None, creates no layer.
+// If a layer fails to be created, the layers already created are closed.
+func Build(ctx context.Context, list string, cfg *config.Config, logger *zerolog.Logger) (Layers, error) {
+	var layers Layers
+	if strings.TrimSpace(list) == None {
+		return layers, nil
+	}
+
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		mu.RLock()
+		factory, ok := factories[name]
+		mu.RUnlock()
+
+		var err error
+		switch {
+		case !ok:
+			err = fmt.Errorf("error: unknown cache layer %s, available: %s", name, strings.Join(Registered(), ", "))
+		case slices.ContainsFunc(layers, func(l Layer) bool { return l.Name == name }):
+			err = fmt.Errorf("error: cache layer %s listed twice", name)
+		default:
+			var repo models.GeoIPRepository
+			repo, err = factory(ctx, cfg, logger)
+			if err == nil && repo == nil {
+				err = errors.New("nil repository")
+			}
+			if err != nil {
+				err = fmt.Errorf("error: failed to create cache layer %s: %w", name, err)
+			} else {
+				layers = append(layers, Layer{Name: name, Repository: repo})
+			}
+		}
+
+		if err != nil {
+			layers.Close()
+			return nil, err
+		}
+	}
+
+	return layers, nil
+}
+
+// Get returns the repository of the layer with the given name.
+func (l Layers) Get(name string) (models.GeoIPRepository, bool) {
+	for _, layer := range l {
+		if layer.Name == name {
+			return layer.Repository, true
+		}
+	}
+	return nil, false
+}
+
+// Names returns the names of the layers, in order.
+func (l Layers) Names() []string {
+	names := make([]string, len(l))
+	for i, layer := range l {
+		names[i] = layer.Name
+	}
+	return names
+}
+
+// Close closes the layers implementing io.Closer, from the last one
+// to the first one, and returns the errors of the layers which failed.
+func (l Layers) Close() error {
+	var errs []error
+	for i := len(l) - 1; i >= 0; i-- {
+		c, ok := l[i].Repository.(io.Closer)
+		if !ok {
+			continue
+		}
+		if err := c.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", l[i].Name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,173 @@
+package layers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/lescactus/geolocation-go/internal/config"
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+var logger = zerolog.New(os.Stdout).Level(zerolog.NoLevel)
+
+// closerRepository is a models.GeoIPRepository recording when it is closed
+type closerRepository struct {
+	models.GeoIPRepository
+	name   string
+	closed *[]string
+	err    error
+}
+
+func (c *closerRepository) Close() error {
+	*c.closed = append(*c.closed, c.name)
+	return c.err
+}
+
+// closed records the names of the closed test layers
+var closed []string
+
+func init() {
+	for _, name := range []string{"test-a", "test-b"} {
+		Register(name, func(ctx context.Context, cfg *config.Config, logger *zerolog.Logger) (models.GeoIPRepository, error) {
+			return &closerRepository{name: name, closed: &closed}, nil
+		})
+	}
+	Register("test-failing", func(ctx context.Context, cfg *config.Config, logger *zerolog.Logger) (models.GeoIPRepository, error) {
+		return nil, errors.New("connection refused")
+	})
+	Register("test-nil", func(ctx context.Context, cfg *config.Config, logger *zerolog.Logger) (models.GeoIPRepository, error) {
+		return nil, nil
+	})
+}
+
+func TestRegister(t *testing.T) {
+	factory := func(ctx context.Context, cfg *config.Config, logger *zerolog.Logger) (models.GeoIPRepository, error) {
+		return nil, nil
+	}
+
+	tests := []struct {
+		name    string
+		layer   string
+		factory Factory
+	}{
+		{name: "Empty name", layer: "", factory: factory},
+		{name: "Name with a comma", layer: "a,b", factory: factory},
+		{name: "Name with a space", layer: "a b", factory: factory},
+		{name: "None", layer: None, factory: factory},
+		{name: "Nil factory", layer: "test-nil-factory", factory: nil},
+		{name: "Registered twice", layer: Memory, factory: factory},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Panics(t, func() { Register(tt.layer, tt.factory) })
+		})
+	}
+}
+
+func TestRegistered(t *testing.T) {
+	assert.Equal(t, []string{Bolt, Memcached, Memory, Postgres, Redis, "test-a", "test-b", "test-failing", "test-nil"}, Registered())
+}
+
+func TestBuild(t *testing.T) {
+	s := miniredis.RunT(t)
+
+	cfg := config.New()
+	cfg.Set("REDIS_CONNECTION_STRING", fmt.Sprintf("redis://%s", s.Addr()))
+	cfg.Set("BOLT_PATH", filepath.Join(t.TempDir(), "geoip.db"))
+
+	tests := []struct {
+		name      string
+		list      string
+		wantNames []string
+		wantErr   bool
+	}{
+		{name: "No cache", list: "", wantNames: []string{}},
+		{name: "None", list: "none", wantNames: []string{}},
+		{name: "Only commas and spaces", list: " , ", wantNames: []string{}},
+		{name: "None with other layers", list: "memory,none", wantErr: true},
+		{name: "Memory", list: "memory", wantNames: []string{Memory}},
+		{name: "Memory and redis", list: "memory,redis", wantNames: []string{Memory, Redis}},
+		{name: "Order is kept - with spaces", list: " redis , memcached, memory,bolt ", wantNames: []string{Redis, Memcached, Memory, Bolt}},
+		{name: "Unknown layer", list: "memory,mysql", wantErr: true},
+		{name: "Listed twice", list: "memory,redis,memory", wantErr: true},
+		{name: "Nil repository", list: "test-nil", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layers, err := Build(context.Background(), tt.list, cfg, &logger)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Build() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			defer layers.Close()
+
+			assert.Equal(t, tt.wantNames, layers.Names())
+
+			// Every layer is a working repository
+			for _, l := range layers {
+				if l.Name == Memcached {
+					continue
+				}
+
+				g := &models.GeoIP{IP: "1.1.1.1", CountryCode: "AU"}
+				assert.NoError(t, l.Repository.Save(context.Background(), g), l.Name)
+				got, err := l.Repository.Get(context.Background(), g.IP)
+				assert.NoError(t, err, l.Name)
+				assert.Equal(t, g, got, l.Name)
+
+				var wg sync.WaitGroup
+				ch := make(chan error, 1)
+				wg.Add(1)
+				l.Repository.Status(context.Background(), &wg, ch)
+				assert.NoError(t, <-ch, l.Name)
+			}
+		})
+	}
+}
+
+func TestBuildFailureClosesLayers(t *testing.T) {
+	closed = nil
+
+	layers, err := Build(context.Background(), "test-a,test-b,test-failing", config.New(), &logger)
+	assert.ErrorContains(t, err, "test-failing")
+	assert.Nil(t, layers)
+
+	// The layers already created are closed, from the last one
+	assert.Equal(t, []string{"test-b", "test-a"}, closed)
+}
+
+func TestLayersGet(t *testing.T) {
+	a := &closerRepository{name: "a"}
+	layers := Layers{{Name: "a", Repository: a}}
+
+	got, ok := layers.Get("a")
+	assert.True(t, ok)
+	assert.Same(t, a, got)
+
+	_, ok = layers.Get("b")
+	assert.False(t, ok)
+}
+
+func TestLayersClose(t *testing.T) {
+	var closed []string
+	layers := Layers{
+		{Name: "a", Repository: &closerRepository{name: "a", closed: &closed, err: errors.New("already closed")}},
+		{Name: "not-a-closer", Repository: struct{ models.GeoIPRepository }{}},
+		{Name: "b", Repository: &closerRepository{name: "b", closed: &closed}},
+	}
+
+	err := layers.Close()
+	assert.ErrorContains(t, err, "a: already closed")
+	assert.Equal(t, []string{"b", "a"}, closed)
+}
@@ -2,17 +2,30 @@ package models
 
 import (
 	"context"
+	"net/netip"
 	"sync"
 )
 
+const (
+	// FamilyIPv4 is the address family of IPv4 addresses
+	FamilyIPv4 = "ipv4"
+
+	// FamilyIPv6 is the address family of IPv6 addresses
+	FamilyIPv6 = "ipv6"
+)
+
 // GeoIP contains IP Geolocation information
 type GeoIP struct {
-	IP          string  `json:"ip"`
-	CountryCode string  `json:"country_code"`
-	CountryName string  `json:"country_name"`
-	City        string  `json:"city,omitempty"`
-	Latitude    float64 `json:"latitude,omitempty"`
-	Longitude   float64 `json:"longitude,omitempty"`
+	IP           string  `json:"ip"`
+	Family       string  `json:"family,omitempty"`
+	CountryCode  string  `json:"country_code"`
+	CountryName  string  `json:"country_name"`
+	City         string  `json:"city,omitempty"`
+	Latitude     float64 `json:"latitude,omitempty"`
+	Longitude    float64 `json:"longitude,omitempty"`
+	ASN          uint    `json:"asn,omitempty"`
+	Organization string  `json:"organization,omitempty"`
+	Source       string  `json:"source,omitempty"`
 }
 
 // GeoIPRepository provides a way to retrieve GeoIP information
@@ -22,3 +35,21 @@ type GeoIPRepository interface {
 	Save(ctx context.Context, geoip *GeoIP) error
 	Status(ctx context.Context, wg *sync.WaitGroup, ch chan error)
 }
+
+// GeoIPDeleter is implemented by the GeoIPRepository
+// able to delete GeoIP information.
+type GeoIPDeleter interface {
+	// Delete removes the GeoIP information of the given ip.
+	// Deleting a missing ip isn't an error.
+	Delete(ctx context.Context, ip string) error
+}
+
+// Family returns the address family of the given address,
+// either FamilyIPv4 or FamilyIPv6.
+// IPv4-mapped IPv6 addresses are considered as IPv4 addresses.
+func Family(addr netip.Addr) string {
+	if addr.Unmap().Is4() {
+		return FamilyIPv4
+	}
+	return FamilyIPv6
+}
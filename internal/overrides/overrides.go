@@ -0,0 +1,201 @@
+package overrides
+
+import (
+	"context"
+	"net/netip"
+	"sort"
+	"sync/atomic"
+
+	"github.com/lescactus/geolocation-go/internal/config"
+	"github.com/lescactus/geolocation-go/internal/filewatch"
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// Source is the value of models.GeoIP.Source for the
+	// GeoIP information coming from an override
+	Source = "override"
+)
+
+// Prometheus metrics
+var (
+	overridesEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "overrides_entries",
+		Help: "The number of location overrides currently loaded",
+	})
+	overridesReloads = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "overrides_reloads_total",
+		Help: "The total number of successful reloads of the overrides file",
+	})
+	overridesFailedReloads = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "overrides_failed_reloads_total",
+		Help: "The total number of failed reloads of the overrides file",
+	})
+	overridesHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "overrides_hits_total",
+		Help: "The total number of lookups answered by a location override",
+	})
+)
+
+// Table is an immutable longest-prefix-match table of location overrides.
+type Table struct {
+	// Location overrides indexed by network
+	entries map[netip.Prefix]*config.Override
+	// Distinct prefix lengths of the IPv4 and IPv6 networks,
+	// sorted from the longest to the shortest
+	lengths4 []int
+	lengths6 []int
+}
+
+// NewTable builds a Table from the given list of overrides.
+// When the same network is defined several times, the last definition wins.
+func NewTable(overrides []config.Override) *Table {
+	t := &Table{entries: make(map[netip.Prefix]*config.Override, len(overrides))}
+
+	seen4 := make(map[int]bool)
+	seen6 := make(map[int]bool)
+
+	for i := range overrides {
+		p := overrides[i].CIDR.Masked()
+		t.entries[p] = &overrides[i]
+
+		if p.Addr().Is4() {
+			if !seen4[p.Bits()] {
+				seen4[p.Bits()] = true
+				t.lengths4 = append(t.lengths4, p.Bits())
+			}
+		} else {
+			if !seen6[p.Bits()] {
+				seen6[p.Bits()] = true
+				t.lengths6 = append(t.lengths6, p.Bits())
+			}
+		}
+	}
+
+	sort.Sort(sort.Reverse(sort.IntSlice(t.lengths4)))
+	sort.Sort(sort.Reverse(sort.IntSlice(t.lengths6)))
+
+	return t
+}
+
+// Len returns the number of networks in the table.
+func (t *Table) Len() int {
+	return len(t.entries)
+}
+
+// Lookup returns the override of the most specific network
+// containing the given address, if any.
+func (t *Table) Lookup(addr netip.Addr) (*config.Override, bool) {
+	addr = addr.Unmap()
+
+	lengths := t.lengths6
+	if addr.Is4() {
+		lengths = t.lengths4
+	}
+
+	for _, bits := range lengths {
+		p, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+
+		if o, ok := t.entries[p]; ok {
+			return o, true
+		}
+	}
+
+	return nil, false
+}
+
+// Overrides provides operator-defined locations for networks which are
+// wrongly geolocated by the public providers, such as VPN egresses or
+// office networks.
+// The overrides are loaded from a file and can be reloaded at runtime
+// without interrupting the lookups.
+type Overrides struct {
+	path   string
+	table  atomic.Pointer[Table]
+	logger *zerolog.Logger
+}
+
+// New will create a new Overrides and load the overrides
+// from the given file.
+func New(path string, logger *zerolog.Logger) (*Overrides, error) {
+	o := &Overrides{path: path, logger: logger}
+
+	if err := o.Reload(); err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+// Reload will read the overrides file again and atomically swap the
+// current overrides with the new ones.
+// The current overrides are kept in case of error.
+func (o *Overrides) Reload() error {
+	overrides, err := config.LoadOverrides(o.path)
+	if err != nil {
+		// Increment Prometheus counter
+		overridesFailedReloads.Inc()
+		return err
+	}
+
+	t := NewTable(overrides)
+	o.table.Store(t)
+
+	// Update Prometheus metrics
+	overridesReloads.Inc()
+	overridesEntries.Set(float64(t.Len()))
+
+	o.logger.Info().Msgf("%d location overrides loaded from %s", t.Len(), o.path)
+
+	return nil
+}
+
+// Watch will reload the overrides every time the overrides
+// file changes on disk, until ctx is cancelled.
+func (o *Overrides) Watch(ctx context.Context) error {
+	return filewatch.Watch(ctx, o.path, filewatch.DefaultDebounce, func() {
+		if err := o.Reload(); err != nil {
+			o.logger.Error().Err(err).Msg("failed to reload location overrides")
+		}
+	})
+}
+
+// Lookup returns the GeoIP information of the given address if it
+// belongs to an overridden network.
+// It is safe to call Lookup on a nil *Overrides, in which case
+// no address is ever overridden.
+func (o *Overrides) Lookup(addr netip.Addr) (*models.GeoIP, bool) {
+	if o == nil {
+		return nil, false
+	}
+
+	t := o.table.Load()
+	if t == nil {
+		return nil, false
+	}
+
+	ov, ok := t.Lookup(addr)
+	if !ok {
+		return nil, false
+	}
+
+	// Increment Prometheus counter
+	overridesHits.Inc()
+
+	return &models.GeoIP{
+		IP:          addr.String(),
+		Family:      models.Family(addr),
+		CountryCode: ov.CountryCode,
+		CountryName: ov.CountryName,
+		City:        ov.City,
+		Latitude:    ov.Latitude,
+		Longitude:   ov.Longitude,
+		Source:      Source,
+	}, true
+}
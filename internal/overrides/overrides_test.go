@@ -0,0 +1,129 @@
+package overrides
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lescactus/geolocation-go/internal/config"
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+var logger = zerolog.New(os.Stdout).Level(zerolog.NoLevel)
+
+func TestTableLookup(t *testing.T) {
+	table := NewTable([]config.Override{
+		{CIDR: netip.MustParsePrefix("203.0.0.0/16"), City: "Lyon"},
+		{CIDR: netip.MustParsePrefix("203.0.113.0/24"), City: "Paris"},
+		{CIDR: netip.MustParsePrefix("203.0.113.42/32"), City: "Marseille"},
+		{CIDR: netip.MustParsePrefix("2001:db8::/32"), City: "Berlin"},
+		{CIDR: netip.MustParsePrefix("2001:db8:1::/48"), City: "Hamburg"},
+		{CIDR: netip.MustParsePrefix("2001:db8:2::/48"), City: "Munich"},
+		{CIDR: netip.MustParsePrefix("2001:db8:2::/48"), City: "Cologne"}, // Duplicated
+	})
+
+	tests := []struct {
+		addr     string
+		wantCity string
+		wantOk   bool
+	}{
+		{"203.0.1.1", "Lyon", true},
+		{"203.0.113.1", "Paris", true},
+		{"203.0.113.42", "Marseille", true},
+		{"::ffff:203.0.113.42", "Marseille", true},
+		{"203.1.0.1", "", false},
+		{"2001:db8::1", "Berlin", true},
+		{"2001:db8:1::1", "Hamburg", true},
+		{"2001:db8:2::1", "Cologne", true},
+		{"2001:db9::1", "", false},
+		{"1.1.1.1", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			got, ok := table.Lookup(netip.MustParseAddr(tt.addr))
+			assert.Equal(t, tt.wantOk, ok)
+			if ok {
+				assert.Equal(t, tt.wantCity, got.City)
+			}
+		})
+	}
+
+	assert.Equal(t, 6, table.Len())
+}
+
+func TestOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overrides.csv")
+	assert.NoError(t, os.WriteFile(path, []byte("203.0.113.0/24,FR,France,Paris,48.8566,2.35222\n"), 0o644))
+
+	o, err := New(path, &logger)
+	assert.NoError(t, err)
+
+	t.Run("Lookup overridden address", func(t *testing.T) {
+		g, ok := o.Lookup(netip.MustParseAddr("203.0.113.1"))
+		assert.True(t, ok)
+		assert.Equal(t, &models.GeoIP{
+			IP:          "203.0.113.1",
+			Family:      models.FamilyIPv4,
+			CountryCode: "FR",
+			CountryName: "France",
+			City:        "Paris",
+			Latitude:    48.8566,
+			Longitude:   2.35222,
+			Source:      Source,
+		}, g)
+	})
+
+	t.Run("Lookup non overridden address", func(t *testing.T) {
+		_, ok := o.Lookup(netip.MustParseAddr("1.1.1.1"))
+		assert.False(t, ok)
+	})
+
+	t.Run("Reload", func(t *testing.T) {
+		assert.NoError(t, os.WriteFile(path, []byte("1.1.1.0/24,AU,Australia,Sydney,-33.8688,151.2093\n"), 0o644))
+		assert.NoError(t, o.Reload())
+
+		_, ok := o.Lookup(netip.MustParseAddr("203.0.113.1"))
+		assert.False(t, ok)
+		g, ok := o.Lookup(netip.MustParseAddr("1.1.1.1"))
+		assert.True(t, ok)
+		assert.Equal(t, "Sydney", g.City)
+	})
+
+	t.Run("Failed reload keeps the current overrides", func(t *testing.T) {
+		assert.NoError(t, os.WriteFile(path, []byte("bla\n"), 0o644))
+		assert.Error(t, o.Reload())
+
+		g, ok := o.Lookup(netip.MustParseAddr("1.1.1.1"))
+		assert.True(t, ok)
+		assert.Equal(t, "Sydney", g.City)
+	})
+
+	t.Run("Watch", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		assert.NoError(t, o.Watch(ctx))
+		assert.NoError(t, os.WriteFile(path, []byte("2.2.2.0/24,FR,France,Paris,48.8566,2.35222\n"), 0o644))
+
+		assert.Eventually(t, func() bool {
+			_, ok := o.Lookup(netip.MustParseAddr("2.2.2.2"))
+			return ok
+		}, 5*time.Second, 50*time.Millisecond)
+	})
+
+	t.Run("Invalid file", func(t *testing.T) {
+		_, err := New(filepath.Join(t.TempDir(), "nonexistent.csv"), &logger)
+		assert.Error(t, err)
+	})
+
+	t.Run("Nil overrides", func(t *testing.T) {
+		var o *Overrides
+		_, ok := o.Lookup(netip.MustParseAddr("1.1.1.1"))
+		assert.False(t, ok)
+	})
+}
@@ -0,0 +1,323 @@
+package repositories
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// DefaultBoltTTL is the default time before an item
+	// of the bolt database expires
+	DefaultBoltTTL = 30 * 24 * time.Hour
+
+	// DefaultBoltCleanupInterval is the default duration between
+	// two removals of the expired items of the bolt database
+	DefaultBoltCleanupInterval = time.Hour
+
+	// boltOpenTimeout is the maximum duration to wait for the lock of
+	// the database file, held by another process
+	boltOpenTimeout = 5 * time.Second
+
+	// boltCleanupBatchSize is the maximum number of items checked for
+	// expiration in a single transaction, so the writers are never
+	// blocked for long
+	boltCleanupBatchSize = 1000
+
+	// boltExpiresAtSize is the size of the expiration time
+	// prepended to the values
+	boltExpiresAtSize = 8
+)
+
+var (
+	// ErrBoltDBKeyDoesNotExists is returned when the bolt database has
+	// no item for a key, or only an expired one
+	ErrBoltDBKeyDoesNotExists = errors.New("no value found for key")
+
+	// errBoltCorruptValue is returned for the values too short to hold
+	// their expiration time
+	errBoltCorruptValue = errors.New("corrupt value")
+)
+
+// Prometheus metrics
+var (
+	boltItemSaved = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bolt_items_saved_total",
+		Help: "The total number of saved items in the bolt database",
+	})
+	boltItemFailedSaved = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bolt_items_failed_saved_total",
+		Help: "The total number of failed saved items in the bolt database",
+	})
+	boltItemRead = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bolt_items_read_total",
+		Help: "The total number of read items from the bolt database",
+	})
+	boltItemFailedRead = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bolt_items_failed_read_total",
+		Help: "The total number of failed read items from the bolt database",
+	})
+	boltItemExpired = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bolt_items_expired_total",
+		Help: "The total number of expired items removed from the bolt database",
+	})
+)
+
+// boltDB is a durable database stored in a single file with bbolt,
+// an embedded key-value store. It is meant to be the last layer of the
+// cache chain, keeping the geolocations for much longer than redis.
+//
+// The items are saved in a bucket named after KeyVersion, so the values
+// of another version of the schema are never decoded. Each value is the
+// expiration time of the item, as unix nanoseconds, followed by its json.
+//
+// The expired items are misses, and are removed by Cleanup. The pages they
+// used are reused by the next writes, so the file doesn't grow beyond the
+// largest number of live items.
+type boltDB struct {
+	db     *bolt.DB
+	bucket []byte
+	ttl    time.Duration
+	logger *zerolog.Logger
+
+	// closed is done once Close has been called,
+	// stopping the Run loops
+	closed context.Context
+	close  context.CancelFunc
+	mu     sync.Mutex
+	runs   sync.WaitGroup
+
+	// now is used to mock the time in the tests
+	now func() time.Time
+}
+
+// NewBoltDB will open, or create, the bolt database file at path.
+// Its items expire after ttl, or DefaultBoltTTL when ttl is 0.
+// It fails if the file is locked by another process for too long.
+func NewBoltDB(path string, ttl time.Duration, logger *zerolog.Logger) (*boltDB, error) {
+	if path == "" {
+		return nil, fmt.Errorf("error: the path of the bolt database is empty")
+	}
+
+	if ttl == 0 {
+		ttl = DefaultBoltTTL
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("error: failed to open bolt database %s: %w", path, err)
+	}
+
+	b := &boltDB{
+		db:     db,
+		bucket: []byte(fmt.Sprintf("geoip:v%d", KeyVersion)),
+		ttl:    ttl,
+		logger: logger,
+		now:    time.Now,
+	}
+	b.closed, b.close = context.WithCancel(context.Background())
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(b.bucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error: failed to create bolt bucket: %w", err)
+	}
+
+	return b, nil
+}
+
+// Save will add the IP Geolocation info of the given IP address
+// in the bolt database, expiring after the TTL of the database.
+func (b *boltDB) Save(ctx context.Context, geoip *models.GeoIP) error {
+	value, err := json.Marshal(geoip)
+	if err == nil {
+		buf := make([]byte, boltExpiresAtSize, boltExpiresAtSize+len(value))
+		binary.BigEndian.PutUint64(buf, uint64(b.now().Add(b.ttl).UnixNano()))
+		buf = append(buf, value...)
+
+		err = b.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(b.bucket).Put([]byte(geoip.IP), buf)
+		})
+	}
+	if err != nil {
+		// Increment Prometheus counter
+		boltItemFailedSaved.Inc()
+		return fmt.Errorf("error: cannot save value in bolt: %w", err)
+	}
+
+	// Increment the Prometheus counter
+	boltItemSaved.Inc()
+
+	return nil
+}
+
+// Get will retrieve the IP Geolocation info of the given IP address
+// from the bolt database. The expired items are misses.
+func (b *boltDB) Get(ctx context.Context, ip string) (*models.GeoIP, error) {
+	var g models.GeoIP
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(b.bucket).Get([]byte(ip))
+		if v == nil {
+			return ErrBoltDBKeyDoesNotExists
+		}
+		if len(v) < boltExpiresAtSize {
+			return errBoltCorruptValue
+		}
+		if b.expired(v) {
+			return ErrBoltDBKeyDoesNotExists
+		}
+
+		// The value is only valid during the transaction,
+		// json.Unmarshal copies it
+		return json.Unmarshal(v[boltExpiresAtSize:], &g)
+	})
+	if err != nil {
+		// Increment Prometheus counter
+		boltItemFailedRead.Inc()
+		return nil, fmt.Errorf("error: cannot read value in bolt for key: %s: %w", ip, err)
+	}
+
+	// Increment the Prometheus counter
+	boltItemRead.Inc()
+
+	return &g, nil
+}
+
+// Delete will remove the IP Geolocation info of the given IP address from the bolt database.
+func (b *boltDB) Delete(ctx context.Context, ip string) error {
+	if err := b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(b.bucket).Delete([]byte(ip))
+	}); err != nil {
+		return fmt.Errorf("error: cannot delete value in bolt for key: %s: %w", ip, err)
+	}
+
+	return nil
+}
+
+// Status will retrieve the status of the bolt database.
+// It fails once the database is closed.
+func (b *boltDB) Status(ctx context.Context, wg *sync.WaitGroup, ch chan error) {
+	defer wg.Done()
+	ch <- b.db.View(func(tx *bolt.Tx) error { return nil })
+}
+
+// Cleanup removes the expired items, and the corrupt ones, from the bolt
+// database and returns their number. The items are checked by batches of
+// boltCleanupBatchSize, each in its own transaction.
+func (b *boltDB) Cleanup(ctx context.Context) (int, error) {
+	var n int
+	var next []byte
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+
+		var expired [][]byte
+		err := b.db.Update(func(tx *bolt.Tx) error {
+			expired = expired[:0]
+			c := tx.Bucket(b.bucket).Cursor()
+
+			k, v := c.First()
+			if next != nil {
+				k, v = c.Seek(next)
+			}
+			for i := 0; k != nil && i < boltCleanupBatchSize; i++ {
+				if len(v) < boltExpiresAtSize || b.expired(v) {
+					expired = append(expired, bytes.Clone(k))
+				}
+				k, v = c.Next()
+			}
+			next = bytes.Clone(k)
+
+			// Deleting while iterating would make the cursor skip items
+			for _, k := range expired {
+				if err := tx.Bucket(b.bucket).Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return n, fmt.Errorf("error: failed to remove the expired items of bolt: %w", err)
+		}
+
+		n += len(expired)
+
+		// Increment Prometheus counter
+		boltItemExpired.Add(float64(len(expired)))
+
+		if next == nil {
+			return n, nil
+		}
+	}
+}
+
+// Run removes the expired items from the bolt database every interval
+// until ctx is done or the database is closed.
+// The default interval is used when interval is not positive.
+func (b *boltDB) Run(ctx context.Context, interval time.Duration) {
+	b.mu.Lock()
+	if b.closed.Err() != nil {
+		b.mu.Unlock()
+		return
+	}
+	b.runs.Add(1)
+	b.mu.Unlock()
+	defer b.runs.Done()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(b.closed, cancel)()
+
+	if interval <= 0 {
+		interval = DefaultBoltCleanupInterval
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			n, err := b.Cleanup(ctx)
+			if err != nil {
+				b.logger.Error().Err(err).Msg("Failed to remove the expired items of the bolt database")
+				continue
+			}
+			b.logger.Debug().Msgf("Removed %d expired items of the bolt database", n)
+		}
+	}
+}
+
+// Close stops the Run loops, then closes the bolt database file.
+func (b *boltDB) Close() error {
+	b.mu.Lock()
+	b.close()
+	b.mu.Unlock()
+
+	b.runs.Wait()
+
+	return b.db.Close()
+}
+
+// expired returns whether the given value has expired.
+func (b *boltDB) expired(v []byte) bool {
+	return b.now().UnixNano() >= int64(binary.BigEndian.Uint64(v))
+}
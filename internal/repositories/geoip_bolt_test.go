@@ -0,0 +1,268 @@
+package repositories
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+var logger = zerolog.New(os.Stdout).Level(zerolog.NoLevel)
+
+// newTestBoltDB opens a bolt database in a temporary directory,
+// whose clock is controlled by the returned function
+func newTestBoltDB(t *testing.T, ttl time.Duration) (*boltDB, func(time.Duration)) {
+	b, err := NewBoltDB(filepath.Join(t.TempDir(), "geoip.db"), ttl, &logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+
+	now := time.Unix(1700000000, 0)
+	b.now = func() time.Time { return now }
+
+	return b, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestNewBoltDB(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name    string
+		path    string
+		ttl     time.Duration
+		wantTTL time.Duration
+		wantErr bool
+	}{
+		{name: "Empty path", path: "", wantErr: true},
+		{name: "Missing directory", path: filepath.Join(dir, "missing", "geoip.db"), wantErr: true},
+		{name: "Default TTL", path: filepath.Join(dir, "default.db"), wantTTL: DefaultBoltTTL},
+		{name: "TTL 1h", path: filepath.Join(dir, "1h.db"), ttl: time.Hour, wantTTL: time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := NewBoltDB(tt.path, tt.ttl, &logger)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewBoltDB() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			defer b.Close()
+
+			assert.Equal(t, tt.wantTTL, b.ttl)
+			assert.Equal(t, []byte("geoip:v2"), b.bucket)
+		})
+	}
+}
+
+func TestBoltDBSaveGet(t *testing.T) {
+	ctx := context.Background()
+	b, _ := newTestBoltDB(t, time.Hour)
+
+	_, err := b.Get(ctx, "1.1.1.1")
+	assert.ErrorIs(t, err, ErrBoltDBKeyDoesNotExists)
+
+	tests := []*models.GeoIP{
+		{IP: "1.1.1.1", CountryCode: "AU", CountryName: "Australia"},
+		{IP: "2001:db8::1", CountryCode: "FR", City: "Paris"},
+	}
+	for _, g := range tests {
+		t.Run(g.IP, func(t *testing.T) {
+			assert.NoError(t, b.Save(ctx, g))
+
+			got, err := b.Get(ctx, g.IP)
+			assert.NoError(t, err)
+			assert.Equal(t, g, got)
+		})
+	}
+
+	// Saving again replaces the item
+	assert.NoError(t, b.Save(ctx, &models.GeoIP{IP: "1.1.1.1", CountryCode: "NZ"}))
+	got, err := b.Get(ctx, "1.1.1.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "NZ", got.CountryCode)
+}
+
+func TestBoltDBPersistence(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "geoip.db")
+
+	b, err := NewBoltDB(path, time.Hour, &logger)
+	assert.NoError(t, err)
+	g := &models.GeoIP{IP: "1.1.1.1", CountryCode: "AU"}
+	assert.NoError(t, b.Save(ctx, g))
+	assert.NoError(t, b.Close())
+
+	// The items survive a restart
+	b, err = NewBoltDB(path, time.Hour, &logger)
+	assert.NoError(t, err)
+	defer b.Close()
+
+	got, err := b.Get(ctx, "1.1.1.1")
+	assert.NoError(t, err)
+	assert.Equal(t, g, got)
+}
+
+func TestBoltDBExpiration(t *testing.T) {
+	ctx := context.Background()
+	b, advance := newTestBoltDB(t, time.Hour)
+
+	assert.NoError(t, b.Save(ctx, &models.GeoIP{IP: "1.1.1.1"}))
+
+	advance(time.Hour - time.Second)
+	_, err := b.Get(ctx, "1.1.1.1")
+	assert.NoError(t, err)
+
+	advance(time.Second)
+	_, err = b.Get(ctx, "1.1.1.1")
+	assert.ErrorIs(t, err, ErrBoltDBKeyDoesNotExists)
+}
+
+func TestBoltDBDelete(t *testing.T) {
+	ctx := context.Background()
+	b, _ := newTestBoltDB(t, time.Hour)
+
+	assert.NoError(t, b.Save(ctx, &models.GeoIP{IP: "1.1.1.1"}))
+	assert.NoError(t, b.Delete(ctx, "1.1.1.1"))
+
+	_, err := b.Get(ctx, "1.1.1.1")
+	assert.ErrorIs(t, err, ErrBoltDBKeyDoesNotExists)
+
+	// Deleting a missing key isn't an error
+	assert.NoError(t, b.Delete(ctx, "1.1.1.1"))
+}
+
+func TestBoltDBCleanup(t *testing.T) {
+	ctx := context.Background()
+	b, advance := newTestBoltDB(t, time.Hour)
+
+	// More than a batch, with expired and live items interleaved
+	n := 2*boltCleanupBatchSize + 10
+	for i := 0; i < n; i++ {
+		if i%2 == 0 {
+			assert.NoError(t, b.Save(ctx, &models.GeoIP{IP: fmt.Sprintf("10.0.%d.%d", i/256, i%256)}))
+		}
+	}
+	advance(30 * time.Minute)
+	for i := 0; i < n; i++ {
+		if i%2 == 1 {
+			assert.NoError(t, b.Save(ctx, &models.GeoIP{IP: fmt.Sprintf("10.0.%d.%d", i/256, i%256)}))
+		}
+	}
+
+	// A corrupt value is removed as well
+	assert.NoError(t, b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(b.bucket).Put([]byte("corrupt"), []byte{1})
+	}))
+
+	advance(30 * time.Minute)
+	removed, err := b.Cleanup(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, n/2+1, removed)
+
+	count := 0
+	assert.NoError(t, b.db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket(b.bucket).Stats().KeyN
+		return nil
+	}))
+	assert.Equal(t, n/2, count)
+
+	_, err = b.Get(ctx, "10.0.0.1")
+	assert.NoError(t, err)
+
+	// Nothing left to remove
+	removed, err = b.Cleanup(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, removed)
+
+	// Cleanup stops once ctx is done
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = b.Cleanup(cctx)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestBoltDBRun(t *testing.T) {
+	ctx := context.Background()
+	b, advance := newTestBoltDB(t, time.Hour)
+
+	assert.NoError(t, b.Save(ctx, &models.GeoIP{IP: "1.1.1.1"}))
+	advance(time.Hour)
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.Run(ctx, 10*time.Millisecond)
+	}()
+
+	assert.Eventually(t, func() bool {
+		count := -1
+		b.db.View(func(tx *bolt.Tx) error {
+			count = tx.Bucket(b.bucket).Stats().KeyN
+			return nil
+		})
+		return count == 0
+	}, time.Second, 5*time.Millisecond)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run() didn't return after the context was done")
+	}
+}
+
+func TestBoltDBCloseStopsRun(t *testing.T) {
+	b, err := NewBoltDB(filepath.Join(t.TempDir(), "geoip.db"), time.Hour, &logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.Run(context.Background(), time.Millisecond)
+	}()
+
+	// Let the loop clean up a few times
+	time.Sleep(10 * time.Millisecond)
+
+	// Close stops Run, although its context is never done
+	assert.NoError(t, b.Close())
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run() didn't return after Close()")
+	}
+
+	// Run returns right away once closed
+	b.Run(context.Background(), time.Millisecond)
+}
+
+func TestBoltDBStatus(t *testing.T) {
+	ctx := context.Background()
+	b, _ := newTestBoltDB(t, time.Hour)
+
+	var wg sync.WaitGroup
+	ch := make(chan error, 2)
+
+	wg.Add(1)
+	b.Status(ctx, &wg, ch)
+	assert.NoError(t, <-ch)
+
+	assert.NoError(t, b.Close())
+	wg.Add(1)
+	b.Status(ctx, &wg, ch)
+	assert.Error(t, <-ch)
+}
@@ -91,6 +91,16 @@ func (m *inMemoryDB) Get(ctx context.Context, ip string) (*models.GeoIP, error)
 	return v, nil
 }
 
+// Delete will remove the IP Geolocation info of the given IP address from the hashmap.
+func (m *inMemoryDB) Delete(ctx context.Context, ip string) error {
+	m.rwm.Lock()
+	defer m.rwm.Unlock()
+
+	delete(m.local, ip)
+
+	return nil
+}
+
 // Status will retrieve the status of the inMemoryDB.
 func (m *inMemoryDB) Status(ctx context.Context, wg *sync.WaitGroup, ch chan error) {
 	defer wg.Done()
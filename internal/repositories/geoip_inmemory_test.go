@@ -143,6 +143,29 @@ func TestInMemoryDBGet(t *testing.T) {
 	}
 }
 
+func TestInMemoryDBDelete(t *testing.T) {
+	m := NewInMemoryDB()
+	ctx := context.Background()
+
+	m.Save(ctx, &models.GeoIP{IP: "1.1.1.1"})
+	m.Save(ctx, &models.GeoIP{IP: "2.2.2.2"})
+
+	if err := m.Delete(ctx, "1.1.1.1"); err != nil {
+		t.Errorf("inMemoryDB.Delete() error = %v", err)
+	}
+	if _, err := m.Get(ctx, "1.1.1.1"); err == nil {
+		t.Errorf("inMemoryDB.Get() of a deleted key, want error")
+	}
+	if _, err := m.Get(ctx, "2.2.2.2"); err != nil {
+		t.Errorf("inMemoryDB.Get() error = %v", err)
+	}
+
+	// Deleting a missing key isn't an error
+	if err := m.Delete(ctx, "1.1.1.1"); err != nil {
+		t.Errorf("inMemoryDB.Delete() error = %v", err)
+	}
+}
+
 func TestInMemoryDBStatus(t *testing.T) {
 	m := NewInMemoryDB()
 	var wg sync.WaitGroup
@@ -0,0 +1,275 @@
+package repositories
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// lruEntryOverhead is the approximate memory used by an entry
+// on top of its GeoIP: list element, map bucket and pointers
+const lruEntryOverhead = 128
+
+// Prometheus metrics
+var (
+	inMemoryItemEvicted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "in_memory_items_evicted_total",
+		Help: "The total number of items evicted from the in-memory database to stay within its size limits",
+	})
+	inMemoryItemExpired = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "in_memory_items_expired_total",
+		Help: "The total number of expired items removed from the in-memory database",
+	})
+	inMemoryItems = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "in_memory_items",
+		Help: "The current number of items in the in-memory database",
+	})
+	inMemoryBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "in_memory_bytes",
+		Help: "The approximate memory used by the items of the in-memory database, in bytes",
+	})
+)
+
+// lruDB is a size-bounded in-memory database.
+// Once it holds maxEntries items or maxBytes bytes, the least recently used
+// items are evicted to make room for the new ones.
+// Each item expires after its TTL.
+type lruDB struct {
+	// Maximum number of items. 0 for no limit
+	maxEntries int
+	// Maximum approximate memory used by the items. 0 for no limit
+	maxBytes int64
+	// Default TTL of the items. 0 for no expiry
+	ttl time.Duration
+
+	// Doubly linked list of the items, the most recently used first
+	ll *list.List
+	// Hashmap to find the items of the list by ip address
+	items map[string]*list.Element
+	// Current approximate memory used by the items
+	bytes int64
+	// Mutex to protect the list and the hashmap from concurrent accesses.
+	// A read moves the item to the front of the list, hence the lack of RWMutex.
+	mu sync.Mutex
+
+	// now is used to mock the time in the tests
+	now func() time.Time
+}
+
+type lruEntry struct {
+	geoip     *models.GeoIP
+	size      int64
+	expiresAt time.Time
+}
+
+// NewLRUDB will create a new lruDB holding at most maxEntries items
+// and maxBytes bytes, each of them expiring after ttl.
+// A limit of 0 disables it.
+func NewLRUDB(maxEntries int, maxBytes int64, ttl time.Duration) *lruDB {
+	if maxEntries < 0 {
+		maxEntries = 0
+	}
+	if maxBytes < 0 {
+		maxBytes = 0
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+
+	return &lruDB{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		ttl:        ttl,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+		now:        time.Now,
+	}
+}
+
+// Save will add the IP Geolocation info of the given IP address
+// with the default TTL of the database.
+func (m *lruDB) Save(ctx context.Context, geoip *models.GeoIP) error {
+	return m.SaveWithTTL(ctx, geoip, m.ttl)
+}
+
+// SaveWithTTL will add the IP Geolocation info of the given IP address,
+// expiring after ttl. A ttl of 0 means no expiry.
+// The least recently used items are evicted if the database is full.
+func (m *lruDB) SaveWithTTL(ctx context.Context, geoip *models.GeoIP, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	e := &lruEntry{geoip: geoip, size: geoIPSize(geoip)}
+	if ttl > 0 {
+		e.expiresAt = now.Add(ttl)
+	}
+
+	if el, ok := m.items[geoip.IP]; ok {
+		m.addBytes(e.size - el.Value.(*lruEntry).size)
+		el.Value = e
+		m.ll.MoveToFront(el)
+	} else {
+		m.items[geoip.IP] = m.ll.PushFront(e)
+		m.addBytes(e.size)
+		inMemoryItems.Inc()
+	}
+
+	// Increment Prometheus counter
+	inMemoryItemSaved.Inc()
+
+	m.evict(now)
+
+	return nil
+}
+
+// Get will retrieve the IP Geolocation info for the given IP address.
+// It returns the IP Geolocation info if it's a cache HIT, or an error otherwise.
+// Expired items are removed on read.
+func (m *lruDB) Get(ctx context.Context, ip string) (*models.GeoIP, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.items[ip]
+	if ok && el.Value.(*lruEntry).expired(m.now()) {
+		m.remove(el)
+
+		// Increment Prometheus counter
+		inMemoryItemExpired.Inc()
+		ok = false
+	}
+
+	if !ok {
+		// Increment Prometheus counter
+		inMemoryItemFailedRead.Inc()
+		return nil, &InMemoryDBError{
+			message: "no value found for key",
+			key:     ip,
+		}
+	}
+
+	m.ll.MoveToFront(el)
+
+	// Increment Prometheus counter
+	inMemoryItemRead.Inc()
+
+	return el.Value.(*lruEntry).geoip, nil
+}
+
+// Delete will remove the IP Geolocation info of the given IP address.
+func (m *lruDB) Delete(ctx context.Context, ip string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if el, ok := m.items[ip]; ok {
+		m.remove(el)
+	}
+
+	return nil
+}
+
+// Purge will remove all the items of the database.
+func (m *lruDB) Purge() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for el := m.ll.Back(); el != nil; el = m.ll.Back() {
+		m.remove(el)
+	}
+}
+
+// Entry is an item of an in-memory database
+type Entry struct {
+	GeoIP *models.GeoIP
+	// Zero if the item doesn't expire
+	ExpiresAt time.Time
+}
+
+// Entries returns the items of the database which aren't expired,
+// the least recently used first.
+func (m *lruDB) Entries() []Entry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	entries := make([]Entry, 0, m.ll.Len())
+	for el := m.ll.Back(); el != nil; el = el.Prev() {
+		e := el.Value.(*lruEntry)
+		if !e.expired(now) {
+			entries = append(entries, Entry{GeoIP: e.geoip, ExpiresAt: e.expiresAt})
+		}
+	}
+
+	return entries
+}
+
+// Len returns the number of items in the database,
+// including the expired ones not removed yet.
+func (m *lruDB) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.ll.Len()
+}
+
+// Status will retrieve the status of the lruDB.
+func (m *lruDB) Status(ctx context.Context, wg *sync.WaitGroup, ch chan error) {
+	defer wg.Done()
+
+	_, _ = m.Get(ctx, "")
+
+	ch <- nil
+}
+
+// evict removes the expired items from the back of the list, then
+// the least recently used items until the database is within its limits.
+// m.mu must be held.
+func (m *lruDB) evict(now time.Time) {
+	for el := m.ll.Back(); el != nil && el.Value.(*lruEntry).expired(now); el = m.ll.Back() {
+		m.remove(el)
+
+		// Increment Prometheus counter
+		inMemoryItemExpired.Inc()
+	}
+
+	for m.ll.Len() > 0 && ((m.maxEntries > 0 && m.ll.Len() > m.maxEntries) || (m.maxBytes > 0 && m.bytes > m.maxBytes)) {
+		m.remove(m.ll.Back())
+
+		// Increment Prometheus counter
+		inMemoryItemEvicted.Inc()
+	}
+}
+
+// remove removes the given item.
+// m.mu must be held.
+func (m *lruDB) remove(el *list.Element) {
+	e := m.ll.Remove(el).(*lruEntry)
+	delete(m.items, e.geoip.IP)
+	m.addBytes(-e.size)
+	inMemoryItems.Dec()
+}
+
+// addBytes updates the memory used by the items.
+// m.mu must be held.
+func (m *lruDB) addBytes(n int64) {
+	m.bytes += n
+	inMemoryBytes.Add(float64(n))
+}
+
+func (e *lruEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
+
+// geoIPSize returns the approximate memory used by an item holding g.
+func geoIPSize(g *models.GeoIP) int64 {
+	// The ip address is stored twice: as map key and in the GeoIP
+	return int64(unsafe.Sizeof(*g)) + lruEntryOverhead +
+		int64(2*len(g.IP)+len(g.Family)+len(g.CountryCode)+len(g.CountryName)+
+			len(g.City)+len(g.Organization)+len(g.Source))
+}
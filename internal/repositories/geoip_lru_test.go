@@ -0,0 +1,272 @@
+package repositories
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// clock is a manually advanced time source
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time { return c.t }
+
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestLRUDB(maxEntries int, maxBytes int64, ttl time.Duration) (*lruDB, *clock) {
+	c := &clock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	m := NewLRUDB(maxEntries, maxBytes, ttl)
+	m.now = c.now
+	return m, c
+}
+
+func TestNewLRUDB(t *testing.T) {
+	tests := []struct {
+		name           string
+		maxEntries     int
+		maxBytes       int64
+		ttl            time.Duration
+		wantMaxEntries int
+		wantMaxBytes   int64
+		wantTTL        time.Duration
+	}{
+		{name: "Custom values", maxEntries: 10, maxBytes: 1024, ttl: time.Hour, wantMaxEntries: 10, wantMaxBytes: 1024, wantTTL: time.Hour},
+		{name: "No limits", wantMaxEntries: 0, wantMaxBytes: 0, wantTTL: 0},
+		{name: "Negative values", maxEntries: -1, maxBytes: -1, ttl: -time.Hour, wantMaxEntries: 0, wantMaxBytes: 0, wantTTL: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewLRUDB(tt.maxEntries, tt.maxBytes, tt.ttl)
+			assert.Equal(t, tt.wantMaxEntries, m.maxEntries)
+			assert.Equal(t, tt.wantMaxBytes, m.maxBytes)
+			assert.Equal(t, tt.wantTTL, m.ttl)
+			assert.Equal(t, 0, m.Len())
+		})
+	}
+}
+
+func TestLRUDBSaveGet(t *testing.T) {
+	m, _ := newTestLRUDB(0, 0, 0)
+	ctx := context.Background()
+
+	g := &models.GeoIP{IP: "1.1.1.1", CountryCode: "AU", CountryName: "Australia", City: "Sydney"}
+	assert.NoError(t, m.Save(ctx, g))
+
+	got, err := m.Get(ctx, "1.1.1.1")
+	assert.NoError(t, err)
+	assert.Equal(t, g, got)
+
+	_, err = m.Get(ctx, "2.2.2.2")
+	assert.Error(t, err)
+
+	// Update an existing item
+	g2 := &models.GeoIP{IP: "1.1.1.1", CountryCode: "FR", CountryName: "France"}
+	assert.NoError(t, m.Save(ctx, g2))
+	got, err = m.Get(ctx, "1.1.1.1")
+	assert.NoError(t, err)
+	assert.Equal(t, g2, got)
+	assert.Equal(t, 1, m.Len())
+	assert.Equal(t, geoIPSize(g2), m.bytes)
+}
+
+func TestLRUDBEviction(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Max entries", func(t *testing.T) {
+		m, _ := newTestLRUDB(2, 0, 0)
+
+		m.Save(ctx, &models.GeoIP{IP: "1.1.1.1"})
+		m.Save(ctx, &models.GeoIP{IP: "2.2.2.2"})
+
+		// 1.1.1.1 becomes the most recently used
+		_, err := m.Get(ctx, "1.1.1.1")
+		assert.NoError(t, err)
+
+		m.Save(ctx, &models.GeoIP{IP: "3.3.3.3"})
+		assert.Equal(t, 2, m.Len())
+
+		_, err = m.Get(ctx, "2.2.2.2")
+		assert.Error(t, err)
+		_, err = m.Get(ctx, "1.1.1.1")
+		assert.NoError(t, err)
+		_, err = m.Get(ctx, "3.3.3.3")
+		assert.NoError(t, err)
+	})
+
+	t.Run("Max bytes", func(t *testing.T) {
+		size := geoIPSize(&models.GeoIP{IP: "1.1.1.1"})
+		m, _ := newTestLRUDB(0, 3*size, 0)
+
+		for i := 0; i < 10; i++ {
+			m.Save(ctx, &models.GeoIP{IP: fmt.Sprintf("%d.1.1.1", i)})
+		}
+
+		assert.Equal(t, 3, m.Len())
+		assert.LessOrEqual(t, m.bytes, 3*size)
+
+		_, err := m.Get(ctx, "9.1.1.1")
+		assert.NoError(t, err)
+		_, err = m.Get(ctx, "0.1.1.1")
+		assert.Error(t, err)
+	})
+
+	t.Run("Item larger than max bytes", func(t *testing.T) {
+		m, _ := newTestLRUDB(0, 1, 0)
+
+		m.Save(ctx, &models.GeoIP{IP: "1.1.1.1"})
+		assert.Equal(t, 0, m.Len())
+		assert.Equal(t, int64(0), m.bytes)
+	})
+}
+
+func TestLRUDBExpiry(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Default TTL", func(t *testing.T) {
+		m, c := newTestLRUDB(0, 0, time.Hour)
+
+		m.Save(ctx, &models.GeoIP{IP: "1.1.1.1"})
+
+		c.advance(59 * time.Minute)
+		_, err := m.Get(ctx, "1.1.1.1")
+		assert.NoError(t, err)
+
+		c.advance(time.Minute)
+		_, err = m.Get(ctx, "1.1.1.1")
+		assert.Error(t, err)
+		assert.Equal(t, 0, m.Len())
+	})
+
+	t.Run("Per-entry TTL", func(t *testing.T) {
+		m, c := newTestLRUDB(0, 0, time.Hour)
+
+		m.SaveWithTTL(ctx, &models.GeoIP{IP: "1.1.1.1"}, time.Minute)
+		m.SaveWithTTL(ctx, &models.GeoIP{IP: "2.2.2.2"}, 0)
+		m.Save(ctx, &models.GeoIP{IP: "3.3.3.3"})
+
+		c.advance(time.Minute)
+		_, err := m.Get(ctx, "1.1.1.1")
+		assert.Error(t, err)
+
+		c.advance(24 * time.Hour)
+		_, err = m.Get(ctx, "2.2.2.2")
+		assert.NoError(t, err)
+		_, err = m.Get(ctx, "3.3.3.3")
+		assert.Error(t, err)
+	})
+
+	t.Run("Expired items are removed on save", func(t *testing.T) {
+		m, c := newTestLRUDB(0, 0, time.Minute)
+
+		m.Save(ctx, &models.GeoIP{IP: "1.1.1.1"})
+		m.Save(ctx, &models.GeoIP{IP: "2.2.2.2"})
+
+		c.advance(time.Minute)
+		m.Save(ctx, &models.GeoIP{IP: "3.3.3.3"})
+		assert.Equal(t, 1, m.Len())
+	})
+}
+
+func TestLRUDBDelete(t *testing.T) {
+	m, _ := newTestLRUDB(0, 0, 0)
+	ctx := context.Background()
+
+	m.Save(ctx, &models.GeoIP{IP: "1.1.1.1"})
+	m.Save(ctx, &models.GeoIP{IP: "2.2.2.2"})
+
+	assert.NoError(t, m.Delete(ctx, "1.1.1.1"))
+	_, err := m.Get(ctx, "1.1.1.1")
+	assert.Error(t, err)
+	assert.Equal(t, 1, m.Len())
+	assert.Equal(t, geoIPSize(&models.GeoIP{IP: "2.2.2.2"}), m.bytes)
+
+	// Deleting a missing key isn't an error
+	assert.NoError(t, m.Delete(ctx, "1.1.1.1"))
+
+	m.Purge()
+	assert.Equal(t, 0, m.Len())
+	assert.Equal(t, int64(0), m.bytes)
+	_, err = m.Get(ctx, "2.2.2.2")
+	assert.Error(t, err)
+}
+
+func TestLRUDBEntries(t *testing.T) {
+	m, c := newTestLRUDB(0, 0, time.Hour)
+	ctx := context.Background()
+
+	m.Save(ctx, &models.GeoIP{IP: "1.1.1.1"})
+	m.SaveWithTTL(ctx, &models.GeoIP{IP: "2.2.2.2"}, 0)
+	m.SaveWithTTL(ctx, &models.GeoIP{IP: "3.3.3.3"}, time.Minute)
+	m.Get(ctx, "1.1.1.1")
+
+	c.advance(time.Minute)
+
+	// 3.3.3.3 is expired, 1.1.1.1 is the most recently used
+	assert.Equal(t, []Entry{
+		{GeoIP: &models.GeoIP{IP: "2.2.2.2"}},
+		{GeoIP: &models.GeoIP{IP: "1.1.1.1"}, ExpiresAt: time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC)},
+	}, m.Entries())
+}
+
+func TestLRUDBConcurrency(t *testing.T) {
+	m := NewLRUDB(100, 0, time.Hour)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				ip := fmt.Sprintf("%d.%d.1.1", i, j%256)
+				m.Save(ctx, &models.GeoIP{IP: ip})
+				m.Get(ctx, ip)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 100, m.Len())
+}
+
+func TestLRUDBStatus(t *testing.T) {
+	m := NewLRUDB(0, 0, 0)
+	var wg sync.WaitGroup
+	ch := make(chan error, 1)
+
+	wg.Add(1)
+	go m.Status(context.Background(), &wg, ch)
+	wg.Wait()
+
+	assert.NoError(t, <-ch)
+}
+
+func BenchmarkLRUDBGet_EntryInLRUDB(b *testing.B) {
+	m := NewLRUDB(1000, 0, time.Hour)
+	m.Save(context.Background(), &models.GeoIP{IP: "1.1.1.1"})
+
+	var ctx = context.Background()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		m.Get(ctx, "1.1.1.1")
+	}
+}
+
+func BenchmarkLRUDBSave_Eviction(b *testing.B) {
+	m := NewLRUDB(1000, 0, time.Hour)
+
+	var ctx = context.Background()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		m.Save(ctx, &models.GeoIP{IP: fmt.Sprintf("%d", i)})
+	}
+}
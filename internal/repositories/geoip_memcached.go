@@ -0,0 +1,159 @@
+package repositories
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// memcachedMaxRelativeExpiration is the longest expiration, in seconds,
+// memcached treats as relative to now. Longer ones are unix timestamps.
+const memcachedMaxRelativeExpiration = 30 * 24 * 60 * 60
+
+// Prometheus metrics
+var (
+	memcachedItemSaved = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "memcached_items_saved_total",
+		Help: "The total number of saved items in the memcached database",
+	})
+	memcachedItemFailedSaved = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "memcached_items_failed_saved_total",
+		Help: "The total number of failed saved items in the memcached database",
+	})
+	memcachedItemRead = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "memcached_items_read_total",
+		Help: "The total number of read items from the memcached database",
+	})
+	memcachedItemFailedRead = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "memcached_items_failed_read_total",
+		Help: "The total number of failed read items from the memcached database",
+	})
+)
+
+type memcachedDB struct {
+	client    *memcache.Client
+	keyTTL    time.Duration
+	keyPrefix string
+
+	// now is used to mock the time in the tests
+	now func() time.Time
+}
+
+// NewMemcachedDB will return a new memcached database using the given
+// comma separated list of servers, ex: "10.0.0.1:11211,10.0.0.2:11211".
+// The keys are spread over the servers, namespaced by prefix and
+// versioned like the redis ones: "<prefix>:v<version>:<ip>".
+func NewMemcachedDB(servers string, ttl time.Duration, prefix string) (*memcachedDB, error) {
+	var addrs []string
+	for _, s := range strings.Split(servers, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			addrs = append(addrs, s)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("error: no memcached server")
+	}
+
+	if strings.ContainsAny(prefix, " \t\r\n") {
+		return nil, fmt.Errorf("error: invalid memcached key prefix %q: whitespaces are not allowed", prefix)
+	}
+
+	var ss memcache.ServerList
+	if err := ss.SetServers(addrs...); err != nil {
+		return nil, fmt.Errorf("error: failed to resolve memcached servers: %w", err)
+	}
+
+	if ttl == 0 {
+		ttl = DefaultKeyTTL
+	}
+
+	return &memcachedDB{
+		client:    memcache.NewFromSelector(&ss),
+		keyTTL:    ttl,
+		keyPrefix: prefix,
+		now:       time.Now,
+	}, nil
+}
+
+func (m *memcachedDB) Save(ctx context.Context, geoip *models.GeoIP) error {
+	value, err := json.Marshal(geoip)
+	if err == nil {
+		err = m.client.Set(&memcache.Item{
+			Key:        versionedKey(m.keyPrefix, geoip.IP),
+			Value:      value,
+			Expiration: memcachedExpiration(m.keyTTL, m.now()),
+		})
+	}
+	if err != nil {
+		// Increment Prometheus counter
+		memcachedItemFailedSaved.Inc()
+		return fmt.Errorf("error: cannot save value in memcached: %w", err)
+	}
+
+	// Increment the Prometheus counter
+	memcachedItemSaved.Inc()
+
+	return nil
+}
+
+func (m *memcachedDB) Get(ctx context.Context, ip string) (*models.GeoIP, error) {
+	var g models.GeoIP
+
+	item, err := m.client.Get(versionedKey(m.keyPrefix, ip))
+	if err == nil {
+		err = json.Unmarshal(item.Value, &g)
+	}
+	if err != nil {
+		// Increment Prometheus counter
+		memcachedItemFailedRead.Inc()
+		return nil, fmt.Errorf("error: cannot read value in memcached for key: %s: %w", ip, err)
+	}
+
+	// Increment the Prometheus counter
+	memcachedItemRead.Inc()
+
+	return &g, nil
+}
+
+// Delete will remove the IP Geolocation info of the given IP address from memcached.
+func (m *memcachedDB) Delete(ctx context.Context, ip string) error {
+	if err := m.client.Delete(versionedKey(m.keyPrefix, ip)); err != nil && !errors.Is(err, memcache.ErrCacheMiss) {
+		return fmt.Errorf("error: cannot delete value in memcached for key: %s: %w", ip, err)
+	}
+
+	return nil
+}
+
+// Status will retrieve the status of the memcached database.
+// It uses the (*memcache.Client).Ping() function, which checks every server.
+func (m *memcachedDB) Status(ctx context.Context, wg *sync.WaitGroup, ch chan error) {
+	defer wg.Done()
+	ch <- m.client.Ping()
+}
+
+// memcachedExpiration returns the memcached expiration of an item saved
+// at now with the given ttl, in seconds and rounded up.
+// The expirations longer than 30 days are converted to unix timestamps,
+// as memcached would otherwise take them for timestamps in 1970.
+func memcachedExpiration(ttl time.Duration, now time.Time) int32 {
+	if ttl <= 0 {
+		return 0
+	}
+
+	seconds := int64(math.Ceil(ttl.Seconds()))
+	if seconds > memcachedMaxRelativeExpiration {
+		return int32(now.Unix() + seconds)
+	}
+
+	return int32(seconds)
+}
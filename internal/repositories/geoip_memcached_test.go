@@ -0,0 +1,333 @@
+package repositories
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeMemcachedItem is an item saved in a fakeMemcached
+type fakeMemcachedItem struct {
+	value      []byte
+	flags      uint32
+	expiration int32
+}
+
+// fakeMemcached is an in-process memcached server implementing
+// the subset of the text protocol used by the client:
+// "gets", "set", "delete" and "version".
+// The expirations are recorded as is and never enforced.
+type fakeMemcached struct {
+	l net.Listener
+
+	mu    sync.Mutex
+	items map[string]fakeMemcachedItem
+}
+
+func runFakeMemcached(t *testing.T) *fakeMemcached {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &fakeMemcached{l: l, items: make(map[string]fakeMemcachedItem)}
+	t.Cleanup(m.Close)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go m.serve(conn)
+		}
+	}()
+
+	return m
+}
+
+func (m *fakeMemcached) Addr() string { return m.l.Addr().String() }
+
+func (m *fakeMemcached) Close() { m.l.Close() }
+
+func (m *fakeMemcached) Item(key string) (fakeMemcachedItem, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item, ok := m.items[key]
+	return item, ok
+}
+
+func (m *fakeMemcached) Set(key string, value []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.items[key] = fakeMemcachedItem{value: value}
+}
+
+func (m *fakeMemcached) serve(conn net.Conn) {
+	defer conn.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+
+		m.mu.Lock()
+		switch {
+		case (args[0] == "get" || args[0] == "gets") && len(args) > 1:
+			for _, key := range args[1:] {
+				if item, ok := m.items[key]; ok {
+					fmt.Fprintf(rw, "VALUE %s %d %d 0\r\n%s\r\n", key, item.flags, len(item.value), item.value)
+				}
+			}
+			rw.WriteString("END\r\n")
+		case args[0] == "set" && len(args) == 5:
+			flags, _ := strconv.ParseUint(args[2], 10, 32)
+			expiration, _ := strconv.ParseInt(args[3], 10, 32)
+			size, _ := strconv.Atoi(args[4])
+			data := make([]byte, size+2)
+			if _, err := io.ReadFull(rw, data); err != nil {
+				m.mu.Unlock()
+				return
+			}
+			m.items[args[1]] = fakeMemcachedItem{value: data[:size], flags: uint32(flags), expiration: int32(expiration)}
+			rw.WriteString("STORED\r\n")
+		case args[0] == "delete" && len(args) == 2:
+			if _, ok := m.items[args[1]]; ok {
+				delete(m.items, args[1])
+				rw.WriteString("DELETED\r\n")
+			} else {
+				rw.WriteString("NOT_FOUND\r\n")
+			}
+		case args[0] == "version":
+			rw.WriteString("VERSION 1.6.0\r\n")
+		default:
+			rw.WriteString("ERROR\r\n")
+		}
+		m.mu.Unlock()
+
+		if err := rw.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func TestNewMemcachedDB(t *testing.T) {
+	type args struct {
+		servers string
+		ttl     time.Duration
+		prefix  string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		wantTTL time.Duration
+		wantErr bool
+	}{
+		{
+			name:    "Empty servers",
+			args:    args{servers: ""},
+			wantErr: true,
+		},
+		{
+			name:    "Only commas",
+			args:    args{servers: " , ,"},
+			wantErr: true,
+		},
+		{
+			name:    "Single server",
+			args:    args{servers: "localhost:11211", prefix: DefaultKeyPrefix},
+			wantTTL: DefaultKeyTTL,
+			wantErr: false,
+		},
+		{
+			name:    "Multiple servers - TTL 1h",
+			args:    args{servers: "127.0.0.1:11211, 127.0.0.2:11211", ttl: time.Hour, prefix: DefaultKeyPrefix},
+			wantTTL: time.Hour,
+			wantErr: false,
+		},
+		{
+			name:    "Invalid server",
+			args:    args{servers: "localhost"},
+			wantErr: true,
+		},
+		{
+			name:    "Invalid prefix",
+			args:    args{servers: "localhost:11211", prefix: "my app"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewMemcachedDB(tt.args.servers, tt.args.ttl, tt.args.prefix)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewMemcachedDB() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			if (err == nil) && (tt.wantTTL != m.keyTTL) {
+				t.Errorf("NewMemcachedDB() keyTTL = %v, wantTTL %v", m.keyTTL, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestMemcachedDBSaveGet(t *testing.T) {
+	s := runFakeMemcached(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name      string
+		keyPrefix string
+		geoip     *models.GeoIP
+		wantKey   string
+	}{
+		{
+			name:      "Default prefix",
+			keyPrefix: DefaultKeyPrefix,
+			geoip:     &models.GeoIP{IP: "1.1.1.1", CountryCode: "AU", CountryName: "Australia"},
+			wantKey:   "geo:v2:1.1.1.1",
+		},
+		{
+			name:      "Custom prefix",
+			keyPrefix: "myapp:geo",
+			geoip:     &models.GeoIP{IP: "2001:db8::1", CountryCode: "FR"},
+			wantKey:   "myapp:geo:v2:2001:db8::1",
+		},
+		{
+			name:    "No prefix",
+			geoip:   &models.GeoIP{IP: "1.1.1.1"},
+			wantKey: "v2:1.1.1.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewMemcachedDB(s.Addr(), time.Hour, tt.keyPrefix)
+			assert.NoError(t, err)
+
+			assert.NoError(t, m.Save(ctx, tt.geoip))
+
+			item, ok := s.Item(tt.wantKey)
+			assert.True(t, ok)
+			assert.Equal(t, int32(3600), item.expiration)
+
+			got, err := m.Get(ctx, tt.geoip.IP)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.geoip, got)
+		})
+	}
+}
+
+func TestMemcachedDBGetErrors(t *testing.T) {
+	s := runFakeMemcached(t)
+	ctx := context.Background()
+
+	m, err := NewMemcachedDB(s.Addr(), time.Hour, DefaultKeyPrefix)
+	assert.NoError(t, err)
+
+	_, err = m.Get(ctx, "1.1.1.1")
+	assert.ErrorIs(t, err, memcache.ErrCacheMiss)
+
+	// Values written by other versions of the schema are never decoded
+	s.Set("geo:v1:1.1.1.1", []byte("garbage"))
+	_, err = m.Get(ctx, "1.1.1.1")
+	assert.ErrorIs(t, err, memcache.ErrCacheMiss)
+
+	s.Set("geo:v2:1.1.1.1", []byte("garbage"))
+	_, err = m.Get(ctx, "1.1.1.1")
+	assert.Error(t, err)
+}
+
+func TestMemcachedDBDelete(t *testing.T) {
+	s := runFakeMemcached(t)
+	ctx := context.Background()
+
+	m, err := NewMemcachedDB(s.Addr(), time.Hour, DefaultKeyPrefix)
+	assert.NoError(t, err)
+
+	assert.NoError(t, m.Save(ctx, &models.GeoIP{IP: "1.1.1.1"}))
+	assert.NoError(t, m.Delete(ctx, "1.1.1.1"))
+	_, ok := s.Item("geo:v2:1.1.1.1")
+	assert.False(t, ok)
+
+	// Deleting a missing key isn't an error
+	assert.NoError(t, m.Delete(ctx, "1.1.1.1"))
+
+	down := runFakeMemcached(t)
+	down.Close()
+	m, err = NewMemcachedDB(down.Addr(), time.Hour, DefaultKeyPrefix)
+	assert.NoError(t, err)
+	assert.Error(t, m.Delete(ctx, "1.1.1.1"))
+}
+
+func TestMemcachedDBStatus(t *testing.T) {
+	ctx := context.Background()
+	up := runFakeMemcached(t)
+	down := runFakeMemcached(t)
+	down.Close()
+
+	tests := []struct {
+		name    string
+		servers string
+		wantErr bool
+	}{
+		{name: "Up", servers: up.Addr(), wantErr: false},
+		{name: "Down", servers: down.Addr(), wantErr: true},
+		{name: "One of the servers down", servers: up.Addr() + "," + down.Addr(), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewMemcachedDB(tt.servers, time.Hour, DefaultKeyPrefix)
+			assert.NoError(t, err)
+			m.client.Timeout = 100 * time.Millisecond
+
+			var wg sync.WaitGroup
+			ch := make(chan error, 1)
+			wg.Add(1)
+			m.Status(ctx, &wg, ch)
+
+			if tt.wantErr {
+				assert.Error(t, <-ch)
+			} else {
+				assert.NoError(t, <-ch)
+			}
+		})
+	}
+}
+
+func TestMemcachedExpiration(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name string
+		ttl  time.Duration
+		want int32
+	}{
+		{name: "No expiration", ttl: 0, want: 0},
+		{name: "Seconds", ttl: time.Hour, want: 3600},
+		{name: "Rounded up", ttl: 1500 * time.Millisecond, want: 2},
+		{name: "30 days", ttl: 30 * 24 * time.Hour, want: 2592000},
+		{name: "Over 30 days", ttl: 31 * 24 * time.Hour, want: 1700000000 + 2678400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, memcachedExpiration(tt.ttl, now))
+		})
+	}
+}
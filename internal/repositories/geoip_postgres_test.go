@@ -0,0 +1,320 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeQuery is a query received by a fakeQuerier
+type fakeQuery struct {
+	sql  string
+	args []any
+}
+
+// fakeRow is a pgx.Row scanning values, or returning err
+type fakeRow struct {
+	values []any
+	err    error
+}
+
+func (r *fakeRow) Scan(dest ...any) error {
+	if r.err != nil {
+		return r.err
+	}
+	if len(dest) != len(r.values) {
+		return fmt.Errorf("%d destinations for %d values", len(dest), len(r.values))
+	}
+	for i, d := range dest {
+		switch d := d.(type) {
+		case *string:
+			*d = r.values[i].(string)
+		case *float64:
+			*d = r.values[i].(float64)
+		case *int64:
+			*d = r.values[i].(int64)
+		default:
+			return fmt.Errorf("unsupported destination %T", d)
+		}
+	}
+	return nil
+}
+
+// fakeQuerier is a PostgresQuerier recording the queries
+// and answering QueryRow with row
+type fakeQuerier struct {
+	queries []fakeQuery
+	row     *fakeRow
+	err     error
+}
+
+func (q *fakeQuerier) Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error) {
+	q.queries = append(q.queries, fakeQuery{sql: sql, args: arguments})
+	return pgconn.CommandTag{}, q.err
+}
+
+func (q *fakeQuerier) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	q.queries = append(q.queries, fakeQuery{sql: sql, args: args})
+	return q.row
+}
+
+func (q *fakeQuerier) Ping(ctx context.Context) error {
+	return q.err
+}
+
+func TestNewPostgresDBFromQuerier(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		err     error
+		wantTTL time.Duration
+		wantErr bool
+	}{
+		{name: "Default TTL", wantTTL: DefaultPostgresTTL},
+		{name: "TTL 1h", ttl: time.Hour, wantTTL: time.Hour},
+		{name: "Migration error", err: errors.New("connection refused"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &fakeQuerier{err: tt.err}
+			p, err := NewPostgresDBFromQuerier(ctx, q, tt.ttl)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewPostgresDBFromQuerier() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			// The schema is migrated once, without arguments,
+			// so the statements are sent at once
+			assert.Len(t, q.queries, 1)
+			assert.Equal(t, postgresMigration, q.queries[0].sql)
+			assert.Empty(t, q.queries[0].args)
+
+			if err == nil {
+				assert.Equal(t, tt.wantTTL, p.ttl)
+				assert.NoError(t, p.Close())
+			}
+		})
+	}
+}
+
+func TestNewPostgresDBInvalidConnectionString(t *testing.T) {
+	_, err := NewPostgresDB(context.Background(), "azertyuiop://", time.Hour)
+	assert.Error(t, err)
+}
+
+func TestPostgresDBSave(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name    string
+		geoip   *models.GeoIP
+		err     error
+		wantErr bool
+	}{
+		{
+			name:  "Save",
+			geoip: &models.GeoIP{IP: "1.1.1.1", Family: models.FamilyIPv4, CountryCode: "AU", CountryName: "Australia", City: "Sydney", Latitude: -33.86, Longitude: 151.2, ASN: 13335, Organization: "Cloudflare", Source: "ip-api"},
+		},
+		{
+			name:    "Error",
+			geoip:   &models.GeoIP{IP: "1.1.1.1"},
+			err:     errors.New("connection refused"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &fakeQuerier{err: tt.err}
+			p := &postgresDB{db: q, ttl: time.Hour, now: func() time.Time { return now }}
+
+			err := p.Save(ctx, tt.geoip)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			g := tt.geoip
+			assert.Equal(t, []fakeQuery{{
+				sql:  postgresUpsert,
+				args: []any{g.IP, g.Family, g.CountryCode, g.CountryName, g.City, g.Latitude, g.Longitude, int64(g.ASN), g.Organization, g.Source, now, now.Add(time.Hour)},
+			}}, q.queries)
+		})
+	}
+}
+
+func TestPostgresDBGet(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name    string
+		ip      string
+		row     *fakeRow
+		want    *models.GeoIP
+		wantErr error
+	}{
+		{
+			name: "Found",
+			ip:   "1.1.1.1",
+			row:  &fakeRow{values: []any{models.FamilyIPv4, "AU", "Australia", "Sydney", -33.86, 151.2, int64(13335), "Cloudflare", "ip-api"}},
+			want: &models.GeoIP{IP: "1.1.1.1", Family: models.FamilyIPv4, CountryCode: "AU", CountryName: "Australia", City: "Sydney", Latitude: -33.86, Longitude: 151.2, ASN: 13335, Organization: "Cloudflare", Source: "ip-api"},
+		},
+		{
+			// The ip is the looked up one, not the network of the row
+			name: "Found in a network",
+			ip:   "10.1.2.3",
+			row:  &fakeRow{values: []any{"", "FR", "France", "", 0.0, 0.0, int64(0), "", ""}},
+			want: &models.GeoIP{IP: "10.1.2.3", CountryCode: "FR", CountryName: "France"},
+		},
+		{
+			name:    "Not found",
+			ip:      "1.1.1.1",
+			row:     &fakeRow{err: pgx.ErrNoRows},
+			wantErr: pgx.ErrNoRows,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &fakeQuerier{row: tt.row}
+			p := &postgresDB{db: q, ttl: time.Hour, now: func() time.Time { return now }}
+
+			got, err := p.Get(ctx, tt.ip)
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Equal(t, tt.want, got)
+
+			// The expired rows are filtered out by the query
+			assert.Equal(t, []fakeQuery{{sql: postgresSelect, args: []any{tt.ip, now}}}, q.queries)
+		})
+	}
+}
+
+func TestPostgresDBDelete(t *testing.T) {
+	ctx := context.Background()
+
+	q := &fakeQuerier{}
+	p := &postgresDB{db: q, now: time.Now}
+	assert.NoError(t, p.Delete(ctx, "1.1.1.1"))
+	assert.Equal(t, []fakeQuery{{sql: postgresDelete, args: []any{"1.1.1.1"}}}, q.queries)
+
+	q.err = errors.New("connection refused")
+	assert.Error(t, p.Delete(ctx, "1.1.1.1"))
+}
+
+func TestPostgresDBStatus(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		err     error
+		wantErr bool
+	}{
+		{name: "Up"},
+		{name: "Down", err: errors.New("connection refused"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &postgresDB{db: &fakeQuerier{err: tt.err}, now: time.Now}
+
+			var wg sync.WaitGroup
+			ch := make(chan error, 1)
+			wg.Add(1)
+			p.Status(ctx, &wg, ch)
+
+			if tt.wantErr {
+				assert.Error(t, <-ch)
+			} else {
+				assert.NoError(t, <-ch)
+			}
+		})
+	}
+}
+
+// TestPostgresDBIntegration runs against the postgres database of
+// the POSTGRES_TEST_URL environment variable. Its geoip table is emptied.
+func TestPostgresDBIntegration(t *testing.T) {
+	connstring := os.Getenv("POSTGRES_TEST_URL")
+	if connstring == "" {
+		t.Skip("POSTGRES_TEST_URL is not set")
+	}
+	ctx := context.Background()
+
+	p, err := NewPostgresDB(ctx, connstring, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// The migration is idempotent
+	again, err := NewPostgresDB(ctx, connstring, time.Hour)
+	assert.NoError(t, err)
+	again.Close()
+
+	_, err = p.db.Exec(ctx, "DELETE FROM geoip")
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	ch := make(chan error, 1)
+	wg.Add(1)
+	p.Status(ctx, &wg, ch)
+	assert.NoError(t, <-ch)
+
+	_, err = p.Get(ctx, "1.1.1.1")
+	assert.ErrorIs(t, err, pgx.ErrNoRows)
+
+	// Save and upsert
+	for _, g := range []*models.GeoIP{
+		{IP: "1.1.1.1", Family: models.FamilyIPv4, CountryCode: "AU", CountryName: "Australia", ASN: 13335},
+		{IP: "1.1.1.1", Family: models.FamilyIPv4, CountryCode: "NZ", CountryName: "New Zealand", ASN: 13335},
+		{IP: "2001:db8::1", Family: models.FamilyIPv6, CountryCode: "FR", CountryName: "France", City: "Paris", Latitude: 48.85, Longitude: 2.35},
+	} {
+		assert.NoError(t, p.Save(ctx, g))
+
+		got, err := p.Get(ctx, g.IP)
+		assert.NoError(t, err)
+		assert.Equal(t, g, got)
+	}
+
+	// The addresses are looked up in their most specific network
+	_, err = p.db.Exec(ctx, `INSERT INTO geoip (network, country_code) VALUES ('10.0.0.0/8', 'US'), ('10.1.0.0/16', 'CA')`)
+	assert.NoError(t, err)
+
+	got, err := p.Get(ctx, "10.1.2.3")
+	assert.NoError(t, err)
+	assert.Equal(t, &models.GeoIP{IP: "10.1.2.3", CountryCode: "CA"}, got)
+
+	got, err = p.Get(ctx, "10.2.0.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "US", got.CountryCode)
+
+	// Deleting an address keeps its networks
+	assert.NoError(t, p.Save(ctx, &models.GeoIP{IP: "10.1.2.3", CountryCode: "MX"}))
+	assert.NoError(t, p.Delete(ctx, "10.1.2.3"))
+	got, err = p.Get(ctx, "10.1.2.3")
+	assert.NoError(t, err)
+	assert.Equal(t, "CA", got.CountryCode)
+
+	// The expired rows are ignored
+	p.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	_, err = p.Get(ctx, "1.1.1.1")
+	assert.ErrorIs(t, err, pgx.ErrNoRows)
+
+	// The rows without expiration never expire
+	_, err = p.Get(ctx, "10.2.0.1")
+	assert.NoError(t, err)
+
+	_, err = p.db.Exec(ctx, "DELETE FROM geoip")
+	assert.NoError(t, err)
+}
@@ -15,6 +15,15 @@ import (
 
 const (
 	DefaultKeyTTL = 24 * time.Hour
+
+	// DefaultKeyPrefix is the default namespace of the redis and memcached keys
+	DefaultKeyPrefix = "geo"
+
+	// KeyVersion is the version of the schema of the values saved in redis
+	// and memcached. It is part of the keys and must be incremented on any incompatible
+	// change of models.GeoIP, so values of another version are never decoded.
+	// Version 1 was the bare ip address, without prefix.
+	KeyVersion = 2
 )
 
 // Prometheus metrics
@@ -38,18 +47,22 @@ var (
 )
 
 type redisDB struct {
-	client *redis.Client
-	cache  *cache.Cache
-	keyTTL time.Duration
+	client    redis.UniversalClient
+	cache     *cache.Cache
+	keyTTL    time.Duration
+	keyPrefix string
 }
 
-func NewRedisDB(connstring string, ttl time.Duration) (*redisDB, error) {
-	opt, err := redis.ParseURL(connstring)
+// NewRedisDB will return a new redis database.
+// The connection string describes either a single node, a sentinel
+// monitored master or a cluster. See newRedisClient() for the URL formats.
+// The keys are namespaced by prefix and versioned: "<prefix>:v<version>:<ip>".
+func NewRedisDB(connstring string, ttl time.Duration, prefix string) (*redisDB, error) {
+	client, err := newRedisClient(connstring)
 	if err != nil {
 		return nil, fmt.Errorf("error: failed to parse redis url: %w", err)
 	}
 
-	client := redis.NewClient(opt)
 	cache := cache.New(&cache.Options{
 		Redis: client,
 	})
@@ -59,16 +72,31 @@ func NewRedisDB(connstring string, ttl time.Duration) (*redisDB, error) {
 	}
 
 	return &redisDB{
-		client: client,
-		cache:  cache,
-		keyTTL: ttl,
+		client:    client,
+		cache:     cache,
+		keyTTL:    ttl,
+		keyPrefix: prefix,
 	}, nil
 }
 
+// key returns the redis key of the given ip address.
+func (r *redisDB) key(ip string) string {
+	return versionedKey(r.keyPrefix, ip)
+}
+
+// versionedKey returns the key of the given ip address,
+// namespaced by prefix and versioned: "<prefix>:v<version>:<ip>".
+func versionedKey(prefix, ip string) string {
+	if prefix == "" {
+		return fmt.Sprintf("v%d:%s", KeyVersion, ip)
+	}
+	return fmt.Sprintf("%s:v%d:%s", prefix, KeyVersion, ip)
+}
+
 func (r *redisDB) Save(ctx context.Context, geoip *models.GeoIP) error {
 	if err := r.cache.Set(&cache.Item{
 		Ctx:   ctx,
-		Key:   geoip.IP,
+		Key:   r.key(geoip.IP),
 		Value: geoip,
 		TTL:   r.keyTTL,
 	}); err != nil {
@@ -85,7 +113,7 @@ func (r *redisDB) Save(ctx context.Context, geoip *models.GeoIP) error {
 
 func (r *redisDB) Get(ctx context.Context, ip string) (*models.GeoIP, error) {
 	var g models.GeoIP
-	if err := r.cache.Get(ctx, ip, &g); err != nil {
+	if err := r.cache.Get(ctx, r.key(ip), &g); err != nil {
 		// Increment Prometheus counter
 		redisItemFailedRead.Inc()
 		return nil, fmt.Errorf("error: cannot read value in redis for key: %s: %w", ip, err)
@@ -97,9 +125,32 @@ func (r *redisDB) Get(ctx context.Context, ip string) (*models.GeoIP, error) {
 	return &g, nil
 }
 
+// Delete will remove the IP Geolocation info of the given IP address from redis.
+func (r *redisDB) Delete(ctx context.Context, ip string) error {
+	if err := r.client.Del(ctx, r.key(ip)).Err(); err != nil {
+		return fmt.Errorf("error: cannot delete value in redis for key: %s: %w", ip, err)
+	}
+
+	return nil
+}
+
+// Client returns the redis client of the database,
+// to share its connections with other redis features.
+func (r *redisDB) Client() redis.UniversalClient {
+	return r.client
+}
+
 // Status will retrieve the status of the Redis database.
-// It uses the (*redis.Client).Ping() function.
+// It uses the Ping() function, against every master of a cluster.
 func (r *redisDB) Status(ctx context.Context, wg *sync.WaitGroup, ch chan error) {
 	defer wg.Done()
+
+	if c, ok := r.client.(*redis.ClusterClient); ok {
+		ch <- c.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+			return client.Ping(ctx).Err()
+		})
+		return
+	}
+
 	ch <- r.client.Ping(ctx).Err()
 }
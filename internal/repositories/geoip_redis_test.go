@@ -3,10 +3,13 @@ package repositories
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
 	"github.com/go-redis/cache/v8"
 	"github.com/go-redis/redis/v8"
 	"github.com/lescactus/geolocation-go/internal/models"
@@ -66,7 +69,7 @@ func TestNewRedisDB(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			r, err := NewRedisDB(tt.args.connstring, tt.args.ttl)
+			r, err := NewRedisDB(tt.args.connstring, tt.args.ttl, DefaultKeyPrefix)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("NewRedisDB() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -85,9 +88,10 @@ func TestRedisDBSave(t *testing.T) {
 	client := redis.NewClient(&redis.Options{Addr: s.Addr()})
 
 	type fields struct {
-		client *redis.Client
-		cache  *cache.Cache
-		keyTTL time.Duration
+		client    redis.UniversalClient
+		cache     *cache.Cache
+		keyTTL    time.Duration
+		keyPrefix string
 	}
 	type args struct {
 		ctx   context.Context
@@ -97,25 +101,42 @@ func TestRedisDBSave(t *testing.T) {
 		name    string
 		fields  fields
 		args    args
+		wantKey string
 		wantErr bool
 	}{
 		{
 			name:    "Save ",
+			fields:  fields{client: redis.NewClient(&redis.Options{Addr: s.Addr()}), cache: cache.New(&cache.Options{Redis: client}), keyTTL: time.Hour, keyPrefix: DefaultKeyPrefix},
+			args:    args{ctx: context.Background(), geoip: &models.GeoIP{IP: "1.1.1.1"}},
+			wantKey: "geo:v2:1.1.1.1",
+			wantErr: false,
+		},
+		{
+			name:    "Save - custom prefix",
+			fields:  fields{client: redis.NewClient(&redis.Options{Addr: s.Addr()}), cache: cache.New(&cache.Options{Redis: client}), keyTTL: time.Hour, keyPrefix: "myapp:geo"},
+			args:    args{ctx: context.Background(), geoip: &models.GeoIP{IP: "2001:db8::1"}},
+			wantKey: "myapp:geo:v2:2001:db8::1",
+			wantErr: false,
+		},
+		{
+			name:    "Save - no prefix",
 			fields:  fields{client: redis.NewClient(&redis.Options{Addr: s.Addr()}), cache: cache.New(&cache.Options{Redis: client}), keyTTL: time.Hour},
 			args:    args{ctx: context.Background(), geoip: &models.GeoIP{IP: "1.1.1.1"}},
+			wantKey: "v2:1.1.1.1",
 			wantErr: false,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			r := &redisDB{
-				client: tt.fields.client,
-				cache:  tt.fields.cache,
+				client:    tt.fields.client,
+				cache:     tt.fields.cache,
+				keyPrefix: tt.fields.keyPrefix,
 			}
 
 			err := r.Save(tt.args.ctx, tt.args.geoip)
-			assert.True(t, s.Exists(tt.args.geoip.IP))
-			assert.Equal(t, tt.fields.keyTTL, s.TTL(tt.args.geoip.IP))
+			assert.True(t, s.Exists(tt.wantKey))
+			assert.Equal(t, tt.fields.keyTTL, s.TTL(tt.wantKey))
 
 			if tt.wantErr == false {
 				assert.NoError(t, err)
@@ -126,10 +147,157 @@ func TestRedisDBSave(t *testing.T) {
 	}
 }
 
+func TestRedisDBGetVersionMismatch(t *testing.T) {
+	s := miniredis.RunT(t)
+	ctx := context.Background()
+
+	r, err := NewRedisDB(fmt.Sprintf("redis://%s", s.Addr()), time.Hour, DefaultKeyPrefix)
+	assert.NoError(t, err)
+
+	// Values written by other versions of the schema are never decoded
+	s.Set("1.1.1.1", "\x85\xa2IP\xa71.1.1.1")
+	s.Set("geo:v1:1.1.1.1", "garbage")
+	s.Set("geo:v3:1.1.1.1", "garbage")
+
+	_, err = r.Get(ctx, "1.1.1.1")
+	assert.ErrorIs(t, err, cache.ErrCacheMiss)
+
+	g := &models.GeoIP{IP: "1.1.1.1", CountryCode: "AU"}
+	assert.NoError(t, r.Save(ctx, g))
+
+	got, err := r.Get(ctx, "1.1.1.1")
+	assert.NoError(t, err)
+	assert.Equal(t, g, got)
+
+	// The other versions are left untouched
+	v, err := s.Get("geo:v1:1.1.1.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "garbage", v)
+}
+
+func TestRedisDBDelete(t *testing.T) {
+	s := miniredis.RunT(t)
+	ctx := context.Background()
+
+	r, err := NewRedisDB(fmt.Sprintf("redis://%s", s.Addr()), time.Hour, DefaultKeyPrefix)
+	assert.NoError(t, err)
+
+	assert.NoError(t, r.Save(ctx, &models.GeoIP{IP: "1.1.1.1"}))
+	assert.NoError(t, r.Delete(ctx, "1.1.1.1"))
+	assert.False(t, s.Exists("geo:v2:1.1.1.1"))
+
+	// Deleting a missing key isn't an error
+	assert.NoError(t, r.Delete(ctx, "1.1.1.1"))
+
+	s.SetError("LOADING")
+	assert.Error(t, r.Delete(ctx, "1.1.1.1"))
+}
+
+// runSentinel starts a fake sentinel monitoring the given master
+func runSentinel(t *testing.T, name string, master *miniredis.Miniredis) *server.Server {
+	s, err := server.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+
+	s.Register("SENTINEL", func(c *server.Peer, cmd string, args []string) {
+		switch {
+		case len(args) == 2 && strings.EqualFold(args[0], "get-master-addr-by-name") && args[1] == name:
+			c.WriteStrings([]string{master.Host(), master.Port()})
+		case len(args) == 2 && strings.EqualFold(args[0], "sentinels") && args[1] == name:
+			c.WriteLen(0)
+		default:
+			c.WriteError("ERR No such master with that name")
+		}
+	})
+	s.Register("SUBSCRIBE", func(c *server.Peer, cmd string, args []string) {
+		for i, channel := range args {
+			c.WriteLen(3)
+			c.WriteBulk("subscribe")
+			c.WriteBulk(channel)
+			c.WriteInt(i + 1)
+		}
+	})
+
+	return s
+}
+
+func TestRedisDBTopologies(t *testing.T) {
+	ctx := context.Background()
+
+	master := miniredis.RunT(t)
+	sentinel := runSentinel(t, "mymaster", master)
+	cluster := miniredis.RunT(t)
+
+	tests := []struct {
+		name       string
+		connstring string
+		redis      *miniredis.Miniredis
+	}{
+		{name: "Single node", connstring: fmt.Sprintf("redis://%s/0", master.Addr()), redis: master},
+		{name: "Sentinel", connstring: fmt.Sprintf("redis-sentinel://%s/mymaster", sentinel.Addr()), redis: master},
+		{name: "Cluster", connstring: fmt.Sprintf("redis-cluster://%s", cluster.Addr()), redis: cluster},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.redis.FlushAll()
+
+			r, err := NewRedisDB(tt.connstring, time.Hour, DefaultKeyPrefix)
+			assert.NoError(t, err)
+			defer r.client.Close()
+
+			var wg sync.WaitGroup
+			ch := make(chan error, 1)
+			wg.Add(1)
+			r.Status(ctx, &wg, ch)
+			assert.NoError(t, <-ch)
+
+			g := &models.GeoIP{IP: "1.1.1.1", CountryCode: "AU", CountryName: "Australia"}
+			assert.NoError(t, r.Save(ctx, g))
+			assert.True(t, tt.redis.Exists("geo:v2:1.1.1.1"))
+			assert.Equal(t, time.Hour, tt.redis.TTL("geo:v2:1.1.1.1"))
+
+			got, err := r.Get(ctx, "1.1.1.1")
+			assert.NoError(t, err)
+			assert.Equal(t, g, got)
+		})
+	}
+}
+
+func TestRedisDBStatusUnavailable(t *testing.T) {
+	ctx := context.Background()
+
+	master := miniredis.RunT(t)
+	sentinel := runSentinel(t, "mymaster", master)
+
+	tests := []struct {
+		name       string
+		connstring string
+	}{
+		{name: "Single node", connstring: "redis://127.0.0.1:1?dial_timeout=100ms&max_retries=-1"},
+		{name: "Unknown sentinel master", connstring: fmt.Sprintf("redis-sentinel://%s/other?dial_timeout=100ms&max_retries=-1", sentinel.Addr())},
+		{name: "Cluster", connstring: "redis-cluster://127.0.0.1:1?dial_timeout=100ms&max_retries=-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewRedisDB(tt.connstring, time.Hour, DefaultKeyPrefix)
+			assert.NoError(t, err)
+			defer r.client.Close()
+
+			var wg sync.WaitGroup
+			ch := make(chan error, 1)
+			wg.Add(1)
+			r.Status(ctx, &wg, ch)
+			assert.Error(t, <-ch)
+		})
+	}
+}
+
 func BenchmarkRedisDBSave(b *testing.B) {
 	s := miniredis.RunT(b)
 	//client := redis.NewClient(&redis.Options{Addr: s.Addr()})
-	r, err := NewRedisDB(fmt.Sprintf("redis://%s", s.Addr()), time.Hour)
+	r, err := NewRedisDB(fmt.Sprintf("redis://%s", s.Addr()), time.Hour, DefaultKeyPrefix)
 	if err != nil {
 		b.Error(err)
 	}
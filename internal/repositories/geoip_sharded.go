@@ -0,0 +1,123 @@
+package repositories
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/lescactus/geolocation-go/internal/models"
+)
+
+// DefaultShards is the default number of shards of a shardedDB
+const DefaultShards = 16
+
+// FNV-1a 32 bits parameters
+// ref: http://www.isthe.com/chongo/tech/comp/fnv/index.html
+const (
+	fnvOffset32 = 2166136261
+	fnvPrime32  = 16777619
+)
+
+// shardedDB is an in-memory database split into independently locked
+// lruDB shards, so concurrent accesses to different keys don't contend
+// on the same mutex. Each key is always stored in the same shard,
+// selected by hashing the key.
+//
+// The size limits are split evenly between the shards, hence the
+// least recently used items are evicted per shard rather than globally.
+type shardedDB struct {
+	shards []*lruDB
+}
+
+// NewShardedDB will create a new shardedDB made of the given number of shards,
+// holding at most maxEntries items and maxBytes bytes in total, each of them
+// expiring after ttl. A limit of 0 disables it.
+// The default number of shards is used when shards is not positive.
+func NewShardedDB(shards int, maxEntries int, maxBytes int64, ttl time.Duration) *shardedDB {
+	if shards <= 0 {
+		shards = DefaultShards
+	}
+
+	db := &shardedDB{shards: make([]*lruDB, shards)}
+	for i := range db.shards {
+		db.shards[i] = NewLRUDB(ceilDiv(maxEntries, shards), int64(ceilDiv(int(maxBytes), shards)), ttl)
+	}
+
+	return db
+}
+
+// Save will add the IP Geolocation info of the given IP address
+// in its shard, with the default TTL of the database.
+func (m *shardedDB) Save(ctx context.Context, geoip *models.GeoIP) error {
+	return m.shard(geoip.IP).Save(ctx, geoip)
+}
+
+// SaveWithTTL will add the IP Geolocation info of the given IP address
+// in its shard, expiring after ttl. A ttl of 0 means no expiry.
+func (m *shardedDB) SaveWithTTL(ctx context.Context, geoip *models.GeoIP, ttl time.Duration) error {
+	return m.shard(geoip.IP).SaveWithTTL(ctx, geoip, ttl)
+}
+
+// Get will retrieve the IP Geolocation info for the given IP address from its shard.
+// It returns the IP Geolocation info if it's a cache HIT, or an error otherwise.
+func (m *shardedDB) Get(ctx context.Context, ip string) (*models.GeoIP, error) {
+	return m.shard(ip).Get(ctx, ip)
+}
+
+// Delete will remove the IP Geolocation info of the given IP address from its shard.
+func (m *shardedDB) Delete(ctx context.Context, ip string) error {
+	return m.shard(ip).Delete(ctx, ip)
+}
+
+// Purge will remove all the items of all the shards.
+func (m *shardedDB) Purge() {
+	for _, s := range m.shards {
+		s.Purge()
+	}
+}
+
+// Entries returns the items of all the shards which aren't expired,
+// shard by shard, the least recently used of each shard first.
+func (m *shardedDB) Entries() []Entry {
+	var entries []Entry
+	for _, s := range m.shards {
+		entries = append(entries, s.Entries()...)
+	}
+	return entries
+}
+
+// Len returns the number of items in all the shards,
+// including the expired ones not removed yet.
+func (m *shardedDB) Len() int {
+	n := 0
+	for _, s := range m.shards {
+		n += s.Len()
+	}
+	return n
+}
+
+// Status will retrieve the status of the shardedDB.
+func (m *shardedDB) Status(ctx context.Context, wg *sync.WaitGroup, ch chan error) {
+	defer wg.Done()
+
+	_, _ = m.Get(ctx, "")
+
+	ch <- nil
+}
+
+// shard returns the shard holding the given key.
+func (m *shardedDB) shard(key string) *lruDB {
+	// Inlined FNV-1a to avoid allocating a hash.Hash32 for each access
+	h := uint32(fnvOffset32)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= fnvPrime32
+	}
+
+	return m.shards[h%uint32(len(m.shards))]
+}
+
+// ceilDiv returns a / b rounded up, for non negative a and positive b.
+func ceilDiv(a, b int) int {
+	return (a + b - 1) / b
+}
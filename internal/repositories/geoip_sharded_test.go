@@ -0,0 +1,181 @@
+package repositories
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewShardedDB(t *testing.T) {
+	tests := []struct {
+		name           string
+		shards         int
+		maxEntries     int
+		maxBytes       int64
+		wantShards     int
+		wantMaxEntries int
+		wantMaxBytes   int64
+	}{
+		{name: "Custom values", shards: 4, maxEntries: 100, maxBytes: 1000, wantShards: 4, wantMaxEntries: 25, wantMaxBytes: 250},
+		{name: "Limits rounded up", shards: 4, maxEntries: 10, maxBytes: 10, wantShards: 4, wantMaxEntries: 3, wantMaxBytes: 3},
+		{name: "No limits", shards: 4, wantShards: 4},
+		{name: "Default shards", shards: 0, maxEntries: 1600, wantShards: DefaultShards, wantMaxEntries: 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewShardedDB(tt.shards, tt.maxEntries, tt.maxBytes, time.Hour)
+			assert.Len(t, m.shards, tt.wantShards)
+			for _, s := range m.shards {
+				assert.Equal(t, tt.wantMaxEntries, s.maxEntries)
+				assert.Equal(t, tt.wantMaxBytes, s.maxBytes)
+				assert.Equal(t, time.Hour, s.ttl)
+			}
+		})
+	}
+}
+
+func TestShardedDBSaveGet(t *testing.T) {
+	m := NewShardedDB(8, 0, 0, 0)
+	ctx := context.Background()
+
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, m.Save(ctx, &models.GeoIP{IP: fmt.Sprintf("%d.1.1.1", i), CountryCode: "AU"}))
+	}
+	assert.NoError(t, m.SaveWithTTL(ctx, &models.GeoIP{IP: "2001:db8::1", CountryCode: "FR"}, time.Hour))
+	assert.Equal(t, 101, m.Len())
+
+	for i := 0; i < 100; i++ {
+		g, err := m.Get(ctx, fmt.Sprintf("%d.1.1.1", i))
+		assert.NoError(t, err)
+		assert.Equal(t, "AU", g.CountryCode)
+	}
+
+	g, err := m.Get(ctx, "2001:db8::1")
+	assert.NoError(t, err)
+	assert.Equal(t, "FR", g.CountryCode)
+
+	_, err = m.Get(ctx, "2.2.2.2")
+	assert.Error(t, err)
+
+	// The keys are spread over the shards
+	for _, s := range m.shards {
+		assert.NotZero(t, s.Len())
+	}
+}
+
+func TestShardedDBEntries(t *testing.T) {
+	m := NewShardedDB(4, 0, 0, 0)
+	ctx := context.Background()
+
+	var want []string
+	for i := 0; i < 20; i++ {
+		ip := fmt.Sprintf("%d.1.1.1", i)
+		want = append(want, ip)
+		m.Save(ctx, &models.GeoIP{IP: ip})
+	}
+
+	var got []string
+	for _, e := range m.Entries() {
+		got = append(got, e.GeoIP.IP)
+	}
+	assert.ElementsMatch(t, want, got)
+}
+
+func TestShardedDBDelete(t *testing.T) {
+	m := NewShardedDB(4, 0, 0, 0)
+	ctx := context.Background()
+
+	for i := 0; i < 20; i++ {
+		m.Save(ctx, &models.GeoIP{IP: fmt.Sprintf("%d.1.1.1", i)})
+	}
+
+	assert.NoError(t, m.Delete(ctx, "1.1.1.1"))
+	_, err := m.Get(ctx, "1.1.1.1")
+	assert.Error(t, err)
+	assert.Equal(t, 19, m.Len())
+
+	m.Purge()
+	assert.Equal(t, 0, m.Len())
+}
+
+func TestShardedDBMaxEntries(t *testing.T) {
+	m := NewShardedDB(4, 100, 0, 0)
+	ctx := context.Background()
+
+	for i := 0; i < 1000; i++ {
+		m.Save(ctx, &models.GeoIP{IP: fmt.Sprintf("10.0.%d.%d", i/256, i%256)})
+	}
+
+	assert.LessOrEqual(t, m.Len(), 100)
+}
+
+func TestShardedDBShard(t *testing.T) {
+	m := NewShardedDB(DefaultShards, 0, 0, 0)
+
+	for _, key := range []string{"", "1.1.1.1", "2001:db8::1"} {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		assert.Same(t, m.shards[h.Sum32()%DefaultShards], m.shard(key), key)
+	}
+}
+
+func TestShardedDBStatus(t *testing.T) {
+	m := NewShardedDB(0, 0, 0, 0)
+	var wg sync.WaitGroup
+	ch := make(chan error, 1)
+
+	wg.Add(1)
+	go m.Status(context.Background(), &wg, ch)
+	wg.Wait()
+
+	assert.NoError(t, <-ch)
+}
+
+// benchmarkParallel runs a mixed read/write workload from concurrent
+// goroutines against the given repository, 90% reads and 10% writes
+// over 1024 keys.
+func benchmarkParallel(b *testing.B, repo models.GeoIPRepository) {
+	ctx := context.Background()
+
+	const nkeys = 1024
+	geoips := make([]*models.GeoIP, nkeys)
+	for i := range geoips {
+		geoips[i] = &models.GeoIP{IP: fmt.Sprintf("10.0.%d.%d", i/256, i%256), CountryCode: "AU"}
+		repo.Save(ctx, geoips[i])
+	}
+
+	var seed atomic.Uint32
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(seed.Add(7919))
+		for pb.Next() {
+			i++
+			g := geoips[i%nkeys]
+			if i%10 == 0 {
+				repo.Save(ctx, g)
+			} else {
+				repo.Get(ctx, g.IP)
+			}
+		}
+	})
+}
+
+func BenchmarkParallel_InMemoryDB(b *testing.B) {
+	benchmarkParallel(b, NewInMemoryDB())
+}
+
+func BenchmarkParallel_LRUDB(b *testing.B) {
+	benchmarkParallel(b, NewLRUDB(0, 0, time.Hour))
+}
+
+func BenchmarkParallel_ShardedDB(b *testing.B) {
+	benchmarkParallel(b, NewShardedDB(DefaultShards, 0, 0, time.Hour))
+}
@@ -0,0 +1,217 @@
+package repositories
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// URL schemes of the redis connection strings
+const (
+	schemeRedis          = "redis"
+	schemeRediss         = "rediss"
+	schemeRedisSentinel  = "redis-sentinel"
+	schemeRedissSentinel = "rediss-sentinel"
+	schemeRedisCluster   = "redis-cluster"
+	schemeRedissCluster  = "rediss-cluster"
+
+	// Default ports of the sentinel and cluster nodes
+	defaultSentinelPort = "26379"
+	defaultRedisPort    = "6379"
+)
+
+// newRedisClient builds the redis client matching the topology described
+// by the connection string:
+//
+//   - single node: redis://[user:pass@]host:port[/db][?options]
+//   - sentinel: redis-sentinel://[user:pass@]host1:port1,host2:port2/master[/db][?options]
+//   - cluster: redis-cluster://[user:pass@]host1:port1,host2:port2[?options]
+//
+// The "rediss" variants of the schemes enable tls.
+// The options are the ones supported by redis.ParseURL(), plus sentinel_username
+// and sentinel_password to authenticate to the sentinels.
+func newRedisClient(connstring string) (redis.UniversalClient, error) {
+	switch {
+	case strings.HasPrefix(connstring, schemeRedisSentinel+"://"), strings.HasPrefix(connstring, schemeRedissSentinel+"://"):
+		opt, err := parseSentinelURL(connstring)
+		if err != nil {
+			return nil, err
+		}
+		return redis.NewFailoverClient(opt), nil
+	case strings.HasPrefix(connstring, schemeRedisCluster+"://"), strings.HasPrefix(connstring, schemeRedissCluster+"://"):
+		opt, err := parseClusterURL(connstring)
+		if err != nil {
+			return nil, err
+		}
+		return redis.NewClusterClient(opt), nil
+	default:
+		opt, err := redis.ParseURL(connstring)
+		if err != nil {
+			return nil, err
+		}
+		return redis.NewClient(opt), nil
+	}
+}
+
+// parseSentinelURL parses a redis-sentinel:// connection string.
+func parseSentinelURL(connstring string) (*redis.FailoverOptions, error) {
+	u, addrs, err := splitNodesURL(connstring, defaultSentinelPort)
+	if err != nil {
+		return nil, err
+	}
+
+	f := strings.FieldsFunc(u.Path, func(r rune) bool { return r == '/' })
+	if len(f) == 0 || len(f) > 2 {
+		return nil, fmt.Errorf("redis: invalid sentinel URL path, expected /master[/db]: %q", u.Path)
+	}
+	path := ""
+	if len(f) == 2 {
+		path = "/" + f[1]
+	}
+
+	// Sentinel specific options, unknown to redis.ParseURL()
+	q := u.Query()
+	sentinelUsername, sentinelPassword := q.Get("sentinel_username"), q.Get("sentinel_password")
+	q.Del("sentinel_username")
+	q.Del("sentinel_password")
+
+	o, err := parseOptions(u, q, path, addrs[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &redis.FailoverOptions{
+		MasterName:         f[0],
+		SentinelAddrs:      addrs,
+		SentinelUsername:   sentinelUsername,
+		SentinelPassword:   sentinelPassword,
+		Username:           o.Username,
+		Password:           o.Password,
+		DB:                 o.DB,
+		MaxRetries:         o.MaxRetries,
+		MinRetryBackoff:    o.MinRetryBackoff,
+		MaxRetryBackoff:    o.MaxRetryBackoff,
+		DialTimeout:        o.DialTimeout,
+		ReadTimeout:        o.ReadTimeout,
+		WriteTimeout:       o.WriteTimeout,
+		PoolFIFO:           o.PoolFIFO,
+		PoolSize:           o.PoolSize,
+		MinIdleConns:       o.MinIdleConns,
+		MaxConnAge:         o.MaxConnAge,
+		PoolTimeout:        o.PoolTimeout,
+		IdleTimeout:        o.IdleTimeout,
+		IdleCheckFrequency: o.IdleCheckFrequency,
+		TLSConfig:          o.TLSConfig,
+	}, nil
+}
+
+// parseClusterURL parses a redis-cluster:// connection string.
+func parseClusterURL(connstring string) (*redis.ClusterOptions, error) {
+	u, addrs, err := splitNodesURL(connstring, defaultRedisPort)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.Trim(u.Path, "/") != "" {
+		return nil, fmt.Errorf("redis: invalid cluster URL path, a cluster has no database: %q", u.Path)
+	}
+
+	o, err := parseOptions(u, u.Query(), "", addrs[0])
+	if err != nil {
+		return nil, err
+	}
+	if o.DB != 0 {
+		return nil, fmt.Errorf("redis: invalid cluster database number, a cluster has no database: %d", o.DB)
+	}
+
+	return &redis.ClusterOptions{
+		Addrs:              addrs,
+		Username:           o.Username,
+		Password:           o.Password,
+		MaxRetries:         o.MaxRetries,
+		MinRetryBackoff:    o.MinRetryBackoff,
+		MaxRetryBackoff:    o.MaxRetryBackoff,
+		DialTimeout:        o.DialTimeout,
+		ReadTimeout:        o.ReadTimeout,
+		WriteTimeout:       o.WriteTimeout,
+		PoolFIFO:           o.PoolFIFO,
+		PoolSize:           o.PoolSize,
+		MinIdleConns:       o.MinIdleConns,
+		MaxConnAge:         o.MaxConnAge,
+		PoolTimeout:        o.PoolTimeout,
+		IdleTimeout:        o.IdleTimeout,
+		IdleCheckFrequency: o.IdleCheckFrequency,
+		TLSConfig:          o.TLSConfig,
+	}, nil
+}
+
+// splitNodesURL splits the comma separated addresses of the nodes out of
+// the connection string, as url.Parse() only accepts a single host.
+// defaultPort is used for the addresses without port.
+func splitNodesURL(connstring string, defaultPort string) (*url.URL, []string, error) {
+	i := strings.Index(connstring, "://")
+	if i < 0 {
+		return nil, nil, fmt.Errorf("redis: invalid URL scheme")
+	}
+
+	authority := connstring[i+3:]
+	if j := strings.IndexAny(authority, "/?#"); j >= 0 {
+		authority = authority[:j]
+	}
+	userinfo, hosts := "", authority
+	if j := strings.LastIndex(authority, "@"); j >= 0 {
+		userinfo, hosts = authority[:j+1], authority[j+1:]
+	}
+
+	var addrs []string
+	for _, host := range strings.Split(hosts, ",") {
+		if host == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(strings.Trim(host, "[]"), defaultPort)
+		}
+		addrs = append(addrs, host)
+	}
+	if len(addrs) == 0 {
+		return nil, nil, fmt.Errorf("redis: no address in URL")
+	}
+
+	// Parse the rest of the URL with a single host
+	u, err := url.Parse(connstring[:i+3] + userinfo + addrs[0] + connstring[i+3+len(authority):])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return u, addrs, nil
+}
+
+// parseOptions returns the connection options parsed by redis.ParseURL()
+// from the credentials of u, the given path and query.
+func parseOptions(u *url.URL, q url.Values, path string, addr string) (*redis.Options, error) {
+	single := *u
+	single.Scheme = schemeRedis
+	if strings.HasPrefix(u.Scheme, schemeRediss) {
+		single.Scheme = schemeRediss
+	}
+	single.Host = addr
+	single.Path = path
+	single.RawPath = ""
+	single.RawQuery = q.Encode()
+
+	o, err := redis.ParseURL(single.String())
+	if err != nil {
+		return nil, err
+	}
+
+	// The server name is the one of each node
+	if o.TLSConfig != nil {
+		o.TLSConfig = &tls.Config{}
+	}
+
+	return o, nil
+}
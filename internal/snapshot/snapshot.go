@@ -0,0 +1,253 @@
+package snapshot
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/lescactus/geolocation-go/internal/repositories"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// Format identifies the snapshot files
+	Format = "geolocation-go-snapshot"
+
+	// Version is the version of the snapshot file format.
+	// It must be incremented on any incompatible change.
+	Version = 1
+
+	// DefaultInterval is the default duration between two snapshots
+	DefaultInterval = 5 * time.Minute
+
+	// maxLineSize is the maximum size of a line of the snapshot file
+	maxLineSize = 64 * 1024
+)
+
+var (
+	// ErrIncompatible is returned when the snapshot file has been written
+	// by an incompatible version
+	ErrIncompatible = errors.New("incompatible snapshot")
+
+	// ErrCorrupt is returned when the snapshot file can't be parsed
+	ErrCorrupt = errors.New("corrupt snapshot")
+)
+
+// Prometheus metrics
+var (
+	snapshotItems = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "snapshot_items",
+		Help: "Number of items in the last snapshot of the in-memory database",
+	})
+	snapshotFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "snapshot_failures_total",
+		Help: "Total number of failed snapshots of the in-memory database",
+	})
+)
+
+// Repository is an in-memory database which can be snapshotted and restored
+type Repository interface {
+	Entries() []repositories.Entry
+	SaveWithTTL(ctx context.Context, geoip *models.GeoIP, ttl time.Duration) error
+}
+
+// header is the first line of a snapshot file
+type header struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// entry is a line of a snapshot file, after the header
+type entry struct {
+	GeoIP     *models.GeoIP `json:"geoip"`
+	ExpiresAt *time.Time    `json:"expires_at,omitempty"`
+}
+
+// Snapshotter saves the items of a Repository to a file
+// and restores them on startup.
+//
+// The file is in the JSON Lines format: a header holding the format
+// version, then an item per line.
+type Snapshotter struct {
+	Path   string
+	Repo   Repository
+	Logger *zerolog.Logger
+
+	// now is used to mock the time in the tests
+	now func() time.Time
+}
+
+// New will return a new Snapshotter of the given Repository to the given file.
+func New(path string, repo Repository, logger *zerolog.Logger) *Snapshotter {
+	return &Snapshotter{Path: path, Repo: repo, Logger: logger, now: time.Now}
+}
+
+// Save writes the items of the Repository to the file.
+// The items are written to a temporary file first, then renamed,
+// so the file is never left partially written.
+func (s *Snapshotter) Save() (int, error) {
+	entries := s.Repo.Entries()
+
+	n, err := s.write(entries)
+	if err != nil {
+		// Increment Prometheus counter
+		snapshotFailures.Inc()
+		return 0, err
+	}
+
+	snapshotItems.Set(float64(n))
+
+	return n, nil
+}
+
+func (s *Snapshotter) write(entries []repositories.Entry) (int, error) {
+	f, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".*.tmp")
+	if err != nil {
+		return 0, fmt.Errorf("error: failed to create snapshot file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+
+	if err := enc.Encode(header{Format: Format, Version: Version, CreatedAt: s.now().UTC()}); err != nil {
+		return 0, fmt.Errorf("error: failed to write snapshot file: %w", err)
+	}
+
+	for _, e := range entries {
+		line := entry{GeoIP: e.GeoIP}
+		if !e.ExpiresAt.IsZero() {
+			line.ExpiresAt = &e.ExpiresAt
+		}
+		if err := enc.Encode(line); err != nil {
+			return 0, fmt.Errorf("error: failed to write snapshot file: %w", err)
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return 0, fmt.Errorf("error: failed to write snapshot file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return 0, fmt.Errorf("error: failed to write snapshot file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return 0, fmt.Errorf("error: failed to write snapshot file: %w", err)
+	}
+
+	if err := os.Rename(f.Name(), s.Path); err != nil {
+		return 0, fmt.Errorf("error: failed to rename snapshot file: %w", err)
+	}
+
+	return len(entries), nil
+}
+
+// Restore reads the file and adds its items to the Repository,
+// skipping the expired ones. The items keep their remaining TTL.
+//
+// Nothing is restored if the file is corrupt (ErrCorrupt) or has been
+// written by an incompatible version (ErrIncompatible).
+func (s *Snapshotter) Restore() (int, error) {
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return 0, fmt.Errorf("error: failed to open snapshot file: %w", err)
+	}
+	defer f.Close()
+
+	entries, err := parse(f)
+	if err != nil {
+		return 0, fmt.Errorf("error: failed to read snapshot file %s: %w", s.Path, err)
+	}
+
+	now := s.now()
+	n := 0
+	for _, e := range entries {
+		var ttl time.Duration
+		if e.ExpiresAt != nil {
+			ttl = e.ExpiresAt.Sub(now)
+			if ttl <= 0 {
+				continue
+			}
+		}
+
+		if err := s.Repo.SaveWithTTL(context.Background(), e.GeoIP, ttl); err != nil {
+			return n, fmt.Errorf("error: failed to restore snapshot: %w", err)
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// parse reads all the entries of a snapshot file.
+func parse(r io.Reader) ([]entry, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), maxLineSize)
+
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrCorrupt, err)
+		}
+		return nil, fmt.Errorf("%w: empty file", ErrCorrupt)
+	}
+
+	var h header
+	if err := json.Unmarshal(scanner.Bytes(), &h); err != nil || h.Format != Format {
+		return nil, fmt.Errorf("%w: invalid header", ErrCorrupt)
+	}
+	if h.Version != Version {
+		return nil, fmt.Errorf("%w: version %d, expected %d", ErrIncompatible, h.Version, Version)
+	}
+
+	var entries []entry
+	for line := 2; scanner.Scan(); line++ {
+		var e entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%w: line %d: %w", ErrCorrupt, line, err)
+		}
+		if e.GeoIP == nil || e.GeoIP.IP == "" {
+			return nil, fmt.Errorf("%w: line %d: missing ip address", ErrCorrupt, line)
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCorrupt, err)
+	}
+
+	return entries, nil
+}
+
+// Run saves the Repository every interval until ctx is done.
+// The default interval is used when interval is not positive.
+func (s *Snapshotter) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			n, err := s.Save()
+			if err != nil {
+				s.Logger.Error().Err(err).Msg("Failed to snapshot the in-memory cache")
+				continue
+			}
+			s.Logger.Debug().Msgf("Saved %d items of the in-memory cache to %s", n, s.Path)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package snapshot
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lescactus/geolocation-go/internal/models"
+	"github.com/lescactus/geolocation-go/internal/repositories"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+var logger = zerolog.New(os.Stdout).Level(zerolog.NoLevel)
+
+var now = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// RepositoryMock records the saved items and their TTL
+type RepositoryMock struct {
+	entries []repositories.Entry
+	saved   map[string]time.Duration
+}
+
+func (m *RepositoryMock) Entries() []repositories.Entry {
+	return m.entries
+}
+
+func (m *RepositoryMock) SaveWithTTL(ctx context.Context, geoip *models.GeoIP, ttl time.Duration) error {
+	if m.saved == nil {
+		m.saved = make(map[string]time.Duration)
+	}
+	m.saved[geoip.IP] = ttl
+	return nil
+}
+
+func newTestSnapshotter(path string, repo Repository) *Snapshotter {
+	s := New(path, repo, &logger)
+	s.now = func() time.Time { return now }
+	return s
+}
+
+func TestSaveRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.jsonl")
+
+	src := &RepositoryMock{entries: []repositories.Entry{
+		{GeoIP: &models.GeoIP{IP: "1.1.1.1", CountryCode: "AU", CountryName: "Australia"}, ExpiresAt: now.Add(time.Hour)},
+		{GeoIP: &models.GeoIP{IP: "2.2.2.2", CountryCode: "FR", CountryName: "France"}},
+		{GeoIP: &models.GeoIP{IP: "3.3.3.3", CountryCode: "US"}, ExpiresAt: now.Add(time.Minute)},
+	}}
+	n, err := newTestSnapshotter(path, src).Save()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	// No temporary file left behind
+	files, _ := os.ReadDir(filepath.Dir(path))
+	assert.Len(t, files, 1)
+
+	// Restore 10 minutes later: 3.3.3.3 is expired
+	dst := &RepositoryMock{}
+	s := newTestSnapshotter(path, dst)
+	s.now = func() time.Time { return now.Add(10 * time.Minute) }
+	n, err = s.Restore()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, map[string]time.Duration{"1.1.1.1": 50 * time.Minute, "2.2.2.2": 0}, dst.saved)
+}
+
+func TestSaveRestoreLRUDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.jsonl")
+	ctx := context.Background()
+
+	src := repositories.NewShardedDB(4, 0, 0, time.Hour)
+	src.Save(ctx, &models.GeoIP{IP: "1.1.1.1", CountryCode: "AU"})
+	src.Save(ctx, &models.GeoIP{IP: "2001:db8::1", CountryCode: "FR"})
+
+	_, err := New(path, src, &logger).Save()
+	assert.NoError(t, err)
+
+	dst := repositories.NewShardedDB(4, 0, 0, time.Hour)
+	n, err := New(path, dst, &logger).Restore()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	g, err := dst.Get(ctx, "2001:db8::1")
+	assert.NoError(t, err)
+	assert.Equal(t, "FR", g.CountryCode)
+}
+
+func TestRestoreInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr error
+	}{
+		{name: "Empty file", content: "", wantErr: ErrCorrupt},
+		{name: "Not json", content: "thisisnotjson\n", wantErr: ErrCorrupt},
+		{name: "Unknown format", content: `{"format":"other","version":1}` + "\n", wantErr: ErrCorrupt},
+		{name: "Incompatible version", content: `{"format":"geolocation-go-snapshot","version":42}` + "\n", wantErr: ErrIncompatible},
+		{name: "Corrupt entry", content: `{"format":"geolocation-go-snapshot","version":1}` + "\n" + `{"geoip":{"ip":"1.1.1.1"}}` + "\n" + `{"geoip":` + "\n", wantErr: ErrCorrupt},
+		{name: "Missing ip address", content: `{"format":"geolocation-go-snapshot","version":1}` + "\n" + `{"geoip":{"country_code":"AU"}}` + "\n", wantErr: ErrCorrupt},
+		{name: "Line too long", content: `{"format":"geolocation-go-snapshot","version":1}` + "\n" + strings.Repeat("a", maxLineSize+1) + "\n", wantErr: ErrCorrupt},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "snapshot.jsonl")
+			assert.NoError(t, os.WriteFile(path, []byte(tt.content), 0o644))
+
+			dst := &RepositoryMock{}
+			n, err := newTestSnapshotter(path, dst).Restore()
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Equal(t, 0, n)
+			assert.Empty(t, dst.saved)
+		})
+	}
+
+	t.Run("Missing file", func(t *testing.T) {
+		_, err := newTestSnapshotter(filepath.Join(t.TempDir(), "missing.jsonl"), &RepositoryMock{}).Restore()
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
+
+func TestSaveInvalidPath(t *testing.T) {
+	s := newTestSnapshotter(filepath.Join(t.TempDir(), "missing", "snapshot.jsonl"), &RepositoryMock{})
+	_, err := s.Save()
+	assert.Error(t, err)
+}
+
+func TestRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.jsonl")
+	src := &RepositoryMock{entries: []repositories.Entry{{GeoIP: &models.GeoIP{IP: "1.1.1.1"}}}}
+	s := newTestSnapshotter(path, src)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(ctx, 10*time.Millisecond)
+	}()
+
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+	<-done
+}
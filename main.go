@@ -2,25 +2,37 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/go-redis/redis/v8"
 	"github.com/gorilla/handlers"
 	"github.com/julienschmidt/httprouter"
 	"github.com/justinas/alice"
 	"github.com/lescactus/geolocation-go/internal/api"
+	"github.com/lescactus/geolocation-go/internal/api/breaker"
+	"github.com/lescactus/geolocation-go/internal/api/csvdb"
+	"github.com/lescactus/geolocation-go/internal/api/failover"
 	"github.com/lescactus/geolocation-go/internal/api/ipapi"
 	"github.com/lescactus/geolocation-go/internal/api/ipbase"
+	"github.com/lescactus/geolocation-go/internal/api/ipinfo"
+	"github.com/lescactus/geolocation-go/internal/api/maxmind"
+	"github.com/lescactus/geolocation-go/internal/api/ratelimit"
 	"github.com/lescactus/geolocation-go/internal/chain"
 	"github.com/lescactus/geolocation-go/internal/config"
 	"github.com/lescactus/geolocation-go/internal/controllers"
+	"github.com/lescactus/geolocation-go/internal/invalidation"
+	"github.com/lescactus/geolocation-go/internal/layers"
 	"github.com/lescactus/geolocation-go/internal/logger"
-	"github.com/lescactus/geolocation-go/internal/repositories"
+	"github.com/lescactus/geolocation-go/internal/overrides"
+	"github.com/lescactus/geolocation-go/internal/snapshot"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/hlog"
@@ -40,45 +52,188 @@ func main() {
 		cfg.GetString("LOGGER_FORMAT"),
 	)
 
-	// Create in-memory database
-	mdb := repositories.NewInMemoryDB()
+	// Create the layers of the cacher chain, in the configured order
+	cacheLayers, err := layers.Build(context.Background(), cfg.GetString("CACHE_CHAIN"), cfg, logger)
+	if err != nil {
+		log.Fatalln(err)
+	}
 
-	// Create redis database client
-	rdb, err := repositories.NewRedisDB(
-		cfg.GetString("REDIS_CONNECTION_STRING"),
-		cfg.GetDuration("REDIS_KEY_TTL"))
+	// Write policies of the layers, write-through when not listed
+	policies, err := chain.ParseWritePolicies(cfg.GetString("CACHE_WRITE_POLICIES"))
 	if err != nil {
 		log.Fatalln(err)
 	}
+	for name := range policies {
+		if _, ok := cacheLayers.Get(name); !ok {
+			log.Fatalf("error: write policy of %s set, but it isn't in the cache chain\n", name)
+		}
+	}
 
 	// Create the cacher chain
 	chain := chain.New(logger)
-	chain.Add("in-memory", mdb)
-	chain.Add("redis", rdb)
+	chain.MaxBackfills = cfg.GetInt("CACHE_MAX_BACKFILLS")
+	chain.WriteBehindQueueSize = cfg.GetInt("CACHE_WRITE_BEHIND_QUEUE_SIZE")
+	for _, l := range cacheLayers {
+		if err := chain.AddWithPolicy(l.Name, l.Repository, policies[l.Name]); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	// The snapshots and the invalidations need the in-memory
+	// and redis layers, when they are in the chain
+	mdb, _ := cacheLayers.Get(layers.Memory)
+	rdb, _ := cacheLayers.Get(layers.Redis)
+
+	// Warm the in-memory database from its last snapshot,
+	// then snapshot it periodically
+	var snap *snapshot.Snapshotter
+	if path := cfg.GetString("SNAPSHOT_PATH"); path != "" {
+		if repo, ok := mdb.(snapshot.Repository); ok {
+			snap = snapshot.New(path, repo, logger)
+
+			n, err := snap.Restore()
+			switch {
+			case errors.Is(err, os.ErrNotExist):
+				logger.Info().Msgf("No snapshot of the in-memory cache found at %s", path)
+			case err != nil:
+				logger.Warn().Err(err).Msg("Ignoring the snapshot of the in-memory cache")
+			default:
+				logger.Info().Msgf("Restored %d items of the in-memory cache from %s", n, path)
+			}
+
+			go snap.Run(context.Background(), cfg.GetDuration("SNAPSHOT_INTERVAL"))
+		} else {
+			logger.Warn().Msgf("Ignoring SNAPSHOT_PATH, the %s cache layer isn't in the cache chain", layers.Memory)
+		}
+	}
+
+	// Drop the entries deleted or replaced by any replica
+	// from the in-memory database
+	var bus *invalidation.Bus
+	if channel := cfg.GetString("REDIS_INVALIDATION_CHANNEL"); channel != "" {
+		local, okLocal := mdb.(invalidation.Repository)
+		client, okClient := rdb.(interface{ Client() redis.UniversalClient })
+		if okLocal && okClient {
+			bus = invalidation.New(client.Client(), channel, local, logger)
+			go bus.Run(context.Background())
+		}
+	}
 
 	// Create http client
 	httpClient := http.DefaultClient
 	httpClient.Timeout = cfg.GetDuration("HTTP_CLIENT_TIMEOUT")
 
-	// Create remote Geo IP API client
-	var rApi api.GeoAPI
+	// Create remote Geo IP API clients.
+	// They are queried in the configured order until one of them answers
+	rApi := failover.New(logger)
+	var mm *maxmind.MaxMindClient
+	var csvc *csvdb.CSVClient
+
+	for _, name := range strings.Split(cfg.GetString("GEOLOCATION_API"), ",") {
+		name = strings.TrimSpace(name)
+
+		var a api.GeoAPI
+		// Whether the api is an upstream http api
+		remote := true
 
-	switch cfg.GetString("GEOLOCATION_API") {
-	case "ip-api":
-		// Create ip-api client
-		rApi = ipapi.NewIPAPIClient(cfg.GetString("IP_API_BASE_URL"), httpClient, logger)
-	case "ipbase":
-		// Create ipbase client
-		rApi = ipbase.NewIPBaseClient(cfg.GetString("IPBASE_BASE_URL"), cfg.GetString("IPBASE_API_KEY"), httpClient, logger)
-	default:
-		// Create ip-api client by default
-		rApi = ipapi.NewIPAPIClient(cfg.GetString("IP_API_BASE_URL"), httpClient, logger)
+		switch name {
+		case "ip-api":
+			// Create ip-api client
+			a = newIPAPI(cfg, httpClient, logger)
+		case "ipbase":
+			// Create ipbase client
+			a = ipbase.NewIPBaseClient(cfg.GetString("IPBASE_BASE_URL"), cfg.GetString("IPBASE_API_KEY"), httpClient, logger)
+			if l := ratelimit.NewLimiter(name, cfg.GetInt("IPBASE_RATE_LIMIT"), time.Minute, cfg.GetDuration("RATE_LIMIT_MAX_WAIT")); l != nil {
+				a = ratelimit.NewGeoAPI(a, l)
+			}
+		case "ipinfo":
+			// Create ipinfo client
+			a = ipinfo.NewIPInfoClient(cfg.GetString("IPINFO_BASE_URL"), cfg.GetString("IPINFO_TOKEN"), httpClient, logger)
+			if l := ratelimit.NewLimiter(name, cfg.GetInt("IPINFO_RATE_LIMIT"), time.Minute, cfg.GetDuration("RATE_LIMIT_MAX_WAIT")); l != nil {
+				a = ratelimit.NewGeoAPI(a, l)
+			}
+		case "maxmind":
+			// Create maxmind client from the local database files
+			mm, err = maxmind.NewMaxMindClient(cfg.GetString("MAXMIND_DB_PATH"), cfg.GetString("MAXMIND_ASN_DB_PATH"), logger)
+			if err != nil {
+				log.Fatalln(err)
+			}
+
+			// Reload the databases when they change on disk
+			if cfg.GetBool("MAXMIND_WATCH") {
+				if err := mm.Watch(context.Background()); err != nil {
+					logger.Warn().Err(err).Msg("Failed to watch the maxmind database files, changes will only be applied on SIGHUP")
+				}
+			}
+			a = mm
+			remote = false
+		case "csv":
+			// Create csv client from the local database file
+			csvc, err = csvdb.NewCSVClient(cfg.GetString("CSV_DB_PATH"), cfg.GetString("CSV_DB_FORMAT"), logger)
+			if err != nil {
+				log.Fatalln(err)
+			}
+
+			// Reload the database when it changes on disk
+			if cfg.GetBool("CSV_DB_WATCH") {
+				if err := csvc.Watch(context.Background()); err != nil {
+					logger.Warn().Err(err).Msg("Failed to watch the csv database file, changes will only be applied on SIGHUP")
+				}
+			}
+			a = csvc
+			remote = false
+		default:
+			// Create ip-api client by default
+			logger.Warn().Msgf("Unknown geolocation api %q, using ip-api instead", name)
+			name = "ip-api"
+			a = newIPAPI(cfg, httpClient, logger)
+		}
+
+		// Fail fast while an upstream api is unhealthy instead of
+		// waiting for each query to time out
+		if remote {
+			a = breaker.New(name, a, cfg.GetInt("BREAKER_FAILURE_THRESHOLD"), cfg.GetDuration("BREAKER_COOLDOWN"), logger)
+		}
+
+		if err := rApi.Add(name, a); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	// Load the operator-defined location overrides
+	var ovr *overrides.Overrides
+	if path := cfg.GetString("OVERRIDES_FILE"); path != "" {
+		ovr, err = overrides.New(path, logger)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		// Reload the overrides when the file changes on disk
+		if cfg.GetBool("OVERRIDES_WATCH") {
+			if err := ovr.Watch(context.Background()); err != nil {
+				logger.Warn().Err(err).Msg("Failed to watch the overrides file, changes will only be applied on SIGHUP")
+			}
+		}
 	}
 
 	// Create http router, middleware manager and handler controller
 	r := httprouter.New()
 	h := controllers.NewBaseHandler(chain, rApi, logger)
 	h.CacheChain = chain
+	h.BatchMaxSize = cfg.GetInt("BATCH_MAX_SIZE")
+	h.TrustedProxies, err = controllers.ParseTrustedProxies(cfg.GetString("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	h.ClientIPHeader, err = controllers.ParseClientIPHeader(cfg.GetString("CLIENT_IP_HEADER"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	h.Overrides = ovr
+	h.AdminToken = cfg.GetString("ADMIN_API_TOKEN")
+	if bus != nil {
+		h.Invalidator = bus
+	}
 	c := alice.New()
 
 	// Create http server
@@ -117,7 +272,9 @@ func main() {
 	c = c.Append(hlog.UserAgentHandler("user_agent"))
 	c = c.Append(hlog.RequestIDHandler("req_id", "X-Request-ID"))
 
-	// Prometheus middleware
+	// Prometheus middleware, returning the middlewares
+	// of the route with the given handler id
+	route := func(id string) alice.Chain { return c }
 	if cfg.GetBool("PROMETHEUS") {
 		p := httpmetricsmiddleware.New(httpmetricsmiddleware.Config{
 			Recorder:               metrics.NewRecorder(metrics.Config{HandlerIDLabel: "path"}),
@@ -125,20 +282,27 @@ func main() {
 			DisableMeasureSize:     true,
 		})
 
-		// Reduce cardinality by setting the handler id
-		c = c.Append(std.HandlerProvider("/rest/v1/:ip", p))
-		r.Handler("GET", cfg.GetString("PROMETHEUS_PATH"), c.Then(promhttp.Handler()))
+		// Reduce cardinality by setting the handler id of each route
+		route = func(id string) alice.Chain { return c.Append(std.HandlerProvider(id, p)) }
+		r.Handler("GET", cfg.GetString("PROMETHEUS_PATH"), route(cfg.GetString("PROMETHEUS_PATH")).Then(promhttp.Handler()))
 	}
 
 	// Register routes
-	r.Handler("GET", "/rest/v1/:ip", c.ThenFunc(h.GetGeoIP))
-	r.Handler("GET", "/ready", c.ThenFunc(h.Healthz))
-	r.Handler("GET", "/alive", c.ThenFunc(h.Healthz))
+	r.Handler("GET", "/rest/v1/:ip", route("/rest/v1/:ip").ThenFunc(h.GetGeoIP))
+	r.Handler("POST", "/rest/v1/batch", route("/rest/v1/batch").ThenFunc(h.PostGeoIPBatch))
+	r.Handler("GET", "/ready", route("/ready").ThenFunc(h.Healthz))
+	r.Handler("GET", "/alive", route("/alive").ThenFunc(h.Healthz))
+
+	// Admin routes, only registered when protected by a token
+	if h.AdminToken != "" {
+		r.Handler("DELETE", "/rest/v1/:ip", route("/admin/rest/v1/:ip").Append(h.RequireAdminToken).ThenFunc(h.DeleteGeoIP))
+		r.Handler("PUT", "/rest/v1/:ip", route("/admin/rest/v1/:ip").Append(h.RequireAdminToken).ThenFunc(h.PutGeoIP))
+	}
 
 	// OPTIONS method, 404 and 405 custom handlers with middlewares
-	r.NotFound = c.ThenFunc(h.NotFoundHandler)
-	r.MethodNotAllowed = c.ThenFunc(h.MethodNotAllowedHandler)
-	r.GlobalOPTIONS = c.ThenFunc(h.OptionsHandler)
+	r.NotFound = route("notfound").ThenFunc(h.NotFoundHandler)
+	r.MethodNotAllowed = route("methodnotallowed").ThenFunc(h.MethodNotAllowedHandler)
+	r.GlobalOPTIONS = route("options").ThenFunc(h.OptionsHandler)
 
 	// logger fields
 	*logger = logger.With().Str("svc", config.AppName).Logger()
@@ -154,6 +318,74 @@ func main() {
 								Dur("server_read_header_timeout", cfg.GetDuration("SERVER_READ_HEADER_TIMEOUT")).
 								Dur("server_write_timeout", cfg.GetDuration("SERVER_WRITE_TIMEOUT")),
 				).
+				Int("batch_max_size", cfg.GetInt("BATCH_MAX_SIZE")).
+				Strs("cache_chain", cacheLayers.Names()).
+				Str("cache_write_policies", cfg.GetString("CACHE_WRITE_POLICIES")).
+				Int("cache_max_backfills", cfg.GetInt("CACHE_MAX_BACKFILLS")).
+				Int("cache_write_behind_queue_size", cfg.GetInt("CACHE_WRITE_BEHIND_QUEUE_SIZE")).
+				Dict("in_memory_config", zerolog.Dict().
+					Int("in_memory_shards", cfg.GetInt("IN_MEMORY_SHARDS")).
+					Int("in_memory_max_entries", cfg.GetInt("IN_MEMORY_MAX_ENTRIES")).
+					Uint("in_memory_max_bytes", cfg.GetSizeInBytes("IN_MEMORY_MAX_BYTES")).
+					Dur("in_memory_ttl", cfg.GetDuration("IN_MEMORY_TTL")),
+				).
+				Str("trusted_proxies", cfg.GetString("TRUSTED_PROXIES")).
+				Str("client_ip_header", cfg.GetString("CLIENT_IP_HEADER")).
+				Dict("memcached_config", zerolog.Dict().
+					Str("memcached_servers", cfg.GetString("MEMCACHED_SERVERS")).
+					Dur("memcached_key_ttl", cfg.GetDuration("MEMCACHED_KEY_TTL")).
+					Str("memcached_key_prefix", cfg.GetString("MEMCACHED_KEY_PREFIX")),
+				).
+				Dict("redis_config", zerolog.Dict().
+					Dur("redis_key_ttl", cfg.GetDuration("REDIS_KEY_TTL")).
+					Str("redis_key_prefix", cfg.GetString("REDIS_KEY_PREFIX")).
+					Str("redis_invalidation_channel", cfg.GetString("REDIS_INVALIDATION_CHANNEL")),
+				).
+				// Don't show postgres connection string in case password is provided
+				Dict("postgres_config", zerolog.Dict().
+					Dur("postgres_ttl", cfg.GetDuration("POSTGRES_TTL")).
+					Dur("postgres_connect_timeout", cfg.GetDuration("POSTGRES_CONNECT_TIMEOUT")),
+				).
+				Dict("bolt_config", zerolog.Dict().
+					Str("bolt_path", cfg.GetString("BOLT_PATH")).
+					Dur("bolt_ttl", cfg.GetDuration("BOLT_TTL")).
+					Dur("bolt_cleanup_interval", cfg.GetDuration("BOLT_CLEANUP_INTERVAL")),
+				).
+				Bool("admin_api_enabled", cfg.GetString("ADMIN_API_TOKEN") != "").
+				Dict("snapshot_config", zerolog.Dict().
+					Str("snapshot_path", cfg.GetString("SNAPSHOT_PATH")).
+					Dur("snapshot_interval", cfg.GetDuration("SNAPSHOT_INTERVAL")),
+				).
+				Dict("overrides_config", zerolog.Dict().
+					Str("overrides_file", cfg.GetString("OVERRIDES_FILE")).
+					Bool("overrides_watch", cfg.GetBool("OVERRIDES_WATCH")),
+				).
+				Dict("maxmind_config", zerolog.Dict().
+					Str("maxmind_db_path", cfg.GetString("MAXMIND_DB_PATH")).
+					Str("maxmind_asn_db_path", cfg.GetString("MAXMIND_ASN_DB_PATH")).
+					Bool("maxmind_watch", cfg.GetBool("MAXMIND_WATCH")),
+				).
+				Dict("breaker_config", zerolog.Dict().
+					Int("breaker_failure_threshold", cfg.GetInt("BREAKER_FAILURE_THRESHOLD")).
+					Dur("breaker_cooldown", cfg.GetDuration("BREAKER_COOLDOWN")),
+				).
+				Dict("ip_api_batch_config", zerolog.Dict().
+					Bool("ip_api_batch", cfg.GetBool("IP_API_BATCH")).
+					Str("ip_api_batch_url", cfg.GetString("IP_API_BATCH_URL")).
+					Dur("ip_api_batch_window", cfg.GetDuration("IP_API_BATCH_WINDOW")).
+					Int("ip_api_batch_rate_limit", cfg.GetInt("IP_API_BATCH_RATE_LIMIT")),
+				).
+				Dict("rate_limit_config", zerolog.Dict().
+					Dur("rate_limit_max_wait", cfg.GetDuration("RATE_LIMIT_MAX_WAIT")).
+					Int("ip_api_rate_limit", cfg.GetInt("IP_API_RATE_LIMIT")).
+					Int("ipbase_rate_limit", cfg.GetInt("IPBASE_RATE_LIMIT")).
+					Int("ipinfo_rate_limit", cfg.GetInt("IPINFO_RATE_LIMIT")),
+				).
+				Dict("csv_db_config", zerolog.Dict().
+					Str("csv_db_path", cfg.GetString("CSV_DB_PATH")).
+					Str("csv_db_format", cfg.GetString("CSV_DB_FORMAT")).
+					Bool("csv_db_watch", cfg.GetBool("CSV_DB_WATCH")),
+				).
 				Dict("logger_config", zerolog.Dict().
 					Str("log_level", cfg.GetString("LOGGER_LOG_LEVEL")).
 					Str("log_format", cfg.GetString("LOGGER_FORMAT")).
@@ -171,6 +403,34 @@ func main() {
 		}
 	}()
 
+	// Reload the location overrides and the local databases on SIGHUP
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for range hupChan {
+			if ovr != nil {
+				logger.Info().Msg("Server received SIGHUP signal. Reloading location overrides...")
+				if err := ovr.Reload(); err != nil {
+					logger.Error().Err(err).Msg("Failed to reload location overrides")
+				}
+			}
+
+			if mm != nil {
+				logger.Info().Msg("Server received SIGHUP signal. Reloading maxmind databases...")
+				if err := mm.Reload(); err != nil {
+					logger.Error().Err(err).Msg("Failed to reload maxmind databases")
+				}
+			}
+
+			if csvc != nil {
+				logger.Info().Msg("Server received SIGHUP signal. Reloading csv database...")
+				if err := csvc.Reload(); err != nil {
+					logger.Error().Err(err).Msg("Failed to reload csv database")
+				}
+			}
+		}
+	}()
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
 
@@ -187,4 +447,40 @@ func main() {
 	if err := s.Shutdown(ctx); err != nil {
 		logger.Warn().Msg("Failed to gracefully shutdown the server")
 	}
+
+	// Wait for the backfills and the write-behind queues of the cache chain
+	if err := chain.Close(ctx); err != nil {
+		logger.Warn().Err(err).Msg("Failed to drain the writes of the cache chain")
+	}
+
+	// Snapshot the in-memory database for the next start
+	if snap != nil {
+		n, err := snap.Save()
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to snapshot the in-memory cache")
+		} else {
+			logger.Info().Msgf("Saved %d items of the in-memory cache to %s", n, snap.Path)
+		}
+	}
+
+	// Close the cache layers, ex: release the lock of the bolt database file
+	if err := cacheLayers.Close(); err != nil {
+		logger.Error().Err(err).Msg("Failed to close the cache layers")
+	}
+}
+
+// newIPAPI returns the ip-api client, rate limited from its quota headers,
+// sending its queries to the batch endpoint when IP_API_BATCH is enabled.
+func newIPAPI(cfg *config.Config, httpClient *http.Client, logger *zerolog.Logger) api.GeoAPI {
+	c := ipapi.NewIPAPIClient(cfg.GetString("IP_API_BASE_URL"), httpClient, logger)
+	c.Limiter = ratelimit.NewLimiter("ip-api", cfg.GetInt("IP_API_RATE_LIMIT"), time.Minute, cfg.GetDuration("RATE_LIMIT_MAX_WAIT"))
+
+	if !cfg.GetBool("IP_API_BATCH") {
+		return c
+	}
+
+	b := ipapi.NewBatcher(c, cfg.GetString("IP_API_BATCH_URL"), cfg.GetDuration("IP_API_BATCH_WINDOW"), ipapi.DefaultBatchMaxSize)
+	b.Limiter = ratelimit.NewLimiter("ip-api-batch", cfg.GetInt("IP_API_BATCH_RATE_LIMIT"), time.Minute, cfg.GetDuration("RATE_LIMIT_MAX_WAIT"))
+
+	return b
 }